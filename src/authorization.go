@@ -2,6 +2,7 @@ package src
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"slices"
 	"strings"
@@ -10,12 +11,148 @@ import (
 	"github.com/spyzhov/ajson"
 )
 
+// Returned when a valid token doesn't satisfy the authorization rules,
+// which results in a 403 instead of a new login.
+type authorizationError struct {
+	reason string
+
+	// The claim which didn't satisfy the rules, if the failure is caused by a single one.
+	claim string
+
+	// The check couldn't be completed, eg. because the webhook is unreachable. So this is no decision.
+	failed bool
+}
+
+func newAuthorizationError(format string, a ...interface{}) *authorizationError {
+	return &authorizationError{
+		reason: fmt.Sprintf(format, a...),
+	}
+}
+
+func newClaimAuthorizationError(claim string, format string, a ...interface{}) *authorizationError {
+	return &authorizationError{
+		reason: fmt.Sprintf(format, a...),
+		claim:  claim,
+	}
+}
+
+func newFailedAuthorizationError(format string, a ...interface{}) *authorizationError {
+	return &authorizationError{
+		reason: fmt.Sprintf(format, a...),
+		failed: true,
+	}
+}
+
+// Returns true if the authorization couldn't be checked, so no decision should be stored.
+func isFailedAuthorization(err error) bool {
+	var authorizationErr *authorizationError
+	return errors.As(err, &authorizationErr) && authorizationErr.failed
+}
+
+func (err *authorizationError) Error() string {
+	return "unauthorized: " + err.reason
+}
+
+// Returns the reason of an authorizationError for logging.
+// The decision may also be taken from the session, in which case there is no error.
+func getAuthorizationFailureReason(err error) string {
+	var authorizationErr *authorizationError
+	if errors.As(err, &authorizationErr) {
+		return authorizationErr.reason
+	}
+
+	return "authorization rules not satisfied"
+}
+
+// Returns the name of the claim which caused an authorizationError, or an empty string if there is none.
+func getAuthorizationFailureClaim(err error) string {
+	var authorizationErr *authorizationError
+	if errors.As(err, &authorizationErr) {
+		return authorizationErr.claim
+	}
+
+	return ""
+}
+
 func isAuthorized(logger *logging.Logger, authorization *AuthorizationConfig, claims map[string]interface{}) bool {
+	return checkAuthorization(logger, authorization, claims) == nil
+}
+
+// Returns an authorizationError, if the subject or one of the groups is denied. It takes precedence over all allow rules.
+func checkDenied(logger *logging.Logger, authorization *AuthorizationConfig, subjectClaim string, claims map[string]interface{}) error {
+	if len(authorization.DeniedSubjects) > 0 {
+		if subject, ok := claims[subjectClaim].(string); ok && slices.Contains(authorization.DeniedSubjects, subject) {
+			logger.Log(logging.LevelWarn, "Unauthorized. The subject %s is denied.", subject)
+			return newClaimAuthorizationError(subjectClaim, "the subject is denied")
+		}
+	}
+
+	if len(authorization.DeniedGroups) > 0 {
+		groups := getGroupsFromClaims(claims, authorization.GroupsClaim)
+
+		for _, deniedGroup := range authorization.DeniedGroups {
+			isMember := slices.ContainsFunc(groups, func(group string) bool {
+				return normalizeGroup(authorization, group) == normalizeGroup(authorization, deniedGroup)
+			})
+
+			if isMember {
+				logger.Log(logging.LevelWarn, "Unauthorized. The user is a member of the denied group %s.", deniedGroup)
+				return newClaimAuthorizationError(authorization.GroupsClaim, "member of the denied group %s", deniedGroup)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns an authorizationError with the reason, if the claims don't satisfy the authorization rules.
+func checkAuthorization(logger *logging.Logger, authorization *AuthorizationConfig, claims map[string]interface{}) error {
+	if len(authorization.RequiredScopes) > 0 {
+		grantedScopes := getScopesFromClaims(claims)
+
+		for _, requiredScope := range authorization.RequiredScopes {
+			if !slices.Contains(grantedScopes, requiredScope) {
+				logger.Log(logging.LevelWarn, "Unauthorized. Required scope %s is missing. Granted scopes are [%s]", requiredScope, strings.Join(grantedScopes, ", "))
+				return newClaimAuthorizationError("scope", "required scope %s is missing", requiredScope)
+			}
+		}
+
+		logger.Log(logging.LevelDebug, "Authorized scopes: Found all required scopes [%s]", strings.Join(authorization.RequiredScopes, ", "))
+	}
+
+	for _, requiredClaim := range authorization.RequiredClaims {
+		if isEmptyClaim(claims[requiredClaim]) {
+			logger.Log(logging.LevelWarn, "Unauthorized. Required claim %s is missing or empty.", requiredClaim)
+			logAvailableClaims(logger, claims)
+			return newClaimAuthorizationError(requiredClaim, "required claim %s is missing or empty", requiredClaim)
+		}
+	}
+
+	if authorization.RequireVerifiedEmail && !isEmailVerified(claims) {
+		logger.Log(logging.LevelWarn, "Unauthorized. The email address is not verified. The email_verified claim is %v", claims["email_verified"])
+		return newClaimAuthorizationError("email_verified", "the email address is not verified")
+	}
+
+	if len(authorization.AllowedGroups) > 0 {
+		groups := getGroupsFromClaims(claims, authorization.GroupsClaim)
+
+		isMember := slices.ContainsFunc(authorization.AllowedGroups, func(allowedGroup string) bool {
+			return slices.ContainsFunc(groups, func(group string) bool {
+				return normalizeGroup(authorization, group) == normalizeGroup(authorization, allowedGroup)
+			})
+		})
+
+		if !isMember {
+			logger.Log(logging.LevelWarn, "Unauthorized. The user is not a member of any of [%s]. Groups in claim %s are [%s]", strings.Join(authorization.AllowedGroups, ", "), authorization.GroupsClaim, strings.Join(groups, ", "))
+			return newClaimAuthorizationError(authorization.GroupsClaim, "not a member of any of the allowed groups %s", strings.Join(authorization.AllowedGroups, ", "))
+		}
+	}
+
 	if authorization.AssertClaims != nil && len(authorization.AssertClaims) > 0 {
 		parsed, err := json.Marshal(claims)
 		if err != nil {
 			logger.Log(logging.LevelWarn, "Error whilst marshalling claims object: %s", err.Error())
-			return false
+			return newAuthorizationError("the claims could not be marshalled")
 		}
 
 	assertions:
@@ -23,11 +160,11 @@ func isAuthorized(logger *logging.Logger, authorization *AuthorizationConfig, cl
 			value, err := ajson.JSONPath(parsed, fmt.Sprintf("$.%s", assertion.Name))
 			if err != nil {
 				logger.Log(logging.LevelWarn, "Error whilst parsing path for claim %s in token claims: %s", assertion.Name, err.Error())
-				return false
+				return newAuthorizationError("the path of claim %s is invalid", assertion.Name)
 			} else if len(value) == 0 {
 				logger.Log(logging.LevelWarn, "Unauthorized. Unable to find claim %s in token claims.", assertion.Name)
 				logAvailableClaims(logger, claims)
-				return false
+				return newClaimAuthorizationError(assertion.Name, "claim %s is missing", assertion.Name)
 			}
 
 			if len(assertion.AllOf) == 0 && len(assertion.AnyOf) == 0 {
@@ -119,11 +256,23 @@ func isAuthorized(logger *logging.Logger, authorization *AuthorizationConfig, cl
 
 			logAvailableClaims(logger, claims)
 
-			return false
+			return newClaimAuthorizationError(assertion.Name, "claim %s doesn't satisfy the assertions", assertion.Name)
 		}
 	}
 
-	return true
+	return nil
+}
+
+// Returns whether the email_verified claim is true. Missing claims mean the email address is not verified.
+func isEmailVerified(claims map[string]interface{}) bool {
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return strings.EqualFold(verified, "true")
+	default:
+		return false
+	}
 }
 
 func logAvailableClaims(logger *logging.Logger, claims map[string]interface{}) {
@@ -133,3 +282,94 @@ func logAvailableClaims(logger *logging.Logger, claims map[string]interface{}) {
 		logger.Log(logging.LevelDebug, "  %v = %v", key, val)
 	}
 }
+
+// Returns true, if the claim is missing, an empty string or an empty array or object.
+func isEmptyClaim(value interface{}) bool {
+	switch val := value.(type) {
+	case nil:
+		return true
+	case string:
+		return val == ""
+	case []string:
+		return len(val) == 0
+	case []interface{}:
+		return len(val) == 0
+	case map[string]interface{}:
+		return len(val) == 0
+	}
+
+	return false
+}
+
+// Returns the value of a claim, which may be nested in objects using a dotted path, eg. realm_access.roles.
+// A claim whose name contains dots itself, like the namespaced claims of some providers, takes precedence.
+func getClaimByPath(claims map[string]interface{}, path string) interface{} {
+	if value, ok := claims[path]; ok {
+		return value
+	}
+
+	var current interface{} = claims
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		current, ok = object[segment]
+		if !ok {
+			return nil
+		}
+	}
+
+	return current
+}
+
+// Returns the groups from the claim, which may be a single string or an array.
+func getGroupsFromClaims(claims map[string]interface{}, groupsClaim string) []string {
+	var groups []string
+
+	switch val := getClaimByPath(claims, groupsClaim).(type) {
+	case string:
+		groups = append(groups, val)
+	case []string:
+		groups = append(groups, val...)
+	case []interface{}:
+		for _, rawVal := range val {
+			groups = append(groups, fmt.Sprintf("%v", rawVal))
+		}
+	}
+
+	return groups
+}
+
+func normalizeGroup(authorization *AuthorizationConfig, group string) string {
+	if authorization.GroupsTrimLeadingSlash {
+		group = strings.TrimLeft(group, "/")
+	}
+	if authorization.GroupsCaseInsensitive {
+		group = strings.ToLower(group)
+	}
+
+	return group
+}
+
+// Returns the granted scopes from either the space-delimited scope claim or the scp claim,
+// which some providers use instead and may be an array.
+func getScopesFromClaims(claims map[string]interface{}) []string {
+	var scopes []string
+
+	for _, claimName := range []string{"scope", "scp"} {
+		switch val := claims[claimName].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(val)...)
+		case []string:
+			scopes = append(scopes, val...)
+		case []interface{}:
+			for _, rawVal := range val {
+				scopes = append(scopes, fmt.Sprintf("%v", rawVal))
+			}
+		}
+	}
+
+	return scopes
+}
@@ -0,0 +1,146 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// A decision of the authorization webhook, cached for the claims it has been asked with.
+type authorizationDecision struct {
+	err       error
+	expiresAt time.Time
+}
+
+type authorizationWebhookResponse struct {
+	Allow bool `json:"allow"`
+}
+
+// Checks the authorization rules and, if they are satisfied, asks the Authorization.Webhook.
+func (toa *TraefikOidcAuth) checkAuthorization(ctx context.Context, claims map[string]interface{}) error {
+	if err := checkDenied(toa.logger, toa.Config.Authorization, toa.Config.SubjectClaim, claims); err != nil {
+		return err
+	}
+	if err := checkAuthorization(toa.logger, toa.Config.Authorization, claims); err != nil {
+		return err
+	}
+
+	if toa.Config.Authorization.Webhook == nil || toa.Config.Authorization.Webhook.Url == "" {
+		return nil
+	}
+
+	return toa.checkAuthorizationWebhook(ctx, claims)
+}
+
+// Returns an authorizationError, if the webhook doesn't allow the request.
+// The decision is cached for the CacheDuration, keyed by a hash of the posted claims. So subjects of different
+// issuers or changed claims of the same subject never share a decision.
+func (toa *TraefikOidcAuth) checkAuthorizationWebhook(ctx context.Context, claims map[string]interface{}) error {
+	webhook := toa.Config.Authorization.Webhook
+	now := time.Now()
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(body)
+	key := hex.EncodeToString(hash[:])
+
+	toa.authorizationDecisionsLock.Lock()
+	cached, ok := toa.authorizationDecisions[key]
+	toa.authorizationDecisionsLock.Unlock()
+
+	if ok && now.Before(cached.expiresAt) {
+		return cached.err
+	}
+
+	err = toa.callAuthorizationWebhook(ctx, body)
+
+	var authorizationErr *authorizationError
+	if !errors.As(err, &authorizationErr) && err != nil {
+		// The RequestTimeout elapsed, which is no decision of the webhook
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Don't cache network errors, the next request may succeed
+		toa.logger.Log(logging.LevelError, "Calling the authorization webhook failed: %s", err.Error())
+		return newFailedAuthorizationError("the authorization webhook failed")
+	}
+
+	if webhook.CacheDuration > 0 {
+		toa.authorizationDecisionsLock.Lock()
+
+		if toa.authorizationDecisions == nil {
+			toa.authorizationDecisions = make(map[string]*authorizationDecision)
+		}
+
+		// Remove the expired decisions, so the cache doesn't grow forever
+		for key, cached := range toa.authorizationDecisions {
+			if !now.Before(cached.expiresAt) {
+				delete(toa.authorizationDecisions, key)
+			}
+		}
+
+		toa.authorizationDecisions[key] = &authorizationDecision{
+			err:       err,
+			expiresAt: now.Add(time.Duration(webhook.CacheDuration) * time.Second),
+		}
+
+		toa.authorizationDecisionsLock.Unlock()
+	}
+
+	return err
+}
+
+// Posts the claims as JSON to the webhook. It must answer with 200 and {"allow": true} to allow the request.
+func (toa *TraefikOidcAuth) callAuthorizationWebhook(ctx context.Context, body []byte) error {
+	webhook := toa.Config.Authorization.Webhook
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(webhook.Timeout)*time.Second)
+	defer cancel()
+
+	// The webhook is no part of the provider and must not receive its credentials
+	ctx = withoutIdpRequestHeaders(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := toa.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		toa.logger.Log(logging.LevelWarn, "Unauthorized. The authorization webhook returned status %d.", resp.StatusCode)
+		return newAuthorizationError("the authorization webhook returned status %d", resp.StatusCode)
+	}
+
+	decision := &authorizationWebhookResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return fmt.Errorf("invalid response of the authorization webhook: %w", err)
+	}
+
+	if !decision.Allow {
+		toa.logger.Log(logging.LevelWarn, "Unauthorized. The authorization webhook denied the request.")
+		return newAuthorizationError("the authorization webhook denied the request")
+	}
+
+	toa.logger.Log(logging.LevelDebug, "The authorization webhook allowed the request.")
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthorizationWebhook(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	requests := 0
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		claims := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&claims)
+
+		switch claims["sub"] {
+		case "alice":
+			json.NewEncoder(w).Encode(map[string]interface{}{"allow": true})
+		case "bob":
+			json.NewEncoder(w).Encode(map[string]interface{}{"allow": false})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer webhookServer.Close()
+
+	toa.Config.Authorization.Webhook = &AuthorizationWebhookConfig{Url: webhookServer.URL, Timeout: 5, CacheDuration: 60}
+
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"sub": "alice"}); err != nil {
+		t.Fatalf("Expected alice to be allowed, but got: %v", err)
+	}
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"sub": "bob"}); err == nil {
+		t.Fatal("Expected bob to be denied")
+	}
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"sub": "eve"}); err == nil {
+		t.Fatal("Expected a failing webhook to deny the request")
+	}
+
+	// The decisions are cached for the same claims
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"sub": "alice"}); err != nil {
+		t.Fatalf("Expected the cached decision to allow alice, but got: %v", err)
+	}
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"sub": "bob"}); err == nil {
+		t.Fatal("Expected the cached decision to deny bob")
+	}
+	if requests != 3 {
+		t.Fatalf("Expected the webhook to be called 3 times, but got %d", requests)
+	}
+
+	// The same subject of another issuer must ask the webhook again
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"iss": "https://other.example.com", "sub": "bob"}); err == nil {
+		t.Fatal("Expected bob of the other issuer to be denied")
+	}
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"iss": "https://other.example.com", "sub": "alice"}); err != nil {
+		t.Fatalf("Expected alice of the other issuer to be allowed, but got: %v", err)
+	}
+	if requests != 5 {
+		t.Fatalf("Expected the webhook to be asked for the other issuer, but it has been called %d times", requests)
+	}
+}
+
+func TestAuthorizationWebhookDenialReturnsForbidden(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.UnauthorizedBehavior = "Unauthorized"
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"allow": false})
+	}))
+	defer webhookServer.Close()
+
+	toa.Config.Authorization.Webhook = &AuthorizationWebhookConfig{Url: webhookServer.URL, Timeout: 5}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+signedToken)
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected the denied request to be forbidden, but got %d", rw.Code)
+	}
+}
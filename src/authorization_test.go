@@ -1,7 +1,9 @@
 package src
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -245,3 +247,275 @@ func TestMultipleAssertions(t *testing.T) {
 		t.Fatal("Should not authorize since both of the assertions do not hold")
 	}
 }
+
+func TestRequiredScopes(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	claims := map[string]interface{}{
+		"scope": "openid profile orders:read",
+	}
+	authorization := &AuthorizationConfig{
+		RequiredScopes: []string{"openid", "orders:read"},
+	}
+
+	if !isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should authorize since all required scopes are granted")
+	}
+
+	authorization = &AuthorizationConfig{
+		RequiredScopes: []string{"orders:read", "orders:write"},
+	}
+
+	if isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should not authorize since a required scope is missing")
+	}
+
+	claims = map[string]interface{}{
+		"scp": []interface{}{"orders:read", "orders:write"},
+	}
+
+	if !isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should authorize since all required scopes are granted by the scp claim")
+	}
+
+	if isAuthorized(logger, authorization, map[string]interface{}{}) {
+		t.Fatal("Should not authorize since no scopes are granted")
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	authorization := &AuthorizationConfig{
+		RequiredClaims: []string{"email", "groups"},
+	}
+
+	claims := map[string]interface{}{
+		"email":  "alice@example.com",
+		"groups": []interface{}{"admin"},
+	}
+
+	if !isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should authorize since all required claims are present")
+	}
+
+	claims = map[string]interface{}{
+		"groups": []interface{}{"admin"},
+	}
+
+	if isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should not authorize since the email claim is missing")
+	}
+
+	claims = map[string]interface{}{
+		"email":  "",
+		"groups": []interface{}{"admin"},
+	}
+
+	if isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should not authorize since the email claim is empty")
+	}
+
+	claims = map[string]interface{}{
+		"email":  "alice@example.com",
+		"groups": []interface{}{},
+	}
+
+	if isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should not authorize since the groups claim is empty")
+	}
+
+	claims = map[string]interface{}{
+		"email":  "alice@example.com",
+		"groups": false,
+	}
+
+	if !isAuthorized(logger, authorization, claims) {
+		t.Fatal("Should authorize since a boolean claim is considered present")
+	}
+}
+
+func TestCheckAuthorizationReturnsReason(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	authorization := &AuthorizationConfig{
+		RequiredScopes: []string{"orders:read"},
+	}
+
+	err := checkAuthorization(logger, authorization, map[string]interface{}{"scope": "profile"})
+
+	var authorizationErr *authorizationError
+	if !errors.As(err, &authorizationErr) {
+		t.Fatalf("Expected an authorizationError, but got %v", err)
+	}
+	if getAuthorizationFailureReason(err) != "required scope orders:read is missing" {
+		t.Fatalf("Unexpected reason %s", getAuthorizationFailureReason(err))
+	}
+
+	if err := checkAuthorization(logger, authorization, map[string]interface{}{"scope": "profile orders:read"}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if getAuthorizationFailureReason(nil) != "authorization rules not satisfied" {
+		t.Fatal("Expected a generic reason if the decision was taken from the session")
+	}
+}
+
+func TestAllowedGroups(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	claims := map[string]interface{}{
+		"groups": []interface{}{"developers", "support"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"offline_access", "admin"},
+		},
+		"https://example.com/groups": "partners",
+	}
+
+	tests := []struct {
+		name          string
+		groupsClaim   string
+		allowedGroups []string
+		authorized    bool
+	}{
+		{name: "top-level groups", groupsClaim: "groups", allowedGroups: []string{"admin", "support"}, authorized: true},
+		{name: "nested roles", groupsClaim: "realm_access.roles", allowedGroups: []string{"admin"}, authorized: true},
+		{name: "namespaced claim", groupsClaim: "https://example.com/groups", allowedGroups: []string{"partners"}, authorized: true},
+		{name: "not a member", groupsClaim: "groups", allowedGroups: []string{"admin"}, authorized: false},
+		{name: "missing claim", groupsClaim: "resource_access.roles", allowedGroups: []string{"admin"}, authorized: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authorization := &AuthorizationConfig{
+				GroupsClaim:   test.groupsClaim,
+				AllowedGroups: test.allowedGroups,
+			}
+
+			if isAuthorized(logger, authorization, claims) != test.authorized {
+				t.Fatalf("Expected authorized to be %v", test.authorized)
+			}
+		})
+	}
+}
+
+func TestAllowedGroupsNormalization(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	claims := map[string]interface{}{
+		"groups": []interface{}{"/Admin", "/developers/Backend"},
+	}
+
+	tests := []struct {
+		name             string
+		trimLeadingSlash bool
+		caseInsensitive  bool
+		allowedGroups    []string
+		authorized       bool
+	}{
+		{name: "disabled", allowedGroups: []string{"admin"}, authorized: false},
+		{name: "exact match when disabled", allowedGroups: []string{"/Admin"}, authorized: true},
+		{name: "only trimmed", trimLeadingSlash: true, allowedGroups: []string{"admin"}, authorized: false},
+		{name: "only case-folded", caseInsensitive: true, allowedGroups: []string{"admin"}, authorized: false},
+		{name: "trimmed and case-folded", trimLeadingSlash: true, caseInsensitive: true, allowedGroups: []string{"admin"}, authorized: true},
+		{name: "allowlist is normalized too", trimLeadingSlash: true, caseInsensitive: true, allowedGroups: []string{"/DEVELOPERS/backend"}, authorized: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authorization := &AuthorizationConfig{
+				GroupsClaim:            "groups",
+				AllowedGroups:          test.allowedGroups,
+				GroupsTrimLeadingSlash: test.trimLeadingSlash,
+				GroupsCaseInsensitive:  test.caseInsensitive,
+			}
+
+			if isAuthorized(logger, authorization, claims) != test.authorized {
+				t.Fatalf("Expected authorized to be %v", test.authorized)
+			}
+		})
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	authorization := &AuthorizationConfig{
+		RequireVerifiedEmail: true,
+	}
+
+	tests := []struct {
+		name          string
+		emailVerified interface{}
+		authorized    bool
+	}{
+		{name: "verified", emailVerified: true, authorized: true},
+		{name: "verified as string", emailVerified: "true", authorized: true},
+		{name: "unverified", emailVerified: false, authorized: false},
+		{name: "unverified as string", emailVerified: "false", authorized: false},
+		{name: "missing", authorized: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := map[string]interface{}{"email": "alice@example.com"}
+			if test.emailVerified != nil {
+				claims["email_verified"] = test.emailVerified
+			}
+
+			err := checkAuthorization(logger, authorization, claims)
+			if (err == nil) != test.authorized {
+				t.Fatalf("Expected authorized to be %v, but got %v", test.authorized, err)
+			}
+			if err != nil && getAuthorizationFailureReason(err) != "the email address is not verified" {
+				t.Fatalf("Unexpected reason %s", getAuthorizationFailureReason(err))
+			}
+		})
+	}
+}
+
+func TestDeniedGroupsOverrideAllowRules(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Authorization.AllowedGroups = []string{"developers"}
+	toa.Config.Authorization.DeniedGroups = []string{"blocked"}
+	toa.Config.Authorization.DeniedSubjects = []string{"mallory"}
+	toa.Config.Authorization.GroupsTrimLeadingSlash = true
+
+	tests := []struct {
+		name       string
+		claims     map[string]interface{}
+		authorized bool
+	}{
+		{name: "allowed", claims: map[string]interface{}{"sub": "alice", "groups": []interface{}{"developers"}}, authorized: true},
+		{name: "denied group", claims: map[string]interface{}{"sub": "bob", "groups": []interface{}{"developers", "/blocked"}}, authorized: false},
+		{name: "denied subject", claims: map[string]interface{}{"sub": "mallory", "groups": []interface{}{"developers"}}, authorized: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := toa.checkAuthorization(context.Background(), test.claims)
+			if (err == nil) != test.authorized {
+				t.Fatalf("Expected authorized to be %v, but got %v", test.authorized, err)
+			}
+		})
+	}
+
+	err := toa.checkAuthorization(context.Background(), tests[1].claims)
+	if getAuthorizationFailureReason(err) != "member of the denied group blocked" || getAuthorizationFailureClaim(err) != "groups" {
+		t.Fatalf("Unexpected failure %v", err)
+	}
+}
+
+func TestGetGroupsFromClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups": []interface{}{"developers", "support"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"admin"},
+		},
+	}
+
+	if groups := getGroupsFromClaims(claims, "realm_access.roles"); len(groups) != 1 || groups[0] != "admin" {
+		t.Errorf("Expected the nested roles, but got %v", groups)
+	}
+	if groups := getGroupsFromClaims(claims, "groups"); len(groups) != 2 || groups[1] != "support" {
+		t.Errorf("Expected the top-level groups, but got %v", groups)
+	}
+}
@@ -0,0 +1,72 @@
+package src
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Returns the token whose claims are returned by the TokenValidation, either id or access.
+func (toa *TraefikOidcAuth) getValidatedTokenType() string {
+	if toa.Config.Provider.TokenValidation == "IdToken" {
+		return "id"
+	}
+
+	return "access"
+}
+
+// Overrides the claims of the validated token with those configured in the ClaimSources.
+// The other token has been received from the token endpoint together with the validated one, so it's only decoded.
+// Tokens which are not a JWT, like opaque access tokens, are skipped.
+func (toa *TraefikOidcAuth) applyClaimSources(claims map[string]interface{}, idToken string, accessToken string) map[string]interface{} {
+	if len(toa.Config.ClaimSources) == 0 {
+		return claims
+	}
+
+	validatedTokenType := toa.getValidatedTokenType()
+	decodedTokens := make(map[string]jwt.MapClaims)
+
+	// Don't modify the claims of the caller
+	merged := make(map[string]interface{}, len(claims))
+	for key, val := range claims {
+		merged[key] = val
+	}
+
+	for _, claimSource := range toa.Config.ClaimSources {
+		if claimSource.Token == validatedTokenType {
+			continue
+		}
+
+		tokenClaims, ok := decodedTokens[claimSource.Token]
+		if !ok {
+			rawToken := accessToken
+			if claimSource.Token == "id" {
+				rawToken = idToken
+			}
+
+			tokenClaims = decodeTokenClaims(toa.logger, claimSource.Token, rawToken)
+			decodedTokens[claimSource.Token] = tokenClaims
+		}
+
+		if value, ok := tokenClaims[claimSource.Name]; ok {
+			merged[claimSource.Name] = value
+		}
+	}
+
+	return merged
+}
+
+func decodeTokenClaims(logger *logging.Logger, tokenType string, rawToken string) jwt.MapClaims {
+	tokenClaims := jwt.MapClaims{}
+
+	if rawToken == "" {
+		return tokenClaims
+	}
+
+	_, _, err := jwt.NewParser().ParseUnverified(rawToken, tokenClaims)
+	if err != nil {
+		logger.Log(logging.LevelDebug, "The %s token can't be decoded to read the ClaimSources: %s", tokenType, err.Error())
+		return jwt.MapClaims{}
+	}
+
+	return tokenClaims
+}
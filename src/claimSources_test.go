@@ -0,0 +1,110 @@
+package src
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func newClaimSourcesTest(t *testing.T, tokenValidation string) (*TraefikOidcAuth, *session.SessionState) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: &Config{
+			Provider: &ProviderConfig{
+				TokenValidation: tokenValidation,
+			},
+			ClaimSources: []ClaimSourceConfig{
+				{Name: "scope", Token: "access"},
+				{Name: "email", Token: "id"},
+			},
+		},
+		Jwks: &oidc.JwksHandler{},
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	t.Cleanup(jwksServer.Close)
+	toa.httpClient = jwksServer.Client()
+
+	signToken := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-kid"
+
+		signed, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signed
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	return toa, &session.SessionState{
+		Id: "session-id",
+		IdToken: signToken(jwt.MapClaims{
+			"sub":   "alice",
+			"exp":   exp,
+			"email": "alice@example.com",
+			"scope": "openid",
+		}),
+		AccessToken: signToken(jwt.MapClaims{
+			"sub":   "alice",
+			"exp":   exp,
+			"email": "access@example.com",
+			"scope": "openid orders:read",
+		}),
+	}
+}
+
+func TestClaimSourcesReadScopeFromAccessToken(t *testing.T) {
+	toa, sessionState := newClaimSourcesTest(t, "IdToken")
+
+	ok, claims, err := toa.validateToken(context.Background(), sessionState)
+	if !ok {
+		t.Fatalf("Expected the token to be valid, but got: %v", err)
+	}
+
+	if claims["scope"] != "openid orders:read" {
+		t.Errorf("Expected the scope of the access token, but got %v", claims["scope"])
+	}
+	if claims["email"] != "alice@example.com" {
+		t.Errorf("Expected the email of the id token, but got %v", claims["email"])
+	}
+}
+
+func TestClaimSourcesReadEmailFromIdToken(t *testing.T) {
+	toa, sessionState := newClaimSourcesTest(t, "AccessToken")
+
+	ok, claims, err := toa.validateToken(context.Background(), sessionState)
+	if !ok {
+		t.Fatalf("Expected the token to be valid, but got: %v", err)
+	}
+
+	if claims["email"] != "alice@example.com" {
+		t.Errorf("Expected the email of the id token, but got %v", claims["email"])
+	}
+	if claims["scope"] != "openid orders:read" {
+		t.Errorf("Expected the scope of the access token, but got %v", claims["scope"])
+	}
+}
+
+func TestClaimSourcesSkipOpaqueTokens(t *testing.T) {
+	toa, sessionState := newClaimSourcesTest(t, "IdToken")
+	sessionState.AccessToken = "opaque-token"
+
+	claims := toa.applyClaimSources(map[string]interface{}{"scope": "openid"}, sessionState.IdToken, sessionState.AccessToken)
+
+	if claims["scope"] != "openid" {
+		t.Errorf("Expected the scope of the validated token to be kept, but got %v", claims["scope"])
+	}
+}
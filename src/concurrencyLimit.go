@@ -0,0 +1,67 @@
+package src
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errConcurrencyLimitExceeded = errors.New("too many concurrent requests to the provider")
+
+// Limits the number of requests which are in flight at the same time. Further requests wait for a free slot,
+// until the queueTimeout elapses or their context is done.
+type concurrencyLimitedTransport struct {
+	inner        http.RoundTripper
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newConcurrencyLimitedTransport(inner http.RoundTripper, maxConcurrentRequests int, queueTimeout time.Duration) *concurrencyLimitedTransport {
+	return &concurrencyLimitedTransport{
+		inner:        inner,
+		slots:        make(chan struct{}, maxConcurrentRequests),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (transport *concurrencyLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timer := time.NewTimer(transport.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case transport.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-timer.C:
+		return nil, errConcurrencyLimitExceeded
+	}
+
+	resp, err := transport.inner.RoundTrip(req)
+	if err != nil {
+		transport.release()
+		return nil, err
+	}
+
+	// The request is in flight until its body has been read
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: transport.release}
+
+	return resp, nil
+}
+
+func (transport *concurrencyLimitedTransport) release() {
+	<-transport.slots
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (body *releasingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
@@ -0,0 +1,79 @@
+package src
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimitCapsOutboundRequests(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			previous := atomic.LoadInt32(&maxInFlight)
+			if current <= previous || atomic.CompareAndSwapInt32(&maxInFlight, previous, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newConcurrencyLimitedTransport(http.DefaultTransport, 2, 5*time.Second)}
+
+	var wg sync.WaitGroup
+	var failed int32
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Fatalf("Expected all requests to succeed, but %d failed", failed)
+	}
+	if maxInFlight > 2 {
+		t.Fatalf("Expected at most 2 concurrent requests, but got %d", maxInFlight)
+	}
+}
+
+func TestConcurrencyLimitQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: newConcurrencyLimitedTransport(http.DefaultTransport, 1, 50*time.Millisecond)}
+
+	go client.Get(server.URL)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := client.Get(server.URL); !errors.Is(err, errConcurrencyLimitExceeded) {
+		t.Fatalf("Expected the queued request to time out, but got %v", err)
+	}
+}
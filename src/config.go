@@ -3,15 +3,22 @@ package src
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
@@ -27,11 +34,30 @@ const DefaultSecret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
 type Config struct {
 	LogLevel string `json:"log_level"`
 
+	// Repetitive messages, which are logged on every request, are written at most once per this number of seconds.
+	// 0 disables the sampling.
+	LogSampleInterval int `json:"log_sample_interval"`
+
+	// Writes every authorization decision to the log, independent of the LogLevel.
+	AuditLog bool `json:"audit_log"`
+
 	Secret string `json:"secret"`
 
+	// The algorithm used to encrypt the cookies with the Secret. AES-256-GCM is the only valid value, so this option
+	// only exists for algorithms which may be added in the future. The ciphertexts carry a version byte, so they can be
+	// added while existing cookies remain readable.
+	CookieEncryptionAlgorithm string `json:"cookie_encryption_algorithm"`
+
 	Provider *ProviderConfig `json:"provider"`
 	Scopes   []string        `json:"scopes"`
 
+	// Resource indicators (RFC 8707) which are sent on the authorization and token requests.
+	Resources []string `json:"resources"`
+
+	// The response_mode which is sent to the provider. With form_post, the provider posts the code and state
+	// to the callback instead of passing them in the query. When empty, the provider's default is used.
+	ResponseMode string `json:"response_mode"`
+
 	// Can be a relative path or a full URL.
 	// If a relative path is used, the scheme and domain will be taken from the incoming request.
 	// In this case, the callback path will overlay all hostnames behind the middleware.
@@ -39,6 +65,10 @@ type Config struct {
 	// that the callback URL is also routed to this middleware plugin.
 	CallbackUri string `json:"callback_uri"`
 
+	// Always uses https for the callback and post logout URLs which are built from the request,
+	// independent of what the X-Forwarded-Proto header says, eg. behind a TLS-terminating proxy.
+	ForceHttpsRedirectUri bool `json:"force_https_redirect_uri"`
+
 	// The URL used to start authorization when needed.
 	// All other requests that are not already authorized will return a 401 Unauthorized.
 	// When left empty, all requests can start authorization.
@@ -49,30 +79,160 @@ type Config struct {
 	PostLogoutRedirectUri       string   `json:"post_logout_redirect_uri"`
 	ValidPostLogoutRedirectUris []string `json:"valid_post_logout_redirect_uris"`
 
+	// An optional url, which renews the tokens of the current session and responds with their new expiration.
+	// Allows frontends to refresh proactively. Requires a valid session.
+	RefreshUri string `json:"refresh_uri"`
+
+	// Reconstructs the original request from the X-Forwarded-Uri header, as passed by Traefik's ForwardAuth middleware.
+	// Authenticated requests are answered with 200 and the Headers set on the response, instead of being forwarded,
+	// so Traefik can copy them to the backend request by its authResponseHeaders.
+	ForwardAuthMode bool `json:"forward_auth_mode"`
+
+	// The prompt parameter which is sent to the provider, depending on why the login has been started.
+	Prompt *PromptConfig `json:"prompt"`
+
+	// CORS preflight requests are never authenticated. Optionally they are answered with these CORS headers.
+	Cors *CorsConfig `json:"cors"`
+
+	// Submits a form again after the login, if it has been posted without a valid session.
+	PostReplay *PostReplayConfig `json:"post_replay"`
+
+	// Optional sources of a login_hint which is passed to the provider to pre-fill the username.
+	LoginHint *LoginHintConfig `json:"login_hint"`
+
 	CookieNamePrefix     string                     `json:"cookie_name_prefix"`
 	SessionCookie        *SessionCookieConfig       `json:"session_cookie"`
+	SessionHeader        *SessionHeaderConfig       `json:"session_header"`
+	SessionStorage       *SessionStorageConfig      `json:"session_storage"`
 	AuthorizationHeader  *AuthorizationHeaderConfig `json:"authorization_header"`
 	AuthorizationCookie  *AuthorizationCookieConfig `json:"authorization_cookie"`
 	UnauthorizedBehavior string                     `json:"unauthorized_behavior"`
 
+	// Exposes a single, non-sensitive claim to the frontend in a cookie which is readable by JavaScript.
+	ClaimCookie *ClaimCookieConfig `json:"claim_cookie"`
+
+	// Optional names which replace the prefix convention for the session and code verifier cookies.
+	SessionCookieName      string `json:"session_cookie_name"`
+	CodeVerifierCookieName string `json:"code_verifier_cookie_name"`
+
+	// The path of the code verifier cookie. It's only needed on the callback, so it defaults to the path of the CallbackUri.
+	CodeVerifierCookiePath string `json:"code_verifier_cookie_path"`
+
+	// The maximum number of cookies a chunked session may be split into. 0 disables the limit.
+	MaxCookieChunks int `json:"max_cookie_chunks"`
+
+	// The number of consecutive redirects to the provider without receiving a valid session, after which
+	// an error page is shown instead of redirecting again. This breaks login loops caused by cookies
+	// which are not sent back by the browser. 0 disables the detection.
+	MaxLoginRedirects int `json:"max_login_redirects"`
+
+	// The status code of the redirect to the provider. Either 302 or 303.
+	// 307 is not allowed, because it would forward the method and body of a POST, eg. a form with credentials, to the provider.
+	LoginRedirectStatusCode int `json:"login_redirect_status_code"`
+
+	// Defines how unauthenticated or unauthorized HEAD requests are answered.
+	// Status returns the bare status code without a redirect or body, Default handles them like any other request.
+	HeadRequestBehavior string `json:"head_request_behavior"`
+
+	// Treats requests without an Accept header like browser requests, so they are redirected to the provider
+	// when the UnauthorizedBehavior is Auto and receive HTML error pages.
+	DefaultToHtmlOnMissingAccept bool `json:"default_to_html_on_missing_accept"`
+
+	// Defines how unauthenticated background requests, sent by XMLHttpRequest or fetch, are answered.
+	// Unauthorized returns a 401 JSON response without a redirect or cookies, Default handles them like any other request.
+	XhrRequestBehavior string `json:"xhr_request_behavior"`
+
+	// Defines what happens when the session cookie is present but corrupt.
+	// Restart clears the cookies and treats the request as unauthenticated, Error shows an error page for debugging.
+	CorruptSessionBehavior string `json:"corrupt_session_behavior"`
+
+	// The maximum lifetime of a session in seconds, counted from the login and independent of token renewals.
+	// When exceeded, the user needs to re-authenticate. 0 disables the absolute timeout.
+	AbsoluteTimeout int `json:"absolute_timeout"`
+
+	// The maximum number of seconds the middleware may spend on authenticating a request, including the calls to the provider.
+	// When exceeded, the request fails with 503 Service Unavailable. 0 disables the timeout.
+	RequestTimeout int `json:"request_timeout"`
+
+	// The maximum number of seconds between starting a login or logout and the callback.
+	// Older callbacks, eg. from a stale tab, are rejected. 0 disables the check.
+	StateTtl int `json:"state_ttl"`
+
+	// Binds the session to the IP address or the user agent of the client, recorded at login.
+	// When they don't match on a subsequent request, the session is invalidated and the user needs to log in again.
+	// Note that the IP of mobile users may change frequently. The IP can't be bound in ForwardAuthMode,
+	// because the requests come from Traefik.
+	BindSessionToIp        bool `json:"bind_session_to_ip"`
+	BindSessionToUserAgent bool `json:"bind_session_to_user_agent"`
+
+	// Encrypts the tokens of a session before they are written to the SessionStorage,
+	// in addition to the encryption of the session cookie.
+	EncryptSessionTokens bool `json:"encrypt_session_tokens"`
+
+	// The claim which identifies the subject of a session. It is stored on the session
+	// and allows the SessionStorage to find all sessions of a subject.
+	SubjectClaim string `json:"subject_claim"`
+
+	// Reads single claims from another token than the one used for TokenValidation, eg. the scope from the access token.
+	// These claims take precedence over the claims of the validated token.
+	ClaimSources []ClaimSourceConfig `json:"claim_sources"`
+
+	// Exchanges the access token of the session for one scoped to another audience (RFC 8693) before forwarding the request.
+	TokenExchange *TokenExchangeConfig `json:"token_exchange"`
+
+	// Limits the number of requests per authenticated subject. Anonymous requests are not limited.
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+
 	Authorization *AuthorizationConfig `json:"authorization"`
 
 	Headers []HeaderConfig `json:"headers"`
 
+	// An optional header which forwards the expiry of the session tokens to the upstream service, in epoch seconds.
+	ExpiresAtHeader string `json:"expires_at_header"`
+
+	// Headers which tell the upstream service how to route the request, eg. by the tenant or role of the user.
+	RoutingHints *RoutingHintsConfig `json:"routing_hints"`
+
 	BypassAuthenticationRule string `json:"bypass_authentication_rule"`
 
 	ErrorPages *errorPages.ErrorPagesConfig `json:"error_pages"`
+	LogoutPage *errorPages.LogoutPageConfig `json:"logout_page"`
+
+	// A reference to the parsed PostLoginRedirectUri-template, if it is one
+	postLoginRedirectTemplate *template.Template
 }
 
 type ProviderConfig struct {
 	Url string `json:"url"`
 
+	// An optional internal URL of the provider, used to fetch the discovery document and for server-to-server requests.
+	// Url is still used for the endpoints the browser is redirected to.
+	InternalDiscoveryUrl string `json:"internal_discovery_url"`
+
+	// Override the endpoints of the discovery document, eg. when a provider publishes a wrong or incomplete document.
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+
 	InsecureSkipVerify     string `json:"insecure_skip_verify"`
 	InsecureSkipVerifyBool bool   `json:"insecure_skip_verify_bool"`
 
 	CABundle     string `json:"ca_bundle"`
 	CABundleFile string `json:"ca_bundle_file"`
 
+	// The minimum TLS version of the connections to the provider. Can be one of 1.0, 1.1, 1.2 or 1.3.
+	MinTlsVersion string `json:"min_tls_version"`
+
+	// Restricts the cipher suites of TLS 1.2 and below to these, eg. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// The cipher suites of TLS 1.3 are not configurable. The defaults of Go are used, if empty.
+	CipherSuites []string `json:"cipher_suites"`
+
+	// Headers which are added to all requests to the provider, eg. the discovery, token and JWKS requests.
+	// Useful for providers behind an API gateway which requires an API key or a tenant id.
+	IdpRequestHeaders map[string]string `json:"idp_request_headers"`
+
 	ClientId              string `json:"client_id"`
 	ClientSecret          string `json:"client_secret"`
 	ClientJwtPrivateKey   string `json:"client_jwt_private_key"`
@@ -81,21 +241,91 @@ type ProviderConfig struct {
 	UsePkce     string `json:"use_pkce"`
 	UsePkceBool bool   `json:"use_pkce_bool"`
 
+	// Use Pushed Authorization Requests (RFC 9126) when the provider supports it.
+	UsePar     string `json:"use_par"`
+	UseParBool bool   `json:"use_par_bool"`
+
 	ValidateAudience     string `json:"validate_audience"`
 	ValidateAudienceBool bool   `json:"validate_audience_bool"`
 	ValidAudience        string `json:"valid_audience"`
 
+	// The audience which must be present in externally provided bearer tokens (AuthorizationHeader or AuthorizationCookie).
+	// When set, this is used instead of ValidAudience, which is meant for the tokens issued to the web client.
+	ResourceAudience string `json:"resource_audience"`
+
+	// Validates the at_hash and c_hash claims of the id token on the callback
+	ValidateTokenHashes     string `json:"validate_token_hashes"`
+	ValidateTokenHashesBool bool   `json:"validate_token_hashes_bool"`
+
 	ValidateIssuer     string `json:"validate_issuer"`
 	ValidateIssuerBool bool   `json:"validate_issuer_bool"`
 	ValidIssuer        string `json:"valid_issuer"`
 
+	// Additional issuers whose tokens are accepted, eg. in federated setups. Each issuer is verified using its own JWKS.
+	TrustedIssuers []TrustedIssuerConfig `json:"trusted_issuers"`
+
+	// The algorithms a token may be signed with. Tokens signed with any other algorithm, eg. none or HS256, are rejected.
+	AllowedSigningAlgorithms []string `json:"allowed_signing_algorithms"`
+
 	// AccessToken or IdToken or Introspection
 	TokenValidation string `json:"verification_token"`
 
+	// When using Introspection, the client_id of the introspection response must match the ClientId.
+	ValidateIntrospectionClientId     string `json:"validate_introspection_client_id"`
+	ValidateIntrospectionClientIdBool bool   `json:"validate_introspection_client_id_bool"`
+
+	// How the iss parameter of the callback (RFC 9207) is validated against the issuer of the provider, to prevent mix-up attacks.
+	// WhenPresent validates it if it's sent or the provider announces it, Required rejects callbacks without it, Disabled ignores it.
+	CallbackIssuerValidation string `json:"callback_issuer_validation"`
+
 	TokenRenewalThreshold float64 `json:"token_renewal_threshold"`
 
+	// Concurrent requests of the same session share a single token renewal.
+	// This is the maximum number of seconds a request waits for a renewal which is already in progress.
+	TokenRenewalWaitTimeout int `json:"token_renewal_wait_timeout"`
+
+	// The number of times a token renewal is retried, when the provider is unreachable or answers with a server error.
+	// A rejected refresh token, eg. because it's expired, is never retried but requires a new login.
+	TokenRenewalRetries int `json:"token_renewal_retries"`
+
+	// Fetches the discovery document and the JWKS in the background when the middleware starts instead of on the first request.
+	// It's retried EagerDiscoveryRetries times, waiting EagerDiscoveryRetryInterval seconds in between,
+	// and then every EagerDiscoveryRetryInterval until it succeeds, the middleware is replaced or an hour has elapsed.
+	EagerDiscovery              bool `json:"eager_discovery"`
+	EagerDiscoveryRetries       int  `json:"eager_discovery_retries"`
+	EagerDiscoveryRetryInterval int  `json:"eager_discovery_retry_interval"`
+
+	// Rejects requests with 503 until the eager discovery has succeeded, instead of trying it on every request.
+	FailClosed bool `json:"fail_closed"`
+
+	// Waits for the eager discovery on startup and fails the startup of the middleware, if it doesn't succeed within the retries,
+	// instead of retrying it in the background.
+	RequireDiscovery bool `json:"require_discovery"`
+
+	// Limits the number of simultaneous outbound requests, eg. to the token, introspection and JWKS endpoints,
+	// so a thundering herd doesn't overwhelm the provider. 0 disables the limit.
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// The maximum number of seconds a request waits for a free slot, when MaxConcurrentRequests are in flight.
+	ConcurrentRequestsQueueTimeout int `json:"concurrent_requests_queue_timeout"`
+
+	// Requests to the provider which take longer than this number of milliseconds are logged as a warning. 0 disables it.
+	SlowRequestThreshold int `json:"slow_request_threshold"`
+
 	UseClaimsFromUserInfo     string `json:"use_claims_from_user_info"`
 	UseClaimsFromUserInfoBool bool   `json:"use_claims_from_user_info_bool"`
+
+	// When enabled, token claims take precedence over conflicting userinfo claims.
+	// Disabled by default, because UseClaimsFromUserInfo has always let userinfo claims override the token claims.
+	PreferTokenClaims     string `json:"prefer_token_claims"`
+	PreferTokenClaimsBool bool   `json:"prefer_token_claims_bool"`
+}
+
+type TrustedIssuerConfig struct {
+	Issuer string `json:"issuer"`
+
+	// The URL of the JWKS of the issuer. If empty, it's taken from the discovery document of the issuer.
+	JwksUri string `json:"jwks_uri"`
 }
 
 type SessionCookieConfig struct {
@@ -105,6 +335,153 @@ type SessionCookieConfig struct {
 	HttpOnly bool   `json:"http_only"`
 	SameSite string `json:"same_site"`
 	MaxAge   int    `json:"max_age"`
+
+	// Sets Secure on the cookies of requests made over https, even if Secure is false.
+	AutoSecure bool `json:"auto_secure"`
+
+	// Meant for local development: cookies with SameSite None are set as Lax and not Secure on requests made over http,
+	// because browsers drop them otherwise and the login would loop.
+	DowngradeSameSiteNoneOnHttp bool `json:"downgrade_same_site_none_on_http"`
+
+	// Can be either Raw or Base64Url, which additionally encodes the value so only URL-safe characters are used.
+	Encoding string `json:"encoding"`
+
+	// Can be either Encrypt, which encrypts the session ticket, or Sign, which only signs it so it can't be modified.
+	// Sign is cheaper, but requires the Memory storage, because the ticket is readable.
+	Protection string `json:"protection"`
+}
+
+// The claim cookie is set after the login using the attributes of the SessionCookie, but never with HttpOnly,
+// so client side code can read it, eg. to render the display name. It must therefore never contain a token.
+type ClaimCookieConfig struct {
+	// The name of the cookie. Defaults to the CookieNamePrefix followed by .Claim.
+	Name string `json:"name"`
+
+	// The claim whose value is written to the cookie. The cookie is disabled when empty.
+	Claim string `json:"claim"`
+}
+
+// Allows a chained proxy to pass the session ticket in a header instead of the session cookie.
+type SessionHeaderConfig struct {
+	Name string `json:"name"`
+}
+
+type SessionStorageConfig struct {
+	// Can be either Cookie, which stores the whole session in the session cookie, or Memory.
+	Type string `json:"type"`
+
+	// The number of seconds after which an unused session is removed from the Memory storage.
+	MaxAge int `json:"max_age"`
+
+	// Keeps the state of pending logins, including the PKCE code verifier, on the server instead of a cookie.
+	// This allows multiple logins to be started in parallel, eg. in multiple tabs. Requires the Memory storage.
+	StorePendingLogins bool `json:"store_pending_logins"`
+
+	// The maximum number of pending logins and redirect urls of the MaxStateSize kept in memory. Every unauthenticated
+	// request may start a login, so the oldest ones are discarded when it's reached.
+	MaxPendingLogins int `json:"max_pending_logins"`
+
+	// The maximum size of a serialized session in bytes, before it's encrypted. 0 disables the limit.
+	MaxSize int `json:"max_size"`
+
+	// Stores the sessions exceeding the MaxSize in memory instead of rejecting them. Requires the Cookie storage.
+	OverflowToMemory bool `json:"overflow_to_memory"`
+
+	// Still accepts the sessions of the Cookie storage, while migrating to the Memory storage.
+	// They are moved to the Memory storage the next time they're written, eg. when the tokens are renewed.
+	// Until then, they're only in the cookie, so a back-channel logout, ie. DeleteBySubject, and MaxSessionsPerSubject
+	// can't revoke them. Can't be combined with SessionCookie.Protection Sign, which doesn't understand the cookie sessions.
+	MigrateCookieSessions bool `json:"migrate_cookie_sessions"`
+
+	// The maximum size of the encoded state parameter in bytes. Longer redirect URLs are kept in memory
+	// and only a key is passed in the state, so the URL of the provider doesn't exceed server limits. 0 disables the limit.
+	MaxStateSize int `json:"max_state_size"`
+
+	// The maximum number of concurrent sessions of a subject. The oldest sessions are removed on login.
+	// 0 disables the limit. Requires the Memory storage.
+	MaxSessionsPerSubject int `json:"max_sessions_per_subject"`
+
+	// The sessions of the Memory storage are encrypted with the Secret and written to this file every PersistenceInterval
+	// seconds, when they have changed. They are restored on startup, so a restart doesn't log out all users. Requires the Memory storage.
+	PersistenceFile     string `json:"persistence_file"`
+	PersistenceInterval int    `json:"persistence_interval"`
+}
+
+type TokenExchangeConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// The audience of the downstream service the exchanged token is issued for.
+	Audience string `json:"audience"`
+
+	// The header the exchanged token is passed upstream in, as a bearer token.
+	HeaderName string `json:"header_name"`
+
+	// Other audiences for the requests matching a rule. The first matching route wins, otherwise the Audience is used.
+	Routes []TokenExchangeRouteConfig `json:"routes"`
+}
+
+type TokenExchangeRouteConfig struct {
+	// A rule of the same syntax as the BypassAuthenticationRule.
+	Rule     string `json:"rule"`
+	Audience string `json:"audience"`
+
+	// A reference to the parsed Rule
+	rule *rules.RequestCondition
+}
+
+type RateLimitConfig struct {
+	// The number of requests per second a subject may make on average. 0 disables the rate limit.
+	Rate float64 `json:"rate"`
+
+	// The number of requests a subject may make at once, before the Rate applies.
+	Burst int `json:"burst"`
+}
+
+type RoutingHintsConfig struct {
+	// The Value of each header is a template which is rendered with the claims only, eg. {{ .org_id }}.
+	// A header is omitted, when a claim of its template is missing.
+	Headers []HeaderConfig `json:"headers"`
+}
+
+type PromptConfig struct {
+	// Used when there is no session, or the login has been started using the LoginUri.
+	Login string `json:"login"`
+
+	// Used when the session exceeded the AbsoluteTimeout, eg. login to enforce entering the credentials again.
+	Reauthentication string `json:"reauthentication"`
+
+	// Used when the tokens of the session expired and couldn't be renewed, eg. none to only reuse the session at the provider.
+	Silent string `json:"silent"`
+
+	// Adds select_account to every prompt, so the user always picks an account, eg. on shared devices.
+	// It's not added to the prompt none, which must not be combined with other values.
+	ForceAccountSelection bool `json:"force_account_selection"`
+}
+
+type CorsConfig struct {
+	// When empty, preflight requests are forwarded to the upstream service.
+	// Otherwise they are answered directly. Use "*" to allow every origin.
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+
+	// The number of seconds the browser may cache the preflight response. 0 doesn't send the header.
+	MaxAge int `json:"max_age"`
+}
+
+type PostReplayConfig struct {
+	// Requires the SessionStorage to store the pending logins.
+	Enabled bool `json:"enabled"`
+
+	// The maximum size of a form body in bytes. Larger forms are not replayed.
+	MaxBodySize int `json:"max_body_size"`
+}
+
+type LoginHintConfig struct {
+	QueryParameter string `json:"query_parameter"`
+	Header         string `json:"header"`
 }
 
 type AuthorizationHeaderConfig struct {
@@ -117,6 +494,57 @@ type AuthorizationCookieConfig struct {
 type AuthorizationConfig struct {
 	AssertClaims        []ClaimAssertion `json:"assert_claims"`
 	CheckOnEveryRequest bool             `json:"check_on_every_request"`
+
+	// Checks the authorization of a session again after this number of seconds, so changed group memberships
+	// take effect without a new login. The tokens are renewed first, unless the claims are taken from the userinfo,
+	// which is fetched on every request anyway. 0 only checks on login.
+	RecheckInterval int `json:"recheck_interval"`
+
+	// A list of OAuth scopes which all must be granted by the token, using either the scope or the scp claim.
+	RequiredScopes []string `json:"required_scopes"`
+
+	// A list of claims which all must be present and non-empty.
+	RequiredClaims []string `json:"required_claims"`
+
+	// The email_verified claim must be true. Some providers send it as the string "true".
+	RequireVerifiedEmail bool `json:"require_verified_email"`
+
+	// The claim containing the groups of the user. Nested claims can be addressed by a dotted path, eg. realm_access.roles.
+	GroupsClaim string `json:"groups_claim"`
+
+	// The user must be a member of at least one of these groups.
+	AllowedGroups []string `json:"allowed_groups"`
+
+	// Members of any of these groups and these subjects, taken from the SubjectClaim, are always denied,
+	// before any other rule is checked.
+	DeniedGroups   []string `json:"denied_groups"`
+	DeniedSubjects []string `json:"denied_subjects"`
+
+	// Normalize the groups of the claim, the AllowedGroups and the DeniedGroups before they are compared,
+	// eg. for the group paths of Keycloak like /admin, or inconsistent casing.
+	GroupsTrimLeadingSlash bool `json:"groups_trim_leading_slash"`
+	GroupsCaseInsensitive  bool `json:"groups_case_insensitive"`
+
+	// Delegates the decision to an external service, after all other rules are satisfied.
+	Webhook *AuthorizationWebhookConfig `json:"webhook"`
+}
+
+type AuthorizationWebhookConfig struct {
+	// The claims are posted as JSON to this URL. It must answer with 200 and {"allow": true} to allow the request.
+	Url string `json:"url"`
+
+	// The number of seconds to wait for the webhook, before the request is denied.
+	Timeout int `json:"timeout"`
+
+	// The number of seconds a decision is cached for the same claims. 0 disables the cache.
+	CacheDuration int `json:"cache_duration"`
+}
+
+type ClaimSourceConfig struct {
+	Name string `json:"name"`
+
+	// Either id or access
+	Token string `json:"token"`
 }
 
 type ClaimAssertion struct {
@@ -129,6 +557,10 @@ type HeaderConfig struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 
+	// Instead of rendering the Value, the header is added once per element of this array claim, eg. groups,
+	// for upstream services which expect repeated headers instead of a joined value.
+	MultiValueClaim string `json:"multi_value_claim"`
+
 	// A reference to the parsed Value-template
 	template *template.Template
 }
@@ -136,24 +568,38 @@ type HeaderConfig struct {
 // Will be called by traefik
 func CreateConfig() *Config {
 	return &Config{
-		LogLevel: logging.LevelWarn,
-		Secret:   DefaultSecret,
+		LogLevel:                  logging.LevelWarn,
+		Secret:                    DefaultSecret,
+		CookieEncryptionAlgorithm: utils.EncryptionAlgorithmAesGcm,
 		Provider: &ProviderConfig{
-			UsePkceBool:               false,
-			InsecureSkipVerifyBool:    false,
-			ValidateIssuerBool:        true,
-			ValidateAudienceBool:      true,
-			TokenValidation:           "IdToken",
-			TokenRenewalThreshold:     0.75,
-			UseClaimsFromUserInfoBool: false,
+			UsePkceBool:                       false,
+			UseParBool:                        false,
+			InsecureSkipVerifyBool:            false,
+			MinTlsVersion:                     "1.2",
+			ValidateIssuerBool:                true,
+			ValidateAudienceBool:              true,
+			ValidateIntrospectionClientIdBool: false,
+			TokenValidation:                   "IdToken",
+			CallbackIssuerValidation:          "WhenPresent",
+			TokenRenewalThreshold:             0.75,
+			TokenRenewalWaitTimeout:           10,
+			TokenRenewalRetries:               1,
+			EagerDiscoveryRetries:             3,
+			EagerDiscoveryRetryInterval:       5,
+			ConcurrentRequestsQueueTimeout:    10,
+			UseClaimsFromUserInfoBool:         false,
+			PreferTokenClaimsBool:             false,
 		},
 		// Note: It looks like we're not allowed to specify a default value for arrays here.
 		// Maybe a traefik bug. So I've moved this to the New() method.
 		//Scopes:                []string{"openid", "profile", "email"},
-		CallbackUri:           "/oidc/callback",
-		LogoutUri:             "/logout",
-		PostLogoutRedirectUri: "/",
-		CookieNamePrefix:      "TraefikOidcAuth",
+		CallbackUri:             "/oidc/callback",
+		LogoutUri:               "/logout",
+		PostLogoutRedirectUri:   "/",
+		CookieNamePrefix:        "TraefikOidcAuth",
+		MaxCookieChunks:         6,
+		MaxLoginRedirects:       5,
+		LoginRedirectStatusCode: 302,
 		SessionCookie: &SessionCookieConfig{
 			Path:     "/",
 			Domain:   "",
@@ -161,17 +607,55 @@ func CreateConfig() *Config {
 			HttpOnly: true,
 			SameSite: "default",
 			MaxAge:   0,
+			Encoding: "Raw",
+
+			Protection: "Encrypt",
+		},
+		SessionHeader: &SessionHeaderConfig{},
+		ClaimCookie:   &ClaimCookieConfig{},
+		SessionStorage: &SessionStorageConfig{
+			Type:                "Cookie",
+			MaxAge:              86400,
+			MaxPendingLogins:    10000,
+			PersistenceInterval: 30,
+		},
+		Prompt:                 &PromptConfig{},
+		LoginHint:              &LoginHintConfig{},
+		AuthorizationHeader:    &AuthorizationHeaderConfig{},
+		AuthorizationCookie:    &AuthorizationCookieConfig{},
+		UnauthorizedBehavior:   "Auto",
+		CorruptSessionBehavior: "Restart",
+		HeadRequestBehavior:    "Status",
+		XhrRequestBehavior:     "Default",
+		SubjectClaim:           "sub",
+		TokenExchange: &TokenExchangeConfig{
+			HeaderName: "Authorization",
+		},
+		RateLimit: &RateLimitConfig{
+			Rate:  0,
+			Burst: 10,
+		},
+		RoutingHints: &RoutingHintsConfig{},
+		Cors:         &CorsConfig{},
+		PostReplay: &PostReplayConfig{
+			MaxBodySize: 16384,
 		},
-		AuthorizationHeader:  &AuthorizationHeaderConfig{},
-		AuthorizationCookie:  &AuthorizationCookieConfig{},
-		UnauthorizedBehavior: "Auto",
 		Authorization: &AuthorizationConfig{
 			CheckOnEveryRequest: false,
+			GroupsClaim:         "groups",
+			Webhook: &AuthorizationWebhookConfig{
+				Timeout:       5,
+				CacheDuration: 60,
+			},
 		},
 		ErrorPages: &errorPages.ErrorPagesConfig{
 			Unauthenticated: &errorPages.ErrorPageConfig{},
 			Unauthorized:    &errorPages.ErrorPageConfig{},
+			Theme:           &errorPages.ThemeConfig{},
+
+			ProblemContentType: errorPages.ProblemContentTypeRfc,
 		},
+		LogoutPage: &errorPages.LogoutPageConfig{},
 	}
 }
 
@@ -180,6 +664,7 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 	config.LogLevel = utils.ExpandEnvironmentVariableString(config.LogLevel)
 
 	logger := logging.CreateLogger(config.LogLevel)
+	logger.SampleInterval = time.Duration(config.LogSampleInterval) * time.Second
 
 	logger.Log(logging.LevelInfo, "Loading Configuration...")
 
@@ -187,6 +672,8 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		return nil, errors.New("missing provider configuration")
 	}
 
+	applyDefaultSubConfigs(config)
+
 	// Hack: Trick the traefik plugin catalog to successfully execute this method with the testData from .traefik.yml.
 	if config.Provider.Url == "https://..." {
 		return &TraefikOidcAuth{
@@ -197,15 +684,49 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 	var err error
 
 	config.Secret = utils.ExpandEnvironmentVariableString(config.Secret)
+	config.CookieEncryptionAlgorithm = utils.ExpandEnvironmentVariableString(config.CookieEncryptionAlgorithm)
 	config.CallbackUri = utils.ExpandEnvironmentVariableString(config.CallbackUri)
 	config.LoginUri = utils.ExpandEnvironmentVariableString(config.LoginUri)
 	config.PostLoginRedirectUri = utils.ExpandEnvironmentVariableString(config.PostLoginRedirectUri)
 	config.LogoutUri = utils.ExpandEnvironmentVariableString(config.LogoutUri)
+	config.RefreshUri = utils.ExpandEnvironmentVariableString(config.RefreshUri)
+	config.ExpiresAtHeader = utils.ExpandEnvironmentVariableString(config.ExpiresAtHeader)
 	config.PostLogoutRedirectUri = utils.ExpandEnvironmentVariableString(config.PostLogoutRedirectUri)
 	config.CookieNamePrefix = utils.ExpandEnvironmentVariableString(config.CookieNamePrefix)
+	config.SessionCookieName = utils.ExpandEnvironmentVariableString(config.SessionCookieName)
+	config.CodeVerifierCookieName = utils.ExpandEnvironmentVariableString(config.CodeVerifierCookieName)
+	config.CodeVerifierCookiePath = utils.ExpandEnvironmentVariableString(config.CodeVerifierCookiePath)
+	config.ClaimCookie.Name = utils.ExpandEnvironmentVariableString(config.ClaimCookie.Name)
+	config.ClaimCookie.Claim = utils.ExpandEnvironmentVariableString(config.ClaimCookie.Claim)
 	config.UnauthorizedBehavior = utils.ExpandEnvironmentVariableString(config.UnauthorizedBehavior)
+	config.HeadRequestBehavior = utils.ExpandEnvironmentVariableString(config.HeadRequestBehavior)
+	config.XhrRequestBehavior = utils.ExpandEnvironmentVariableString(config.XhrRequestBehavior)
+	config.ResponseMode = utils.ExpandEnvironmentVariableString(config.ResponseMode)
+	config.CorruptSessionBehavior = utils.ExpandEnvironmentVariableString(config.CorruptSessionBehavior)
+	config.SessionStorage.Type = utils.ExpandEnvironmentVariableString(config.SessionStorage.Type)
+	config.SessionStorage.PersistenceFile = utils.ExpandEnvironmentVariableString(config.SessionStorage.PersistenceFile)
+	config.SubjectClaim = utils.ExpandEnvironmentVariableString(config.SubjectClaim)
+	config.Prompt.Login = utils.ExpandEnvironmentVariableString(config.Prompt.Login)
+	config.Prompt.Reauthentication = utils.ExpandEnvironmentVariableString(config.Prompt.Reauthentication)
+	config.Prompt.Silent = utils.ExpandEnvironmentVariableString(config.Prompt.Silent)
 	config.BypassAuthenticationRule = utils.ExpandEnvironmentVariableString(config.BypassAuthenticationRule)
+	config.Authorization.GroupsClaim = utils.ExpandEnvironmentVariableString(config.Authorization.GroupsClaim)
+	if config.Authorization.Webhook != nil {
+		config.Authorization.Webhook.Url = utils.ExpandEnvironmentVariableString(config.Authorization.Webhook.Url)
+	}
+	config.TokenExchange.Audience = utils.ExpandEnvironmentVariableString(config.TokenExchange.Audience)
+	config.TokenExchange.HeaderName = utils.ExpandEnvironmentVariableString(config.TokenExchange.HeaderName)
+	for i := range config.TokenExchange.Routes {
+		config.TokenExchange.Routes[i].Rule = utils.ExpandEnvironmentVariableString(config.TokenExchange.Routes[i].Rule)
+		config.TokenExchange.Routes[i].Audience = utils.ExpandEnvironmentVariableString(config.TokenExchange.Routes[i].Audience)
+	}
 	config.Provider.Url = utils.ExpandEnvironmentVariableString(config.Provider.Url)
+	config.Provider.InternalDiscoveryUrl = utils.ExpandEnvironmentVariableString(config.Provider.InternalDiscoveryUrl)
+	config.Provider.AuthorizationEndpoint = utils.ExpandEnvironmentVariableString(config.Provider.AuthorizationEndpoint)
+	config.Provider.TokenEndpoint = utils.ExpandEnvironmentVariableString(config.Provider.TokenEndpoint)
+	config.Provider.JwksUri = utils.ExpandEnvironmentVariableString(config.Provider.JwksUri)
+	config.Provider.EndSessionEndpoint = utils.ExpandEnvironmentVariableString(config.Provider.EndSessionEndpoint)
+	config.Provider.IntrospectionEndpoint = utils.ExpandEnvironmentVariableString(config.Provider.IntrospectionEndpoint)
 	config.Provider.ClientId = utils.ExpandEnvironmentVariableString(config.Provider.ClientId)
 	config.Provider.ClientSecret = utils.ExpandEnvironmentVariableString(config.Provider.ClientSecret)
 	config.Provider.ClientJwtPrivateKeyId = utils.ExpandEnvironmentVariableString(config.Provider.ClientJwtPrivateKeyId)
@@ -214,20 +735,41 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 	if err != nil {
 		return nil, err
 	}
+	config.Provider.UseParBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.UsePar, config.Provider.UseParBool)
+	if err != nil {
+		return nil, err
+	}
 	config.Provider.UseClaimsFromUserInfoBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.UseClaimsFromUserInfo, config.Provider.UseClaimsFromUserInfoBool)
 	if err != nil {
 		return nil, err
 	}
+	config.Provider.PreferTokenClaimsBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.PreferTokenClaims, config.Provider.PreferTokenClaimsBool)
+	if err != nil {
+		return nil, err
+	}
 	config.Provider.ValidateIssuerBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.ValidateIssuer, config.Provider.ValidateIssuerBool)
 	if err != nil {
 		return nil, err
 	}
 	config.Provider.ValidIssuer = utils.ExpandEnvironmentVariableString(config.Provider.ValidIssuer)
+	for i := range config.Provider.TrustedIssuers {
+		config.Provider.TrustedIssuers[i].Issuer = utils.ExpandEnvironmentVariableString(config.Provider.TrustedIssuers[i].Issuer)
+		config.Provider.TrustedIssuers[i].JwksUri = utils.ExpandEnvironmentVariableString(config.Provider.TrustedIssuers[i].JwksUri)
+	}
+	config.Provider.ValidateTokenHashesBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.ValidateTokenHashes, config.Provider.ValidateTokenHashesBool)
+	if err != nil {
+		return nil, err
+	}
 	config.Provider.ValidateAudienceBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.ValidateAudience, config.Provider.ValidateAudienceBool)
 	if err != nil {
 		return nil, err
 	}
 	config.Provider.ValidAudience = utils.ExpandEnvironmentVariableString(config.Provider.ValidAudience)
+	config.Provider.ValidateIntrospectionClientIdBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.ValidateIntrospectionClientId, config.Provider.ValidateIntrospectionClientIdBool)
+	if err != nil {
+		return nil, err
+	}
+	config.Provider.ResourceAudience = utils.ExpandEnvironmentVariableString(config.Provider.ResourceAudience)
 	config.Provider.InsecureSkipVerifyBool, err = utils.ExpandEnvironmentVariableBoolean(config.Provider.InsecureSkipVerify, config.Provider.InsecureSkipVerifyBool)
 	if err != nil {
 		return nil, err
@@ -243,26 +785,50 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 
 	config.Provider.CABundle = utils.ExpandEnvironmentVariableString(config.Provider.CABundle)
 	config.Provider.CABundleFile = utils.ExpandEnvironmentVariableString(config.Provider.CABundleFile)
+	config.Provider.MinTlsVersion = utils.ExpandEnvironmentVariableString(config.Provider.MinTlsVersion)
+	for name, value := range config.Provider.IdpRequestHeaders {
+		config.Provider.IdpRequestHeaders[name] = utils.ExpandEnvironmentVariableString(value)
+	}
 	config.Provider.TokenValidation = utils.ExpandEnvironmentVariableString(config.Provider.TokenValidation)
+	config.Provider.CallbackIssuerValidation = utils.ExpandEnvironmentVariableString(config.Provider.CallbackIssuerValidation)
 
 	config.ErrorPages.Unauthenticated.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthenticated.FilePath)
 	config.ErrorPages.Unauthenticated.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthenticated.RedirectTo)
 	config.ErrorPages.Unauthorized.FilePath = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthorized.FilePath)
 	config.ErrorPages.Unauthorized.RedirectTo = utils.ExpandEnvironmentVariableString(config.ErrorPages.Unauthorized.RedirectTo)
+	config.ErrorPages.InstanceClaim = utils.ExpandEnvironmentVariableString(config.ErrorPages.InstanceClaim)
+	config.ErrorPages.ProblemContentType = utils.ExpandEnvironmentVariableString(config.ErrorPages.ProblemContentType)
+	if config.ErrorPages.Theme != nil {
+		config.ErrorPages.Theme.ProductName = utils.ExpandEnvironmentVariableString(config.ErrorPages.Theme.ProductName)
+		config.ErrorPages.Theme.LogoUrl = utils.ExpandEnvironmentVariableString(config.ErrorPages.Theme.LogoUrl)
+		config.ErrorPages.Theme.PrimaryColor = utils.ExpandEnvironmentVariableString(config.ErrorPages.Theme.PrimaryColor)
+	}
+	config.LogoutPage.FilePath = utils.ExpandEnvironmentVariableString(config.LogoutPage.FilePath)
+	config.LogoutPage.RedirectTo = utils.ExpandEnvironmentVariableString(config.LogoutPage.RedirectTo)
 
-	if config.Secret == DefaultSecret {
-		logger.Log(logging.LevelWarn, "You're using the default secret! It is highly recommended to change the secret by specifying a random 32 character value using the Secret-option.")
+	if errs := ValidateConfig(config); len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, err := range errs {
+			logger.Log(logging.LevelError, "Invalid configuration: %s", err.Error())
+			messages[i] = err.Error()
+		}
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(messages, "; "))
 	}
 
-	secret := []byte(config.Secret)
-	if len(secret) != 32 {
-		logger.Log(logging.LevelError, "Invalid secret provided. Secret must be exactly 32 characters in length. The provided secret has %d characters.", len(secret))
-		return nil, errors.New("invalid secret")
+	if isRedirectTemplate(config.PostLoginRedirectUri) {
+		// Already validated above
+		config.postLoginRedirectTemplate, _ = parseRedirectTemplate(config.PostLoginRedirectUri)
+	}
+	for i := range config.RoutingHints.Headers {
+		config.RoutingHints.Headers[i].template, _ = parseRoutingHintTemplate(config.RoutingHints.Headers[i].Value)
 	}
 
-	if config.Provider.CABundle != "" && config.Provider.CABundleFile != "" {
-		logger.Log(logging.LevelError, "You can only use an inline CABundle OR CABundleFile, not both.")
-		return nil, errors.New("you can only use an inline CABundle OR CABundleFile, not both.")
+	if config.SessionCookie.DowngradeSameSiteNoneOnHttp {
+		logger.Log(logging.LevelWarn, "SessionCookie.DowngradeSameSiteNoneOnHttp is enabled. Cookies of requests over http are set with SameSite Lax and without Secure. Never enable this in production!")
+	}
+
+	if config.Secret == DefaultSecret {
+		logger.Log(logging.LevelWarn, "You're using the default secret! It is highly recommended to change the secret by specifying a random 32 character value using the Secret-option.")
 	}
 
 	// Specify default scopes if not provided
@@ -270,18 +836,21 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		config.Scopes = []string{"openid", "profile", "email"}
 	}
 
-	parsedURL, err := utils.ParseUrl(config.Provider.Url)
-	if err != nil {
-		logger.Log(logging.LevelError, "Error while parsing Provider.Url: %s", err.Error())
-		return nil, err
+	// Specify the default signing algorithms if not provided
+	if len(config.Provider.AllowedSigningAlgorithms) == 0 {
+		config.Provider.AllowedSigningAlgorithms = []string{"RS256"}
 	}
 
-	parsedCallbackURL, err := url.Parse(config.CallbackUri)
-	if err != nil {
-		logger.Log(logging.LevelError, "Error while parsing CallbackUri: %s", err.Error())
-		return nil, err
+	// The URLs have already been validated by ValidateConfig
+	parsedURL, _ := utils.ParseUrl(config.Provider.Url)
+
+	var parsedInternalURL *url.URL
+	if config.Provider.InternalDiscoveryUrl != "" {
+		parsedInternalURL, _ = utils.ParseUrl(config.Provider.InternalDiscoveryUrl)
 	}
 
+	parsedCallbackURL, _ := url.Parse(config.CallbackUri)
+
 	logger.Log(logging.LevelInfo, "Provider Url: %v", parsedURL)
 	logger.Log(logging.LevelInfo, "I will use this URL for callbacks from the IDP: %v", parsedCallbackURL)
 	if utils.UrlIsAbsolute(parsedCallbackURL) {
@@ -290,12 +859,10 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		logger.Log(logging.LevelInfo, "Callback URL is relative, will overlay any wrapped host")
 	}
 	logger.Log(logging.LevelDebug, "Scopes: %s", strings.Join(config.Scopes, ", "))
-	logger.Log(logging.LevelDebug, "SessionCookie: %v", config.SessionCookie)
-
-	if config.Provider.TokenRenewalThreshold < 0.5 || config.Provider.TokenRenewalThreshold > 1.0 {
-		logger.Log(logging.LevelError, "Invalid TokenRenewalThreshold. The value must be >= 0.5 and <= 1.0.")
-		return nil, errors.New("invalid TokenRenewalThreshold")
+	if len(config.Resources) > 0 {
+		logger.Log(logging.LevelDebug, "Resources: %s", strings.Join(config.Resources, ", "))
 	}
+	logger.Log(logging.LevelDebug, "SessionCookie: %v", config.SessionCookie)
 
 	var conditionalAuth *rules.RequestCondition
 	if config.BypassAuthenticationRule != "" {
@@ -308,12 +875,217 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		conditionalAuth = ca
 	}
 
+	// The rules have already been validated by ValidateConfig
+	for i := range config.TokenExchange.Routes {
+		config.TokenExchange.Routes[i].rule, _ = rules.ParseRequestCondition(config.TokenExchange.Routes[i].Rule)
+	}
+
+	providerHosts := newProviderHosts(config.Provider.Url, config.Provider.InternalDiscoveryUrl, config.Provider.AuthorizationEndpoint,
+		config.Provider.TokenEndpoint, config.Provider.JwksUri, config.Provider.EndSessionEndpoint, config.Provider.IntrospectionEndpoint)
+
+	httpClient, err := createHttpClient(logger, config, providerHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessionStorage session.SessionStorage = session.CreateCookieSessionStorage()
+	var pendingLoginStorage session.PendingLoginStorage
+	var redirectUrlStorage session.PendingLoginStorage
+
+	if config.SessionStorage.Type == "Memory" {
+		var memoryStorage *session.InMemorySessionStorage
+		if config.SessionStorage.PersistenceFile != "" {
+			memoryStorage = getPersistentSessionStorage(logger, config.SessionStorage.PersistenceFile, config.Secret, time.Duration(config.SessionStorage.MaxAge)*time.Second, time.Duration(config.SessionStorage.PersistenceInterval)*time.Second)
+		} else {
+			memoryStorage = session.CreateInMemorySessionStorage(time.Duration(config.SessionStorage.MaxAge) * time.Second)
+		}
+		sessionStorage = memoryStorage
+
+		// New sessions are written to the Memory storage, which is also tried first when reading them
+		if config.SessionStorage.MigrateCookieSessions {
+			sessionStorage = session.CreateChainedSessionStorage(0, memoryStorage, session.CreateLegacyCookieSessionStorage())
+		}
+
+		if config.SessionStorage.StorePendingLogins {
+			memoryStorage.LimitPendingLogins(config.SessionStorage.MaxPendingLogins, getPendingLoginMaxAge(config))
+			pendingLoginStorage = memoryStorage
+		}
+		if config.SessionStorage.MaxStateSize > 0 {
+			memoryStorage.LimitPendingLogins(config.SessionStorage.MaxPendingLogins, getPendingLoginMaxAge(config))
+			redirectUrlStorage = memoryStorage
+		}
+	} else if config.SessionStorage.MaxStateSize > 0 {
+		memoryStorage := session.CreateInMemorySessionStorage(time.Duration(config.SessionStorage.MaxAge) * time.Second)
+		memoryStorage.LimitPendingLogins(config.SessionStorage.MaxPendingLogins, getPendingLoginMaxAge(config))
+		redirectUrlStorage = memoryStorage
+	}
+
+	var overflowStorage session.SessionStorage
+	if config.SessionStorage.OverflowToMemory {
+		overflowStorage = session.CreateInMemorySessionStorage(time.Duration(config.SessionStorage.MaxAge) * time.Second)
+	}
+
+	if config.EncryptSessionTokens {
+		sessionStorage = session.CreateEncryptedSessionStorage(sessionStorage, config.Secret)
+
+		if overflowStorage != nil {
+			overflowStorage = session.CreateEncryptedSessionStorage(overflowStorage, config.Secret)
+		}
+	}
+
+	// Applied last, so the size of the final session ticket is limited
+	if config.SessionStorage.MaxSize > 0 {
+		sessionStorage = session.CreateSizeLimitedSessionStorage(sessionStorage, config.SessionStorage.MaxSize, overflowStorage)
+	}
+
+	var rateLimiter *utils.RateLimiter
+	if config.RateLimit.Rate > 0 {
+		rateLimiter = utils.CreateRateLimiter(config.RateLimit.Rate, config.RateLimit.Burst)
+	}
+
+	logger.Log(logging.LevelInfo, "Configuration loaded successfully, starting OIDC Auth middleware...")
+
+	toa := &TraefikOidcAuth{
+		logger:                   logger,
+		auditLogger:              logging.CreateAuditLogger(config.AuditLog),
+		next:                     next,
+		httpClient:               httpClient,
+		providerHosts:            providerHosts,
+		httpClientKey:            getHttpClientKey(config),
+		ProviderURL:              parsedURL,
+		InternalProviderURL:      parsedInternalURL,
+		ClientJwtPrivateKey:      clientAssertionPrivateKey,
+		CallbackURL:              parsedCallbackURL,
+		Config:                   config,
+		SessionStorage:           sessionStorage,
+		PendingLoginStorage:      pendingLoginStorage,
+		RedirectUrlStorage:       redirectUrlStorage,
+		BypassAuthenticationRule: conditionalAuth,
+		rateLimiter:              rateLimiter,
+	}
+
+	if config.Provider.EagerDiscovery {
+		if err := toa.startEagerDiscovery(uctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return toa, nil
+}
+
+// Returns whether the scope or scp claim is read from the access token, so the RequiredScopes can be checked with IdToken validation.
+func hasScopeClaimSource(config *Config) bool {
+	return slices.ContainsFunc(config.ClaimSources, func(claimSource ClaimSourceConfig) bool {
+		return (claimSource.Name == "scope" || claimSource.Name == "scp") && claimSource.Token == "access"
+	})
+}
+
+// Sub configs which are explicitly set to null get their defaults, so they don't need to be checked everywhere.
+func applyDefaultSubConfigs(config *Config) {
+	defaults := CreateConfig()
+
+	if config.SessionCookie == nil {
+		config.SessionCookie = defaults.SessionCookie
+	}
+	if config.SessionHeader == nil {
+		config.SessionHeader = defaults.SessionHeader
+	}
+	if config.ClaimCookie == nil {
+		config.ClaimCookie = defaults.ClaimCookie
+	}
+	if config.SessionStorage == nil {
+		config.SessionStorage = defaults.SessionStorage
+	}
+	if config.Prompt == nil {
+		config.Prompt = defaults.Prompt
+	}
+	if config.LoginHint == nil {
+		config.LoginHint = defaults.LoginHint
+	}
+	if config.AuthorizationHeader == nil {
+		config.AuthorizationHeader = defaults.AuthorizationHeader
+	}
+	if config.AuthorizationCookie == nil {
+		config.AuthorizationCookie = defaults.AuthorizationCookie
+	}
+	if config.TokenExchange == nil {
+		config.TokenExchange = defaults.TokenExchange
+	}
+	if config.RateLimit == nil {
+		config.RateLimit = defaults.RateLimit
+	}
+	if config.RoutingHints == nil {
+		config.RoutingHints = defaults.RoutingHints
+	}
+	if config.Cors == nil {
+		config.Cors = defaults.Cors
+	}
+	if config.PostReplay == nil {
+		config.PostReplay = defaults.PostReplay
+	}
+	if config.Authorization == nil {
+		config.Authorization = defaults.Authorization
+	}
+	if config.ErrorPages == nil {
+		config.ErrorPages = defaults.ErrorPages
+	}
+	if config.ErrorPages.Unauthenticated == nil {
+		config.ErrorPages.Unauthenticated = defaults.ErrorPages.Unauthenticated
+	}
+	if config.ErrorPages.Unauthorized == nil {
+		config.ErrorPages.Unauthorized = defaults.ErrorPages.Unauthorized
+	}
+	if config.ErrorPages.Theme == nil {
+		config.ErrorPages.Theme = defaults.ErrorPages.Theme
+	}
+	if config.LogoutPage == nil {
+		config.LogoutPage = defaults.LogoutPage
+	}
+}
+
+// Pending logins expire with the StateTtl, because their callback would be rejected afterwards anyway.
+func getPendingLoginMaxAge(config *Config) time.Duration {
+	if config.StateTtl > 0 {
+		return time.Duration(config.StateTtl) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// Identifies the settings of the client created by createHttpClient, which affect the responses of the provider.
+// The values of the IdpRequestHeaders may be secrets, so the settings are hashed.
+func getHttpClientKey(config *Config) string {
+	settings := []string{
+		strconv.FormatBool(config.Provider.InsecureSkipVerifyBool),
+		config.Provider.CABundle,
+		config.Provider.CABundleFile,
+		config.Provider.MinTlsVersion,
+		strings.Join(config.Provider.CipherSuites, ","),
+	}
+
+	headerNames := make([]string, 0, len(config.Provider.IdpRequestHeaders))
+	for name := range config.Provider.IdpRequestHeaders {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		settings = append(settings, name+": "+config.Provider.IdpRequestHeaders[name])
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(settings, "\n")))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// Creates the client for the requests to the provider, using the CA bundle and the TLS settings of the Provider.
+// The IdpRequestHeaders are only sent to the providerHosts.
+func createHttpClient(logger *logging.Logger, config *Config, providerHosts *providerHosts) (*http.Client, error) {
 	rootCAs, _ := x509.SystemCertPool()
 	if rootCAs == nil {
 		rootCAs = x509.NewCertPool()
 	}
 
 	var caBundleData []byte
+	var err error
 
 	if config.Provider.CABundle != "" {
 		if strings.HasPrefix(config.Provider.CABundle, "base64:") {
@@ -345,6 +1117,10 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 
 	}
 
+	// Both have already been validated by ValidateConfig
+	minTlsVersion, _ := parseTlsVersion(config.Provider.MinTlsVersion)
+	cipherSuites, _ := parseCipherSuites(config.Provider.CipherSuites)
+
 	httpTransport := &http.Transport{
 		// MaxIdleConns:    10,
 		// IdleConnTimeout: 30 * time.Second,
@@ -352,24 +1128,495 @@ func New(uctx context.Context, next http.Handler, config *Config, name string) (
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: config.Provider.InsecureSkipVerifyBool,
 			RootCAs:            rootCAs,
+			MinVersion:         minTlsVersion,
+			CipherSuites:       cipherSuites,
 		},
 	}
 
-	httpClient := &http.Client{
-		Transport: httpTransport,
+	var httpRoundTripper http.RoundTripper = httpTransport
+	if config.Provider.SlowRequestThreshold > 0 {
+		httpRoundTripper = newSlowRequestLoggingTransport(httpRoundTripper, logger, time.Duration(config.Provider.SlowRequestThreshold)*time.Millisecond)
 	}
+	if len(config.Provider.IdpRequestHeaders) > 0 {
+		// The values may be secrets, so only the names are logged
+		headerNames := make([]string, 0, len(config.Provider.IdpRequestHeaders))
+		for name := range config.Provider.IdpRequestHeaders {
+			headerNames = append(headerNames, name)
+		}
+		sort.Strings(headerNames)
+		logger.Log(logging.LevelDebug, "Adding the headers [%s] to the requests to the provider", strings.Join(headerNames, ", "))
 
-	logger.Log(logging.LevelInfo, "Configuration loaded successfully, starting OIDC Auth middleware...")
+		httpRoundTripper = newIdpRequestHeadersTransport(httpRoundTripper, config.Provider.IdpRequestHeaders, providerHosts)
+	}
+	if config.Provider.MaxConcurrentRequests > 0 {
+		httpRoundTripper = newConcurrencyLimitedTransport(httpRoundTripper, config.Provider.MaxConcurrentRequests, time.Duration(config.Provider.ConcurrentRequestsQueueTimeout)*time.Second)
+	}
 
-	return &TraefikOidcAuth{
-		logger:                   logger,
-		next:                     next,
-		httpClient:               httpClient,
-		ProviderURL:              parsedURL,
-		ClientJwtPrivateKey:      clientAssertionPrivateKey,
-		CallbackURL:              parsedCallbackURL,
-		Config:                   config,
-		SessionStorage:           session.CreateCookieSessionStorage(),
-		BypassAuthenticationRule: conditionalAuth,
+	return &http.Client{
+		Transport: httpRoundTripper,
 	}, nil
 }
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Returns the TLS version for a version like 1.2. An empty version uses the default of Go.
+func parseTlsVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+
+	tlsVersion, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version '%s'. Must be one of 1.0, 1.1, 1.2 or 1.3", version)
+	}
+
+	return tlsVersion, nil
+}
+
+// Returns the ids of the cipher suites with the given names. Insecure cipher suites are rejected.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		index := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool {
+			return suite.Name == name
+		})
+		if index < 0 {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+
+		ids = append(ids, tls.CipherSuites()[index].ID)
+	}
+
+	return ids, nil
+}
+
+// Validates the configuration after the environment variables have been expanded.
+// All problems are returned at once, so they can be fixed before the middleware is started.
+// The provider is not contacted here. Use Provider.RequireDiscovery to fail the startup, if it isn't reachable.
+func ValidateConfig(config *Config) []error {
+	var errs []error
+
+	if config.Provider == nil {
+		return []error{errors.New("missing provider configuration")}
+	}
+
+	if _, err := utils.ParseUrl(config.Provider.Url); err != nil {
+		errs = append(errs, fmt.Errorf("Provider.Url is invalid: %s", err.Error()))
+	}
+	for i, trustedIssuer := range config.Provider.TrustedIssuers {
+		if _, err := utils.ParseUrl(trustedIssuer.Issuer); err != nil {
+			errs = append(errs, fmt.Errorf("Provider.TrustedIssuers[%d].Issuer is invalid: %s", i, err.Error()))
+		}
+		if trustedIssuer.JwksUri != "" {
+			if _, err := utils.ParseUrl(trustedIssuer.JwksUri); err != nil {
+				errs = append(errs, fmt.Errorf("Provider.TrustedIssuers[%d].JwksUri is invalid: %s", i, err.Error()))
+			}
+		}
+	}
+
+	if config.Provider.InternalDiscoveryUrl != "" {
+		if _, err := utils.ParseUrl(config.Provider.InternalDiscoveryUrl); err != nil {
+			errs = append(errs, fmt.Errorf("Provider.InternalDiscoveryUrl is invalid: %s", err.Error()))
+		}
+	}
+	discoveryOverrides := []struct {
+		name  string
+		value string
+	}{
+		{"AuthorizationEndpoint", config.Provider.AuthorizationEndpoint},
+		{"TokenEndpoint", config.Provider.TokenEndpoint},
+		{"JwksUri", config.Provider.JwksUri},
+		{"EndSessionEndpoint", config.Provider.EndSessionEndpoint},
+		{"IntrospectionEndpoint", config.Provider.IntrospectionEndpoint},
+	}
+	for _, override := range discoveryOverrides {
+		if override.value == "" {
+			continue
+		}
+		if _, err := utils.ParseUrl(override.value); err != nil {
+			errs = append(errs, fmt.Errorf("Provider.%s is invalid: %s", override.name, err.Error()))
+		}
+	}
+	if callbackUrl, err := url.Parse(config.CallbackUri); err != nil {
+		errs = append(errs, fmt.Errorf("CallbackUri is invalid: %s", err.Error()))
+	} else if config.CodeVerifierCookiePath != "" && !isCookiePathMatch(callbackUrl.Path, config.CodeVerifierCookiePath) {
+		errs = append(errs, fmt.Errorf("CodeVerifierCookiePath '%s' is invalid. It must be the path of the CallbackUri or one of its parent paths", config.CodeVerifierCookiePath))
+	}
+
+	if config.ClaimCookie != nil && slices.Contains(tokenClaimNames, config.ClaimCookie.Claim) {
+		errs = append(errs, fmt.Errorf("ClaimCookie.Claim '%s' is invalid. Tokens must never be exposed to JavaScript", config.ClaimCookie.Claim))
+	}
+
+	if len(config.Secret) != 32 {
+		errs = append(errs, fmt.Errorf("Secret must be exactly 32 characters in length. The provided secret has %d characters", len(config.Secret)))
+	}
+	if !utils.IsValidEncryptionAlgorithm(config.CookieEncryptionAlgorithm) {
+		errs = append(errs, fmt.Errorf("CookieEncryptionAlgorithm '%s' is invalid. Must be %s", config.CookieEncryptionAlgorithm, utils.EncryptionAlgorithmAesGcm))
+	}
+
+	if config.Provider.CABundle != "" && config.Provider.CABundleFile != "" {
+		errs = append(errs, errors.New("you can only use an inline CABundle OR CABundleFile, not both"))
+	}
+	if _, err := parseTlsVersion(config.Provider.MinTlsVersion); err != nil {
+		errs = append(errs, fmt.Errorf("Provider.MinTlsVersion is invalid: %s", err.Error()))
+	}
+	if _, err := parseCipherSuites(config.Provider.CipherSuites); err != nil {
+		errs = append(errs, fmt.Errorf("Provider.CipherSuites is invalid: %s", err.Error()))
+	}
+	for name := range config.Provider.IdpRequestHeaders {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			errs = append(errs, fmt.Errorf("Provider.IdpRequestHeaders '%s' is invalid. Must be a valid header name", name))
+		}
+	}
+
+	if config.Provider.TokenValidation != "IdToken" && config.Provider.TokenValidation != "AccessToken" && config.Provider.TokenValidation != "Introspection" {
+		errs = append(errs, fmt.Errorf("Provider.TokenValidation '%s' is invalid. Must be one of IdToken, AccessToken or Introspection", config.Provider.TokenValidation))
+	}
+	if config.Provider.CallbackIssuerValidation != "" && config.Provider.CallbackIssuerValidation != "WhenPresent" && config.Provider.CallbackIssuerValidation != "Required" && config.Provider.CallbackIssuerValidation != "Disabled" {
+		errs = append(errs, fmt.Errorf("Provider.CallbackIssuerValidation '%s' is invalid. Must be one of WhenPresent, Required or Disabled", config.Provider.CallbackIssuerValidation))
+	}
+	if config.Provider.TokenRenewalThreshold < 0.5 || config.Provider.TokenRenewalThreshold > 1.0 {
+		errs = append(errs, fmt.Errorf("Provider.TokenRenewalThreshold %v is invalid. Must be between 0.5 and 1.0", config.Provider.TokenRenewalThreshold))
+	}
+	if config.Provider.TokenRenewalWaitTimeout < 1 {
+		errs = append(errs, fmt.Errorf("Provider.TokenRenewalWaitTimeout %d is invalid. Must be at least 1 second", config.Provider.TokenRenewalWaitTimeout))
+	}
+	if config.Provider.EagerDiscovery {
+		if config.Provider.EagerDiscoveryRetries < 0 {
+			errs = append(errs, fmt.Errorf("Provider.EagerDiscoveryRetries %d is invalid. Must not be negative", config.Provider.EagerDiscoveryRetries))
+		}
+		if config.Provider.EagerDiscoveryRetryInterval < 1 {
+			errs = append(errs, fmt.Errorf("Provider.EagerDiscoveryRetryInterval %d is invalid. Must be at least 1 second", config.Provider.EagerDiscoveryRetryInterval))
+		}
+	} else if config.Provider.FailClosed {
+		errs = append(errs, errors.New("Provider.FailClosed requires EagerDiscovery"))
+	}
+	if config.Provider.RequireDiscovery && !config.Provider.EagerDiscovery {
+		errs = append(errs, errors.New("Provider.RequireDiscovery requires EagerDiscovery"))
+	}
+	if config.Provider.TokenRenewalRetries < 0 {
+		errs = append(errs, fmt.Errorf("Provider.TokenRenewalRetries %d is invalid. Must not be negative", config.Provider.TokenRenewalRetries))
+	}
+	if config.Provider.MaxConcurrentRequests < 0 {
+		errs = append(errs, fmt.Errorf("Provider.MaxConcurrentRequests %d is invalid. Must not be negative", config.Provider.MaxConcurrentRequests))
+	} else if config.Provider.MaxConcurrentRequests > 0 && config.Provider.ConcurrentRequestsQueueTimeout < 1 {
+		errs = append(errs, fmt.Errorf("Provider.ConcurrentRequestsQueueTimeout %d is invalid. Must be at least 1 second", config.Provider.ConcurrentRequestsQueueTimeout))
+	}
+	if config.Provider.SlowRequestThreshold < 0 {
+		errs = append(errs, fmt.Errorf("Provider.SlowRequestThreshold %d is invalid. Must not be negative", config.Provider.SlowRequestThreshold))
+	}
+
+	if config.SessionCookie != nil {
+		if err := validateCookieSameSite(config.SessionCookie.SameSite); err != nil {
+			errs = append(errs, fmt.Errorf("SessionCookie is invalid: %s", err.Error()))
+		} else if err := validateCookieSecure(config.SessionCookie.SameSite, config.SessionCookie.Secure); err != nil {
+			errs = append(errs, fmt.Errorf("SessionCookie is invalid: %s", err.Error()))
+		}
+		if config.SessionCookie.Encoding != "" && config.SessionCookie.Encoding != "Raw" && config.SessionCookie.Encoding != "Base64Url" {
+			errs = append(errs, fmt.Errorf("SessionCookie.Encoding '%s' is invalid. Must be either Raw or Base64Url", config.SessionCookie.Encoding))
+		}
+		switch config.SessionCookie.Protection {
+		case "", "Encrypt":
+		case "Sign":
+			// The Cookie storage puts the tokens into the ticket
+			if config.SessionStorage == nil || config.SessionStorage.Type != "Memory" {
+				errs = append(errs, errors.New("SessionCookie.Protection Sign requires the Memory storage"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("SessionCookie.Protection '%s' is invalid. Must be either Encrypt or Sign", config.SessionCookie.Protection))
+		}
+	}
+
+	if config.ErrorPages != nil {
+		if config.ErrorPages.Unauthenticated != nil && !errorPages.IsValidStatusCodeOverride(config.ErrorPages.Unauthenticated.StatusCodeOverride) {
+			errs = append(errs, fmt.Errorf("StatusCodeOverride %d of the Unauthenticated error page is invalid. Must be a valid HTTP status code between 200 and 599 with a body and no redirect", config.ErrorPages.Unauthenticated.StatusCodeOverride))
+		}
+		if config.ErrorPages.Unauthorized != nil && !errorPages.IsValidStatusCodeOverride(config.ErrorPages.Unauthorized.StatusCodeOverride) {
+			errs = append(errs, fmt.Errorf("StatusCodeOverride %d of the Unauthorized error page is invalid. Must be a valid HTTP status code between 200 and 599 with a body and no redirect", config.ErrorPages.Unauthorized.StatusCodeOverride))
+		}
+		if config.ErrorPages.Unauthenticated != nil && !errorPages.IsValidRedirectStatusCode(config.ErrorPages.Unauthenticated.RedirectStatusCode) {
+			errs = append(errs, fmt.Errorf("RedirectStatusCode %d of the Unauthenticated error page is invalid. Must be one of 302, 303 or 307", config.ErrorPages.Unauthenticated.RedirectStatusCode))
+		}
+		if config.ErrorPages.Unauthorized != nil && !errorPages.IsValidRedirectStatusCode(config.ErrorPages.Unauthorized.RedirectStatusCode) {
+			errs = append(errs, fmt.Errorf("RedirectStatusCode %d of the Unauthorized error page is invalid. Must be one of 302, 303 or 307", config.ErrorPages.Unauthorized.RedirectStatusCode))
+		}
+		if config.ErrorPages.ProblemContentType != "" && !errorPages.IsValidProblemContentType(config.ErrorPages.ProblemContentType) {
+			errs = append(errs, fmt.Errorf("ErrorPages.ProblemContentType '%s' is invalid. Must be either %s, %s or application/json", config.ErrorPages.ProblemContentType, errorPages.ProblemContentTypeRfc, errorPages.ProblemContentTypeLegacy))
+		}
+	}
+
+	if config.HeadRequestBehavior != "" && config.HeadRequestBehavior != "Status" && config.HeadRequestBehavior != "Default" {
+		errs = append(errs, fmt.Errorf("HeadRequestBehavior '%s' is invalid. Must be either Status or Default", config.HeadRequestBehavior))
+	}
+	if config.XhrRequestBehavior != "" && config.XhrRequestBehavior != "Unauthorized" && config.XhrRequestBehavior != "Default" {
+		errs = append(errs, fmt.Errorf("XhrRequestBehavior '%s' is invalid. Must be either Unauthorized or Default", config.XhrRequestBehavior))
+	}
+	if config.CorruptSessionBehavior != "" && config.CorruptSessionBehavior != "Restart" && config.CorruptSessionBehavior != "Error" {
+		errs = append(errs, fmt.Errorf("CorruptSessionBehavior '%s' is invalid. Must be either Restart or Error", config.CorruptSessionBehavior))
+	}
+
+	if config.MaxCookieChunks < 0 {
+		errs = append(errs, fmt.Errorf("MaxCookieChunks %d is invalid. Must not be negative", config.MaxCookieChunks))
+	}
+	if isRedirectTemplate(config.PostLoginRedirectUri) {
+		if _, err := parseRedirectTemplate(config.PostLoginRedirectUri); err != nil {
+			errs = append(errs, fmt.Errorf("PostLoginRedirectUri is not a valid template: %s", err.Error()))
+		}
+		if len(config.ValidPostLoginRedirectUris) == 0 {
+			errs = append(errs, errors.New("ValidPostLoginRedirectUris must be set when PostLoginRedirectUri is a template"))
+		}
+	}
+
+	if config.SessionStorage != nil {
+		switch config.SessionStorage.Type {
+		case "Cookie":
+			if config.SessionStorage.StorePendingLogins {
+				errs = append(errs, errors.New("SessionStorage.StorePendingLogins requires the Memory storage"))
+			}
+		case "Memory":
+			if config.SessionStorage.MaxAge < 1 {
+				errs = append(errs, fmt.Errorf("SessionStorage.MaxAge %d is invalid. Must be at least 1", config.SessionStorage.MaxAge))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("SessionStorage.Type '%s' is invalid. Must be one of Cookie, Memory", config.SessionStorage.Type))
+		}
+
+		if config.SessionStorage.MaxSize < 0 {
+			errs = append(errs, fmt.Errorf("SessionStorage.MaxSize %d is invalid. Must not be negative", config.SessionStorage.MaxSize))
+		}
+		if config.SessionStorage.MigrateCookieSessions && config.SessionStorage.Type != "Memory" {
+			errs = append(errs, errors.New("SessionStorage.MigrateCookieSessions requires the Memory storage"))
+		}
+		if config.SessionStorage.MigrateCookieSessions && config.SessionCookie != nil && config.SessionCookie.Protection == "Sign" {
+			errs = append(errs, errors.New("SessionStorage.MigrateCookieSessions can't be combined with SessionCookie.Protection Sign"))
+		}
+		if config.SessionStorage.OverflowToMemory {
+			if config.SessionStorage.Type != "Cookie" {
+				errs = append(errs, errors.New("SessionStorage.OverflowToMemory requires the Cookie storage"))
+			}
+			if config.SessionStorage.MaxSize == 0 {
+				errs = append(errs, errors.New("SessionStorage.OverflowToMemory requires a SessionStorage.MaxSize"))
+			}
+			if config.SessionStorage.MaxAge < 1 {
+				errs = append(errs, fmt.Errorf("SessionStorage.MaxAge %d is invalid. Must be at least 1", config.SessionStorage.MaxAge))
+			}
+		}
+
+		if config.SessionStorage.MaxStateSize < 0 {
+			errs = append(errs, fmt.Errorf("SessionStorage.MaxStateSize %d is invalid. Must not be negative", config.SessionStorage.MaxStateSize))
+		}
+		if (config.SessionStorage.StorePendingLogins || config.SessionStorage.MaxStateSize > 0) && config.SessionStorage.MaxPendingLogins < 1 {
+			errs = append(errs, fmt.Errorf("SessionStorage.MaxPendingLogins %d is invalid. Must be at least 1", config.SessionStorage.MaxPendingLogins))
+		}
+		if config.SessionStorage.MaxSessionsPerSubject < 0 {
+			errs = append(errs, fmt.Errorf("SessionStorage.MaxSessionsPerSubject %d is invalid. Must not be negative", config.SessionStorage.MaxSessionsPerSubject))
+		} else if config.SessionStorage.MaxSessionsPerSubject > 0 {
+			if config.SessionStorage.Type != "Memory" {
+				errs = append(errs, errors.New("SessionStorage.MaxSessionsPerSubject requires the Memory storage"))
+			}
+			if config.SubjectClaim == "" {
+				errs = append(errs, errors.New("SessionStorage.MaxSessionsPerSubject requires a SubjectClaim"))
+			}
+		}
+
+		if config.SessionStorage.PersistenceFile != "" && config.SessionStorage.Type != "Memory" {
+			errs = append(errs, errors.New("SessionStorage.PersistenceFile requires the Memory storage"))
+		}
+		if config.SessionStorage.PersistenceFile != "" && config.SessionStorage.PersistenceInterval < 1 {
+			errs = append(errs, fmt.Errorf("SessionStorage.PersistenceInterval %d is invalid. Must be at least 1 second", config.SessionStorage.PersistenceInterval))
+		}
+	}
+
+	if config.Prompt != nil {
+		if !isValidPrompt(config.Prompt.Login) {
+			errs = append(errs, fmt.Errorf("Prompt.Login '%s' is invalid. Must be a space-separated list of none, login, consent, select_account", config.Prompt.Login))
+		}
+		if !isValidPrompt(config.Prompt.Reauthentication) {
+			errs = append(errs, fmt.Errorf("Prompt.Reauthentication '%s' is invalid. Must be a space-separated list of none, login, consent, select_account", config.Prompt.Reauthentication))
+		}
+		if !isValidPrompt(config.Prompt.Silent) {
+			errs = append(errs, fmt.Errorf("Prompt.Silent '%s' is invalid. Must be a space-separated list of none, login, consent, select_account", config.Prompt.Silent))
+		}
+	}
+
+	if config.ResponseMode != "" && config.ResponseMode != "query" && config.ResponseMode != "form_post" {
+		errs = append(errs, fmt.Errorf("ResponseMode '%s' is invalid. Must be either query or form_post", config.ResponseMode))
+	}
+	// Browsers don't send the code verifier cookie on the cross-site post of the provider
+	if config.ResponseMode == "form_post" && config.Provider.UsePkceBool && (config.SessionStorage == nil || !config.SessionStorage.StorePendingLogins) {
+		errs = append(errs, errors.New("ResponseMode form_post with PKCE requires SessionStorage.StorePendingLogins"))
+	}
+
+	if config.MaxLoginRedirects < 0 {
+		errs = append(errs, fmt.Errorf("MaxLoginRedirects %d is invalid. Must not be negative", config.MaxLoginRedirects))
+	}
+	if !errorPages.IsValidRedirectStatusCode(config.LoginRedirectStatusCode) || config.LoginRedirectStatusCode == http.StatusTemporaryRedirect {
+		errs = append(errs, fmt.Errorf("LoginRedirectStatusCode %d is invalid. Must be one of 302 or 303", config.LoginRedirectStatusCode))
+	}
+	if config.AbsoluteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("AbsoluteTimeout %d is invalid. Must not be negative", config.AbsoluteTimeout))
+	}
+	// The requests of the ForwardAuth middleware come from Traefik, so all sessions would be bound to its IP
+	if config.BindSessionToIp && config.ForwardAuthMode {
+		errs = append(errs, errors.New("BindSessionToIp can't be combined with ForwardAuthMode"))
+	}
+	for i, claimSource := range config.ClaimSources {
+		if claimSource.Name == "" {
+			errs = append(errs, fmt.Errorf("ClaimSources[%d].Name must not be empty", i))
+		} else if protectedClaims[claimSource.Name] {
+			errs = append(errs, fmt.Errorf("ClaimSources[%d].Name '%s' is invalid. It must be read from the validated token", i, claimSource.Name))
+		}
+		if claimSource.Token != "id" && claimSource.Token != "access" {
+			errs = append(errs, fmt.Errorf("ClaimSources[%d].Token '%s' is invalid. Must be one of id, access", i, claimSource.Token))
+		}
+	}
+
+	if config.RequestTimeout < 0 {
+		errs = append(errs, fmt.Errorf("RequestTimeout %d is invalid. Must not be negative", config.RequestTimeout))
+	}
+	if config.StateTtl < 0 {
+		errs = append(errs, fmt.Errorf("StateTtl %d is invalid. Must not be negative", config.StateTtl))
+	}
+	if config.Authorization != nil && config.Authorization.RecheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("Authorization.RecheckInterval %d is invalid. Must not be negative", config.Authorization.RecheckInterval))
+	}
+	if config.LogSampleInterval < 0 {
+		errs = append(errs, fmt.Errorf("LogSampleInterval %d is invalid. Must not be negative", config.LogSampleInterval))
+	}
+
+	if config.TokenExchange != nil && config.TokenExchange.Enabled {
+		if config.TokenExchange.Audience == "" && len(config.TokenExchange.Routes) == 0 {
+			errs = append(errs, errors.New("TokenExchange.Audience is required when the token exchange is enabled"))
+		}
+		if config.TokenExchange.HeaderName == "" {
+			errs = append(errs, errors.New("TokenExchange.HeaderName is required when the token exchange is enabled"))
+		}
+		for i, route := range config.TokenExchange.Routes {
+			if _, err := rules.ParseRequestCondition(route.Rule); err != nil {
+				errs = append(errs, fmt.Errorf("TokenExchange.Routes[%d].Rule is invalid: %s", i, err.Error()))
+			}
+			if route.Audience == "" {
+				errs = append(errs, fmt.Errorf("TokenExchange.Routes[%d].Audience is required", i))
+			}
+		}
+	}
+
+	for i, header := range config.Headers {
+		if header.MultiValueClaim != "" && header.Value != "" {
+			errs = append(errs, fmt.Errorf("Headers[%d] is invalid. Must not set both Value and MultiValueClaim", i))
+		}
+	}
+
+	if config.RoutingHints != nil {
+		for i, header := range config.RoutingHints.Headers {
+			if header.Name == "" {
+				errs = append(errs, fmt.Errorf("RoutingHints.Headers[%d].Name is required", i))
+			}
+			if _, err := parseRoutingHintTemplate(header.Value); err != nil {
+				errs = append(errs, fmt.Errorf("RoutingHints.Headers[%d].Value is not a valid template: %s", i, err.Error()))
+			}
+		}
+	}
+
+	if config.RateLimit != nil {
+		if config.RateLimit.Rate < 0 {
+			errs = append(errs, fmt.Errorf("RateLimit.Rate %v is invalid. Must not be negative", config.RateLimit.Rate))
+		} else if config.RateLimit.Rate > 0 && config.RateLimit.Burst < 1 {
+			errs = append(errs, fmt.Errorf("RateLimit.Burst %d is invalid. Must be at least 1", config.RateLimit.Burst))
+		}
+	}
+
+	if config.Cors != nil {
+		if config.Cors.MaxAge < 0 {
+			errs = append(errs, fmt.Errorf("Cors.MaxAge %d is invalid. Must not be negative", config.Cors.MaxAge))
+		}
+		for i, origin := range config.Cors.AllowedOrigins {
+			if origin == "*" {
+				if config.Cors.AllowCredentials {
+					errs = append(errs, errors.New("Cors.AllowedOrigins must not contain * when Cors.AllowCredentials is enabled"))
+				}
+				continue
+			}
+			if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+				errs = append(errs, fmt.Errorf("Cors.AllowedOrigins[%d] '%s' is invalid. Must be an origin like https://app.example.com", i, origin))
+			}
+		}
+	}
+
+	// The id token has no scope claim, so the scopes of a session can only be read from the access token
+	if config.Authorization != nil && len(config.Authorization.RequiredScopes) > 0 && config.Provider.TokenValidation == "IdToken" && !hasScopeClaimSource(config) &&
+		(config.AuthorizationHeader == nil || config.AuthorizationHeader.Name == "") && (config.AuthorizationCookie == nil || config.AuthorizationCookie.Name == "") {
+		errs = append(errs, errors.New("Authorization.RequiredScopes can't be checked with Provider.TokenValidation IdToken. Use AccessToken or Introspection, or add a ClaimSource for the scope of the access token"))
+	}
+	if config.Authorization != nil && len(config.Authorization.AllowedGroups) > 0 && config.Authorization.GroupsClaim == "" {
+		errs = append(errs, errors.New("Authorization.AllowedGroups requires a GroupsClaim"))
+	}
+	if config.Authorization != nil && len(config.Authorization.DeniedGroups) > 0 && config.Authorization.GroupsClaim == "" {
+		errs = append(errs, errors.New("Authorization.DeniedGroups requires a GroupsClaim"))
+	}
+	if config.Authorization != nil && len(config.Authorization.DeniedSubjects) > 0 && config.SubjectClaim == "" {
+		errs = append(errs, errors.New("Authorization.DeniedSubjects requires a SubjectClaim"))
+	}
+
+	if config.Authorization != nil && config.Authorization.Webhook != nil && config.Authorization.Webhook.Url != "" {
+		webhook := config.Authorization.Webhook
+		if _, err := utils.ParseUrl(webhook.Url); err != nil {
+			errs = append(errs, fmt.Errorf("Authorization.Webhook.Url is invalid: %s", err.Error()))
+		}
+		if webhook.Timeout < 1 {
+			errs = append(errs, fmt.Errorf("Authorization.Webhook.Timeout %d is invalid. Must be at least 1 second", webhook.Timeout))
+		}
+		if webhook.CacheDuration < 0 {
+			errs = append(errs, fmt.Errorf("Authorization.Webhook.CacheDuration %d is invalid. Must not be negative", webhook.CacheDuration))
+		}
+	}
+
+	if config.PostReplay != nil && config.PostReplay.Enabled {
+		if config.SessionStorage == nil || !config.SessionStorage.StorePendingLogins {
+			errs = append(errs, errors.New("PostReplay requires SessionStorage.StorePendingLogins"))
+		}
+		if config.PostReplay.MaxBodySize < 1 {
+			errs = append(errs, fmt.Errorf("PostReplay.MaxBodySize %d is invalid. Must be at least 1", config.PostReplay.MaxBodySize))
+		}
+	}
+
+	return errs
+}
+
+// An empty prompt is valid and means the parameter isn't sent.
+func isValidPrompt(prompt string) bool {
+	for _, value := range strings.Fields(prompt) {
+		switch value {
+		case "none", "login", "consent", "select_account":
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// A PostLoginRedirectUri containing template actions is rendered with the claims after login.
+func isRedirectTemplate(redirectUri string) bool {
+	return strings.Contains(redirectUri, "{{")
+}
+
+func parseRedirectTemplate(redirectUri string) (*template.Template, error) {
+	// Missing claims must not silently render into the url
+	return template.New("").Funcs(utils.TemplateFuncs()).Option("missingkey=error").Parse(redirectUri)
+}
+
+func parseRoutingHintTemplate(value string) (*template.Template, error) {
+	// A request with a missing claim must not be routed to the wrong tenant
+	return template.New("").Funcs(utils.TemplateFuncs()).Option("missingkey=error").Parse(value)
+}
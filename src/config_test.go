@@ -0,0 +1,559 @@
+package src
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func newValidConfig() *Config {
+	config := CreateConfig()
+	config.Provider.Url = "https://idp.example.com/realms/test"
+	config.Provider.ClientId = "my-client"
+
+	return config
+}
+
+func TestValidateConfigValid(t *testing.T) {
+	if errs := ValidateConfig(newValidConfig()); len(errs) != 0 {
+		t.Fatalf("Expected the default config to be valid, but got %v", errs)
+	}
+}
+
+func TestValidateConfigRequiredScopesWithIdToken(t *testing.T) {
+	config := newValidConfig()
+	config.Authorization.RequiredScopes = []string{"orders:read"}
+	config.ClaimSources = []ClaimSourceConfig{{Name: "scope", Token: "access"}}
+
+	if errs := ValidateConfig(config); len(errs) != 0 {
+		t.Fatalf("Expected the scope of the access token to allow the RequiredScopes, but got %v", errs)
+	}
+
+	config.ClaimSources = nil
+	config.AuthorizationHeader.Name = "Authorization"
+
+	if errs := ValidateConfig(config); len(errs) != 0 {
+		t.Fatalf("Expected bearer tokens to allow the RequiredScopes, but got %v", errs)
+	}
+}
+
+func TestValidateConfigWithoutSubConfigs(t *testing.T) {
+	config := newValidConfig()
+	config.ClaimCookie = nil
+	config.Prompt = nil
+	config.SessionCookie = nil
+	config.SessionStorage = nil
+	config.ErrorPages = nil
+	config.TokenExchange = nil
+	config.RoutingHints = nil
+	config.RateLimit = nil
+	config.Cors = nil
+	config.PostReplay = nil
+	config.Authorization = nil
+
+	if errs := ValidateConfig(config); len(errs) != 0 {
+		t.Fatalf("Expected missing sub configs to be skipped, but got %v", errs)
+	}
+}
+
+func TestNewWithoutSubConfigs(t *testing.T) {
+	config := newValidConfig()
+	config.ClaimCookie = nil
+	config.Prompt = nil
+	config.SessionCookie = nil
+	config.SessionHeader = nil
+	config.SessionStorage = nil
+	config.LoginHint = nil
+	config.AuthorizationHeader = nil
+	config.AuthorizationCookie = nil
+	config.ErrorPages = nil
+	config.LogoutPage = nil
+	config.TokenExchange = nil
+	config.RoutingHints = nil
+	config.RateLimit = nil
+	config.Cors = nil
+	config.PostReplay = nil
+	config.Authorization = nil
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, t.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.RoutingHints == nil || config.SessionCookie.Path != "/" || config.ErrorPages.Theme == nil {
+		t.Fatal("Expected the missing sub configs to get their defaults")
+	}
+}
+
+func TestValidateConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(config *Config)
+		expected []string
+	}{
+		{
+			name: "invalid provider url",
+			modify: func(config *Config) {
+				config.Provider.Url = "not a url"
+			},
+			expected: []string{"Provider.Url"},
+		},
+		{
+			name: "short secret",
+			modify: func(config *Config) {
+				config.Secret = "too-short"
+			},
+			expected: []string{"Secret"},
+		},
+		{
+			name: "invalid cookie encryption algorithm",
+			modify: func(config *Config) {
+				config.CookieEncryptionAlgorithm = "AES-128-CBC"
+			},
+			expected: []string{"CookieEncryptionAlgorithm"},
+		},
+		{
+			name: "invalid same site",
+			modify: func(config *Config) {
+				config.SessionCookie.SameSite = "lox"
+			},
+			expected: []string{"SessionCookie"},
+		},
+		{
+			name: "same site none without secure",
+			modify: func(config *Config) {
+				config.SessionCookie.SameSite = "None"
+				config.SessionCookie.Secure = false
+			},
+			expected: []string{"SameSite none requires Secure"},
+		},
+		{
+			name: "code verifier cookie path outside of the callback",
+			modify: func(config *Config) {
+				config.CodeVerifierCookiePath = "/auth"
+			},
+			expected: []string{"CodeVerifierCookiePath"},
+		},
+		{
+			name: "code verifier cookie path ending within a segment of the callback",
+			modify: func(config *Config) {
+				config.CodeVerifierCookiePath = "/oidc/call"
+			},
+			expected: []string{"CodeVerifierCookiePath '/oidc/call'"},
+		},
+		{
+			name: "token in the claim cookie",
+			modify: func(config *Config) {
+				config.ClaimCookie.Claim = "access_token"
+			},
+			expected: []string{"ClaimCookie.Claim"},
+		},
+		{
+			name: "invalid cookie encoding",
+			modify: func(config *Config) {
+				config.SessionCookie.Encoding = "base64"
+			},
+			expected: []string{"SessionCookie.Encoding"},
+		},
+		{
+			name: "signed cookie with cookie storage",
+			modify: func(config *Config) {
+				config.SessionCookie.Protection = "Sign"
+			},
+			expected: []string{"SessionCookie.Protection"},
+		},
+		{
+			name: "invalid token validation and renewal threshold",
+			modify: func(config *Config) {
+				config.Provider.TokenValidation = "Something"
+				config.Provider.CallbackIssuerValidation = "Always"
+				config.Provider.TokenRenewalThreshold = 0.2
+			},
+			expected: []string{"Provider.TokenValidation", "Provider.CallbackIssuerValidation", "Provider.TokenRenewalThreshold"},
+		},
+		{
+			name: "concurrency limit without queue timeout",
+			modify: func(config *Config) {
+				config.Provider.MaxConcurrentRequests = 4
+				config.Provider.ConcurrentRequestsQueueTimeout = 0
+			},
+			expected: []string{"Provider.ConcurrentRequestsQueueTimeout"},
+		},
+		{
+			name: "header with value and multi value claim",
+			modify: func(config *Config) {
+				config.Headers = []HeaderConfig{{Name: "X-Group", Value: "{{ .claims.groups }}", MultiValueClaim: "groups"}}
+			},
+			expected: []string{"Headers[0] is invalid. Must not set both Value and MultiValueClaim"},
+		},
+		{
+			name: "invalid routing hints",
+			modify: func(config *Config) {
+				config.RoutingHints.Headers = []HeaderConfig{{Value: "{{ .org_id }}"}, {Name: "X-Tenant", Value: "{{ .org_id"}}
+			},
+			expected: []string{"RoutingHints.Headers[0].Name is required", "RoutingHints.Headers[1].Value is not a valid template"},
+		},
+		{
+			name: "negative slow request threshold",
+			modify: func(config *Config) {
+				config.Provider.SlowRequestThreshold = -1
+			},
+			expected: []string{"Provider.SlowRequestThreshold -1 is invalid"},
+		},
+		{
+			name: "post login redirect template",
+			modify: func(config *Config) {
+				config.PostLoginRedirectUri = "https://{{ .claims.tenant }.example.com/"
+			},
+			expected: []string{"PostLoginRedirectUri", "ValidPostLoginRedirectUris"},
+		},
+		{
+			name: "pending logins without server-side storage",
+			modify: func(config *Config) {
+				config.SessionStorage.StorePendingLogins = true
+			},
+			expected: []string{"SessionStorage.StorePendingLogins"},
+		},
+		{
+			name: "pending logins without limit",
+			modify: func(config *Config) {
+				config.SessionStorage.Type = "Memory"
+				config.SessionStorage.StorePendingLogins = true
+				config.SessionStorage.MaxPendingLogins = 0
+			},
+			expected: []string{"SessionStorage.MaxPendingLogins"},
+		},
+		{
+			name: "invalid session storage",
+			modify: func(config *Config) {
+				config.SessionStorage.Type = "Redis"
+			},
+			expected: []string{"SessionStorage.Type"},
+		},
+		{
+			name: "invalid trusted issuer",
+			modify: func(config *Config) {
+				config.Provider.TrustedIssuers = []TrustedIssuerConfig{
+					{Issuer: "https://partner.example.com", JwksUri: "ftp://partner.example.com/jwks"},
+				}
+			},
+			expected: []string{"Provider.TrustedIssuers[0].JwksUri"},
+		},
+		{
+			name: "invalid xhr request behavior",
+			modify: func(config *Config) {
+				config.XhrRequestBehavior = "Json"
+			},
+			expected: []string{"XhrRequestBehavior"},
+		},
+		{
+			name: "invalid prompt",
+			modify: func(config *Config) {
+				config.Prompt.Reauthentication = "login force"
+			},
+			expected: []string{"Prompt.Reauthentication"},
+		},
+		{
+			name: "overflow without max size",
+			modify: func(config *Config) {
+				config.SessionStorage.OverflowToMemory = true
+			},
+			expected: []string{"SessionStorage.MaxSize"},
+		},
+		{
+			name: "cookie session migration with cookie storage",
+			modify: func(config *Config) {
+				config.SessionStorage.MigrateCookieSessions = true
+			},
+			expected: []string{"SessionStorage.MigrateCookieSessions requires the Memory storage"},
+		},
+		{
+			name: "cookie session migration with signed cookies",
+			modify: func(config *Config) {
+				config.SessionStorage.Type = "Memory"
+				config.SessionStorage.MigrateCookieSessions = true
+				config.SessionCookie.Protection = "Sign"
+			},
+			expected: []string{"SessionStorage.MigrateCookieSessions can't be combined with SessionCookie.Protection Sign"},
+		},
+		{
+			name: "session limit with cookie storage",
+			modify: func(config *Config) {
+				config.SessionStorage.MaxSessionsPerSubject = 2
+			},
+			expected: []string{"SessionStorage.MaxSessionsPerSubject"},
+		},
+		{
+			name: "persistence with cookie storage",
+			modify: func(config *Config) {
+				config.SessionStorage.PersistenceFile = "/data/sessions"
+			},
+			expected: []string{"SessionStorage.PersistenceFile"},
+		},
+		{
+			name: "persistence without interval",
+			modify: func(config *Config) {
+				config.SessionStorage.Type = "Memory"
+				config.SessionStorage.PersistenceFile = "/data/sessions"
+				config.SessionStorage.PersistenceInterval = 0
+			},
+			expected: []string{"SessionStorage.PersistenceInterval 0 is invalid"},
+		},
+		{
+			name: "invalid claim sources",
+			modify: func(config *Config) {
+				config.ClaimSources = []ClaimSourceConfig{
+					{Name: "scope", Token: "refresh"},
+					{Name: "aud", Token: "access"},
+				}
+			},
+			expected: []string{"ClaimSources[0].Token", "ClaimSources[1].Name"},
+		},
+		{
+			name: "token exchange without audience",
+			modify: func(config *Config) {
+				config.TokenExchange.Enabled = true
+			},
+			expected: []string{"TokenExchange.Audience"},
+		},
+		{
+			name: "invalid redirect status codes",
+			modify: func(config *Config) {
+				config.LoginRedirectStatusCode = 301
+				config.ErrorPages.Unauthorized.RedirectStatusCode = 200
+			},
+			expected: []string{"RedirectStatusCode 200 of the Unauthorized error page", "LoginRedirectStatusCode 301"},
+		},
+		{
+			name: "status code overrides without a body",
+			modify: func(config *Config) {
+				config.ErrorPages.Unauthenticated.StatusCodeOverride = 204
+				config.ErrorPages.Unauthorized.StatusCodeOverride = 302
+			},
+			expected: []string{"StatusCodeOverride 204 of the Unauthenticated error page", "StatusCodeOverride 302 of the Unauthorized error page"},
+		},
+		{
+			name: "required scopes with id token validation",
+			modify: func(config *Config) {
+				config.Authorization.RequiredScopes = []string{"orders:read"}
+			},
+			expected: []string{"Authorization.RequiredScopes can't be checked with Provider.TokenValidation IdToken"},
+		},
+		{
+			name: "ip binding in forward auth mode",
+			modify: func(config *Config) {
+				config.ForwardAuthMode = true
+				config.BindSessionToIp = true
+			},
+			expected: []string{"BindSessionToIp can't be combined with ForwardAuthMode"},
+		},
+		{
+			name: "login redirect preserving the body",
+			modify: func(config *Config) {
+				config.LoginRedirectStatusCode = 307
+			},
+			expected: []string{"LoginRedirectStatusCode 307"},
+		},
+		{
+			name: "fail closed without eager discovery",
+			modify: func(config *Config) {
+				config.Provider.FailClosed = true
+			},
+			expected: []string{"Provider.FailClosed requires EagerDiscovery"},
+		},
+		{
+			name: "require discovery without eager discovery",
+			modify: func(config *Config) {
+				config.Provider.RequireDiscovery = true
+			},
+			expected: []string{"Provider.RequireDiscovery requires EagerDiscovery"},
+		},
+		{
+			name: "invalid tls settings",
+			modify: func(config *Config) {
+				config.Provider.MinTlsVersion = "1.4"
+				config.Provider.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}
+			},
+			expected: []string{"Provider.MinTlsVersion", "Provider.CipherSuites is invalid: unknown or insecure cipher suite 'TLS_RSA_WITH_RC4_128_SHA'"},
+		},
+		{
+			name: "invalid idp request header name",
+			modify: func(config *Config) {
+				config.Provider.IdpRequestHeaders = map[string]string{"X Api Key": "secret"}
+			},
+			expected: []string{"Provider.IdpRequestHeaders 'X Api Key' is invalid"},
+		},
+		{
+			name: "rate limit without burst",
+			modify: func(config *Config) {
+				config.RateLimit.Rate = 5
+				config.RateLimit.Burst = 0
+			},
+			expected: []string{"RateLimit.Burst"},
+		},
+		{
+			name: "invalid cors origins",
+			modify: func(config *Config) {
+				config.Cors.AllowedOrigins = []string{"*", "app.example.com"}
+				config.Cors.AllowCredentials = true
+			},
+			expected: []string{"Cors.AllowedOrigins must not contain *", "Cors.AllowedOrigins[1]"},
+		},
+		{
+			name: "allowed groups without groups claim",
+			modify: func(config *Config) {
+				config.Authorization.AllowedGroups = []string{"admins"}
+				config.Authorization.GroupsClaim = ""
+			},
+			expected: []string{"Authorization.AllowedGroups"},
+		},
+		{
+			name: "denylists without claims",
+			modify: func(config *Config) {
+				config.Authorization.DeniedGroups = []string{"blocked"}
+				config.Authorization.DeniedSubjects = []string{"mallory"}
+				config.Authorization.GroupsClaim = ""
+				config.SubjectClaim = ""
+			},
+			expected: []string{"Authorization.DeniedGroups", "Authorization.DeniedSubjects"},
+		},
+		{
+			name: "invalid authorization webhook",
+			modify: func(config *Config) {
+				config.Authorization.Webhook.Url = "ftp://authz.internal"
+				config.Authorization.Webhook.Timeout = 0
+			},
+			expected: []string{"Authorization.Webhook.Url", "Authorization.Webhook.Timeout"},
+		},
+		{
+			name: "post replay without pending logins",
+			modify: func(config *Config) {
+				config.PostReplay.Enabled = true
+				config.PostReplay.MaxBodySize = 0
+			},
+			expected: []string{"SessionStorage.StorePendingLogins", "PostReplay.MaxBodySize"},
+		},
+		{
+			name: "invalid discovery override",
+			modify: func(config *Config) {
+				config.Provider.TokenEndpoint = "not a url"
+			},
+			expected: []string{"Provider.TokenEndpoint"},
+		},
+		{
+			name: "form post with pkce but without pending logins",
+			modify: func(config *Config) {
+				config.ResponseMode = "form_post"
+				config.Provider.UsePkceBool = true
+			},
+			expected: []string{"ResponseMode form_post"},
+		},
+		{
+			name: "multiple problems",
+			modify: func(config *Config) {
+				config.Provider.InternalDiscoveryUrl = "ftp://idp.internal"
+				config.Provider.CABundle = "inline"
+				config.Provider.CABundleFile = "/some/file"
+				config.ErrorPages.Unauthorized.StatusCodeOverride = 99
+				config.ErrorPages.ProblemContentType = "application/xml"
+				config.CorruptSessionBehavior = "Ignore"
+				config.MaxCookieChunks = -1
+				config.MaxLoginRedirects = -1
+				config.RequestTimeout = -1
+				config.StateTtl = -1
+				config.Authorization.RecheckInterval = -1
+				config.LogSampleInterval = -1
+			},
+			expected: []string{"Provider.InternalDiscoveryUrl", "CABundle", "StatusCodeOverride 99", "ErrorPages.ProblemContentType", "CorruptSessionBehavior", "MaxCookieChunks", "MaxLoginRedirects", "RequestTimeout", "StateTtl", "Authorization.RecheckInterval", "LogSampleInterval"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newValidConfig()
+			test.modify(config)
+
+			errs := ValidateConfig(config)
+
+			if len(errs) != len(test.expected) {
+				t.Fatalf("Expected %d errors, but got %v", len(test.expected), errs)
+			}
+
+			for i, expected := range test.expected {
+				if !strings.Contains(errs[i].Error(), expected) {
+					t.Errorf("Expected error %d to mention %s, but got: %s", i, expected, errs[i].Error())
+				}
+			}
+		})
+	}
+}
+
+func TestCreateHttpClientWithMinTlsVersion(t *testing.T) {
+	newServer := func(maxVersion uint16) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{MaxVersion: maxVersion}
+		server.StartTLS()
+		return server
+	}
+
+	tls12Server := newServer(tls.VersionTLS12)
+	defer tls12Server.Close()
+	tls13Server := newServer(tls.VersionTLS13)
+	defer tls13Server.Close()
+
+	config := newValidConfig()
+	config.Provider.MinTlsVersion = "1.3"
+	config.Provider.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	config.Provider.InsecureSkipVerifyBool = true
+
+	httpClient, err := createHttpClient(logging.CreateLogger(logging.LevelDebug), config, newProviderHosts())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig := httpClient.Transport.(*http.Transport).TLSClientConfig
+	if tlsConfig.MinVersion != tls.VersionTLS13 || !slices.Equal(tlsConfig.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Fatalf("Unexpected TLS config: min version %x, cipher suites %v", tlsConfig.MinVersion, tlsConfig.CipherSuites)
+	}
+
+	if _, err := httpClient.Get(tls12Server.URL); err == nil {
+		t.Error("Expected the connection to a TLS 1.2 server to fail")
+	}
+
+	resp, err := httpClient.Get(tls13Server.URL)
+	if err != nil {
+		t.Fatalf("Expected the connection to a TLS 1.3 server to succeed, but got: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHttpClientKeyIdentifiesTheClientSettings(t *testing.T) {
+	config := newValidConfig()
+	key := getHttpClientKey(config)
+
+	if getHttpClientKey(newValidConfig()) != key {
+		t.Fatal("Expected the same key for the same settings")
+	}
+
+	config.Provider.InsecureSkipVerifyBool = true
+	if getHttpClientKey(config) == key {
+		t.Error("Expected InsecureSkipVerify to change the key")
+	}
+
+	config = newValidConfig()
+	config.Provider.CABundleFile = "/etc/ssl/internal-ca.pem"
+	if getHttpClientKey(config) == key {
+		t.Error("Expected the CA bundle to change the key")
+	}
+
+	config = newValidConfig()
+	config.Provider.IdpRequestHeaders = map[string]string{"X-Api-Key": "secret"}
+	if headerKey := getHttpClientKey(config); headerKey == key || strings.Contains(headerKey, "secret") {
+		t.Errorf("Expected the IdpRequestHeaders to change the key without exposing their values, but got %s", headerKey)
+	}
+}
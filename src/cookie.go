@@ -1,18 +1,34 @@
 package src
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
-func setChunkedCookies(config *Config, rw http.ResponseWriter, cookieName string, cookieValue string) {
+func setChunkedCookies(logger *logging.Logger, config *Config, rw http.ResponseWriter, req *http.Request, cookieName string, cookieValue string) error {
+	// Encode the whole value, so the chunks can simply be joined again before decoding
+	cookieValue = encodeCookieValue(config, cookieValue)
+
 	cookieChunks := utils.ChunkString(cookieValue, 3072)
 
-	baseCookie := createSessionCookie(config)
+	// Browsers limit the number of cookies per domain, so rather fail than emitting cookies which may get dropped.
+	if config.MaxCookieChunks > 0 && len(cookieChunks) > config.MaxCookieChunks {
+		return fmt.Errorf("the cookie %s would need %d chunks, which exceeds the maximum of %d", cookieName, len(cookieChunks), config.MaxCookieChunks)
+	}
+
+	baseCookie := createSessionCookie(logger, config, req)
 	baseCookie.Name = cookieName
 
 	// Set the cookie
@@ -32,8 +48,10 @@ func setChunkedCookies(config *Config, rw http.ResponseWriter, cookieName string
 			http.SetCookie(rw, c)
 		}
 	}
+
+	return nil
 }
-func readChunkedCookie(req *http.Request, cookieName string) (string, error) {
+func readChunkedCookie(config *Config, req *http.Request, cookieName string) (string, error) {
 	chunkCount, err := getChunkedCookieCount(req, cookieName)
 	if err != nil {
 		return "", err
@@ -45,7 +63,7 @@ func readChunkedCookie(req *http.Request, cookieName string) (string, error) {
 			return "", err
 		}
 
-		return cookie.Value, nil
+		return decodeCookieValue(config, cookie.Value)
 	}
 
 	value := ""
@@ -53,13 +71,39 @@ func readChunkedCookie(req *http.Request, cookieName string) (string, error) {
 	for i := 0; i < chunkCount; i++ {
 		cookie, err := req.Cookie(fmt.Sprintf("%s.%d", cookieName, i+1))
 		if err != nil {
-			return "", err
+			return "", fmt.Errorf("chunk %d of %d is missing", i+1, chunkCount)
 		}
 
 		value += cookie.Value
 	}
 
-	return value, nil
+	return decodeCookieValue(config, value)
+}
+
+func isBase64UrlCookieEncoding(config *Config) bool {
+	return config.SessionCookie != nil && config.SessionCookie.Encoding == "Base64Url"
+}
+
+// Some proxies mangle cookie values which contain characters like + / or =, even though they are valid.
+func encodeCookieValue(config *Config, value string) string {
+	if !isBase64UrlCookieEncoding(config) {
+		return value
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeCookieValue(config *Config, value string) (string, error) {
+	if !isBase64UrlCookieEncoding(config) {
+		return value, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode cookie value: %s", err.Error())
+	}
+
+	return string(decoded), nil
 }
 func getChunkedCookieCount(req *http.Request, cookieName string) (int, error) {
 	chunksCookie, err := req.Cookie(fmt.Sprintf("%s.Chunks", cookieName))
@@ -90,17 +134,25 @@ func getChunkedCookieNames(req *http.Request, cookieName string) (map[string]str
 	}
 	return cookieNames, nil
 }
-func clearChunkedCookie(config *Config, rw http.ResponseWriter, req *http.Request, cookieName string) error {
+func clearChunkedCookie(logger *logging.Logger, config *Config, rw http.ResponseWriter, req *http.Request, cookieName string) error {
+	baseCookie := createSessionCookie(logger, config, req)
+	baseCookie.Name = cookieName
+	baseCookie.Value = ""
+	makeCookieExpireImmediately(baseCookie)
+
 	chunkCount, err := getChunkedCookieCount(req, cookieName)
 	if err != nil {
+		// The chunk count is garbled, so clear every cookie matching the chunk scheme
+		for _, c := range req.Cookies() {
+			if c.Name == cookieName || strings.HasPrefix(c.Name, cookieName+".") {
+				baseCookie.Name = c.Name
+				http.SetCookie(rw, baseCookie)
+			}
+		}
+
 		return err
 	}
 
-	baseCookie := createSessionCookie(config)
-	baseCookie.Name = cookieName
-	baseCookie.Value = ""
-	makeCookieExpireImmediately(baseCookie)
-
 	if chunkCount == 0 {
 		http.SetCookie(rw, baseCookie)
 	} else {
@@ -117,15 +169,70 @@ func clearChunkedCookie(config *Config, rw http.ResponseWriter, req *http.Reques
 	return nil
 }
 
-func parseCookieSameSite(sameSite string) http.SameSite {
-	switch sameSite {
+// Validates the SameSite value at config load, so typos fail fast instead of silently falling back to default.
+func validateCookieSameSite(sameSite string) error {
+	switch strings.ToLower(sameSite) {
+	case "", "default", "none", "lax", "strict", "auto":
+		return nil
+	default:
+		return fmt.Errorf("invalid SameSite value \"%s\". Must be one of default, none, lax, strict, auto", sameSite)
+	}
+}
+
+// The cookies are Secure when configured or, with SessionCookie.AutoSecure, when the request has been made over https,
+// as told by the X-Forwarded-Proto header, TLS or ForceHttpsRedirectUri.
+func isSecureCookieRequest(config *Config, req *http.Request) bool {
+	if config.SessionCookie.Secure {
+		return true
+	}
+	if !config.SessionCookie.AutoSecure {
+		return false
+	}
+
+	return isHttpsRequest(config, req)
+}
+
+func isHttpsRequest(config *Config, req *http.Request) bool {
+	return config.ForceHttpsRedirectUri || strings.HasPrefix(utils.GetFullHost(req), "https://")
+}
+
+// Browsers silently drop SameSite=None cookies which aren't Secure, so the session would never stick.
+func validateCookieSecure(sameSite string, secure bool) error {
+	if strings.EqualFold(sameSite, "none") && !secure {
+		return errors.New("SameSite none requires Secure to be true, otherwise browsers drop the cookie")
+	}
+
+	return nil
+}
+
+// A request is considered to be embedded into another site, when the browser tells it's cross-site by the
+// Sec-Fetch-Site header and it's not a top-level navigation, like the redirect back from the provider.
+func isCrossSiteRequest(req *http.Request) bool {
+	return req.Header.Get("Sec-Fetch-Site") == "cross-site" && req.Header.Get("Sec-Fetch-Dest") != "document"
+}
+
+func isAutoCookieSameSite(sameSite string) bool {
+	return strings.EqualFold(sameSite, "auto")
+}
+
+// With auto, the mode is chosen per request: None for cross-site requests and Lax otherwise.
+func parseCookieSameSite(logger *logging.Logger, sameSite string, req *http.Request) http.SameSite {
+	switch strings.ToLower(sameSite) {
+	case "auto":
+		if isCrossSiteRequest(req) {
+			return http.SameSiteNoneMode
+		}
+		return http.SameSiteLaxMode
 	case "none":
 		return http.SameSiteNoneMode
 	case "lax":
 		return http.SameSiteLaxMode
 	case "strict":
 		return http.SameSiteStrictMode
+	case "", "default":
+		return http.SameSiteDefaultMode
 	default:
+		logger.Log(logging.LevelWarn, "Unknown SameSite value \"%s\". Falling back to default.", sameSite)
 		return http.SameSiteDefaultMode
 	}
 }
@@ -137,11 +244,191 @@ func makeCookieExpireImmediately(cookie *http.Cookie) *http.Cookie {
 }
 
 func getCodeVerifierCookieName(config *Config) string {
+	if config.CodeVerifierCookieName != "" {
+		return config.CodeVerifierCookieName
+	}
 	return makeCookieName(config, "CodeVerifier")
 }
+
+// Every login gets its own code verifier cookie, so parallel logins in multiple tabs don't overwrite each other.
+// States without a verifierKey have been issued by older versions, which used a single cookie.
+func getStateCodeVerifierCookieName(config *Config, verifierKey string) string {
+	if verifierKey == "" {
+		return getCodeVerifierCookieName(config)
+	}
+	return fmt.Sprintf("%s.%s", getCodeVerifierCookieName(config), verifierKey)
+}
+
+func isCodeVerifierCookieName(config *Config, cookieName string) bool {
+	codeVerifierCookieName := getCodeVerifierCookieName(config)
+	return cookieName == codeVerifierCookieName || strings.HasPrefix(cookieName, codeVerifierCookieName+".")
+}
+
+// Cookies of abandoned logins must not pile up, so they expire with the state.
+const defaultCodeVerifierCookieMaxAge = 60 * 60
+
+func (toa *TraefikOidcAuth) getCodeVerifierCookieMaxAge() int {
+	if toa.Config.StateTtl > 0 {
+		return toa.Config.StateTtl
+	}
+	return defaultCodeVerifierCookieMaxAge
+}
+
+// The browser must send the code verifier cookie to the callback, but it's not needed anywhere else
+func (toa *TraefikOidcAuth) getCodeVerifierCookiePath() string {
+	if toa.Config.CodeVerifierCookiePath != "" {
+		return toa.Config.CodeVerifierCookiePath
+	}
+	return toa.CallbackURL.Path
+}
+
+// Returns whether a cookie with the cookiePath is sent with requests to the requestPath (RFC 6265, section 5.1.4).
+// Unlike a plain prefix, /oidc/call doesn't match /oidc/callback.
+func isCookiePathMatch(requestPath string, cookiePath string) bool {
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+
+	return len(requestPath) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
+
+// Every pending login gets its own cookie, so parallel logins in multiple tabs don't overwrite each other.
+func getPendingLoginCookieName(config *Config, stateKey string) string {
+	if len(stateKey) > 16 {
+		stateKey = stateKey[:16]
+	}
+	return fmt.Sprintf("%s.%s", makeCookieName(config, "PendingLogin"), stateKey)
+}
+
+func isPendingLoginCookieName(config *Config, cookieName string) bool {
+	return strings.HasPrefix(cookieName, makeCookieName(config, "PendingLogin")+".")
+}
+
+// The pending login cookie holds a hash of the state key, so the callback is only accepted
+// from the browser which started the login (login CSRF).
+func hashPendingLoginState(stateKey string) string {
+	hash := sha256.Sum256([]byte(stateKey))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Like the code verifier cookie, the pending login cookie is only needed on the callback.
+func (toa *TraefikOidcAuth) createPendingLoginCookie(stateKey string) *http.Cookie {
+	// The provider posts the form_post callback cross-site, which Lax cookies aren't sent with
+	sameSite := http.SameSiteLaxMode
+	if toa.Config.ResponseMode == "form_post" {
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return &http.Cookie{
+		Name:     getPendingLoginCookieName(toa.Config, stateKey),
+		Value:    hashPendingLoginState(stateKey),
+		MaxAge:   toa.getCodeVerifierCookieMaxAge(),
+		Secure:   true,
+		HttpOnly: true,
+		Path:     toa.getCodeVerifierCookiePath(),
+		Domain:   toa.CallbackURL.Host,
+		SameSite: sameSite,
+	}
+}
+
+// Returns whether the browser has started the pending login with the state key.
+func (toa *TraefikOidcAuth) isPendingLoginOfBrowser(req *http.Request, stateKey string) bool {
+	cookie, err := req.Cookie(getPendingLoginCookieName(toa.Config, stateKey))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashPendingLoginState(stateKey))) == 1
+}
+
+func getClaimCookieName(config *Config) string {
+	if config.ClaimCookie.Name != "" {
+		return config.ClaimCookie.Name
+	}
+	return makeCookieName(config, "Claim")
+}
+
+// Claims which carry tokens and must never end up in the claim cookie.
+var tokenClaimNames = []string{"access_token", "id_token", "refresh_token"}
+
+// Writes the configured claim to a cookie without HttpOnly, so the frontend can read it.
+// The value is percent-encoded, so it can be read by decodeURIComponent.
+func (toa *TraefikOidcAuth) setClaimCookie(rw http.ResponseWriter, req *http.Request, session *session.SessionState, claims map[string]interface{}) {
+	if toa.Config.ClaimCookie == nil || toa.Config.ClaimCookie.Claim == "" {
+		return
+	}
+
+	var value string
+	switch claim := getClaimByPath(claims, toa.Config.ClaimCookie.Claim).(type) {
+	case nil:
+		return
+	case string:
+		value = claim
+	default:
+		value = fmt.Sprint(claim)
+	}
+
+	// Some providers include tokens in the claims, which must never be readable by JavaScript
+	if value == session.AccessToken || value == session.IdToken || value == session.RefreshToken {
+		toa.logger.Log(logging.LevelWarn, "Not exposing the claim %s in a cookie, because it contains a token.", toa.Config.ClaimCookie.Claim)
+		return
+	}
+
+	cookie := createSessionCookie(toa.logger, toa.Config, req)
+	cookie.Name = getClaimCookieName(toa.Config)
+	cookie.Value = url.PathEscape(value)
+	cookie.HttpOnly = false
+
+	http.SetCookie(rw, cookie)
+}
+
+// Clears the claim cookie with the same path and domain as setClaimCookie, whenever the session ends.
+func (toa *TraefikOidcAuth) clearClaimCookie(rw http.ResponseWriter, req *http.Request) {
+	if toa.Config.ClaimCookie == nil || toa.Config.ClaimCookie.Claim == "" {
+		return
+	}
+	if _, err := req.Cookie(getClaimCookieName(toa.Config)); err != nil {
+		return
+	}
+
+	cookie := createSessionCookie(toa.logger, toa.Config, req)
+	cookie.Name = getClaimCookieName(toa.Config)
+	cookie.HttpOnly = false
+
+	http.SetCookie(rw, makeCookieExpireImmediately(cookie))
+}
+
+func getLoginAttemptsCookieName(config *Config) string {
+	return makeCookieName(config, "LoginAttempts")
+}
 func getSessionCookieName(config *Config) string {
+	if config.SessionCookieName != "" {
+		return config.SessionCookieName
+	}
 	return makeCookieName(config, "Session")
 }
+
+// Returns whether the cookie is used internally by the plugin and must not be forwarded upstream.
+func isInternalCookie(config *Config, cookieName string) bool {
+	if strings.HasPrefix(cookieName, config.CookieNamePrefix) {
+		return true
+	}
+
+	if config.CodeVerifierCookieName != "" && isCodeVerifierCookieName(config, cookieName) {
+		return true
+	}
+
+	if config.ClaimCookie != nil && cookieName == config.ClaimCookie.Name {
+		return true
+	}
+
+	// The session cookie may be chunked, eg. Name.Chunks, Name.1 etc.
+	if config.SessionCookieName != "" && (cookieName == config.SessionCookieName || strings.HasPrefix(cookieName, config.SessionCookieName+".")) {
+		return true
+	}
+
+	return false
+}
 func makeCookieName(config *Config, name string) string {
 	return fmt.Sprintf("%s.%s", config.CookieNamePrefix, name)
 }
@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 )
 
 func TestSetChunkedCookiesNonChunked(t *testing.T) {
@@ -22,7 +26,7 @@ func TestSetChunkedCookiesNonChunked(t *testing.T) {
 
 	rw := newMockResponseWriter()
 
-	setChunkedCookies(config, rw, "TraefikOidcAuth.Session", "some-short-value")
+	setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, httptest.NewRequest("GET", "/", nil), "TraefikOidcAuth.Session", "some-short-value")
 
 	setCookieHeader := rw.HeaderMap.Get("Set-Cookie")
 
@@ -48,7 +52,7 @@ func TestSetChunkedCookiesChunked(t *testing.T) {
 
 	longValue := randomFixedLengthString(4000)
 
-	setChunkedCookies(config, rw, "TraefikOidcAuth.Session", longValue)
+	setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, httptest.NewRequest("GET", "/", nil), "TraefikOidcAuth.Session", longValue)
 
 	setCookieHeader := rw.HeaderMap.Values("Set-Cookie")
 
@@ -67,6 +71,35 @@ func TestSetChunkedCookiesChunked(t *testing.T) {
 	}
 }
 
+func TestSetChunkedCookiesExceedingMaxCookieChunks(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		MaxCookieChunks:  2,
+		SessionCookie: &SessionCookieConfig{
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+		},
+	}
+
+	rw := newMockResponseWriter()
+
+	err := setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, httptest.NewRequest("GET", "/", nil), "TraefikOidcAuth.Session", randomFixedLengthString(3*3072))
+
+	if err == nil {
+		t.Fatal("Expected an error because the value exceeds MaxCookieChunks")
+	}
+	if len(rw.HeaderMap.Values("Set-Cookie")) != 0 {
+		t.Fatal("Expected no cookies to be set")
+	}
+
+	err = setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, httptest.NewRequest("GET", "/", nil), "TraefikOidcAuth.Session", randomFixedLengthString(2*3072))
+
+	if err != nil || len(rw.HeaderMap.Values("Set-Cookie")) != 3 {
+		t.Fatalf("Expected the value to fit into the chunks, but got %v", err)
+	}
+}
+
 func TestReadChunkedCookieOrdered(t *testing.T) {
 	req, err := http.NewRequest("GET", "https://example.com", nil)
 	if err != nil {
@@ -90,7 +123,7 @@ func TestReadChunkedCookieOrdered(t *testing.T) {
 		Value: "333",
 	})
 
-	cookieValue, err := readChunkedCookie(req, "TraefikOidcAuth.Session")
+	cookieValue, err := readChunkedCookie(&Config{}, req, "TraefikOidcAuth.Session")
 	if err != nil {
 		t.Fail()
 	}
@@ -123,7 +156,7 @@ func TestReadChunkedCookieUnordered(t *testing.T) {
 		Value: "222",
 	})
 
-	cookieValue, err := readChunkedCookie(req, "TraefikOidcAuth.Session")
+	cookieValue, err := readChunkedCookie(&Config{}, req, "TraefikOidcAuth.Session")
 	if err != nil {
 		t.Fail()
 	}
@@ -152,7 +185,7 @@ func TestReadChunkedCookieWithIncompleteChunks(t *testing.T) {
 		Value: "222",
 	})
 
-	cookieValue, err := readChunkedCookie(req, "TraefikOidcAuth.Session")
+	cookieValue, err := readChunkedCookie(&Config{}, req, "TraefikOidcAuth.Session")
 
 	// readChunkedCookie should fail
 	if err == nil || cookieValue != "" {
@@ -179,7 +212,7 @@ func TestReadChunkedCookieWithNoCount(t *testing.T) {
 		Value: "222",
 	})
 
-	cookieValue, err := readChunkedCookie(req, "TraefikOidcAuth.Session")
+	cookieValue, err := readChunkedCookie(&Config{}, req, "TraefikOidcAuth.Session")
 
 	// readChunkedCookie should fail
 	if err == nil || cookieValue != "" {
@@ -187,6 +220,125 @@ func TestReadChunkedCookieWithNoCount(t *testing.T) {
 	}
 }
 
+func TestValidateCookieSameSite(t *testing.T) {
+	for _, sameSite := range []string{"", "default", "none", "lax", "strict", "Lax", "auto"} {
+		if err := validateCookieSameSite(sameSite); err != nil {
+			t.Errorf("Expected SameSite value \"%s\" to be valid, but got: %v", sameSite, err)
+		}
+	}
+
+	for _, sameSite := range []string{"lox", "no", "strict "} {
+		if err := validateCookieSameSite(sameSite); err == nil {
+			t.Errorf("Expected SameSite value \"%s\" to be invalid", sameSite)
+		}
+	}
+}
+
+func TestParseCookieSameSite(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	if parseCookieSameSite(logger, "lax", req) != http.SameSiteLaxMode {
+		t.Fail()
+	}
+	if parseCookieSameSite(logger, "Strict", req) != http.SameSiteStrictMode {
+		t.Fail()
+	}
+	if parseCookieSameSite(logger, "none", req) != http.SameSiteNoneMode {
+		t.Fail()
+	}
+	if parseCookieSameSite(logger, "lox", req) != http.SameSiteDefaultMode {
+		t.Fail()
+	}
+}
+
+func TestCustomCookieNames(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+		},
+	}
+
+	if getSessionCookieName(config) != "TraefikOidcAuth.Session" || getCodeVerifierCookieName(config) != "TraefikOidcAuth.CodeVerifier" {
+		t.Fatal("Expected the prefix convention to be used by default")
+	}
+
+	config.SessionCookieName = "__Host-session"
+	config.CodeVerifierCookieName = "pkce"
+
+	if getSessionCookieName(config) != "__Host-session" || getCodeVerifierCookieName(config) != "pkce" {
+		t.Fatal("Expected the custom cookie names to be used")
+	}
+
+	rw := newMockResponseWriter()
+
+	setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, httptest.NewRequest("GET", "/", nil), getSessionCookieName(config), randomFixedLengthString(4000))
+
+	setCookieHeader := rw.HeaderMap.Values("Set-Cookie")
+
+	if len(setCookieHeader) != 3 ||
+		!strings.HasPrefix(setCookieHeader[0], "__Host-session.Chunks=2;") ||
+		!strings.HasPrefix(setCookieHeader[1], "__Host-session.1=") ||
+		!strings.HasPrefix(setCookieHeader[2], "__Host-session.2=") {
+		t.Fatalf("Expected the chunks to be named after the custom cookie name, but got %v", setCookieHeader)
+	}
+
+	for _, name := range []string{"TraefikOidcAuth.Other", "__Host-session", "__Host-session.Chunks", "__Host-session.1", "pkce", "pkce.1"} {
+		if !isInternalCookie(config, name) {
+			t.Errorf("Expected cookie %s to be internal", name)
+		}
+	}
+	for _, name := range []string{"other", "__Host-sessionX", "pkceX"} {
+		if isInternalCookie(config, name) {
+			t.Errorf("Expected cookie %s not to be internal", name)
+		}
+	}
+}
+
+func TestChunkedCookiesBase64UrlEncoding(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			Encoding: "Base64Url",
+		},
+	}
+
+	for _, value := range []string{
+		`a+b/c==; d "e",\f`,
+		randomFixedLengthString(4000) + "+/=;",
+	} {
+		rw := newMockResponseWriter()
+
+		if err := setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, httptest.NewRequest("GET", "/", nil), "TraefikOidcAuth.Session", value); err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", "https://example.com", nil)
+
+		for _, cookie := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+			if strings.ContainsAny(cookie.Value, "+/=;\" \\,") {
+				t.Fatalf("Expected only URL-safe characters, but got %s", cookie.Value)
+			}
+			req.AddCookie(cookie)
+		}
+
+		cookieValue, err := readChunkedCookie(config, req, "TraefikOidcAuth.Session")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cookieValue != value {
+			t.Fatalf("Expected the value to roundtrip, but got %s", cookieValue)
+		}
+	}
+}
+
 type mockResponseWriter struct {
 	HeaderMap http.Header
 }
@@ -215,3 +367,170 @@ func randomFixedLengthString(n int) string {
 	}
 	return string(b)
 }
+
+func TestCodeVerifierCookiePath(t *testing.T) {
+	getCodeVerifierCookie := func(toa *TraefikOidcAuth) *http.Cookie {
+		req := httptest.NewRequest("GET", "/some/page", nil)
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		for _, cookie := range rw.Result().Cookies() {
+			if isCodeVerifierCookieName(toa.Config, cookie.Name) {
+				return cookie
+			}
+		}
+
+		t.Fatalf("Expected a code verifier cookie, but got %v", rw.Header().Values("Set-Cookie"))
+		return nil
+	}
+
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.UsePkceBool = true
+
+	if cookie := getCodeVerifierCookie(toa); cookie.Path != "/oidc/callback" {
+		t.Errorf("Expected the code verifier cookie to be scoped to the callback path, but got %s", cookie.Path)
+	}
+
+	toa.Config.CodeVerifierCookiePath = "/oidc"
+
+	if cookie := getCodeVerifierCookie(toa); cookie.Path != "/oidc" {
+		t.Errorf("Expected the configured code verifier cookie path, but got %s", cookie.Path)
+	}
+}
+
+func TestIsCookiePathMatch(t *testing.T) {
+	tests := []struct {
+		cookiePath string
+		match      bool
+	}{
+		{cookiePath: "/", match: true},
+		{cookiePath: "/oidc", match: true},
+		{cookiePath: "/oidc/", match: true},
+		{cookiePath: "/oidc/callback", match: true},
+		{cookiePath: "/oidc/call", match: false},
+		{cookiePath: "/oidc/callback/", match: false},
+		{cookiePath: "/auth", match: false},
+	}
+
+	for _, test := range tests {
+		if match := isCookiePathMatch("/oidc/callback", test.cookiePath); match != test.match {
+			t.Errorf("Expected the match of %s to be %v, but got %v", test.cookiePath, test.match, match)
+		}
+	}
+}
+
+func TestSetChunkedCookiesAutoSecure(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:       "/",
+			Secure:     false,
+			AutoSecure: true,
+			HttpOnly:   true,
+			SameSite:   "default",
+		},
+	}
+
+	tests := []struct {
+		scheme string
+		secure bool
+	}{
+		{scheme: "https", secure: true},
+		{scheme: "http", secure: false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-Proto", test.scheme)
+		rw := httptest.NewRecorder()
+
+		if err := setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, req, "TraefikOidcAuth.Session", "some-short-value"); err != nil {
+			t.Fatal(err)
+		}
+
+		if secure := rw.Result().Cookies()[0].Secure; secure != test.secure {
+			t.Errorf("Expected Secure to be %v on a %s request, but got %v", test.secure, test.scheme, secure)
+		}
+	}
+}
+
+func TestSetChunkedCookiesAutoSameSite(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: "auto",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		fetchSite   string
+		fetchDest   string
+		sameSite    http.SameSite
+		partitioned bool
+	}{
+		{name: "embedded", fetchSite: "cross-site", fetchDest: "iframe", sameSite: http.SameSiteNoneMode, partitioned: true},
+		{name: "same-site", fetchSite: "same-origin", fetchDest: "document", sameSite: http.SameSiteLaxMode},
+		{name: "cross-site navigation", fetchSite: "cross-site", fetchDest: "document", sameSite: http.SameSiteLaxMode},
+		{name: "without fetch metadata", sameSite: http.SameSiteLaxMode},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.fetchSite != "" {
+			req.Header.Set("Sec-Fetch-Site", test.fetchSite)
+			req.Header.Set("Sec-Fetch-Dest", test.fetchDest)
+		}
+		rw := httptest.NewRecorder()
+
+		if err := setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, req, "TraefikOidcAuth.Session", "some-short-value"); err != nil {
+			t.Fatal(err)
+		}
+
+		cookie := rw.Result().Cookies()[0]
+		if cookie.SameSite != test.sameSite || cookie.Partitioned != test.partitioned || cookie.Secure != test.partitioned {
+			t.Errorf("Unexpected cookie attributes for the %s request: %s", test.name, rw.Result().Header.Get("Set-Cookie"))
+		}
+	}
+}
+
+func TestSetChunkedCookiesDowngradesSameSiteNoneOnHttp(t *testing.T) {
+	config := &Config{
+		CookieNamePrefix: "TraefikOidcAuth",
+		SessionCookie: &SessionCookieConfig{
+			Path:                        "/",
+			Secure:                      true,
+			HttpOnly:                    true,
+			SameSite:                    "none",
+			DowngradeSameSiteNoneOnHttp: true,
+		},
+	}
+
+	setCookie := func(proto string) *http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		rw := httptest.NewRecorder()
+
+		if err := setChunkedCookies(logging.CreateLogger(logging.LevelDebug), config, rw, req, "TraefikOidcAuth.Session", "some-short-value"); err != nil {
+			t.Fatal(err)
+		}
+
+		return rw.Result().Cookies()[0]
+	}
+
+	if cookie := setCookie("http"); cookie.SameSite != http.SameSiteLaxMode || cookie.Secure {
+		t.Errorf("Expected a Lax cookie without Secure on http, but got SameSite %v and Secure %v", cookie.SameSite, cookie.Secure)
+	}
+	if cookie := setCookie("https"); cookie.SameSite != http.SameSiteNoneMode || !cookie.Secure {
+		t.Errorf("Expected the configured None cookie on https, but got SameSite %v and Secure %v", cookie.SameSite, cookie.Secure)
+	}
+
+	config.SessionCookie.DowngradeSameSiteNoneOnHttp = false
+
+	if cookie := setCookie("http"); cookie.SameSite != http.SameSiteNoneMode || !cookie.Secure {
+		t.Errorf("Expected no downgrade when disabled, but got SameSite %v and Secure %v", cookie.SameSite, cookie.Secure)
+	}
+}
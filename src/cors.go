@@ -0,0 +1,75 @@
+package src
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Preflight requests are sent by the browser before cross-origin requests and never carry credentials,
+// so they must not be redirected to the provider.
+func isPreflightRequest(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Answers the preflight request with the configured CORS headers, or forwards it upstream if no origins are configured.
+func (toa *TraefikOidcAuth) handlePreflight(rw http.ResponseWriter, req *http.Request) {
+	toa.auditDecision(req, "", logging.AuditResultBypassed, "cors preflight")
+
+	cors := toa.Config.Cors
+	if len(cors.AllowedOrigins) == 0 {
+		toa.logger.Log(logging.LevelDebug, "Forwarding CORS preflight request without authentication.")
+
+		toa.sanitizeForUpstream(req)
+		toa.stripIdentityHeaders(req)
+		toa.next.ServeHTTP(rw, req)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	rw.Header().Add("Vary", "Origin")
+
+	// A preflight without the CORS headers makes the browser block the actual request
+	if isAllowedCorsOrigin(cors.AllowedOrigins, origin) {
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if len(cors.AllowedMethods) > 0 {
+			rw.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+		} else {
+			rw.Header().Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+		}
+
+		if len(cors.AllowedHeaders) > 0 {
+			rw.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+		} else if requestHeaders := req.Header.Get("Access-Control-Request-Headers"); requestHeaders != "" {
+			rw.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+		}
+
+		if cors.AllowCredentials {
+			rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if cors.MaxAge > 0 {
+			rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+		}
+	} else {
+		toa.logger.Log(logging.LevelDebug, "CORS preflight from origin %s is not allowed.", origin)
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func isAllowedCorsOrigin(allowedOrigins []string, origin string) bool {
+	for _, allowedOrigin := range allowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newPreflightRequest(origin string) *http.Request {
+	req := httptest.NewRequest("OPTIONS", "/api/items", nil)
+	req.Host = "api.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+
+	return req
+}
+
+func TestPreflightIsForwardedWithoutAuthentication(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	forwarded := false
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = true
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, newPreflightRequest("https://app.example.com"))
+
+	if !forwarded || rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected the preflight to be forwarded, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestPreflightIsAnsweredWithCorsHeaders(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Cors.AllowedOrigins = []string{"https://app.example.com"}
+	toa.Config.Cors.AllowedMethods = []string{"GET", "PUT"}
+	toa.Config.Cors.AllowCredentials = true
+	toa.Config.Cors.MaxAge = 600
+
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, newPreflightRequest("https://app.example.com"))
+
+	if rw.Code != http.StatusNoContent || rw.Header().Get("Location") != "" {
+		t.Fatalf("Expected the preflight to be answered, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	expectedHeaders := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "content-type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	}
+	for name, expected := range expectedHeaders {
+		if value := rw.Header().Get(name); value != expected {
+			t.Errorf("Expected %s to be %s, but got %s", name, expected, value)
+		}
+	}
+
+	// Other origins don't get any CORS headers, so the browser blocks the request
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, newPreflightRequest("https://evil.example.com"))
+
+	if rw.Code != http.StatusNoContent || rw.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no CORS headers for another origin, but got %d %v", rw.Code, rw.Header())
+	}
+}
+
+func TestOptionsWithoutPreflightHeadersRequiresAuthentication(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	req := httptest.NewRequest("OPTIONS", "/api/items", nil)
+	req.Host = "api.example.com"
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected a plain OPTIONS request to be authenticated, but got %d", rw.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// The background discovery gives up after this time. Afterwards, requests try the discovery themselves.
+const maxBackgroundDiscoveryDuration = time.Hour
+
+// Traefik creates a new middleware instance on every configuration reload, without stopping the previous one.
+// The latest instance is registered by the name of the middleware, so the background discovery of a replaced one stops.
+var (
+	eagerDiscoveryInstances     = make(map[string]*TraefikOidcAuth)
+	eagerDiscoveryInstancesLock sync.Mutex
+)
+
+// Fetches the discovery document and the JWKS when the middleware is created.
+// Only with Provider.RequireDiscovery the startup waits for it, including the Provider.EagerDiscoveryRetries,
+// and fails if it doesn't succeed. Otherwise, it's done in the background and keeps retrying after the retries,
+// until the instance is replaced, the context is cancelled or maxBackgroundDiscoveryDuration has elapsed.
+func (toa *TraefikOidcAuth) startEagerDiscovery(ctx context.Context, name string) error {
+	toa.setDiscoveryPending(true)
+
+	eagerDiscoveryInstancesLock.Lock()
+	eagerDiscoveryInstances[name] = toa
+	eagerDiscoveryInstancesLock.Unlock()
+
+	if toa.Config.Provider.RequireDiscovery {
+		if err := toa.discoverWithRetries(ctx); err != nil {
+			return fmt.Errorf("eager discovery failed: %s", err.Error())
+		}
+
+		toa.setDiscoveryPending(false)
+		return nil
+	}
+
+	go func() {
+		if err := toa.discoverWithRetries(ctx); err != nil {
+			toa.logger.Log(logging.LevelError, "Eager discovery failed: %s. Retrying in the background.", err.Error())
+			toa.retryDiscoveryInBackground(ctx, name)
+			return
+		}
+
+		toa.setDiscoveryPending(false)
+	}()
+
+	return nil
+}
+
+func (toa *TraefikOidcAuth) isReplacedInstance(name string) bool {
+	eagerDiscoveryInstancesLock.Lock()
+	defer eagerDiscoveryInstancesLock.Unlock()
+
+	return eagerDiscoveryInstances[name] != toa
+}
+
+func (toa *TraefikOidcAuth) discoverWithRetries(ctx context.Context) error {
+	interval := time.Duration(toa.Config.Provider.EagerDiscoveryRetryInterval) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		err := toa.discover(ctx)
+		if err == nil || attempt > toa.Config.Provider.EagerDiscoveryRetries {
+			return err
+		}
+
+		toa.logger.Log(logging.LevelWarn, "Eager discovery failed, retrying (%d of %d): %s", attempt, toa.Config.Provider.EagerDiscoveryRetries, err.Error())
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (toa *TraefikOidcAuth) retryDiscoveryInBackground(ctx context.Context, name string) {
+	interval := time.Duration(toa.Config.Provider.EagerDiscoveryRetryInterval) * time.Second
+	deadline := time.Now().Add(maxBackgroundDiscoveryDuration)
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		if toa.isReplacedInstance(name) {
+			toa.logger.Log(logging.LevelDebug, "Stopping the background discovery, because the middleware has been replaced.")
+			return
+		}
+		if time.Now().After(deadline) {
+			toa.logger.Log(logging.LevelError, "Giving up the background discovery. Requests try the discovery themselves from now on.")
+			toa.setDiscoveryPending(false)
+			return
+		}
+
+		if err := toa.discover(ctx); err != nil {
+			toa.logger.Log(logging.LevelWarn, "Background discovery failed: %s", err.Error())
+			continue
+		}
+
+		toa.logger.Log(logging.LevelInfo, "Background discovery succeeded.")
+		toa.setDiscoveryPending(false)
+		return
+	}
+}
+
+func (toa *TraefikOidcAuth) discover(ctx context.Context) error {
+	if err := toa.EnsureOidcDiscovery(ctx); err != nil {
+		return err
+	}
+
+	return toa.Jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, false)
+}
+
+func (toa *TraefikOidcAuth) setDiscoveryPending(pending bool) {
+	toa.discoveryPendingLock.Lock()
+	defer toa.discoveryPendingLock.Unlock()
+
+	toa.discoveryPending = pending
+}
+
+// Returns whether requests must be rejected, because the eager discovery hasn't succeeded yet and FailClosed is set.
+func (toa *TraefikOidcAuth) isFailingClosed() bool {
+	return toa.Config.Provider.FailClosed && toa.isDiscoveryPending()
+}
+
+func (toa *TraefikOidcAuth) isDiscoveryPending() bool {
+	toa.discoveryPendingLock.Lock()
+	defer toa.discoveryPendingLock.Unlock()
+
+	return toa.discoveryPending
+}
+
+func (toa *TraefikOidcAuth) writeDiscoveryUnavailableError(rw http.ResponseWriter, req *http.Request) {
+	data := toa.newPageData()
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.4"
+	data["statusCode"] = http.StatusServiceUnavailable
+	data["statusName"] = "Service Unavailable"
+	data["description"] = "The identity provider is not available.\nPlease try again later."
+
+	rw.Header().Set("Retry-After", strconv.Itoa(toa.Config.Provider.EagerDiscoveryRetryInterval))
+	toa.writeError(&errorPages.ErrorPageConfig{}, rw, req, data)
+}
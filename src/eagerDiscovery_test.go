@@ -0,0 +1,218 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+// A provider whose discovery endpoint fails until available is set.
+type flakyProvider struct {
+	*httptest.Server
+
+	lock              sync.Mutex
+	available         bool
+	discoveryRequests int
+}
+
+func newFlakyProvider(t *testing.T, available bool) *flakyProvider {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := newJwksServer(privateKey)
+	t.Cleanup(jwksServer.Close)
+
+	provider := &flakyProvider{available: available}
+	provider.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider.lock.Lock()
+		provider.discoveryRequests++
+		available := provider.available
+		provider.lock.Unlock()
+
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcDiscovery{
+			Issuer:                provider.URL,
+			AuthorizationEndpoint: provider.URL + "/authorize",
+			TokenEndpoint:         provider.URL + "/token",
+			JWKSURI:               jwksServer.URL,
+		})
+	}))
+	t.Cleanup(provider.Close)
+
+	return provider
+}
+
+func (provider *flakyProvider) setAvailable(available bool) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	provider.available = available
+}
+
+func (provider *flakyProvider) getDiscoveryRequests() int {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	return provider.discoveryRequests
+}
+
+func newEagerDiscoveryTest(t *testing.T, provider *flakyProvider) *TraefikOidcAuth {
+	toa := newServeHttpTest(t)
+	toa.ProviderURL, _ = url.Parse(provider.URL)
+	toa.DiscoveryDocument = nil
+	toa.Jwks = nil
+	toa.Config.Provider.EagerDiscovery = true
+	toa.Config.Provider.EagerDiscoveryRetries = 1
+	toa.Config.Provider.EagerDiscoveryRetryInterval = 1
+
+	return toa
+}
+
+func waitForDiscovery(t *testing.T, toa *TraefikOidcAuth) {
+	deadline := time.Now().Add(5 * time.Second)
+	for toa.isDiscoveryPending() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the eager discovery to succeed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEagerDiscoveryRetries(t *testing.T) {
+	provider := newFlakyProvider(t, false)
+	toa := newEagerDiscoveryTest(t, provider)
+
+	// The provider becomes available before the retry
+	time.AfterFunc(200*time.Millisecond, func() { provider.setAvailable(true) })
+
+	toa.startEagerDiscovery(context.Background(), t.Name())
+	waitForDiscovery(t, toa)
+
+	if toa.DiscoveryDocument == nil || toa.DiscoveryDocument.TokenEndpoint != provider.URL+"/token" {
+		t.Fatalf("Expected the discovery document to be loaded, but got %+v", toa.DiscoveryDocument)
+	}
+	if toa.Jwks == nil || len(toa.Jwks.RsaKeys) != 1 {
+		t.Fatal("Expected the JWKS to be loaded")
+	}
+	if requests := provider.getDiscoveryRequests(); requests != 2 {
+		t.Fatalf("Expected a single retry, but got %d requests", requests)
+	}
+	if toa.isFailingClosed() {
+		t.Fatal("Expected the discovery not to be pending anymore")
+	}
+}
+
+func TestEagerDiscoveryFailsClosed(t *testing.T) {
+	provider := newFlakyProvider(t, false)
+	toa := newEagerDiscoveryTest(t, provider)
+	toa.Config.Provider.FailClosed = true
+	toa.Config.Provider.EagerDiscoveryRetries = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toa.startEagerDiscovery(ctx, t.Name())
+
+	// The initial attempt runs in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for provider.getDiscoveryRequests() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest("GET", "/protected", nil)
+	rw := httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected 503 while the discovery is pending, but got %d", rw.Code)
+	}
+	if requests := provider.getDiscoveryRequests(); requests != 1 {
+		t.Fatalf("Expected requests not to try the discovery themselves, but got %d discovery requests", requests)
+	}
+
+	// The background retry picks up the provider once it's available
+	provider.setAvailable(true)
+	waitForDiscovery(t, toa)
+
+	rw = httptest.NewRecorder()
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider after the discovery succeeded, but got %d", rw.Code)
+	}
+}
+
+func TestEagerDiscoveryRequiresDiscovery(t *testing.T) {
+	provider := newFlakyProvider(t, false)
+	toa := newEagerDiscoveryTest(t, provider)
+	toa.Config.Provider.RequireDiscovery = true
+	toa.Config.Provider.EagerDiscoveryRetries = 0
+
+	if err := toa.startEagerDiscovery(context.Background(), t.Name()); err == nil {
+		t.Fatal("Expected the startup to fail while the provider is unavailable")
+	}
+
+	provider.setAvailable(true)
+	toa.DiscoveryDocument = nil
+
+	if err := toa.startEagerDiscovery(context.Background(), t.Name()); err != nil {
+		t.Fatalf("Expected the startup to succeed once the provider is available, but got: %v", err)
+	}
+}
+
+func TestEagerDiscoveryDoesntDelayTheStartup(t *testing.T) {
+	provider := newFlakyProvider(t, false)
+	toa := newEagerDiscoveryTest(t, provider)
+	toa.Config.Provider.EagerDiscoveryRetries = 3
+
+	start := time.Now()
+	if err := toa.startEagerDiscovery(context.Background(), t.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected the startup not to wait for the retries, but it took %s", elapsed)
+	}
+}
+
+func TestBackgroundDiscoveryStopsWhenReplaced(t *testing.T) {
+	provider := newFlakyProvider(t, false)
+	toa := newEagerDiscoveryTest(t, provider)
+	toa.Config.Provider.EagerDiscoveryRetries = 0
+
+	toa.startEagerDiscovery(context.Background(), t.Name())
+
+	// Wait for the initial attempt to fail
+	deadline := time.Now().Add(5 * time.Second)
+	for provider.getDiscoveryRequests() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// A configuration reload creates a new instance of the same middleware
+	replacement := newEagerDiscoveryTest(t, provider)
+	replacement.Config.Provider.RequireDiscovery = true
+	provider.setAvailable(true)
+	if err := replacement.startEagerDiscovery(context.Background(), t.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replaced instance gives up on its next attempt
+	time.Sleep(1500 * time.Millisecond)
+	if !toa.isDiscoveryPending() || toa.DiscoveryDocument != nil {
+		t.Fatal("Expected the replaced instance to stop its background discovery")
+	}
+}
@@ -1,11 +1,109 @@
 package errorPages
 
+import "net/http"
+
+const (
+	// The media type of problem details registered by RFC 7807.
+	ProblemContentTypeRfc = "application/problem+json"
+
+	// The media type which has been written by previous versions.
+	ProblemContentTypeLegacy = "application/json+problem"
+)
+
 type ErrorPagesConfig struct {
 	Unauthenticated *ErrorPageConfig `json:"unauthenticated"`
 	Unauthorized    *ErrorPageConfig `json:"unauthorized"`
+
+	// Brands the default pages without the need for a custom FilePath.
+	Theme *ThemeConfig `json:"theme"`
+
+	// The claim whose hashed value is returned as the instance of forbidden errors,
+	// so support teams can correlate them without the response containing personal data.
+	InstanceClaim string `json:"instance_claim"`
+
+	// Passes the value of the claim which failed the authorization to custom templates of the forbidden page.
+	// The value is personal data of the user, so this is intended for debugging only.
+	ExposeClaimValues bool `json:"expose_claim_values"`
+
+	// The Content-Type of problem details responses. Either application/problem+json, as registered by RFC 7807,
+	// application/json+problem for clients relying on the type of previous versions, or application/json.
+	ProblemContentType string `json:"problem_content_type"`
+}
+
+type ThemeConfig struct {
+	ProductName  string `json:"product_name"`
+	LogoUrl      string `json:"logo_url"`
+	PrimaryColor string `json:"primary_color"`
 }
 
 type ErrorPageConfig struct {
 	FilePath   string `json:"file_path"`
 	RedirectTo string `json:"redirect_to"`
+
+	// An optional HTTP status code which is written instead of the original one.
+	// The body still contains the original status name and description.
+	StatusCodeOverride int `json:"status_code_override"`
+
+	// The status code of the redirect to RedirectTo. Either 302, 303 or 307. Defaults to 302.
+	RedirectStatusCode int `json:"redirect_status_code"`
+}
+
+type LogoutPageConfig struct {
+	// Renders a "logged out" page after logout instead of redirecting to the PostLogoutRedirectUri.
+	Enabled bool `json:"enabled"`
+
+	FilePath   string `json:"file_path"`
+	RedirectTo string `json:"redirect_to"`
+}
+
+func IsValidProblemContentType(contentType string) bool {
+	return contentType == ProblemContentTypeRfc || contentType == ProblemContentTypeLegacy || contentType == "application/json"
+}
+
+// Returns whether the given status code can be used as a StatusCodeOverride.
+// The error page is written as the body, so status codes without a body (204, 205 and 304) are not allowed,
+// as well as redirects, which lack a Location.
+func IsValidStatusCodeOverride(statusCode int) bool {
+	if statusCode == http.StatusNoContent || statusCode == http.StatusResetContent || (statusCode >= 300 && statusCode <= 399) {
+		return false
+	}
+
+	return statusCode == 0 || (statusCode >= 200 && statusCode <= 599)
+}
+
+// 303 makes the browser follow the redirect with a GET, 307 preserves the method and body of eg. a POST.
+// 0 uses the default of 302.
+func IsValidRedirectStatusCode(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusFound || statusCode == http.StatusSeeOther || statusCode == http.StatusTemporaryRedirect
+}
+
+// Returns the configured redirect status code, or 302 if it isn't set.
+func GetRedirectStatusCode(statusCode int) int {
+	if statusCode == 0 {
+		return http.StatusFound
+	}
+
+	return statusCode
+}
+
+// Returns the theme in the form it is passed to the page templates, eg. {{ .theme.productName }}.
+// Unset values fall back to the defaults of the built-in page.
+func (theme *ThemeConfig) TemplateData() map[string]interface{} {
+	data := map[string]interface{}{
+		"productName":  "",
+		"logoUrl":      "",
+		"primaryColor": "orange",
+	}
+
+	if theme == nil {
+		return data
+	}
+
+	data["productName"] = theme.ProductName
+	data["logoUrl"] = theme.LogoUrl
+	if theme.PrimaryColor != "" {
+		data["primaryColor"] = theme.PrimaryColor
+	}
+
+	return data
 }
@@ -3,6 +3,7 @@ package errorPages
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
 	"os"
@@ -11,41 +12,98 @@ import (
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
+// The representations an error can be written in. JSON comes first, so it is used for */* as well as the fallback.
+var offeredContentTypes = []string{
+	"application/json",
+	"application/problem+json",
+	"text/html",
+	"application/xhtml+xml",
+	"text/plain",
+}
+
 type ProblemDetails struct {
-	Type   string `json:"type"`
-	Title  string `json:"title"`
-	Detail string `json:"detail"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance,omitempty"`
 }
 
 func WriteError(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseWriter, req *http.Request, data map[string]interface{}) {
 	if page.RedirectTo != "" {
-		http.Redirect(rw, req, page.RedirectTo, http.StatusFound)
+		http.Redirect(rw, req, page.RedirectTo, GetRedirectStatusCode(page.RedirectStatusCode))
 		return
 	}
 
-	if utils.IsHtmlRequest(req) {
-		html, err := renderPage(logger, page, data)
+	statusCode := data["statusCode"].(int)
+	if page.StatusCodeOverride != 0 {
+		statusCode = page.StatusCodeOverride
+	}
+
+	contentType := utils.NegotiateContentType(req, offeredContentTypes)
+
+	if contentType == "text/html" || contentType == "application/xhtml+xml" {
+		html, err := renderPage(logger, page.FilePath, data)
 		if err != nil {
 			logger.Log(logging.LevelError, "Error while rendering unauthorized page: %s", err.Error())
 			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 
 		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
-		rw.WriteHeader(data["statusCode"].(int))
+		rw.WriteHeader(statusCode)
 		rw.Write([]byte(html))
 		return
 	}
 
-	problemDetails := ProblemDetails{
-		Type:   data["statusType"].(string),
-		Title:  data["statusName"].(string),
-		Detail: data["description"].(string),
+	if contentType == "text/plain" {
+		writePlainText(rw, statusCode, data)
+		return
+	}
+
+	writeProblemDetail(logger, newProblemDetails(data), rw, statusCode, getProblemContentType(data))
+}
+
+// Writes the error as problem details (RFC 7807), independent of the Accept header of the request.
+// RedirectTo is ignored, because the response is meant to be consumed by a script.
+func WriteProblemDetails(logger *logging.Logger, page *ErrorPageConfig, rw http.ResponseWriter, data map[string]interface{}) {
+	statusCode := data["statusCode"].(int)
+	if page.StatusCodeOverride != 0 {
+		statusCode = page.StatusCodeOverride
+	}
+
+	writeProblemDetail(logger, newProblemDetails(data), rw, statusCode, getProblemContentType(data))
+}
+
+// The content type is passed with the data, like the theme.
+func getProblemContentType(data map[string]interface{}) string {
+	if contentType, ok := data["problemContentType"].(string); ok && contentType != "" {
+		return contentType
+	}
+
+	return ProblemContentTypeRfc
+}
+
+func newProblemDetails(data map[string]interface{}) ProblemDetails {
+	// The instance is optional
+	instance, _ := data["instance"].(string)
+
+	return ProblemDetails{
+		Type:     data["statusType"].(string),
+		Title:    data["statusName"].(string),
+		Detail:   data["description"].(string),
+		Instance: instance,
+	}
+}
+
+// Writes only the status code without a body, eg. for HEAD requests from uptime monitors.
+func WriteStatusCode(page *ErrorPageConfig, rw http.ResponseWriter, statusCode int) {
+	if page.StatusCodeOverride != 0 {
+		statusCode = page.StatusCodeOverride
 	}
 
-	writeProblemDetail(logger, problemDetails, rw, data["statusCode"].(int))
+	rw.WriteHeader(statusCode)
 }
 
-func writeProblemDetail(logger *logging.Logger, problem ProblemDetails, rw http.ResponseWriter, statusCode int) {
+func writeProblemDetail(logger *logging.Logger, problem ProblemDetails, rw http.ResponseWriter, statusCode int, contentType string) {
 	json, err := json.Marshal(problem)
 	if err != nil {
 		logger.Log(logging.LevelError, err.Error())
@@ -53,16 +111,23 @@ func writeProblemDetail(logger *logging.Logger, problem ProblemDetails, rw http.
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json+problem")
+	rw.Header().Set("Content-Type", contentType)
 	rw.WriteHeader(statusCode)
 	rw.Write([]byte(json))
 }
 
-func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[string]interface{}) (string, error) {
+func writePlainText(rw http.ResponseWriter, statusCode int, data map[string]interface{}) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(statusCode)
+	rw.Write([]byte(fmt.Sprintf("%s\n\n%s\n", data["statusName"], data["description"])))
+}
+
+func renderPage(logger *logging.Logger, filePath string, evalContext map[string]interface{}) (string, error) {
 	htmlTemplate := `<!DOCTYPE html>
 <html>
 <head>
-  <title>{{ .statusName }}</title>
+  <title>{{ .statusName }}{{ if .theme.productName }} - {{ .theme.productName }}{{ end }}</title>
   <style>
     body {
       width: 100vw;
@@ -90,8 +155,17 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
       justify-content: center;
       align-items: center;
     }
+    .logo {
+      max-width: 12em;
+      max-height: 6em;
+      margin-bottom: 1em;
+    }
+    .product-name {
+      color: #888;
+      margin-bottom: 1em;
+    }
     .error-code {
-      color: orange;
+      color: {{ .theme.primaryColor }};
       font-size: 1.5em;
     }
     .button-container {
@@ -103,7 +177,7 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
     }
     .button-primary {
       all: unset;
-      background-color: orange;
+      background-color: {{ .theme.primaryColor }};
       color: white;
       cursor: pointer;
       padding: 1em;
@@ -113,7 +187,7 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
     }
     .button-secondary {
       all: unset;
-      color: orange;
+      color: {{ .theme.primaryColor }};
       cursor: pointer;
     }
     .footer {
@@ -131,7 +205,14 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
 
 <body>
   <div class="container">
+    {{ if .theme.logoUrl }}
+    <img class="logo" src="{{ .theme.logoUrl }}" alt="{{ .theme.productName }}">
+    {{ else if .theme.productName }}
+    <span class="product-name">{{ .theme.productName }}</span>
+    {{ end }}
+    {{ if .statusCode }}
     <span class="error-code">{{ .statusCode }}</span>
+    {{ end }}
     <h1>{{ .statusName }}</h1>
     <h2>{{ .description }}</h2>
 
@@ -151,16 +232,21 @@ func renderPage(logger *logging.Logger, page *ErrorPageConfig, evalContext map[s
 </body>
 </html>`
 
-	if page.FilePath != "" {
-		templateData, err := os.ReadFile(page.FilePath)
+	if filePath != "" {
+		templateData, err := os.ReadFile(filePath)
 		if err != nil {
-			logger.Log(logging.LevelWarn, "Error while reading error page file \"%s\": %s", page.FilePath, err.Error())
+			logger.Log(logging.LevelWarn, "Error while reading error page file \"%s\": %s", filePath, err.Error())
 		} else {
 			htmlTemplate = string(templateData)
 		}
 	}
 
-	tpl, err := template.New("").Parse(htmlTemplate)
+	// Make sure the default template can always access the theme
+	if _, ok := evalContext["theme"]; !ok {
+		evalContext["theme"] = (*ThemeConfig)(nil).TemplateData()
+	}
+
+	tpl, err := template.New("").Funcs(utils.TemplateFuncs()).Parse(htmlTemplate)
 	if err != nil {
 		return "", err
 	}
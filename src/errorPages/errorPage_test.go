@@ -0,0 +1,214 @@
+package errorPages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func createTestErrorData() map[string]interface{} {
+	return map[string]interface{}{
+		"statusType":  "https://tools.ietf.org/html/rfc9110#section-15.5.2",
+		"statusCode":  http.StatusUnauthorized,
+		"statusName":  "Unauthorized",
+		"description": "You're not authorized to access this resource.",
+	}
+}
+
+func TestWriteErrorStatusCode(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	rw := httptest.NewRecorder()
+
+	WriteError(logger, &ErrorPageConfig{}, rw, req, createTestErrorData())
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusUnauthorized, rw.Code)
+	}
+}
+
+func TestWriteErrorStatusCodeOverride(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	page := &ErrorPageConfig{
+		StatusCodeOverride: http.StatusForbidden,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	rw := httptest.NewRecorder()
+
+	WriteError(logger, page, rw, req, createTestErrorData())
+
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusForbidden, rw.Code)
+	}
+
+	expectedBody := `{"type":"https://tools.ietf.org/html/rfc9110#section-15.5.2","title":"Unauthorized","detail":"You're not authorized to access this resource."}`
+	if rw.Body.String() != expectedBody {
+		t.Fatalf("Expected the original problem details in the body, but got %s", rw.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com", nil)
+	req.Header.Set("Accept", "text/html")
+	rw = httptest.NewRecorder()
+
+	page.StatusCodeOverride = http.StatusOK
+
+	WriteError(logger, page, rw, req, createTestErrorData())
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rw.Code)
+	}
+}
+
+func TestWriteErrorRedirectStatusCode(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	page := &ErrorPageConfig{
+		RedirectTo: "https://example.com/error",
+	}
+
+	for _, statusCode := range []int{0, http.StatusSeeOther, http.StatusTemporaryRedirect} {
+		page.RedirectStatusCode = statusCode
+
+		req := httptest.NewRequest("POST", "https://example.com", nil)
+		rw := httptest.NewRecorder()
+
+		WriteError(logger, page, rw, req, createTestErrorData())
+
+		if rw.Code != GetRedirectStatusCode(statusCode) || rw.Header().Get("Location") != page.RedirectTo {
+			t.Fatalf("Expected a %d redirect, but got %d to %s", GetRedirectStatusCode(statusCode), rw.Code, rw.Header().Get("Location"))
+		}
+	}
+
+	if GetRedirectStatusCode(0) != http.StatusFound {
+		t.Fatal("Expected 302 to be the default")
+	}
+}
+
+func TestIsValidStatusCodeOverride(t *testing.T) {
+	for _, code := range []int{0, 200, 203, 206, 400, 403, 599} {
+		if !IsValidStatusCodeOverride(code) {
+			t.Errorf("Expected %d to be a valid status code override", code)
+		}
+	}
+
+	for _, code := range []int{-1, 100, 199, 204, 205, 301, 302, 304, 399, 600, 1000} {
+		if IsValidStatusCodeOverride(code) {
+			t.Errorf("Expected %d to be an invalid status code override", code)
+		}
+	}
+}
+
+func TestWriteErrorContentNegotiation(t *testing.T) {
+	expectWrittenContentType(t, "application/json;q=0.9, text/html;q=0.8", "application/problem+json")
+	expectWrittenContentType(t, "application/json;q=0.8, text/html;q=0.9", "text/html; charset=utf-8")
+	expectWrittenContentType(t, "text/plain", "text/plain; charset=utf-8")
+	expectWrittenContentType(t, "*/*", "application/problem+json")
+	expectWrittenContentType(t, "", "application/problem+json")
+}
+
+func expectWrittenContentType(t *testing.T, accept string, expected string) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rw := httptest.NewRecorder()
+
+	WriteError(logger, &ErrorPageConfig{}, rw, req, createTestErrorData())
+
+	if actual := rw.Header().Get("Content-Type"); actual != expected {
+		t.Errorf("Expected Accept header \"%s\" to write content type \"%s\", but got \"%s\"", accept, expected, actual)
+	}
+}
+
+func TestWriteErrorProblemContentType(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	for _, contentType := range []string{ProblemContentTypeRfc, ProblemContentTypeLegacy, "application/json"} {
+		data := createTestErrorData()
+		data["problemContentType"] = contentType
+
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		req.Header.Set("Accept", "application/json")
+		rw := httptest.NewRecorder()
+
+		WriteError(logger, &ErrorPageConfig{}, rw, req, data)
+
+		if actual := rw.Header().Get("Content-Type"); actual != contentType {
+			t.Errorf("Expected the configured content type %s, but got %s", contentType, actual)
+		}
+	}
+}
+
+func TestWriteErrorWithTheme(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	theme := &ThemeConfig{
+		ProductName:  "ACME Portal",
+		LogoUrl:      "https://acme.example.com/logo.svg",
+		PrimaryColor: "#0055aa",
+	}
+
+	data := createTestErrorData()
+	data["theme"] = theme.TemplateData()
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	WriteError(logger, &ErrorPageConfig{}, rw, req, data)
+
+	body := rw.Body.String()
+
+	if !strings.Contains(body, "ACME Portal") {
+		t.Fatal("Expected the product name to be rendered")
+	}
+	if !strings.Contains(body, `src="https://acme.example.com/logo.svg"`) {
+		t.Fatal("Expected the logo to be rendered")
+	}
+	if !strings.Contains(body, "#0055aa") || strings.Contains(body, "orange") {
+		t.Fatal("Expected the primary color to replace the default one")
+	}
+}
+
+func TestWriteErrorCustomTemplateFuncs(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	filePath := filepath.Join(t.TempDir(), "error.html")
+	os.WriteFile(filePath, []byte(`<p>{{ .statusName | upper }}: {{ .supportContact | default "help@example.com" }}</p>`), 0600)
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	WriteError(logger, &ErrorPageConfig{FilePath: filePath}, rw, req, createTestErrorData())
+
+	if body := rw.Body.String(); !strings.Contains(body, "UNAUTHORIZED: help@example.com") {
+		t.Fatalf("Expected the template functions to be applied, but got %s", body)
+	}
+}
+
+func TestWriteErrorWithoutTheme(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	WriteError(logger, &ErrorPageConfig{}, rw, req, createTestErrorData())
+
+	body := rw.Body.String()
+
+	if !strings.Contains(body, "orange") || strings.Contains(body, "<img") {
+		t.Fatal("Expected the default theme to be used")
+	}
+}
@@ -0,0 +1,30 @@
+package errorPages
+
+import (
+	"net/http"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Returns whether the logout page should be used instead of the default post logout redirect.
+func (page *LogoutPageConfig) IsActive() bool {
+	return page != nil && (page.Enabled || page.RedirectTo != "")
+}
+
+func WriteLogoutPage(logger *logging.Logger, page *LogoutPageConfig, rw http.ResponseWriter, req *http.Request, data map[string]interface{}) {
+	if page.RedirectTo != "" {
+		http.Redirect(rw, req, page.RedirectTo, http.StatusFound)
+		return
+	}
+
+	html, err := renderPage(logger, page.FilePath, data)
+	if err != nil {
+		logger.Log(logging.LevelError, "Error while rendering logout page: %s", err.Error())
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(html))
+}
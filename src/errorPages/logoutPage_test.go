@@ -0,0 +1,51 @@
+package errorPages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestWriteDefaultLogoutPage(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	req := httptest.NewRequest("GET", "https://example.com/oidc/callback", nil)
+	rw := httptest.NewRecorder()
+
+	WriteLogoutPage(logger, &LogoutPageConfig{Enabled: true}, rw, req, map[string]interface{}{
+		"statusName":        "Logged out",
+		"description":       "You have been logged out successfully.",
+		"primaryButtonText": "Sign in",
+		"primaryButtonUrl":  "https://example.com/login",
+	})
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rw.Code)
+	}
+
+	body := rw.Body.String()
+
+	if !strings.Contains(body, `<a href="https://example.com/login" class="button-primary">Sign in</a>`) {
+		t.Fatalf("Expected the logout page to contain a sign-in link, but got: %s", body)
+	}
+
+	if strings.Contains(body, `class="error-code"`) {
+		t.Fatal("Expected the logout page not to contain a status code")
+	}
+}
+
+func TestWriteLogoutPageRedirect(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	req := httptest.NewRequest("GET", "https://example.com/oidc/callback", nil)
+	rw := httptest.NewRecorder()
+
+	WriteLogoutPage(logger, &LogoutPageConfig{RedirectTo: "https://example.com/bye"}, rw, req, map[string]interface{}{})
+
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/bye" {
+		t.Fatalf("Expected a redirect to the configured page, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,87 @@
+package errorPages
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// The page is rendered using html/template, because the fields contain user input.
+var replayPageTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <title>Continue</title>
+</head>
+<body onload="document.forms[0].submit()">
+  <form method="post" action="{{ .action }}">
+    {{ range .fields }}
+    <input type="hidden" name="{{ .Name }}" value="{{ .Value }}">
+    {{ end }}
+    <noscript>
+      <p>You have been logged in. Please continue to submit the form again.</p>
+      <button type="submit">Continue</button>
+    </noscript>
+  </form>
+</body>
+</html>`))
+
+type formField struct {
+	Name  string
+	Value string
+}
+
+// Writes a page which submits the given url-encoded form body to the action URL again.
+// This allows a form which has been submitted without a valid session to be replayed after the login.
+func WriteReplayPage(logger *logging.Logger, rw http.ResponseWriter, action string, body string) error {
+	fields, err := parseFormFields(body)
+	if err != nil {
+		return err
+	}
+
+	var html bytes.Buffer
+	err = replayPageTemplate.Execute(&html, map[string]interface{}{
+		"action": action,
+		"fields": fields,
+	})
+	if err != nil {
+		logger.Log(logging.LevelError, "Error while rendering replay page: %s", err.Error())
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(html.Bytes())
+
+	return nil
+}
+
+// Parses an url-encoded form body. Unlike url.ParseQuery, the order of the fields is kept.
+func parseFormFields(body string) ([]formField, error) {
+	fields := make([]formField, 0)
+
+	for _, pair := range strings.Split(body, "&") {
+		if pair == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(pair, "=")
+
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, formField{Name: name, Value: value})
+	}
+
+	return fields, nil
+}
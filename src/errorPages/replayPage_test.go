@@ -0,0 +1,61 @@
+package errorPages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestWriteReplayPage(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	rw := httptest.NewRecorder()
+
+	err := WriteReplayPage(logger, rw, "https://example.com/save?a=1&b=2", "title=%22%3E%3Cscript%3E&tags=a&tags=b&empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rw.Code)
+	}
+
+	body := rw.Body.String()
+
+	for _, expected := range []string{
+		`action="https://example.com/save?a=1&amp;b=2"`,
+		`name="title" value="&#34;&gt;&lt;script&gt;"`,
+		`name="tags" value="a"`,
+		`name="tags" value="b"`,
+		`name="empty" value=""`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected the replay page to contain %s, but got: %s", expected, body)
+		}
+	}
+
+	if strings.Contains(body, "<script>") {
+		t.Fatal("Expected the form values to be escaped")
+	}
+
+	if strings.Index(body, `value="a"`) > strings.Index(body, `value="b"`) {
+		t.Error("Expected the fields to keep their order")
+	}
+}
+
+func TestWriteReplayPageInvalidBody(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	rw := httptest.NewRecorder()
+
+	if err := WriteReplayPage(logger, rw, "https://example.com/save", "title=%zz"); err == nil {
+		t.Fatal("Expected an invalid body to fail")
+	}
+
+	if rw.Body.Len() != 0 {
+		t.Fatal("Expected nothing to be written for an invalid body")
+	}
+}
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+)
+
+// Marks requests which are not sent to the provider, so they don't get the IdpRequestHeaders.
+type skipIdpRequestHeadersKey struct{}
+
+func withoutIdpRequestHeaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipIdpRequestHeadersKey{}, true)
+}
+
+// The hosts of the provider, which are the only ones receiving the IdpRequestHeaders. Other hosts, eg. of
+// TrustedIssuers or redirect targets, must not get them, because they may contain secrets like an API key.
+type providerHosts struct {
+	lock  sync.RWMutex
+	hosts map[string]bool
+}
+
+func newProviderHosts(urls ...string) *providerHosts {
+	hosts := &providerHosts{
+		hosts: make(map[string]bool),
+	}
+	hosts.add(urls...)
+
+	return hosts
+}
+
+// Empty and invalid urls are ignored.
+func (hosts *providerHosts) add(urls ...string) {
+	hosts.lock.Lock()
+	defer hosts.lock.Unlock()
+
+	for _, rawUrl := range urls {
+		if parsedUrl, err := url.Parse(rawUrl); err == nil && parsedUrl.Host != "" {
+			hosts.hosts[strings.ToLower(parsedUrl.Host)] = true
+		}
+	}
+}
+
+// The endpoints announced by the discovery document of the provider belong to it.
+func (hosts *providerHosts) addDiscovery(discovery *oidc.OidcDiscovery) {
+	hosts.add(discovery.AuthorizationEndpoint, discovery.TokenEndpoint, discovery.JWKSURI, discovery.UserinfoEndpoint,
+		discovery.IntrospectionEndpoint, discovery.EndSessionEndpoint, discovery.PushedAuthorizationRequestEndpoint, discovery.RevocationEndpoint)
+}
+
+func (hosts *providerHosts) contains(host string) bool {
+	hosts.lock.RLock()
+	defer hosts.lock.RUnlock()
+
+	return hosts.hosts[strings.ToLower(host)]
+}
+
+// Adds the Provider.IdpRequestHeaders to every request to the provider, eg. an API key of a gateway in front of it.
+type idpRequestHeadersTransport struct {
+	inner   http.RoundTripper
+	headers map[string]string
+	hosts   *providerHosts
+}
+
+func newIdpRequestHeadersTransport(inner http.RoundTripper, headers map[string]string, hosts *providerHosts) *idpRequestHeadersTransport {
+	return &idpRequestHeadersTransport{
+		inner:   inner,
+		headers: headers,
+		hosts:   hosts,
+	}
+}
+
+func (transport *idpRequestHeadersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if skip, _ := req.Context().Value(skipIdpRequestHeadersKey{}).(bool); skip || !transport.hosts.contains(req.URL.Host) {
+		return transport.inner.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the original request
+	req = req.Clone(req.Context())
+	for name, value := range transport.headers {
+		req.Header.Set(name, value)
+	}
+
+	return transport.inner.RoundTrip(req)
+}
@@ -0,0 +1,109 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestIdpRequestHeadersAreSentToTheProvider(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.IdpRequestHeaders = map[string]string{"X-Api-Key": "gateway-secret"}
+
+	var tokenApiKey string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenApiKey = r.Header.Get("X-Api-Key")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "new-access-token"})
+	}))
+	defer tokenServer.Close()
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+
+	httpClient, err := createHttpClient(logging.CreateLogger(logging.LevelDebug), toa.Config, newProviderHosts(tokenServer.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	toa.httpClient = httpClient
+
+	if _, err := toa.renewToken(context.Background(), "refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+	if tokenApiKey != "gateway-secret" {
+		t.Fatalf("Expected the token request to contain the header, but got '%s'", tokenApiKey)
+	}
+
+	// The webhook isn't part of the provider
+	webhookApiKey := "not called"
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookApiKey = r.Header.Get("X-Api-Key")
+		json.NewEncoder(w).Encode(map[string]interface{}{"allow": true})
+	}))
+	defer webhookServer.Close()
+	toa.Config.Authorization.Webhook = &AuthorizationWebhookConfig{Url: webhookServer.URL, Timeout: 5}
+
+	if err := toa.checkAuthorization(context.Background(), map[string]interface{}{"sub": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if webhookApiKey != "" {
+		t.Fatalf("Expected the webhook request not to contain the header, but got '%s'", webhookApiKey)
+	}
+}
+
+func TestIdpRequestHeadersAreOnlySentToTheProviderHosts(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.IdpRequestHeaders = map[string]string{"X-Api-Key": "gateway-secret"}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receivedApiKeys := make(map[string]string)
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedApiKeys[r.URL.Path] = r.Header.Get("X-Api-Key")
+		json.NewEncoder(w).Encode(newJwks(privateKey))
+	}))
+	defer otherServer.Close()
+
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedApiKeys["provider"] = r.Header.Get("X-Api-Key")
+		http.Redirect(w, r, otherServer.URL+"/redirected", http.StatusFound)
+	}))
+	defer providerServer.Close()
+
+	httpClient, err := createHttpClient(logging.CreateLogger(logging.LevelDebug), toa.Config, newProviderHosts(providerServer.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	toa.httpClient = httpClient
+
+	// A redirect of the provider to another host
+	resp, err := toa.httpClient.Get(providerServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if receivedApiKeys["provider"] != "gateway-secret" {
+		t.Fatalf("Expected the provider to receive the header, but got '%s'", receivedApiKeys["provider"])
+	}
+	if apiKey, ok := receivedApiKeys["/redirected"]; !ok || apiKey != "" {
+		t.Fatalf("Expected the redirect target to be called without the header, but got '%s'", apiKey)
+	}
+
+	// The JWKS of a trusted issuer on another host
+	trustedIssuer := &TrustedIssuerConfig{Issuer: "https://partner.example.com", JwksUri: otherServer.URL + "/jwks"}
+	jwks, err := toa.getTrustedIssuerJwks(context.Background(), trustedIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.EnsureLoaded(context.Background(), toa.logger, toa.httpClient, false); err != nil {
+		t.Fatal(err)
+	}
+	if apiKey, ok := receivedApiKeys["/jwks"]; !ok || apiKey != "" {
+		t.Fatalf("Expected the trusted issuer to be called without the header, but got '%s'", apiKey)
+	}
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	AuditResultAllowed         string = "allowed"
+	AuditResultDenied          string = "denied"
+	AuditResultUnauthenticated string = "unauthenticated"
+	AuditResultBypassed        string = "bypassed"
+)
+
+// A single authorization decision.
+// Never put tokens or claims in here, the subject is hashed before it is written.
+type AuditEvent struct {
+	Subject string
+	Route   string
+	Result  string
+	Reason  string
+}
+
+// Writes an audit trail of the authorization decisions, independent of the configured LogLevel.
+type AuditLogger struct {
+	Enabled bool
+
+	writer io.Writer
+}
+
+func CreateAuditLogger(enabled bool) *AuditLogger {
+	return &AuditLogger{
+		Enabled: enabled,
+		writer:  os.Stdout,
+	}
+}
+
+func (audit *AuditLogger) Log(event *AuditEvent) {
+	if audit == nil || !audit.Enabled {
+		return
+	}
+
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	message := fmt.Sprintf("subject=%s route=%q result=%s reason=%q", HashSubject(event.Subject), event.Route, event.Result, event.Reason)
+
+	audit.writer.Write([]byte(currentTime + " [" + LevelInfo + "]" + " [traefik-oidc-auth] [audit] " + message + "\n"))
+}
+
+// Returns a pseudonymized representation of the subject, which still allows to correlate the events of a user.
+func HashSubject(subject string) string {
+	if subject == "" {
+		return "-"
+	}
+
+	hash := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAuditLoggerDisabled(t *testing.T) {
+	var buffer bytes.Buffer
+
+	audit := CreateAuditLogger(false)
+	audit.writer = &buffer
+
+	audit.Log(&AuditEvent{Subject: "alice", Route: "GET example.com/", Result: AuditResultAllowed, Reason: "authorized"})
+
+	if buffer.Len() != 0 {
+		t.Fatalf("Expected nothing to be logged, but got %s", buffer.String())
+	}
+}
+
+func TestAuditLoggerHashesSubject(t *testing.T) {
+	var buffer bytes.Buffer
+
+	audit := CreateAuditLogger(true)
+	audit.writer = &buffer
+
+	audit.Log(&AuditEvent{Subject: "alice", Route: "GET example.com/admin", Result: AuditResultDenied, Reason: "authorization rules not satisfied"})
+
+	line := buffer.String()
+
+	if strings.Contains(line, "alice") {
+		t.Fatalf("Expected the subject to be hashed, but got %s", line)
+	}
+	if !strings.Contains(line, "[INFO]") ||
+		!strings.Contains(line, "subject="+HashSubject("alice")) ||
+		!strings.Contains(line, `route="GET example.com/admin"`) ||
+		!strings.Contains(line, "result=denied") ||
+		!strings.Contains(line, `reason="authorization rules not satisfied"`) {
+		t.Fatalf("Unexpected audit line %s", line)
+	}
+
+	if HashSubject("alice") == HashSubject("bob") || HashSubject("") != "-" {
+		t.Fatal("Expected distinct hashes for distinct subjects")
+	}
+}
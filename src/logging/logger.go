@@ -2,21 +2,42 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Logger struct {
 	MinLevel string
+
+	// Messages logged by LogSampled are written at most once per interval and key. 0 disables the sampling.
+	SampleInterval time.Duration
+
+	writer  io.Writer
+	lock    sync.Mutex
+	samples map[string]*logSample
+}
+
+type logSample struct {
+	loggedAt   time.Time
+	suppressed int
 }
 
 func CreateLogger(minLevel string) *Logger {
 	return &Logger{
 		MinLevel: minLevel,
+		writer:   os.Stdout,
+		samples:  make(map[string]*logSample),
 	}
 }
 
+// Replaces the writer the messages are written to, which is stdout by default.
+func (logger *Logger) SetOutput(writer io.Writer) {
+	logger.writer = writer
+}
+
 func shouldLog(minLevel, level string) bool {
 	return LogLevels[strings.ToUpper(minLevel)] >= LogLevels[strings.ToUpper(level)]
 }
@@ -26,6 +47,50 @@ func (logger *Logger) Log(level string, format string, a ...interface{}) {
 		return
 	}
 
+	logger.write(level, fmt.Sprintf(format, a...))
+}
+
+// Like Log, but for messages which are repeated on every request. Within the SampleInterval, only the first message
+// of a key is written and the others are counted. The key should be a constant, as every key is held in memory.
+func (logger *Logger) LogSampled(key string, level string, format string, a ...interface{}) {
+	if !shouldLog(logger.MinLevel, level) {
+		return
+	}
+
+	if logger.SampleInterval <= 0 {
+		logger.write(level, fmt.Sprintf(format, a...))
+		return
+	}
+
+	logger.lock.Lock()
+
+	sample, ok := logger.samples[key]
+	if !ok {
+		sample = &logSample{}
+		logger.samples[key] = sample
+	}
+
+	if time.Since(sample.loggedAt) < logger.SampleInterval {
+		sample.suppressed++
+		logger.lock.Unlock()
+		return
+	}
+
+	suppressed := sample.suppressed
+	sample.loggedAt = time.Now()
+	sample.suppressed = 0
+
+	logger.lock.Unlock()
+
+	message := fmt.Sprintf(format, a...)
+	if suppressed > 0 {
+		message += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+
+	logger.write(level, message)
+}
+
+func (logger *Logger) write(level string, message string) {
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	os.Stdout.WriteString(currentTime + " [" + level + "]" + " [traefik-oidc-auth] " + fmt.Sprintf(format, a...) + "\n")
+	logger.writer.Write([]byte(currentTime + " [" + level + "]" + " [traefik-oidc-auth] " + message + "\n"))
 }
@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSampledRateLimitsRepeatedMessages(t *testing.T) {
+	var buffer bytes.Buffer
+
+	logger := CreateLogger(LevelDebug)
+	logger.writer = &buffer
+	logger.SampleInterval = time.Hour
+
+	for i := 0; i < 10; i++ {
+		logger.LogSampled("session-present", LevelDebug, "A session is present for the request.")
+	}
+	logger.LogSampled("no-session", LevelDebug, "No session found")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per key, but got %d: %s", len(lines), buffer.String())
+	}
+
+	// Once the interval has passed, the number of suppressed messages is written along with the next one
+	logger.samples["session-present"].loggedAt = time.Now().Add(-2 * time.Hour)
+	buffer.Reset()
+
+	logger.LogSampled("session-present", LevelDebug, "A session is present for the request.")
+
+	if !strings.Contains(buffer.String(), "(9 similar messages suppressed)") {
+		t.Fatalf("Expected the suppressed messages to be counted, but got %s", buffer.String())
+	}
+}
+
+func TestLogSampledWithoutInterval(t *testing.T) {
+	var buffer bytes.Buffer
+
+	logger := CreateLogger(LevelInfo)
+	logger.writer = &buffer
+
+	for i := 0; i < 3; i++ {
+		logger.LogSampled("key", LevelInfo, "Message %d", i)
+	}
+	logger.LogSampled("key", LevelDebug, "Below the MinLevel")
+
+	if lines := strings.Split(strings.TrimSpace(buffer.String()), "\n"); len(lines) != 3 {
+		t.Fatalf("Expected every message to be written without sampling, but got %d: %s", len(lines), buffer.String())
+	}
+}
@@ -2,17 +2,24 @@ package src
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
 	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
@@ -25,34 +32,92 @@ import (
 
 type TraefikOidcAuth struct {
 	logger                   *logging.Logger
+	auditLogger              *logging.AuditLogger
 	next                     http.Handler
 	httpClient               *http.Client
+	httpClientKey            string
+	providerHosts            *providerHosts
 	ProviderURL              *url.URL
+	InternalProviderURL      *url.URL
 	ClientJwtPrivateKey      *rsa.PrivateKey
 	CallbackURL              *url.URL
 	Config                   *Config
 	SessionStorage           session.SessionStorage
+	PendingLoginStorage      session.PendingLoginStorage
+	RedirectUrlStorage       session.PendingLoginStorage
 	DiscoveryDocument        *oidc.OidcDiscovery
+	providerCache            *oidc.ProviderCache
 	Jwks                     *oidc.JwksHandler
 	Lock                     sync.RWMutex
 	BypassAuthenticationRule *rules.RequestCondition
+
+	renewalsLock sync.Mutex
+	renewals     map[string]*tokenRenewal
+
+	exchangedTokensLock sync.Mutex
+	exchangedTokens     map[string]*exchangedToken
+
+	// Limits the requests per subject, nil when disabled
+	rateLimiter *utils.RateLimiter
+
+	authorizationDecisionsLock sync.Mutex
+	authorizationDecisions     map[string]*authorizationDecision
+
+	// Providers only issue a refresh token for certain scopes, like offline_access, which is logged only once
+	missingRefreshTokenLogged sync.Once
+
+	// Set while the eager discovery hasn't succeeded yet
+	discoveryPendingLock sync.Mutex
+	discoveryPending     bool
 }
 
 // Make sure we fetch oidc discovery document during first request - avoid race condition
 // Perform lock when changing document - we are in concurrent environment
-func (toa *TraefikOidcAuth) EnsureOidcDiscovery() error {
+func (toa *TraefikOidcAuth) EnsureOidcDiscovery(ctx context.Context) error {
 	var config = toa.Config
 	var parsedURL = toa.ProviderURL
-	if toa.DiscoveryDocument == nil {
+	if toa.isDiscoveryExpired() {
 		toa.Lock.Lock()
 		defer toa.Lock.Unlock()
 		// check again after lock
-		if toa.DiscoveryDocument == nil {
-			var jwks = &oidc.JwksHandler{}
-			toa.Jwks = jwks
-			toa.logger.Log(logging.LevelInfo, "Getting OIDC discovery document...")
+		if toa.isDiscoveryExpired() {
+			discoveryURL := parsedURL
+			cacheKey := parsedURL.String()
+			// Documents fetched with other TLS settings, eg. InsecureSkipVerify, must not be shared
+			if toa.httpClientKey != "" {
+				cacheKey += " client " + toa.httpClientKey
+			}
+			if toa.InternalProviderURL != nil {
+				discoveryURL = toa.InternalProviderURL
+				cacheKey += " " + toa.InternalProviderURL.String()
+			}
+
+			// Instances overriding endpoints must not share the document with those which don't
+			provider := config.Provider
+			overrides := []string{provider.AuthorizationEndpoint, provider.TokenEndpoint, provider.JwksUri, provider.EndSessionEndpoint, provider.IntrospectionEndpoint}
+			if strings.Join(overrides, "") != "" {
+				cacheKey += " overrides " + strings.Join(overrides, " ")
+			}
+
+			// Other middleware instances using the same provider share the discovery document and the JWKS
+			providerCache := oidc.GetProviderCache(cacheKey)
+
+			oidcDiscoveryDocument, err := providerCache.EnsureDiscovery(toa.logger, func() (*oidc.OidcDiscovery, error) {
+				toa.logger.Log(logging.LevelInfo, "Getting OIDC discovery document...")
+
+				oidcDiscoveryDocument, err := GetOidcDiscovery(ctx, toa.logger, toa.httpClient, discoveryURL)
+				if err != nil {
+					return nil, err
+				}
+
+				if toa.InternalProviderURL != nil {
+					applySplitHorizonEndpoints(oidcDiscoveryDocument, toa.InternalProviderURL, parsedURL)
+				}
+
+				applyDiscoveryOverrides(oidcDiscoveryDocument, config.Provider)
 
-			oidcDiscoveryDocument, err := GetOidcDiscovery(toa.logger, toa.httpClient, parsedURL)
+				return oidcDiscoveryDocument, nil
+			})
 			if err != nil {
 				toa.logger.Log(logging.LevelError, "Error while retrieving discovery document: %s", err.Error())
 				return err
@@ -68,8 +133,13 @@ func (toa *TraefikOidcAuth) EnsureOidcDiscovery() error {
 
 			toa.logger.Log(logging.LevelInfo, "OIDC Discovery successful. AuthEndPoint: %s", oidcDiscoveryDocument.AuthorizationEndpoint)
 
+			if toa.providerHosts != nil {
+				toa.providerHosts.addDiscovery(oidcDiscoveryDocument)
+			}
+
+			toa.Jwks = providerCache.Jwks
+			toa.providerCache = providerCache
 			toa.DiscoveryDocument = oidcDiscoveryDocument
-			toa.Jwks.Url = oidcDiscoveryDocument.JWKSURI
 		}
 		return nil
 	}
@@ -77,16 +147,38 @@ func (toa *TraefikOidcAuth) EnsureOidcDiscovery() error {
 	return nil
 }
 
+// The discovery document is loaded on the first request and reloaded, once it has expired in the shared cache.
+func (toa *TraefikOidcAuth) isDiscoveryExpired() bool {
+	if toa.DiscoveryDocument == nil {
+		return true
+	}
+
+	return toa.providerCache != nil && toa.providerCache.IsDiscoveryExpired()
+}
+
 func (toa *TraefikOidcAuth) GetAbsoluteCallbackURL(req *http.Request) *url.URL {
 	if utils.UrlIsAbsolute(toa.CallbackURL) {
 		return toa.CallbackURL
 	} else {
 		abs := *toa.CallbackURL
-		utils.FillHostSchemeFromRequest(req, &abs)
+		utils.FillHostSchemeFromRequest(toa.withForcedHttps(req), &abs)
 		return &abs
 	}
 }
 
+// Returns a copy of the request which claims to be made over https, if ForceHttpsRedirectUri is enabled.
+// It's used to build the redirect URIs sent to the provider, when a TLS-terminating proxy in front doesn't set X-Forwarded-Proto.
+func (toa *TraefikOidcAuth) withForcedHttps(req *http.Request) *http.Request {
+	if !toa.Config.ForceHttpsRedirectUri || req.Header.Get("X-Forwarded-Proto") == "https" {
+		return req
+	}
+
+	httpsReq := req.Clone(req.Context())
+	httpsReq.Header.Set("X-Forwarded-Proto", "https")
+
+	return httpsReq
+}
+
 func (toa *TraefikOidcAuth) isCallbackRequest(req *http.Request) bool {
 	u := req.URL
 	utils.FillHostSchemeFromRequest(req, u)
@@ -107,21 +199,42 @@ func (toa *TraefikOidcAuth) isCallbackRequest(req *http.Request) bool {
 func (toa *TraefikOidcAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if toa.BypassAuthenticationRule != nil {
 		if toa.BypassAuthenticationRule.Match(toa.logger, req) {
-			toa.logger.Log(logging.LevelDebug, "BypassAuthenticationRule matched. Forwarding request without authentication.")
+			toa.logger.LogSampled("bypass-matched", logging.LevelDebug, "BypassAuthenticationRule matched. Forwarding request without authentication.")
+			toa.auditDecision(req, "", logging.AuditResultBypassed, "bypass authentication rule matched")
 
 			// Forward the request
 			toa.sanitizeForUpstream(req)
+			toa.stripIdentityHeaders(req)
 			toa.next.ServeHTTP(rw, req)
 			return
 		} else {
-			toa.logger.Log(logging.LevelDebug, "BypassAuthenticationRule not matched. Requiring authentication.")
+			toa.logger.LogSampled("bypass-not-matched", logging.LevelDebug, "BypassAuthenticationRule not matched. Requiring authentication.")
 		}
 	}
 
-	err := toa.EnsureOidcDiscovery()
+	if isPreflightRequest(req) {
+		toa.handlePreflight(rw, req)
+		return
+	}
+
+	if toa.Config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		req, cancel = toa.withRequestTimeout(req)
+		defer cancel()
+	}
+
+	if toa.isFailingClosed() {
+		toa.writeDiscoveryUnavailableError(rw, req)
+		return
+	}
+
+	err := toa.EnsureOidcDiscovery(req.Context())
 
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Error getting oidc discovery: %s", err.Error())
+		if toa.writeErrorIfTimedOut(rw, req) {
+			return
+		}
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -132,13 +245,18 @@ func (toa *TraefikOidcAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	}
 
 	if toa.Config.LoginUri != "" && strings.HasPrefix(req.RequestURI, toa.Config.LoginUri) {
-		toa.redirectToProvider(rw, req)
+		toa.redirectToProvider(rw, req, loginTriggerLogin)
 		return
 	}
 
-	session, updateSession, claims, err := toa.getSessionForRequest(req)
+	// Renewed tokens must be stored, as well as other changes of the session, eg. a new authorization decision
+	session, renewed, claims, err := toa.getSessionForRequest(req)
+	updateSession := renewed
 
 	if err == nil && session != nil {
+		// The browser sends back our cookies, so there is no login loop
+		toa.clearLoginRedirects(rw, req)
+
 		// Handle logout
 		if strings.HasPrefix(req.RequestURI, toa.Config.LogoutUri) {
 			toa.handleLogout(rw, req, session)
@@ -148,39 +266,170 @@ func (toa *TraefikOidcAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		// If this request is using external authentication by using a header or custom cookie,
 		// we need to validate the authorization on every request.
 		// Ensure the session is authorized
+		var authorizationErr error
 		if session.Id == "AuthorizationHeader" || session.Id == "AuthorizationCookie" || toa.Config.Authorization.CheckOnEveryRequest {
-			session.IsAuthorized = isAuthorized(toa.logger, toa.Config.Authorization, claims)
+			authorizationErr = toa.checkAuthorization(req.Context(), claims)
+			session.IsAuthorized = authorizationErr == nil
+		} else if toa.isAuthorizationRecheckDue(session) {
+			claims, renewed = toa.refreshClaimsForRecheck(req.Context(), session, claims, renewed)
+			updateSession = updateSession || renewed
+
+			authorizationErr = toa.checkAuthorization(req.Context(), claims)
+			if isFailedAuthorization(authorizationErr) {
+				// No decision has been taken, so the previous one is kept and the recheck is repeated on the next request
+				toa.logger.Log(logging.LevelWarn, "Keeping the previous authorization decision, because the recheck failed: %s", authorizationErr.Error())
+			} else {
+				session.IsAuthorized = authorizationErr == nil
+				session.AuthorizedAt = time.Now()
+				updateSession = true
+			}
+		}
+
+		subject := session.Subject
+		if subject == "" && ((toa.auditLogger != nil && toa.auditLogger.Enabled) || toa.rateLimiter != nil) {
+			subject = toa.getSessionSubject(claims)
 		}
 
 		if !session.IsAuthorized {
-			toa.handleUnauthorized(rw, req)
+			if toa.writeErrorIfTimedOut(rw, req) {
+				return
+			}
+
+			// Keeps the decision until the next recheck
+			if updateSession {
+				if err := toa.storeSessionAndAttachCookie(session, rw, req); err != nil {
+					return
+				}
+			}
+
+			toa.auditDecision(req, subject, logging.AuditResultDenied, getAuthorizationFailureReason(authorizationErr))
+			toa.handleUnauthorized(rw, req, claims, authorizationErr)
+			return
+		}
+
+		// Anonymous requests are not limited, because they don't have a subject to be keyed by
+		if toa.rateLimiter != nil && subject != "" && !toa.rateLimiter.Allow(subject) {
+			toa.logger.Log(logging.LevelInfo, "Rate limit exceeded")
+			toa.auditDecision(req, subject, logging.AuditResultDenied, "rate limit exceeded")
+			toa.writeTooManyRequestsError(rw, req)
 			return
 		}
 
+		if toa.isRefreshRequest(req) {
+			toa.handleRefresh(rw, req, session, renewed)
+			return
+		}
+
+		toa.auditDecision(req, subject, logging.AuditResultAllowed, "authorized")
+
+		// In ForwardAuth mode, Traefik copies the identity headers from our response to the backend request
+		identityHeaders := req.Header
+		if toa.Config.ForwardAuthMode {
+			identityHeaders = rw.Header()
+		}
+
+		// Headers which aren't set from the session below must not carry the values of the client
+		toa.stripIdentityHeaders(req)
+
 		// Attach upstream headers
-		err = toa.attachHeaders(req, session, claims)
+		err = toa.attachHeaders(identityHeaders, session, claims)
 		if err != nil {
 			toa.logger.Log(logging.LevelError, "Error while attaching headers: %s", err.Error())
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		toa.attachRoutingHints(identityHeaders, claims)
+
+		if audience := toa.getTokenExchangeAudience(req); audience != "" {
+			exchangedAccessToken, err := toa.getExchangedToken(req.Context(), session.AccessToken, audience)
+			if err != nil {
+				toa.logger.Log(logging.LevelError, "Error while exchanging the access token: %s", err.Error())
+				if toa.writeErrorIfTimedOut(rw, req) {
+					return
+				}
+				http.Error(rw, "Token exchange failed", http.StatusInternalServerError)
+				return
+			}
+
+			identityHeaders.Set(toa.Config.TokenExchange.HeaderName, "Bearer "+exchangedAccessToken)
+		}
+
 		if updateSession {
-			toa.storeSessionAndAttachCookie(session, rw)
+			if err := toa.storeSessionAndAttachCookie(session, rw, req); err != nil {
+				return
+			}
+		}
+
+		if toa.Config.ForwardAuthMode {
+			rw.WriteHeader(http.StatusOK)
+			return
 		}
 
 		// Forward the request
 		toa.sanitizeForUpstream(req)
-		toa.next.ServeHTTP(rw, req)
+		toa.next.ServeHTTP(rw, withoutRequestTimeout(req))
 		return
-	} else {
+	} else if errors.Is(err, errCorruptSession) {
+		toa.logger.Log(logging.LevelWarn, "Clearing corrupt session: %s", err.Error())
+	} else if isExpiredError(err) {
+		toa.logger.Log(logging.LevelInfo, "The session is expired: %s", err.Error())
+	} else if err != nil {
 		toa.logger.Log(logging.LevelInfo, "Verifying token: %s", err.Error())
 	}
 
-	// Clear the session cookie
-	clearChunkedCookie(toa.Config, rw, req, getSessionCookieName(toa.Config))
+	// The session may still be valid, so it must not be cleared
+	if toa.writeErrorIfTimedOut(rw, req) {
+		return
+	}
+
+	// Clear the session cookie, but never on background requests which should not touch any cookies
+	if !toa.isXhrOnlyRequest(req) {
+		if errors.Is(err, errCorruptSession) {
+			toa.clearAllPluginCookies(rw, req)
+		} else {
+			clearChunkedCookie(toa.logger, toa.Config, rw, req, getSessionCookieName(toa.Config))
+			toa.clearClaimCookie(rw, req)
+		}
+	}
+
+	if errors.Is(err, errCorruptSession) {
+		toa.auditDecision(req, "", logging.AuditResultUnauthenticated, "corrupt session")
+	} else if isExpiredError(err) {
+		toa.auditDecision(req, "", logging.AuditResultUnauthenticated, "expired session")
+	} else if err != nil {
+		toa.auditDecision(req, "", logging.AuditResultUnauthenticated, "invalid session")
+	} else {
+		toa.auditDecision(req, "", logging.AuditResultUnauthenticated, "no session")
+	}
+
+	if errors.Is(err, errCorruptSession) && toa.Config.CorruptSessionBehavior == "Error" {
+		toa.writeCorruptSessionError(rw, req, err)
+		return
+	}
+
+	// The refresh endpoint is called by scripts, which can't follow a redirect to the provider
+	if toa.isRefreshRequest(req) {
+		toa.writeUnauthenticatedError(rw, req, err)
+		return
+	}
+
+	toa.handleUnauthenticated(rw, req, err)
+}
+
+// Records the authorization decision of a request in the audit log.
+// Only the subject is passed, tokens and claims must never end up in there.
+func (toa *TraefikOidcAuth) auditDecision(req *http.Request, subject string, result string, reason string) {
+	if toa.auditLogger == nil || !toa.auditLogger.Enabled {
+		return
+	}
 
-	toa.handleUnauthenticated(rw, req)
+	toa.auditLogger.Log(&logging.AuditEvent{
+		Subject: subject,
+		Route:   req.Method + " " + utils.GetFullHost(req) + req.URL.Path,
+		Result:  result,
+		Reason:  reason,
+	})
 }
 
 func (toa *TraefikOidcAuth) sanitizeForUpstream(req *http.Request) {
@@ -188,7 +437,7 @@ func (toa *TraefikOidcAuth) sanitizeForUpstream(req *http.Request) {
 	keepCookies := make([]*http.Cookie, 0)
 
 	for _, c := range req.Cookies() {
-		if !strings.HasPrefix(c.Name, toa.Config.CookieNamePrefix) {
+		if !isInternalCookie(toa.Config, c.Name) {
 			keepCookies = append(keepCookies, c)
 		}
 	}
@@ -198,21 +447,47 @@ func (toa *TraefikOidcAuth) sanitizeForUpstream(req *http.Request) {
 	for _, c := range keepCookies {
 		req.AddCookie(c)
 	}
+
+	// The session ticket is internal as well
+	if toa.Config.SessionHeader != nil && toa.Config.SessionHeader.Name != "" {
+		req.Header.Del(toa.Config.SessionHeader.Name)
+	}
+}
+
+// Removes the headers which are set from the session, so a client can't spoof them on requests which are forwarded without one.
+func (toa *TraefikOidcAuth) stripIdentityHeaders(req *http.Request) {
+	for _, header := range toa.Config.Headers {
+		req.Header.Del(header.Name)
+	}
+
+	if toa.Config.TokenExchange != nil && toa.Config.TokenExchange.Enabled {
+		req.Header.Del(toa.Config.TokenExchange.HeaderName)
+	}
+
+	if toa.Config.ExpiresAtHeader != "" {
+		req.Header.Del(toa.Config.ExpiresAtHeader)
+	}
+
+	for _, header := range toa.Config.RoutingHints.Headers {
+		req.Header.Del(header.Name)
+	}
 }
 
-func (toa *TraefikOidcAuth) attachHeaders(req *http.Request, session *session.SessionState, claims map[string]interface{}) error {
+func (toa *TraefikOidcAuth) attachHeaders(headers http.Header, session *session.SessionState, claims map[string]interface{}) error {
 	if toa.Config.Headers != nil {
 		evalContext := make(map[string]interface{})
 
-		evalContext["claims"] = claims
+		evalContext["claims"] = utils.PrepareTemplateClaims(claims)
 		evalContext["accessToken"] = session.AccessToken
 		evalContext["idToken"] = session.IdToken
 		evalContext["refreshToken"] = session.RefreshToken
 
 		for _, header := range toa.Config.Headers {
-			if header.Value != "" {
+			if header.MultiValueClaim != "" {
+				attachMultiValueHeader(headers, header.Name, getClaimByPath(claims, header.MultiValueClaim))
+			} else if header.Value != "" {
 				if header.template == nil {
-					tpl, err := template.New("").Parse(header.Value)
+					tpl, err := template.New("").Funcs(utils.TemplateFuncs()).Parse(header.Value)
 
 					if err != nil {
 						return err
@@ -225,30 +500,137 @@ func (toa *TraefikOidcAuth) attachHeaders(req *http.Request, session *session.Se
 				err := header.template.Execute(&renderedValue, evalContext)
 
 				if err == nil {
-					req.Header.Set(header.Name, renderedValue.String())
+					headers.Set(header.Name, renderedValue.String())
 				} else {
-					req.Header.Set(header.Name, err.Error())
+					headers.Set(header.Name, err.Error())
 				}
 			} else {
-				req.Header.Set(header.Name, "")
+				headers.Set(header.Name, "")
 			}
 		}
 	}
 
+	if toa.Config.ExpiresAtHeader != "" {
+		// Without an expiry of the provider, a value of the client must not be forwarded either
+		headers.Del(toa.Config.ExpiresAtHeader)
+
+		if session.TokenExpiresIn > 0 {
+			expiresAt := session.RefreshedAt.Add(time.Duration(session.TokenExpiresIn) * time.Second)
+			headers.Set(toa.Config.ExpiresAtHeader, strconv.FormatInt(expiresAt.Unix(), 10))
+		}
+	}
+
+	return nil
+}
+
+// Adds the header once per element of an array claim. Other values are added once, and a missing claim omits the header.
+func attachMultiValueHeader(headers http.Header, name string, claim interface{}) {
+	headers.Del(name)
+
+	switch value := claim.(type) {
+	case nil:
+	case []interface{}:
+		for _, element := range value {
+			headers.Add(name, fmt.Sprint(element))
+		}
+	case []string:
+		for _, element := range value {
+			headers.Add(name, element)
+		}
+	case string:
+		headers.Add(name, value)
+	default:
+		headers.Add(name, fmt.Sprint(value))
+	}
+}
+
+// Renders the routing hint headers with the claims. Unlike the identity headers, a header which can't be rendered is omitted.
+func (toa *TraefikOidcAuth) attachRoutingHints(headers http.Header, claims map[string]interface{}) {
+	if len(toa.Config.RoutingHints.Headers) == 0 {
+		return
+	}
+
+	templateClaims := utils.PrepareTemplateClaims(claims)
+
+	for _, header := range toa.Config.RoutingHints.Headers {
+		// A header which isn't rendered must not keep a value of the client
+		headers.Del(header.Name)
+
+		tpl := header.template
+		if tpl == nil {
+			var err error
+			if tpl, err = parseRoutingHintTemplate(header.Value); err != nil {
+				continue
+			}
+		}
+
+		var renderedValue bytes.Buffer
+		if err := tpl.Execute(&renderedValue, templateClaims); err != nil {
+			toa.logger.Log(logging.LevelDebug, "Omitting the routing hint %s: %s", header.Name, err.Error())
+			continue
+		}
+
+		if renderedValue.Len() > 0 {
+			headers.Set(header.Name, renderedValue.String())
+		}
+	}
+}
+
+// Returns the parameters of the callback, which are posted by the provider when the ResponseMode is form_post.
+func (toa *TraefikOidcAuth) getCallbackParameters(req *http.Request) url.Values {
+	if toa.Config.ResponseMode == "form_post" && req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			toa.logger.Log(logging.LevelWarn, "Failed to parse the posted callback: %s", err.Error())
+		}
+
+		return req.PostForm
+	}
+
+	return req.URL.Query()
+}
+
+// Validates the iss parameter of the authorization response (RFC 9207), so the code isn't sent to the wrong provider
+// when the user has been redirected by another one (mix-up attack).
+func (toa *TraefikOidcAuth) validateCallbackIssuer(parameters url.Values) error {
+	validation := toa.Config.Provider.CallbackIssuerValidation
+	if validation == "Disabled" {
+		return nil
+	}
+
+	issuer := parameters.Get("iss")
+	if issuer == "" {
+		if validation == "Required" || toa.DiscoveryDocument.AuthorizationResponseIssParameterSupported {
+			return errors.New("the iss parameter is missing")
+		}
+
+		return nil
+	}
+
+	expectedIssuer := toa.DiscoveryDocument.Issuer
+	if expectedIssuer == "" {
+		expectedIssuer = toa.Config.Provider.ValidIssuer
+	}
+
+	if issuer != expectedIssuer {
+		return fmt.Errorf("expected %s, but got %s", expectedIssuer, issuer)
+	}
+
 	return nil
 }
 
 func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Request) {
-	base64State := req.URL.Query().Get("state")
+	parameters := toa.getCallbackParameters(req)
+
+	base64State := parameters.Get("state")
 	if base64State == "" {
 		toa.logger.Log(logging.LevelWarn, "State on callback request is missing.")
 		http.Error(rw, "State is missing", http.StatusInternalServerError)
 		return
 	}
 
-	state, err := oidc.DecodeState(base64State)
+	state, pendingLogin, err := toa.resolveCallbackState(req, base64State)
 	if err != nil {
-		toa.logger.Log(logging.LevelWarn, "State on callback request is invalid.")
+		toa.logger.Log(logging.LevelWarn, "State on callback request is invalid: %s", err.Error())
 		http.Error(rw, "State is invalid", http.StatusInternalServerError)
 		return
 	}
@@ -256,16 +638,30 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 	redirectUrl := state.RedirectUrl
 
 	if state.Action == "Login" {
-		authCode := req.URL.Query().Get("code")
+		if err := toa.validateCallbackIssuer(parameters); err != nil {
+			toa.logger.Log(logging.LevelWarn, "Callback issuer is invalid: %s", err.Error())
+			http.Error(rw, "Issuer is invalid", http.StatusBadRequest)
+			return
+		}
+
+		authCode := parameters.Get("code")
 		if authCode == "" {
 			toa.logger.Log(logging.LevelWarn, "Code is missing.")
 			http.Error(rw, "Code is missing", http.StatusInternalServerError)
 			return
 		}
 
-		token, err := exchangeAuthCode(toa, req, authCode)
+		codeVerifier := ""
+		if pendingLogin != nil {
+			codeVerifier = pendingLogin.CodeVerifier
+		}
+
+		token, err := exchangeAuthCode(toa, req, authCode, codeVerifier, state.VerifierKey)
 		if err != nil {
 			toa.logger.Log(logging.LevelError, "Exchange Auth Code: %s", err.Error())
+			if toa.writeErrorIfTimedOut(rw, req) {
+				return
+			}
 			http.Error(rw, "Failed to exchange auth code", http.StatusInternalServerError)
 			return
 		}
@@ -291,17 +687,51 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 		var claims map[string]interface{}
 
 		if toa.Config.Provider.TokenValidation == "Introspection" {
-			_, claims, err = toa.introspectToken(usedToken)
+			_, claims, err = toa.introspectToken(req.Context(), usedToken, toa.getExpectedAudience(false))
 		} else {
-			_, claims, err = toa.validateTokenLocally(usedToken)
+			_, claims, err = toa.validateTokenLocally(req.Context(), usedToken, toa.getExpectedAudience(false))
 		}
 
 		if err != nil {
 			toa.logger.Log(logging.LevelError, "Returned token is not valid: %s", err.Error())
+			if toa.writeErrorIfTimedOut(rw, req) {
+				return
+			}
 			http.Error(rw, "Returned token is not valid", http.StatusInternalServerError)
 			return
 		}
 
+		// The hashes can only be trusted, if the signature of the id token has been verified.
+		// Providers may not return an id token at all, if the access token is validated.
+		if toa.Config.Provider.ValidateTokenHashesBool && token.IdToken != "" {
+			if usedToken != token.IdToken {
+				_, _, err = toa.validateTokenLocally(req.Context(), token.IdToken, toa.getExpectedAudience(false))
+			}
+			if err == nil {
+				err = validateIdTokenHashes(token.IdToken, token.AccessToken, authCode)
+			}
+			if err != nil {
+				toa.logger.Log(logging.LevelError, "Returned id token is not valid: %s", err.Error())
+				if toa.writeErrorIfTimedOut(rw, req) {
+					return
+				}
+				http.Error(rw, "Returned token is not valid", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// The audience can only be verified, if the access token has been validated
+		if toa.Config.Provider.TokenValidation == "AccessToken" || toa.Config.Provider.TokenValidation == "Introspection" {
+			err = toa.validateResourceAudience(claims)
+			if err != nil {
+				toa.logger.Log(logging.LevelError, "Returned token is not valid: %s", err.Error())
+				http.Error(rw, "Returned token is not valid", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		claims = toa.applyClaimSources(claims, token.IdToken, token.AccessToken)
+
 		if toa.Config.Provider.UseClaimsFromUserInfoBool {
 			subClaim, ok := claims["sub"].(string)
 			if !ok {
@@ -310,60 +740,111 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 				return
 			}
 
-			userInfoClaims, err := toa.getUserInfo(token.AccessToken, subClaim)
+			userInfoClaims, err := toa.getUserInfo(req.Context(), token.AccessToken, subClaim)
 			if err != nil {
 				toa.logger.Log(logging.LevelError, "failed to fetch UserInfo: %s", err.Error())
+				if toa.writeErrorIfTimedOut(rw, req) {
+					return
+				}
 				http.Error(rw, "Failed to fetch UserInfo", http.StatusInternalServerError)
 				return
 			}
 
-			claims = mergeClaims(claims, userInfoClaims)
+			claims = mergeClaims(claims, userInfoClaims, toa.Config.Provider.PreferTokenClaimsBool)
 		}
 
 		toa.logger.Log(logging.LevelInfo, "Exchange Auth Code completed. Token: %+v", redactedToken)
 
-		isAuthorized := isAuthorized(toa.logger, toa.Config.Authorization, claims)
+		authorizationErr := toa.checkAuthorization(req.Context(), claims)
+		isAuthorized := authorizationErr == nil
+
+		// Without a decision, the authorization is checked again on the next request
+		authorizedAt := time.Now()
+		if isFailedAuthorization(authorizationErr) {
+			authorizedAt = time.Time{}
+		}
+
+		if !isAuthorized && toa.writeErrorIfTimedOut(rw, req) {
+			return
+		}
+
+		// Never continue a session which existed before the login, it may have been planted by an attacker
+		toa.deletePreLoginSession(req)
 
 		session := &session.SessionState{
 			Id:             session.GenerateSessionId(),
+			Subject:        toa.getSessionSubject(claims),
+			CreatedAt:      time.Now(),
 			RefreshedAt:    time.Now(),
 			AccessToken:    token.AccessToken,
 			IdToken:        token.IdToken,
 			RefreshToken:   token.RefreshToken,
 			IsAuthorized:   isAuthorized,
+			AuthorizedAt:   authorizedAt,
 			TokenExpiresIn: token.ExpiresIn,
+			Fingerprint:    toa.getClientFingerprint(req),
+		}
+
+		if err := toa.storeSessionAndAttachCookie(session, rw, req); err != nil {
+			return
 		}
 
-		toa.storeSessionAndAttachCookie(session, rw)
+		toa.limitSessionsPerSubject(session.Subject)
+
+		toa.setClaimCookie(rw, req, session, claims)
 
 		http.SetCookie(rw, &http.Cookie{
-			Name:     getCodeVerifierCookieName(toa.Config),
+			Name:     getStateCodeVerifierCookieName(toa.Config, state.VerifierKey),
 			Value:    "",
 			Expires:  time.Now().Add(-24 * time.Hour),
 			MaxAge:   -1,
 			Secure:   true,
 			HttpOnly: true,
-			Path:     toa.CallbackURL.Path,
+			Path:     toa.getCodeVerifierCookiePath(),
 			Domain:   toa.CallbackURL.Host,
 			SameSite: http.SameSiteDefaultMode,
 		})
 
+		if pendingLogin != nil {
+			pendingLoginCookie := toa.createPendingLoginCookie(base64State)
+			pendingLoginCookie.Value = ""
+			http.SetCookie(rw, makeCookieExpireImmediately(pendingLoginCookie))
+		}
+
 		if redirectUrl != "" {
 			redirectUrl = utils.EnsureAbsoluteUrl(req, redirectUrl)
 		} else {
-			redirectUrl = utils.EnsureAbsoluteUrl(req, toa.Config.PostLoginRedirectUri)
+			redirectUrl = toa.getPostLoginRedirectUrl(req, claims)
 		}
 
 		if !isAuthorized {
-			toa.handleUnauthorized(rw, req)
+			toa.auditDecision(req, session.Subject, logging.AuditResultDenied, getAuthorizationFailureReason(authorizationErr)+" on login")
+			toa.handleUnauthorized(rw, req, claims, authorizationErr)
 			return
 		}
 
+		toa.auditDecision(req, session.Subject, logging.AuditResultAllowed, "authorized on login")
+
+		if pendingLogin != nil && pendingLogin.Replay != nil {
+			toa.logger.Log(logging.LevelInfo, "Replaying the form submission to %s", pendingLogin.Replay.Url)
+
+			if err := errorPages.WriteReplayPage(toa.logger, rw, pendingLogin.Replay.Url, pendingLogin.Replay.Body); err == nil {
+				return
+			}
+
+			toa.logger.Log(logging.LevelWarn, "Failed to replay the form submission, redirecting instead.")
+		}
+
 	} else if state.Action == "Logout" {
 		toa.logger.Log(logging.LevelDebug, "Post logout. Clearing cookie.")
 
-		// Clear the cookie
-		clearChunkedCookie(toa.Config, rw, req, getSessionCookieName(toa.Config))
+		// Clear the cookies
+		toa.clearAllPluginCookies(rw, req)
+
+		if toa.Config.LogoutPage.IsActive() {
+			toa.writeLogoutPage(rw, req, redirectUrl)
+			return
+		}
 	}
 
 	toa.logger.Log(logging.LevelInfo, "Redirecting to %s", redirectUrl)
@@ -371,6 +852,81 @@ func (toa *TraefikOidcAuth) handleCallback(rw http.ResponseWriter, req *http.Req
 	http.Redirect(rw, req, redirectUrl, http.StatusFound)
 }
 
+// Deletes the session the request carried before the login from the SessionStorage.
+// The session cookie itself is replaced by the new session.
+func (toa *TraefikOidcAuth) deletePreLoginSession(req *http.Request) {
+	sessionTicket, err := toa.readSessionTicket(req)
+	if err != nil || sessionTicket == "" {
+		return
+	}
+
+	plainSessionTicket, err := toa.unprotectSessionTicket(sessionTicket)
+	if err != nil {
+		return
+	}
+
+	if err := toa.SessionStorage.DeleteSession(plainSessionTicket); err != nil {
+		toa.logger.Log(logging.LevelWarn, "Failed to delete the session which existed before the login: %s", err.Error())
+		return
+	}
+
+	toa.logger.Log(logging.LevelDebug, "Deleted the session which existed before the login")
+}
+
+// Removes the oldest sessions of the subject exceeding the SessionStorage.MaxSessionsPerSubject.
+func (toa *TraefikOidcAuth) limitSessionsPerSubject(subject string) {
+	if toa.Config.SessionStorage.MaxSessionsPerSubject < 1 || subject == "" {
+		return
+	}
+
+	if err := toa.SessionStorage.LimitSessionsPerSubject(subject, toa.Config.SessionStorage.MaxSessionsPerSubject); err != nil {
+		toa.logger.Log(logging.LevelWarn, "Failed to limit the sessions of subject %s: %s", subject, err.Error())
+	}
+}
+
+// In ForwardAuthMode, the refresh endpoint is the path of the original request.
+func (toa *TraefikOidcAuth) isRefreshRequest(req *http.Request) bool {
+	return toa.Config.RefreshUri != "" && strings.HasPrefix(toa.getOriginalRequestUri(req), toa.Config.RefreshUri)
+}
+
+// Renews the tokens of the session on demand and responds with their new expiration.
+func (toa *TraefikOidcAuth) handleRefresh(rw http.ResponseWriter, req *http.Request, session *session.SessionState, alreadyRenewed bool) {
+	if session.RefreshToken == "" {
+		http.Error(rw, "The session has no refresh token", http.StatusBadRequest)
+		return
+	}
+
+	// The tokens may just have been renewed while reading the session
+	if !alreadyRenewed {
+		if _, err := toa.renewSession(req.Context(), session); err != nil {
+			toa.logger.Log(logging.LevelError, "Error while renewing the tokens: %s", err.Error())
+			if toa.writeErrorIfTimedOut(rw, req) {
+				return
+			}
+			// The session can't be renewed anymore, so the script must start a new login
+			if errors.Is(err, errRefreshTokenRejected) {
+				clearChunkedCookie(toa.logger, toa.Config, rw, req, getSessionCookieName(toa.Config))
+				toa.clearClaimCookie(rw, req)
+				toa.writeUnauthenticatedError(rw, req, fmt.Errorf("%w: %s", errSessionExpired, err.Error()))
+				return
+			}
+			http.Error(rw, "Token renewal failed", http.StatusBadGateway)
+			return
+		}
+	}
+
+	if err := toa.storeSessionAndAttachCookie(session, rw, req); err != nil {
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"expires_in": session.TokenExpiresIn,
+		"expires_at": session.RefreshedAt.Add(time.Duration(session.TokenExpiresIn) * time.Second).Unix(),
+	})
+}
+
 func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Request, session *session.SessionState) {
 	toa.logger.Log(logging.LevelInfo, "Logging out...")
 
@@ -384,7 +940,7 @@ func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Reque
 	}
 
 	callbackUri := toa.GetAbsoluteCallbackURL(req).String()
-	redirectUri := utils.EnsureAbsoluteUrl(req, toa.Config.PostLogoutRedirectUri)
+	redirectUri := utils.EnsureAbsoluteUrl(toa.withForcedHttps(req), toa.Config.PostLogoutRedirectUri)
 
 	redirectUriFromQuery := req.URL.Query().Get("redirect_uri")
 	if redirectUriFromQuery == "" {
@@ -400,7 +956,7 @@ func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Reque
 		}
 
 		if redirectUriFromQuery != "" {
-			redirectUri = utils.EnsureAbsoluteUrl(req, redirectUriFromQuery)
+			redirectUri = utils.EnsureAbsoluteUrl(toa.withForcedHttps(req), redirectUriFromQuery)
 		}
 	}
 
@@ -426,50 +982,204 @@ func (toa *TraefikOidcAuth) handleLogout(rw http.ResponseWriter, req *http.Reque
 	http.Redirect(rw, req, endSessionURL.String(), http.StatusFound)
 }
 
-func (toa *TraefikOidcAuth) handleUnauthenticated(rw http.ResponseWriter, req *http.Request) {
+// Creates the data for the error and logout page templates, including the theme.
+func (toa *TraefikOidcAuth) newPageData() map[string]interface{} {
+	data := make(map[string]interface{})
+
+	if toa.Config.ErrorPages != nil {
+		data["theme"] = toa.Config.ErrorPages.Theme.TemplateData()
+		data["problemContentType"] = toa.Config.ErrorPages.ProblemContentType
+	}
+
+	return data
+}
+
+func (toa *TraefikOidcAuth) writeLogoutPage(rw http.ResponseWriter, req *http.Request, redirectUrl string) {
+	data := toa.newPageData()
+
+	data["statusName"] = "Logged out"
+	data["description"] = "You have been logged out successfully."
+	data["primaryButtonText"] = "Sign in"
+
+	if toa.Config.LoginUri != "" {
+		data["primaryButtonUrl"] = utils.EnsureAbsoluteUrl(req, toa.Config.LoginUri)
+	} else {
+		data["primaryButtonUrl"] = redirectUrl
+	}
+
+	errorPages.WriteLogoutPage(toa.logger, toa.Config.LogoutPage, rw, req, data)
+}
+
+// The error explains why the request is not authenticated, eg. because the token is missing, invalid or expired.
+// It may be nil.
+func (toa *TraefikOidcAuth) handleUnauthenticated(rw http.ResponseWriter, req *http.Request, err error) {
+	if toa.isStatusOnlyRequest(req) {
+		errorPages.WriteStatusCode(toa.Config.ErrorPages.Unauthenticated, rw, http.StatusUnauthorized)
+		return
+	}
+
+	if toa.isXhrOnlyRequest(req) {
+		toa.writeUnauthenticatedError(rw, req, err)
+		return
+	}
+
 	switch toa.Config.UnauthorizedBehavior {
 	case "Challenge":
 		// Redirect to Identity Provider
-		toa.redirectToProvider(rw, req)
+		toa.redirectToProvider(rw, req, getLoginTrigger(err))
 	case "Unauthorized":
 		// Respond with 401 Unauthorized
-		toa.writeUnauthenticatedError(rw, req)
+		toa.writeUnauthenticatedError(rw, req, err)
 	case "Auto":
-		if utils.IsHtmlRequest(req) {
+		if toa.isHtmlRequest(req) {
 			// Redirect to Identity Provider for HTML requests
-			toa.redirectToProvider(rw, req)
+			toa.redirectToProvider(rw, req, getLoginTrigger(err))
 		} else {
 			// Respond with 401 Unauthorized for non-HTML requests
-			toa.writeUnauthenticatedError(rw, req)
+			toa.writeUnauthenticatedError(rw, req, err)
 		}
 	default:
 		// Respond with 401 Unauthorized as a fallback
-		toa.writeUnauthenticatedError(rw, req)
+		toa.writeUnauthenticatedError(rw, req, err)
 	}
 }
 
-func (toa *TraefikOidcAuth) writeUnauthenticatedError(rw http.ResponseWriter, req *http.Request) {
-	data := make(map[string]interface{})
+// Requests without an Accept header are ambiguous, they are treated as browser requests if DefaultToHtmlOnMissingAccept is enabled.
+func (toa *TraefikOidcAuth) isHtmlRequest(req *http.Request) bool {
+	return utils.IsHtmlRequest(toa.withDefaultAccept(req))
+}
+
+// Writes an error page using the content type negotiated with the request.
+func (toa *TraefikOidcAuth) writeError(page *errorPages.ErrorPageConfig, rw http.ResponseWriter, req *http.Request, data map[string]interface{}) {
+	errorPages.WriteError(toa.logger, page, rw, toa.withDefaultAccept(req), data)
+}
+
+// Returns a copy of the request which accepts HTML, if it doesn't have an Accept header and DefaultToHtmlOnMissingAccept is enabled.
+// The original request is not modified, because it may still be forwarded upstream.
+func (toa *TraefikOidcAuth) withDefaultAccept(req *http.Request) *http.Request {
+	if !toa.Config.DefaultToHtmlOnMissingAccept || req.Header.Get("Accept") != "" {
+		return req
+	}
+
+	htmlReq := req.Clone(req.Context())
+	htmlReq.Header.Set("Accept", "text/html")
+
+	return htmlReq
+}
+
+// Background requests of SPAs should neither be redirected nor receive cookies, but a 401 JSON response.
+func (toa *TraefikOidcAuth) isXhrOnlyRequest(req *http.Request) bool {
+	return toa.Config.XhrRequestBehavior == "Unauthorized" && utils.IsXhrRequest(req)
+}
+
+// HEAD requests, eg. from uptime monitors, should neither be redirected nor receive an error page.
+func (toa *TraefikOidcAuth) isStatusOnlyRequest(req *http.Request) bool {
+	return req.Method == http.MethodHead && toa.Config.HeadRequestBehavior != "Default"
+}
+
+func (toa *TraefikOidcAuth) writeUnauthenticatedError(rw http.ResponseWriter, req *http.Request, err error) {
+	data := toa.newPageData()
 
 	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.2"
 	data["statusCode"] = http.StatusUnauthorized
 	data["statusName"] = "Unauthorized"
 	data["description"] = "You're not authorized to access this resource. Please log in to continue."
 
+	if isExpiredError(err) {
+		data["description"] = "Your session has expired. Please log in again to continue."
+	}
+
 	if toa.Config.LoginUri != "" {
 		data["primaryButtonText"] = "Login"
 		data["primaryButtonUrl"] = utils.EnsureAbsoluteUrl(req, toa.Config.LoginUri)
 	}
 
-	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Unauthenticated, rw, req, data)
+	if toa.isXhrOnlyRequest(req) || toa.isRefreshRequest(req) {
+		errorPages.WriteProblemDetails(toa.logger, toa.Config.ErrorPages.Unauthenticated, rw, data)
+		return
+	}
+
+	toa.writeError(toa.Config.ErrorPages.Unauthenticated, rw, req, data)
 }
 
-func (toa *TraefikOidcAuth) handleUnauthorized(rw http.ResponseWriter, req *http.Request) {
-	toa.writeUnauthorizedError(rw, req)
+func (toa *TraefikOidcAuth) writeCorruptSessionError(rw http.ResponseWriter, req *http.Request, err error) {
+	data := toa.newPageData()
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.1"
+	data["statusCode"] = http.StatusBadRequest
+	data["statusName"] = "Bad Request"
+	data["description"] = fmt.Sprintf("Your session is corrupt and has been cleared. Reload the page to log in again.\n%s", err.Error())
+
+	toa.writeError(&errorPages.ErrorPageConfig{}, rw, req, data)
 }
 
-func (toa *TraefikOidcAuth) writeUnauthorizedError(rw http.ResponseWriter, req *http.Request) {
-	data := make(map[string]interface{})
+func (toa *TraefikOidcAuth) writeSessionTooLargeError(rw http.ResponseWriter, req *http.Request) {
+	data := toa.newPageData()
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.1"
+	data["statusCode"] = http.StatusInternalServerError
+	data["statusName"] = "Internal Server Error"
+	data["description"] = "Your session is too large to be stored in cookies.\nPlease contact the administrator, who may need to increase MaxCookieChunks or SessionStorage.MaxSize, enable SessionStorage.OverflowToMemory or request fewer scopes and claims."
+
+	toa.writeError(&errorPages.ErrorPageConfig{}, rw, req, data)
+}
+
+func (toa *TraefikOidcAuth) writeRedirectLoopError(rw http.ResponseWriter, req *http.Request) {
+	data := toa.newPageData()
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.1"
+	data["statusCode"] = http.StatusInternalServerError
+	data["statusName"] = "Internal Server Error"
+	data["description"] = "The login was aborted, because you have been redirected to the identity provider too many times without receiving a valid session.\n" +
+		"This usually means your browser doesn't send back the session cookie. Please contact the administrator. " +
+		"The most common cause is a Secure cookie on a site served over plain HTTP, or a cookie Domain or Path which doesn't match the site."
+
+	toa.writeError(&errorPages.ErrorPageConfig{}, rw, req, data)
+}
+
+func (toa *TraefikOidcAuth) writeTooManyRequestsError(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Retry-After", strconv.Itoa(toa.rateLimiter.RetryAfter()))
+
+	data := toa.newPageData()
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc6585#section-4"
+	data["statusCode"] = http.StatusTooManyRequests
+	data["statusName"] = "Too Many Requests"
+	data["description"] = "You have sent too many requests in a given amount of time.\nPlease wait a moment and try again."
+
+	toa.writeError(&errorPages.ErrorPageConfig{}, rw, req, data)
+}
+
+// The claims are those of the valid token which is not authorized.
+// The error explains why, if the authorization has been checked on this request. It may be nil.
+func (toa *TraefikOidcAuth) handleUnauthorized(rw http.ResponseWriter, req *http.Request, claims map[string]interface{}, err error) {
+	if toa.isStatusOnlyRequest(req) {
+		errorPages.WriteStatusCode(toa.Config.ErrorPages.Unauthorized, rw, http.StatusForbidden)
+		return
+	}
+
+	toa.writeUnauthorizedError(rw, req, claims, err)
+}
+
+func (toa *TraefikOidcAuth) writeUnauthorizedError(rw http.ResponseWriter, req *http.Request, claims map[string]interface{}, err error) {
+	data := toa.newPageData()
+
+	if instance := toa.getErrorInstance(claims); instance != "" {
+		data["instance"] = instance
+	}
+
+	// Only available to custom templates, the default pages and problem details never contain them
+	if err != nil {
+		data["authorizationReason"] = getAuthorizationFailureReason(err)
+
+		if claim := getAuthorizationFailureClaim(err); claim != "" {
+			data["claimName"] = claim
+
+			if toa.Config.ErrorPages != nil && toa.Config.ErrorPages.ExposeClaimValues {
+				data["claimValue"] = sanitizeClaimValue(getClaimByPath(claims, claim))
+			}
+		}
+	}
 
 	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.5.4"
 	data["statusCode"] = http.StatusForbidden
@@ -484,13 +1194,100 @@ func (toa *TraefikOidcAuth) writeUnauthorizedError(rw http.ResponseWriter, req *
 	data["secondaryButtonText"] = "Logout"
 	data["secondaryButtonUrl"] = utils.EnsureAbsoluteUrl(req, toa.Config.LogoutUri)
 
-	errorPages.WriteError(toa.logger, toa.Config.ErrorPages.Unauthorized, rw, req, data)
+	toa.writeError(toa.Config.ErrorPages.Unauthorized, rw, req, data)
 }
 
-func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http.Request) {
+const maxErrorClaimValueLength = 256
+
+// Formats a claim for an error page. Control characters are removed and long values are truncated.
+func sanitizeClaimValue(value interface{}) string {
+	var formatted string
+	switch val := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(val))
+		for i, item := range val {
+			items[i] = fmt.Sprint(item)
+		}
+		formatted = strings.Join(items, ", ")
+	default:
+		formatted = fmt.Sprint(val)
+	}
+
+	formatted = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, formatted)
+
+	if runes := []rune(formatted); len(runes) > maxErrorClaimValueLength {
+		formatted = string(runes[:maxErrorClaimValueLength]) + "..."
+	}
+
+	return formatted
+}
+
+// Returns the hashed value of the ErrorPages.InstanceClaim, or an empty string if it's not configured or missing.
+// It's hashed the same way as the subject in the audit log, so both can be correlated.
+func (toa *TraefikOidcAuth) getErrorInstance(claims map[string]interface{}) string {
+	if toa.Config.ErrorPages == nil || toa.Config.ErrorPages.InstanceClaim == "" {
+		return ""
+	}
+
+	value, ok := claims[toa.Config.ErrorPages.InstanceClaim].(string)
+	if !ok || value == "" {
+		return ""
+	}
+
+	return logging.HashSubject(value)
+}
+
+// The reasons a login can be started for. They decide which Prompt is sent to the provider.
+const (
+	loginTriggerLogin            = "Login"
+	loginTriggerReauthentication = "Reauthentication"
+	loginTriggerSilent           = "Silent"
+)
+
+// A prompt passed on the request, eg. by the "Login with a different account" button, takes precedence.
+func (toa *TraefikOidcAuth) getPrompt(req *http.Request, trigger string) string {
+	prompt := req.URL.Query().Get("prompt")
+
+	if prompt == "" {
+		switch trigger {
+		case loginTriggerReauthentication:
+			prompt = toa.Config.Prompt.Reauthentication
+		case loginTriggerSilent:
+			prompt = toa.Config.Prompt.Silent
+		default:
+			prompt = toa.Config.Prompt.Login
+		}
+	}
+
+	if toa.Config.Prompt.ForceAccountSelection {
+		values := strings.Fields(prompt)
+
+		if !slices.Contains(values, "none") && !slices.Contains(values, "select_account") {
+			prompt = strings.TrimSpace(prompt + " select_account")
+		}
+	}
+
+	return prompt
+}
+
+func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http.Request, trigger string) {
+	if !toa.trackLoginRedirect(rw, req) {
+		toa.writeRedirectLoopError(rw, req)
+		return
+	}
+
 	toa.logger.Log(logging.LevelInfo, "Redirecting to OIDC provider...")
 	var redirectUrl string
 
+	requestUri := toa.getOriginalRequestUri(req)
+
 	// If the user specified one on the /login request, use this one
 	redirectUriFromQuery, err := utils.ValidateRedirectUri(req.URL.Query().Get("redirect_uri"), toa.Config.ValidPostLoginRedirectUris)
 	if err != nil {
@@ -499,16 +1296,19 @@ func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http
 		return
 	}
 
-	if toa.Config.LoginUri != "" && strings.HasPrefix(req.RequestURI, toa.Config.LoginUri) && redirectUriFromQuery != "" {
+	if toa.Config.LoginUri != "" && strings.HasPrefix(requestUri, toa.Config.LoginUri) && redirectUriFromQuery != "" {
 		redirectUrl = redirectUriFromQuery
+	} else if isRedirectTemplate(toa.Config.PostLoginRedirectUri) {
+		// The template is rendered with the claims on the callback
+		redirectUrl = ""
 	} else if toa.Config.PostLoginRedirectUri != "" {
 		redirectUrl = utils.EnsureAbsoluteUrl(req, toa.Config.PostLoginRedirectUri)
 	} else {
 		host := utils.GetFullHost(req)
-		redirectUrl = fmt.Sprintf("%s%s", host, req.RequestURI)
+		redirectUrl = fmt.Sprintf("%s%s", host, requestUri)
 
 		// Special case: If someone just calls /login but doesn't provide a redirect_uri, we go to / instead of /login again.
-		if toa.Config.LoginUri != "" && strings.HasPrefix(req.RequestURI, toa.Config.LoginUri) {
+		if toa.Config.LoginUri != "" && strings.HasPrefix(requestUri, toa.Config.LoginUri) {
 			redirectUrl = host
 		}
 	}
@@ -520,7 +1320,15 @@ func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http
 		RedirectUrl: redirectUrl,
 	}
 
-	stateBase64, err := oidc.EncodeState(&state)
+	if toa.Config.Provider.UsePkceBool && toa.PendingLoginStorage == nil {
+		state.VerifierKey, err = randomBytesInHex(8)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stateBase64, err := toa.encodeLoginState(&state)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Failed to serialize state: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -544,12 +1352,26 @@ func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http
 		"state":         {stateBase64},
 	}
 
-	if prompt := req.URL.Query().Get("prompt"); prompt != "" {
+	for _, resource := range toa.Config.Resources {
+		urlValues.Add("resource", resource)
+	}
+
+	if toa.Config.ResponseMode != "" {
+		urlValues.Add("response_mode", toa.Config.ResponseMode)
+	}
+
+	if prompt := toa.getPrompt(req, trigger); prompt != "" {
 		urlValues.Add("prompt", prompt)
 	}
 
+	if loginHint := toa.getLoginHint(req); loginHint != "" {
+		urlValues.Add("login_hint", loginHint)
+	}
+
+	codeVerifier := ""
+
 	if toa.Config.Provider.UsePkceBool {
-		codeVerifier, err := randomBytesInHex(32)
+		codeVerifier, err = randomBytesInHex(32)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
@@ -565,26 +1387,382 @@ func (toa *TraefikOidcAuth) redirectToProvider(rw http.ResponseWriter, req *http
 		urlValues.Add("code_challenge_method", "S256")
 		urlValues.Add("code_challenge", codeChallenge)
 
-		encryptedCodeVerifier, err := utils.Encrypt(codeVerifier, toa.Config.Secret)
+		// The code verifier is kept with the pending login on the server instead
+		if toa.PendingLoginStorage == nil {
+			encryptedCodeVerifier, err := utils.EncryptWithAlgorithm(codeVerifier, toa.Config.Secret, toa.Config.CookieEncryptionAlgorithm)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// TODO: Make configurable
+			// TODO does this need domain tweaks?  it is in the login flow
+			http.SetCookie(rw, &http.Cookie{
+				Name:     getStateCodeVerifierCookieName(toa.Config, state.VerifierKey),
+				Value:    encryptedCodeVerifier,
+				MaxAge:   toa.getCodeVerifierCookieMaxAge(),
+				Secure:   true,
+				HttpOnly: true,
+				Path:     toa.getCodeVerifierCookiePath(),
+				Domain:   toa.CallbackURL.Host,
+				SameSite: http.SameSiteDefaultMode,
+			})
+		}
+	}
+
+	if toa.PendingLoginStorage != nil {
+		// Every login gets its own random state, so parallel logins don't clobber each other
+		stateKey, err := randomBytesInHex(32)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// TODO: Make configurable
-		// TODO does this need domain tweaks?  it is in the login flow
-		http.SetCookie(rw, &http.Cookie{
-			Name:     getCodeVerifierCookieName(toa.Config),
-			Value:    encryptedCodeVerifier,
-			Secure:   true,
-			HttpOnly: true,
-			Path:     toa.CallbackURL.Path,
-			Domain:   toa.CallbackURL.Host,
-			SameSite: http.SameSiteDefaultMode,
+		err = toa.PendingLoginStorage.StorePendingLogin(stateKey, &session.PendingLogin{
+			RedirectUrl:  redirectUrl,
+			CodeVerifier: codeVerifier,
+			CreatedAt:    time.Now(),
+			Replay:       toa.captureReplayRequest(req),
 		})
+		if err != nil {
+			toa.logger.Log(logging.LevelError, "Failed to store the pending login: %s", err.Error())
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		urlValues.Set("state", stateKey)
+
+		http.SetCookie(rw, toa.createPendingLoginCookie(stateKey))
+	}
+
+	if toa.Config.Provider.UseParBool {
+		if toa.DiscoveryDocument.PushedAuthorizationRequestEndpoint != "" {
+			parResponse, err := toa.pushAuthorizationRequest(req.Context(), urlValues)
+			if err != nil {
+				if toa.writeErrorIfTimedOut(rw, req) {
+					return
+				}
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			urlValues = url.Values{
+				"client_id":   {toa.Config.Provider.ClientId},
+				"request_uri": {parResponse.RequestUri},
+			}
+		} else {
+			toa.logger.Log(logging.LevelWarn, "UsePar is enabled but the provider doesn't specify a pushed_authorization_request_endpoint. Falling back to a regular authorization request.")
+		}
 	}
 
 	authorizationEndpointUrl.RawQuery = urlValues.Encode()
 
-	http.Redirect(rw, req, authorizationEndpointUrl.String(), http.StatusFound)
+	http.Redirect(rw, req, authorizationEndpointUrl.String(), errorPages.GetRedirectStatusCode(toa.Config.LoginRedirectStatusCode))
+}
+
+const maxLoginHintLength = 256
+
+// Redirect urls exceeding the MaxStateSize are kept in memory, but not if they are longer than this.
+// The user is then redirected to the PostLoginRedirectUri instead.
+const maxStoredRedirectUrlLength = 8192
+
+// Returns the form submission of the request, so it can be replayed after the login, or nil if it can't be replayed.
+// Only url-encoded forms up to the MaxBodySize are captured, because the browser must be able to submit them again.
+// The form must have been submitted from the same origin, otherwise another site could get a form submitted on behalf of the user.
+func (toa *TraefikOidcAuth) captureReplayRequest(req *http.Request) *session.ReplayRequest {
+	if !toa.Config.PostReplay.Enabled || req.Method != http.MethodPost || req.Body == nil {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+
+	host := utils.GetFullHost(req)
+	if req.Header.Get("Sec-Fetch-Site") != "same-origin" && req.Header.Get("Origin") != host {
+		toa.logger.Log(logging.LevelDebug, "Not capturing the form submission, because it doesn't come from the same origin.")
+		return nil
+	}
+
+	maxBodySize := int64(toa.Config.PostReplay.MaxBodySize)
+	if req.ContentLength > maxBodySize {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	if err != nil || int64(len(body)) > maxBodySize {
+		return nil
+	}
+
+	return &session.ReplayRequest{
+		Url:  host + toa.getOriginalRequestUri(req),
+		Body: string(body),
+	}
+}
+
+// Encodes the state of a login. If it exceeds the SessionStorage.MaxStateSize, the redirect URL is stored
+// on the server and only its key is encoded.
+func (toa *TraefikOidcAuth) encodeLoginState(state *oidc.OidcState) (string, error) {
+	stateBase64, err := oidc.EncodeState(state)
+	if err != nil || toa.RedirectUrlStorage == nil || toa.PendingLoginStorage != nil || len(stateBase64) <= toa.Config.SessionStorage.MaxStateSize {
+		return stateBase64, err
+	}
+
+	if len(state.RedirectUrl) > maxStoredRedirectUrlLength {
+		toa.logger.Log(logging.LevelDebug, "The redirect url exceeds %d bytes. Redirecting to the PostLoginRedirectUri after the login instead.", maxStoredRedirectUrlLength)
+
+		return oidc.EncodeState(&oidc.OidcState{
+			Action:      state.Action,
+			VerifierKey: state.VerifierKey,
+			IssuedAt:    state.IssuedAt,
+		})
+	}
+
+	redirectKey, err := randomBytesInHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := toa.RedirectUrlStorage.StorePendingLogin(redirectKey, &session.PendingLogin{RedirectUrl: state.RedirectUrl}); err != nil {
+		return "", err
+	}
+
+	toa.logger.Log(logging.LevelDebug, "The state exceeds %d bytes. Storing the redirect url on the server.", toa.Config.SessionStorage.MaxStateSize)
+
+	return oidc.EncodeState(&oidc.OidcState{
+		Action:      state.Action,
+		RedirectKey: redirectKey,
+		VerifierKey: state.VerifierKey,
+		IssuedAt:    state.IssuedAt,
+	})
+}
+
+// Returns the state of the callback. If pending logins are stored on the server, the state parameter is
+// the key of the pending login, which is removed so it can't be used twice. Otherwise, or for logouts,
+// the state is encoded in the parameter itself.
+func (toa *TraefikOidcAuth) resolveCallbackState(req *http.Request, stateParameter string) (*oidc.OidcState, *session.PendingLogin, error) {
+	// The pending login is only used by the browser which started it, otherwise the callback url of
+	// another login could be used to log the user into that account. It isn't taken either, so it remains usable.
+	if toa.PendingLoginStorage != nil && toa.isPendingLoginOfBrowser(req, stateParameter) {
+		pendingLogin, err := toa.PendingLoginStorage.TakePendingLogin(stateParameter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if pendingLogin != nil {
+			return &oidc.OidcState{
+				Action:      "Login",
+				RedirectUrl: pendingLogin.RedirectUrl,
+			}, pendingLogin, nil
+		}
+	}
+
+	state, err := oidc.DecodeState(stateParameter)
+	if err != nil {
+		if toa.PendingLoginStorage != nil {
+			return nil, nil, errors.New("unknown pending login or it has been started by another browser")
+		}
+		return nil, nil, err
+	}
+
+	// Logins must be known to the server
+	if toa.PendingLoginStorage != nil && state.Action == "Login" {
+		return nil, nil, errors.New("unknown or expired pending login")
+	}
+
+	if toa.Config.StateTtl > 0 && state.IsOlderThan(time.Duration(toa.Config.StateTtl)*time.Second) {
+		return nil, nil, fmt.Errorf("the state is older than the StateTtl of %ds", toa.Config.StateTtl)
+	}
+
+	if state.RedirectKey != "" {
+		if toa.RedirectUrlStorage == nil {
+			return nil, nil, errors.New("the state refers to a stored redirect url, but there is no storage")
+		}
+
+		stored, err := toa.RedirectUrlStorage.TakePendingLogin(state.RedirectKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if stored == nil {
+			return nil, nil, errors.New("unknown or expired redirect url")
+		}
+
+		state.RedirectUrl = stored.RedirectUrl
+	}
+
+	return state, nil, nil
+}
+
+// Returns the PostLoginRedirectUri. If it is a template, it's rendered with the claims of the user,
+// eg. https://{{ .claims.tenant }}.example.com/, and must match one of the ValidPostLoginRedirectUris.
+// If rendering fails, the user is redirected to the root of the current host instead.
+func (toa *TraefikOidcAuth) getPostLoginRedirectUrl(req *http.Request, claims map[string]interface{}) string {
+	if toa.Config.postLoginRedirectTemplate == nil {
+		return utils.EnsureAbsoluteUrl(req, toa.Config.PostLoginRedirectUri)
+	}
+
+	fallbackUrl := utils.GetFullHost(req)
+
+	evalContext := map[string]interface{}{
+		"claims": utils.PrepareTemplateClaims(claims),
+	}
+
+	var renderedValue bytes.Buffer
+	if err := toa.Config.postLoginRedirectTemplate.Execute(&renderedValue, evalContext); err != nil {
+		toa.logger.Log(logging.LevelWarn, "Failed to render the PostLoginRedirectUri: %s", err.Error())
+		return fallbackUrl
+	}
+
+	redirectUrl, err := utils.ValidateRedirectUri(renderedValue.String(), toa.Config.ValidPostLoginRedirectUris)
+	if err != nil || redirectUrl == "" {
+		toa.logger.Log(logging.LevelWarn, "The rendered PostLoginRedirectUri %s doesn't match any of the ValidPostLoginRedirectUris.", renderedValue.String())
+		return fallbackUrl
+	}
+
+	return utils.EnsureAbsoluteUrl(req, redirectUrl)
+}
+
+// Counts the consecutive redirects to the provider in a short-lived cookie.
+// Returns false when MaxLoginRedirects is exceeded, which means we are stuck in a login loop.
+func (toa *TraefikOidcAuth) trackLoginRedirect(rw http.ResponseWriter, req *http.Request) bool {
+	if toa.Config.MaxLoginRedirects <= 0 {
+		return true
+	}
+
+	cookieName := getLoginAttemptsCookieName(toa.Config)
+
+	attempts := 0
+	if cookie, err := req.Cookie(cookieName); err == nil {
+		attempts, _ = strconv.Atoi(cookie.Value)
+	}
+
+	if attempts >= toa.Config.MaxLoginRedirects {
+		toa.logger.Log(logging.LevelError, "Detected a login loop after %d redirects to the provider without a valid session. Check the SessionCookie settings, eg. Secure cookies require HTTPS.", attempts)
+
+		// Reset the counter, so the user can retry after the problem is fixed
+		toa.clearLoginRedirects(rw, req)
+		return false
+	}
+
+	// This cookie is intentionally not Secure, so the detection also works when a Secure session cookie is served over HTTP.
+	http.SetCookie(rw, &http.Cookie{
+		Name:     cookieName,
+		Value:    strconv.Itoa(attempts + 1),
+		MaxAge:   120,
+		Path:     "/",
+		Domain:   toa.Config.SessionCookie.Domain,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return true
+}
+
+func (toa *TraefikOidcAuth) clearLoginRedirects(rw http.ResponseWriter, req *http.Request) {
+	if _, err := req.Cookie(getLoginAttemptsCookieName(toa.Config)); err != nil {
+		return
+	}
+
+	http.SetCookie(rw, makeCookieExpireImmediately(&http.Cookie{
+		Name:     getLoginAttemptsCookieName(toa.Config),
+		Value:    "",
+		Path:     "/",
+		Domain:   toa.Config.SessionCookie.Domain,
+		HttpOnly: true,
+	}))
+}
+
+// Expires the session cookie and every other cookie of the plugin the browser sent, eg. the code verifier
+// and the login attempts.
+func (toa *TraefikOidcAuth) clearAllPluginCookies(rw http.ResponseWriter, req *http.Request) {
+	sessionCookieName := getSessionCookieName(toa.Config)
+
+	clearChunkedCookie(toa.logger, toa.Config, rw, req, sessionCookieName)
+	toa.clearClaimCookie(rw, req)
+
+	claimCookieName := ""
+	if toa.Config.ClaimCookie != nil && toa.Config.ClaimCookie.Claim != "" {
+		claimCookieName = getClaimCookieName(toa.Config)
+	}
+
+	for _, c := range req.Cookies() {
+		// The session and claim cookies have already been cleared, including all chunks
+		if c.Name == sessionCookieName || strings.HasPrefix(c.Name, sessionCookieName+".") || c.Name == claimCookieName || !isInternalCookie(toa.Config, c.Name) {
+			continue
+		}
+
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    "",
+			Path:     "/",
+			Domain:   toa.Config.SessionCookie.Domain,
+			HttpOnly: true,
+		}
+
+		// The code verifier and pending login cookies are scoped to the callback
+		if isCodeVerifierCookieName(toa.Config, c.Name) || isPendingLoginCookieName(toa.Config, c.Name) {
+			cookie.Path = toa.getCodeVerifierCookiePath()
+			cookie.Domain = toa.CallbackURL.Host
+			cookie.Secure = true
+		}
+
+		http.SetCookie(rw, makeCookieExpireImmediately(cookie))
+	}
+}
+
+// Returns the path and query of the request the user originally made.
+// When running behind Traefik's ForwardAuth, this is passed via the X-Forwarded-Uri header,
+// because the request itself targets the auth endpoint. Values which aren't a plain path are ignored
+// to prevent redirects to other hosts.
+func (toa *TraefikOidcAuth) getOriginalRequestUri(req *http.Request) string {
+	if toa.Config.ForwardAuthMode {
+		forwardedUri := req.Header.Get("X-Forwarded-Uri")
+
+		if strings.HasPrefix(forwardedUri, "/") && !strings.HasPrefix(forwardedUri, "//") && !strings.HasPrefix(forwardedUri, "/\\") {
+			return forwardedUri
+		} else if forwardedUri != "" {
+			toa.logger.Log(logging.LevelWarn, "Ignoring invalid X-Forwarded-Uri header.")
+		}
+	}
+
+	return req.RequestURI
+}
+
+// Reads the login_hint from the configured query parameter or header.
+// The value is escaped when encoding the authorization request, but values which are
+// too long or contain control characters are rejected.
+func (toa *TraefikOidcAuth) getLoginHint(req *http.Request) string {
+	if toa.Config.LoginHint == nil {
+		return ""
+	}
+
+	loginHint := ""
+
+	if toa.Config.LoginHint.QueryParameter != "" {
+		loginHint = req.URL.Query().Get(toa.Config.LoginHint.QueryParameter)
+	}
+	if loginHint == "" && toa.Config.LoginHint.Header != "" {
+		loginHint = req.Header.Get(toa.Config.LoginHint.Header)
+	}
+
+	loginHint = strings.TrimSpace(loginHint)
+
+	if loginHint == "" {
+		return ""
+	}
+
+	if len(loginHint) > maxLoginHintLength {
+		toa.logger.Log(logging.LevelWarn, "Ignoring login_hint because it exceeds %d characters.", maxLoginHintLength)
+		return ""
+	}
+
+	for _, r := range loginHint {
+		if unicode.IsControl(r) {
+			toa.logger.Log(logging.LevelWarn, "Ignoring login_hint because it contains control characters.")
+			return ""
+		}
+	}
+
+	return loginHint
 }
@@ -0,0 +1,2439 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+func newServeHttpTest(t *testing.T) *TraefikOidcAuth {
+	config := CreateConfig()
+	config.Provider.ClientId = "my-client"
+	config.Scopes = []string{"openid"}
+	config.UnauthorizedBehavior = "Challenge"
+
+	callbackUrl, _ := url.Parse(config.CallbackUri)
+
+	return &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("The request should not be forwarded upstream")
+		}),
+		httpClient:     http.DefaultClient,
+		CallbackURL:    callbackUrl,
+		Config:         config,
+		SessionStorage: session.CreateCookieSessionStorage(),
+		DiscoveryDocument: &oidc.OidcDiscovery{
+			AuthorizationEndpoint: "https://idp.example.com/authorize",
+		},
+		Jwks: &oidc.JwksHandler{},
+	}
+}
+
+// Serves a request authenticated by a bearer token with the given claims and returns the headers of the forwarded request.
+func serveAuthenticatedRequest(t *testing.T, toa *TraefikOidcAuth, claims jwt.MapClaims, requestHeaders map[string]string) http.Header {
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forwardedHeaders http.Header
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwardedHeaders = req.Header
+	})
+
+	req := httptest.NewRequest("GET", "https://app.example.com/page", nil)
+	req.Header.Set("Authorization", "Bearer "+signedToken)
+	for name, value := range requestHeaders {
+		req.Header.Set(name, value)
+	}
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if forwardedHeaders == nil {
+		t.Fatalf("Expected the request to be forwarded, but got %d %s", rw.Code, rw.Body.String())
+	}
+
+	return forwardedHeaders
+}
+
+func addGarbledSessionCookies(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.Chunks", Value: "2"})
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.1", Value: "garbled!"})
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.2", Value: "garbled!"})
+}
+
+func expectClearedCookies(t *testing.T, rw *httptest.ResponseRecorder, names ...string) {
+	setCookies := rw.Header().Values("Set-Cookie")
+
+	for _, name := range names {
+		found := false
+		for _, setCookie := range setCookies {
+			if strings.HasPrefix(setCookie, name+"=;") && strings.Contains(setCookie, "Max-Age=0") {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Errorf("Expected cookie %s to be cleared, but got %v", name, setCookies)
+		}
+	}
+}
+
+func TestCorruptSessionRestartsLogin(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	req := httptest.NewRequest("GET", "https://example.com/some/page", nil)
+	addGarbledSessionCookies(req)
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound || !strings.HasPrefix(rw.Header().Get("Location"), "https://idp.example.com/authorize?") {
+		t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	expectClearedCookies(t, rw, "TraefikOidcAuth.Session.Chunks", "TraefikOidcAuth.Session.1", "TraefikOidcAuth.Session.2")
+}
+
+func TestCorruptSessionChunkCountIsCleared(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	req := httptest.NewRequest("GET", "https://example.com/some/page", nil)
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.Chunks", Value: "garbled"})
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session.1", Value: "garbled"})
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, but got %d", rw.Code)
+	}
+
+	expectClearedCookies(t, rw, "TraefikOidcAuth.Session.Chunks", "TraefikOidcAuth.Session.1")
+}
+
+func TestCorruptSessionShowsError(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.CorruptSessionBehavior = "Error"
+
+	req := httptest.NewRequest("GET", "https://example.com/some/page", nil)
+	addGarbledSessionCookies(req)
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusBadRequest, rw.Code)
+	}
+
+	expectClearedCookies(t, rw, "TraefikOidcAuth.Session.Chunks", "TraefikOidcAuth.Session.1", "TraefikOidcAuth.Session.2")
+}
+
+func TestLoginHintIsPassedToProvider(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.LoginHint = &LoginHintConfig{
+		QueryParameter: "login_hint",
+		Header:         "X-Login-Hint",
+	}
+
+	getLoginHint := func(req *http.Request) string {
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if rw.Code != http.StatusFound || err != nil {
+			t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+		}
+
+		return location.Query().Get("login_hint")
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/some/page?login_hint=alice%40example.com%26prompt%3Dnone", nil)
+	if loginHint := getLoginHint(req); loginHint != "alice@example.com&prompt=none" {
+		t.Fatalf("Expected the login_hint from the query, but got %s", loginHint)
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/some/page", nil)
+	req.Header.Set("X-Login-Hint", "bob@example.com")
+	if loginHint := getLoginHint(req); loginHint != "bob@example.com" {
+		t.Fatalf("Expected the login_hint from the header, but got %s", loginHint)
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/some/page?login_hint=alice%0D%0A", nil)
+	if loginHint := getLoginHint(req); loginHint != "alice" {
+		t.Fatalf("Expected surrounding whitespace to be trimmed, but got %s", loginHint)
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/some/page?login_hint=al%00ice", nil)
+	if loginHint := getLoginHint(req); loginHint != "" {
+		t.Fatalf("Expected a login_hint with control characters to be ignored, but got %s", loginHint)
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/some/page?login_hint="+strings.Repeat("a", 257), nil)
+	if loginHint := getLoginHint(req); loginHint != "" {
+		t.Fatalf("Expected a too long login_hint to be ignored, but got %s", loginHint)
+	}
+}
+
+func TestHeadRequestReturnsStatusOnly(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	req := httptest.NewRequest("HEAD", "https://example.com/some/page", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusUnauthorized, rw.Code)
+	}
+	if rw.Header().Get("Location") != "" || rw.Body.Len() != 0 {
+		t.Fatalf("Expected neither a redirect nor a body, but got %s %s", rw.Header().Get("Location"), rw.Body.String())
+	}
+
+	toa.Config.HeadRequestBehavior = "Default"
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected the HEAD request to be redirected, but got %d", rw.Code)
+	}
+}
+
+func TestForwardAuthModeRedirectsToForwardedUri(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	getRedirectUrl := func(req *http.Request) string {
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if rw.Code != http.StatusFound || err != nil {
+			t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+		}
+
+		state, err := oidc.DecodeState(location.Query().Get("state"))
+		if err != nil {
+			t.Fatalf("Failed to decode the state: %s", err.Error())
+		}
+
+		return state.RedirectUrl
+	}
+
+	req := httptest.NewRequest("GET", "/verify", nil)
+	req.Host = "auth.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/some/page?tab=settings&id=42")
+
+	if redirectUrl := getRedirectUrl(req); redirectUrl != "https://app.example.com/verify" {
+		t.Fatalf("Expected the X-Forwarded-Uri to be ignored without ForwardAuthMode, but got %s", redirectUrl)
+	}
+
+	toa.Config.ForwardAuthMode = true
+
+	if redirectUrl := getRedirectUrl(req); redirectUrl != "https://app.example.com/some/page?tab=settings&id=42" {
+		t.Fatalf("Expected the redirect url to include the forwarded uri and query, but got %s", redirectUrl)
+	}
+
+	req.Header.Set("X-Forwarded-Uri", "//evil.example.com/")
+
+	if redirectUrl := getRedirectUrl(req); redirectUrl != "https://app.example.com/verify" {
+		t.Fatalf("Expected an invalid X-Forwarded-Uri to be ignored, but got %s", redirectUrl)
+	}
+}
+
+func TestForwardAuthModeRespondsWithIdentityHeaders(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ForwardAuthMode = true
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+	toa.Config.Headers = []HeaderConfig{
+		{Name: "X-Oidc-Subject", Value: "{{ .claims.sub }}"},
+	}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "https://auth.example.com/verify", nil)
+	req.Header.Set("Authorization", "Bearer "+signedToken)
+	rw := httptest.NewRecorder()
+
+	// The next handler of newServeHttpTest fails the test when called
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d", rw.Code)
+	}
+	if subject := rw.Header().Get("X-Oidc-Subject"); subject != "alice" {
+		t.Fatalf("Expected the identity header on the response, but got %q", subject)
+	}
+}
+
+func TestRedirectLoopIsDetected(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.MaxLoginRedirects = 3
+
+	var attemptsCookie *http.Cookie
+
+	// Simulate a browser which only sends back the attempts cookie, but never a session
+	redirect := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/some/page", nil)
+		req.Header.Set("Accept", "text/html")
+		if attemptsCookie != nil {
+			req.AddCookie(attemptsCookie)
+		}
+
+		rw := httptest.NewRecorder()
+		toa.ServeHTTP(rw, req)
+
+		for _, cookie := range rw.Result().Cookies() {
+			if cookie.Name == "TraefikOidcAuth.LoginAttempts" {
+				attemptsCookie = cookie
+			}
+		}
+
+		return rw
+	}
+
+	for i := 1; i <= 3; i++ {
+		if rw := redirect(); rw.Code != http.StatusFound {
+			t.Fatalf("Expected redirect %d to the provider, but got %d", i, rw.Code)
+		}
+	}
+
+	rw := redirect()
+
+	if rw.Code != http.StatusInternalServerError || rw.Header().Get("Location") != "" {
+		t.Fatalf("Expected the login loop to be detected, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+	if !strings.Contains(rw.Body.String(), "Secure cookie") {
+		t.Fatalf("Expected a diagnostic error page, but got %s", rw.Body.String())
+	}
+	if attemptsCookie.MaxAge >= 0 {
+		t.Fatal("Expected the attempts cookie to be reset")
+	}
+}
+
+func TestPostLoginRedirectTemplate(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.PostLoginRedirectUri = "https://{{ .claims.tenant }}.example.com/"
+	toa.Config.ValidPostLoginRedirectUris = []string{"https://*.example.com/"}
+	toa.Config.postLoginRedirectTemplate, _ = parseRedirectTemplate(toa.Config.PostLoginRedirectUri)
+
+	req := httptest.NewRequest("GET", "https://app.example.com/oidc/callback", nil)
+
+	if redirectUrl := toa.getPostLoginRedirectUrl(req, map[string]interface{}{"tenant": "acme"}); redirectUrl != "https://acme.example.com/" {
+		t.Fatalf("Expected the redirect url to be rendered with the claims, but got %s", redirectUrl)
+	}
+	if redirectUrl := toa.getPostLoginRedirectUrl(req, map[string]interface{}{}); redirectUrl != "https://app.example.com" {
+		t.Fatalf("Expected a missing claim to fall back to the host, but got %s", redirectUrl)
+	}
+	if redirectUrl := toa.getPostLoginRedirectUrl(req, map[string]interface{}{"tenant": "evil.com/x?"}); redirectUrl != "https://app.example.com" {
+		t.Fatalf("Expected an invalid rendered url to fall back to the host, but got %s", redirectUrl)
+	}
+}
+
+func TestConcurrentPendingLogins(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.UsePkceBool = true
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+	toa.PendingLoginStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The code challenge which was sent for each authorization code
+	codeChallenges := make(map[string]string)
+
+	// The cookies of both tabs, as the browser shares them
+	var pendingLoginCookies []*http.Cookie
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		hash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(hash[:]) != codeChallenges[r.PostForm.Get("code")] {
+			http.Error(w, "invalid code_verifier", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	startLogin := func(page string, code string) string {
+		req := httptest.NewRequest("GET", page, nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if rw.Code != http.StatusFound || err != nil {
+			t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+		}
+
+		for _, cookie := range rw.Result().Cookies() {
+			if isCodeVerifierCookieName(toa.Config, cookie.Name) {
+				t.Fatal("Expected the code verifier not to be stored in a cookie")
+			}
+			if isPendingLoginCookieName(toa.Config, cookie.Name) {
+				pendingLoginCookies = append(pendingLoginCookies, cookie)
+			}
+		}
+
+		codeChallenges[code] = location.Query().Get("code_challenge")
+
+		return location.Query().Get("state")
+	}
+
+	completeLogin := func(state string, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/oidc/callback?code="+code+"&state="+url.QueryEscape(state), nil)
+		for _, cookie := range pendingLoginCookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	stateA := startLogin("/page-a", "code-a")
+	stateB := startLogin("/page-b", "code-b")
+
+	if stateA == stateB {
+		t.Fatal("Expected each login to have its own state")
+	}
+
+	// Complete the logins in reverse order
+	if rw := completeLogin(stateB, "code-b"); rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/page-b" {
+		t.Fatalf("Expected login B to complete, but got %d %s %s", rw.Code, rw.Header().Get("Location"), rw.Body.String())
+	}
+	if rw := completeLogin(stateA, "code-a"); rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/page-a" {
+		t.Fatalf("Expected login A to complete, but got %d %s %s", rw.Code, rw.Header().Get("Location"), rw.Body.String())
+	}
+
+	// A pending login can only be used once
+	if rw := completeLogin(stateA, "code-a"); rw.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected a replayed state to be rejected, but got %d", rw.Code)
+	}
+}
+
+func TestPendingLoginIsBoundToTheBrowser(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+	toa.PendingLoginStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "attacker",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	// The attacker starts a login and keeps the callback url
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	state := location.Query().Get("state")
+
+	var pendingLoginCookie *http.Cookie
+	for _, cookie := range rw.Result().Cookies() {
+		if isPendingLoginCookieName(toa.Config, cookie.Name) {
+			pendingLoginCookie = cookie
+		}
+	}
+	if pendingLoginCookie == nil || !pendingLoginCookie.HttpOnly || pendingLoginCookie.Value == state {
+		t.Fatalf("Expected an HttpOnly cookie with a hash of the state, but got %v", pendingLoginCookie)
+	}
+
+	callback := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oidc/callback?code=some-code&state="+url.QueryEscape(state), nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	// The victim opens the callback url without the cookie
+	if rw := callback(nil); rw.Code != http.StatusInternalServerError || !strings.Contains(rw.Body.String(), "State is invalid") {
+		t.Fatalf("Expected the callback without the pending login cookie to fail, but got %d: %s", rw.Code, rw.Body.String())
+	}
+	if rw := callback(&http.Cookie{Name: pendingLoginCookie.Name, Value: hashPendingLoginState("another-state")}); rw.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected the callback with the cookie of another login to fail, but got %d", rw.Code)
+	}
+
+	// The failed callbacks don't use up the pending login of the browser which started it
+	rw = callback(&http.Cookie{Name: pendingLoginCookie.Name, Value: pendingLoginCookie.Value})
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected the callback of the browser which started the login to succeed, but got %d: %s", rw.Code, rw.Body.String())
+	}
+	expectClearedCookies(t, rw, pendingLoginCookie.Name)
+}
+
+func TestConcurrentLoginsWithCodeVerifierCookies(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.UsePkceBool = true
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codeChallenges := make(map[string]string)
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		hash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(hash[:]) != codeChallenges[r.PostForm.Get("code")] {
+			http.Error(w, "invalid code_verifier", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	// The cookies of both tabs, as the browser shares them
+	var codeVerifierCookies []*http.Cookie
+
+	startLogin := func(page string, code string) string {
+		req := httptest.NewRequest("GET", page, nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if rw.Code != http.StatusFound || err != nil {
+			t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+		}
+
+		for _, cookie := range rw.Result().Cookies() {
+			if isCodeVerifierCookieName(toa.Config, cookie.Name) {
+				codeVerifierCookies = append(codeVerifierCookies, cookie)
+			}
+		}
+
+		codeChallenges[code] = location.Query().Get("code_challenge")
+
+		return location.Query().Get("state")
+	}
+
+	completeLogin := func(state string, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/oidc/callback?code="+code+"&state="+url.QueryEscape(state), nil)
+		for _, cookie := range codeVerifierCookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	stateA := startLogin("/page-a", "code-a")
+	stateB := startLogin("/page-b", "code-b")
+
+	if len(codeVerifierCookies) != 2 || codeVerifierCookies[0].Name == codeVerifierCookies[1].Name {
+		t.Fatalf("Expected each login to have its own code verifier cookie, but got %v", codeVerifierCookies)
+	}
+
+	if rw := completeLogin(stateB, "code-b"); rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/page-b" {
+		t.Fatalf("Expected login B to complete, but got %d %s %s", rw.Code, rw.Header().Get("Location"), rw.Body.String())
+	}
+	if rw := completeLogin(stateA, "code-a"); rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/page-a" {
+		t.Fatalf("Expected login A to complete, but got %d %s %s", rw.Code, rw.Header().Get("Location"), rw.Body.String())
+	}
+}
+
+func TestUnauthenticatedAndUnauthorizedStatusCodes(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.UnauthorizedBehavior = "Unauthorized"
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+	toa.Config.Authorization = &AuthorizationConfig{RequiredScopes: []string{"orders:read"}}
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	signToken := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	tests := []struct {
+		name                string
+		token               string
+		expectedStatus      int
+		expectedDescription string
+	}{
+		{
+			name:                "missing token",
+			token:               "",
+			expectedStatus:      http.StatusUnauthorized,
+			expectedDescription: "Please log in to continue.",
+		},
+		{
+			name:                "invalid token",
+			token:               "not-a-token",
+			expectedStatus:      http.StatusUnauthorized,
+			expectedDescription: "Please log in to continue.",
+		},
+		{
+			name:                "expired token",
+			token:               signToken(jwt.MapClaims{"sub": "12345", "scope": "orders:read", "exp": time.Now().Add(-time.Hour).Unix()}),
+			expectedStatus:      http.StatusUnauthorized,
+			expectedDescription: "Your session has expired.",
+		},
+		{
+			name:                "valid token failing authorization",
+			token:               signToken(jwt.MapClaims{"sub": "12345", "scope": "profile", "exp": time.Now().Add(time.Hour).Unix()}),
+			expectedStatus:      http.StatusForbidden,
+			expectedDescription: "not allowed to access this resource",
+		},
+		{
+			name:           "valid and authorized token",
+			token:          signToken(jwt.MapClaims{"sub": "12345", "scope": "orders:read", "exp": time.Now().Add(time.Hour).Unix()}),
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://example.com/api/orders", nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rw := httptest.NewRecorder()
+
+			toa.ServeHTTP(rw, req)
+
+			if rw.Code != test.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d: %s", test.expectedStatus, rw.Code, rw.Body.String())
+			}
+			if !strings.Contains(rw.Body.String(), test.expectedDescription) {
+				t.Fatalf("Expected the description to contain %q, but got %s", test.expectedDescription, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestRateLimitIsPerSubject(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.UnauthorizedBehavior = "Unauthorized"
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+	toa.rateLimiter = utils.CreateRateLimiter(0.001, 2)
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	signToken := func(subject string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	alice := signToken("alice")
+	bob := signToken("bob")
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/api/orders", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := serve(alice); rw.Code != http.StatusOK {
+			t.Fatalf("Expected request %d of alice to be allowed, but got %d", i+1, rw.Code)
+		}
+	}
+
+	rw := serve(alice)
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected alice to be rate limited, but got %d", rw.Code)
+	}
+	if rw.Header().Get("Retry-After") != "1000" {
+		t.Fatalf("Expected a Retry-After header of 1000, but got %q", rw.Header().Get("Retry-After"))
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := serve(bob); rw.Code != http.StatusOK {
+			t.Fatalf("Expected request %d of bob to be allowed, but got %d", i+1, rw.Code)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if rw := serve(""); rw.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected anonymous requests not to be rate limited, but got %d", rw.Code)
+		}
+	}
+}
+
+func TestLoginRotatesSessionId(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	// A session which was planted before the login, eg. by an attacker
+	plantedTicket, _ := storage.StoreSession("planted-id", &session.SessionState{Id: "planted-id", Subject: "attacker", IsAuthorized: true})
+	encryptedPlantedTicket, err := utils.Encrypt(plantedTicket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectUrl: "https://example.com/"})
+
+	req := httptest.NewRequest("GET", "/oidc/callback?code=some-code&state="+url.QueryEscape(state), nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedPlantedTicket})
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected the login to complete, but got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	newTicket := ""
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == getSessionCookieName(toa.Config) {
+			newTicket, err = utils.Decrypt(cookie.Value, toa.Config.Secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if newTicket == "" || newTicket == "planted-id" {
+		t.Fatalf("Expected a fresh session id after the login, but got %q", newTicket)
+	}
+
+	if newSession, _ := storage.TryGetSession(newTicket); newSession == nil || newSession.Id != newTicket || newSession.Subject != "12345" {
+		t.Fatalf("Expected the new session to be stored, but got %+v", newSession)
+	}
+	if plantedSession, _ := storage.TryGetSession("planted-id"); plantedSession != nil {
+		t.Fatal("Expected the pre-login session to be deleted")
+	}
+}
+
+func TestClaimCookieIsReadableByJavaScript(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ClaimCookie = &ClaimCookieConfig{Claim: "name"}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":  "12345",
+		"name": "Jane Doe",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectUrl: "https://example.com/"})
+
+	req := httptest.NewRequest("GET", "/oidc/callback?code=some-code&state="+url.QueryEscape(state), nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected the login to complete, but got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name != getClaimCookieName(toa.Config) {
+			continue
+		}
+
+		if cookie.HttpOnly {
+			t.Error("Expected the claim cookie to be set without HttpOnly")
+		}
+		if cookie.Value != "Jane%20Doe" {
+			t.Errorf("Expected the percent-encoded claim, but got %q", cookie.Value)
+		}
+		return
+	}
+
+	t.Fatalf("Expected a claim cookie, but got %v", rw.Header().Values("Set-Cookie"))
+}
+
+func TestClaimCookieIsClearedWithItsPathAndDomain(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ClaimCookie = &ClaimCookieConfig{Claim: "name"}
+	toa.Config.SessionCookie.Path = "/app"
+	toa.Config.SessionCookie.Domain = "example.com"
+
+	req := httptest.NewRequest("GET", "https://example.com/app/oidc/callback", nil)
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: "ticket"})
+	req.AddCookie(&http.Cookie{Name: getClaimCookieName(toa.Config), Value: "Jane%20Doe"})
+	rw := httptest.NewRecorder()
+
+	toa.clearAllPluginCookies(rw, req)
+
+	cleared := 0
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name != getClaimCookieName(toa.Config) {
+			continue
+		}
+
+		cleared++
+		if cookie.MaxAge >= 0 || cookie.Path != "/app" || cookie.Domain != "example.com" {
+			t.Errorf("Expected the claim cookie to be cleared with the path and domain it has been set with, but got %+v", cookie)
+		}
+	}
+	if cleared != 1 {
+		t.Fatalf("Expected the claim cookie to be cleared once, but got %v", rw.Header().Values("Set-Cookie"))
+	}
+}
+
+func TestFormPostCallbackCreatesSession(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ResponseMode = "form_post"
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	if responseMode := location.Query().Get("response_mode"); responseMode != "form_post" {
+		t.Fatalf("Expected the response_mode to be sent to the provider, but got %q", responseMode)
+	}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receivedCode := ""
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		receivedCode = r.PostForm.Get("code")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectUrl: "https://example.com/"})
+	form := url.Values{"code": {"posted-code"}, "state": {state}}
+
+	req = httptest.NewRequest("POST", "/oidc/callback", strings.NewReader(form.Encode()))
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected the login to complete, but got %d: %s", rw.Code, rw.Body.String())
+	}
+	if receivedCode != "posted-code" {
+		t.Errorf("Expected the posted code to be exchanged, but got %q", receivedCode)
+	}
+
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == getSessionCookieName(toa.Config) && cookie.Value != "" {
+			return
+		}
+	}
+
+	t.Fatalf("Expected a session cookie, but got %v", rw.Header().Values("Set-Cookie"))
+}
+
+func TestFormPostCallbackOfPendingLogin(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ResponseMode = "form_post"
+	toa.Config.Provider.UsePkceBool = true
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+	toa.PendingLoginStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	state := location.Query().Get("state")
+
+	var pendingLoginCookie *http.Cookie
+	for _, cookie := range rw.Result().Cookies() {
+		if isPendingLoginCookieName(toa.Config, cookie.Name) {
+			pendingLoginCookie = cookie
+		}
+	}
+
+	// The provider posts the callback cross-site
+	if pendingLoginCookie == nil || pendingLoginCookie.SameSite != http.SameSiteNoneMode || !pendingLoginCookie.Secure {
+		t.Fatalf("Expected a SameSite=None and Secure pending login cookie, but got %v", pendingLoginCookie)
+	}
+
+	callback := func(cookie *http.Cookie) int {
+		form := url.Values{"code": {"posted-code"}, "state": {state}}
+
+		req := httptest.NewRequest("POST", "/oidc/callback", strings.NewReader(form.Encode()))
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	if code := callback(nil); code != http.StatusInternalServerError {
+		t.Fatalf("Expected the posted callback without the pending login cookie to fail, but got %d", code)
+	}
+	if code := callback(&http.Cookie{Name: pendingLoginCookie.Name, Value: pendingLoginCookie.Value}); code != http.StatusFound {
+		t.Fatalf("Expected the posted callback with the pending login cookie to succeed, but got %d", code)
+	}
+}
+
+func TestCallbackIssuerIsValidated(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.DiscoveryDocument.Issuer = "https://idp.example.com"
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges++
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	serve := func(issuer string) int {
+		state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectUrl: "https://example.com/"})
+		query := url.Values{"code": {"some-code"}, "state": {state}}
+		if issuer != "" {
+			query.Set("iss", issuer)
+		}
+
+		req := httptest.NewRequest("GET", "/oidc/callback?"+query.Encode(), nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	if code := serve("https://attacker.example.com"); code != http.StatusBadRequest || exchanges != 0 {
+		t.Fatalf("Expected a mismatching issuer to be rejected before the code exchange, but got %d with %d exchanges", code, exchanges)
+	}
+	if code := serve("https://idp.example.com"); code != http.StatusFound {
+		t.Fatalf("Expected a matching issuer to be accepted, but got %d", code)
+	}
+	if code := serve(""); code != http.StatusFound {
+		t.Fatalf("Expected a callback without issuer to be accepted, but got %d", code)
+	}
+
+	toa.DiscoveryDocument.AuthorizationResponseIssParameterSupported = true
+	if code := serve(""); code != http.StatusBadRequest {
+		t.Fatalf("Expected a missing issuer to be rejected when the provider announces it, but got %d", code)
+	}
+}
+
+func TestCallbackValidatesTokenHashesOfVerifiedIdTokens(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.TokenValidation = "AccessToken"
+	toa.Config.Provider.ValidateTokenHashesBool = true
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signToken := func(key interface{}, claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	accessToken := signToken(privateKey, jwt.MapClaims{"sub": "12345"})
+	accessTokenHash := sha256.Sum256([]byte(accessToken))
+	atHash := base64.RawURLEncoding.EncodeToString(accessTokenHash[:len(accessTokenHash)/2])
+
+	idToken := ""
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		}
+		if idToken != "" {
+			response["id_token"] = idToken
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	serve := func() int {
+		state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectUrl: "https://example.com/"})
+		query := url.Values{"code": {"some-code"}, "state": {state}}
+
+		req := httptest.NewRequest("GET", "/oidc/callback?"+query.Encode(), nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	if code := serve(); code != http.StatusFound {
+		t.Fatalf("Expected a callback without id token to be accepted, but got %d", code)
+	}
+
+	idToken = signToken(privateKey, jwt.MapClaims{"sub": "12345", "at_hash": atHash})
+	if code := serve(); code != http.StatusFound {
+		t.Fatalf("Expected a verified id token with a matching at_hash to be accepted, but got %d", code)
+	}
+
+	idToken = signToken(otherKey, jwt.MapClaims{"sub": "12345", "at_hash": atHash})
+	if code := serve(); code != http.StatusInternalServerError {
+		t.Fatalf("Expected an id token with an invalid signature to be rejected, but got %d", code)
+	}
+}
+
+func TestRefreshUriRenewsTheSession(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.RefreshUri = "/oidc/refresh"
+	toa.Config.Provider.TokenValidation = "IdToken"
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signToken := func() string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcTokenResponse{
+			AccessToken: "new-access-token",
+			IdToken:     signToken(),
+			ExpiresIn:   7200,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	// Without a session, the endpoint must not redirect
+	req := httptest.NewRequest("GET", "/oidc/refresh", nil)
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusUnauthorized || !strings.Contains(rw.Header().Get("Content-Type"), "json") {
+		t.Fatalf("Expected a 401 JSON response without a session, but got %d %s", rw.Code, rw.Header().Get("Content-Type"))
+	}
+
+	ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+		Id:             "session-id",
+		CreatedAt:      time.Now(),
+		RefreshedAt:    time.Now(),
+		IdToken:        signToken(),
+		RefreshToken:   "refresh-token",
+		IsAuthorized:   true,
+		TokenExpiresIn: 300,
+	})
+	encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET", "/oidc/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+	rw = httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the session to be refreshed, but got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response["expires_in"] != float64(7200) {
+		t.Errorf("Expected the new expiration in the response, but got %v", response["expires_in"])
+	}
+
+	if renewed, _ := storage.TryGetSession("session-id"); renewed == nil || renewed.TokenExpiresIn != 7200 || renewed.AccessToken != "new-access-token" {
+		t.Fatalf("Expected the stored session to be renewed, but got %+v", renewed)
+	}
+}
+
+func TestRefreshUriRenewsTheSessionInForwardAuthModeAfterARecheck(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ForwardAuthMode = true
+	toa.Config.RefreshUri = "/oidc/refresh"
+	toa.Config.Provider.TokenValidation = "IdToken"
+	toa.Config.Provider.UseClaimsFromUserInfoBool = true
+	toa.Config.Authorization.RecheckInterval = 60
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewals := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renewals++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcTokenResponse{
+			AccessToken: "new-access-token",
+			IdToken:     signedToken,
+			ExpiresIn:   7200,
+		})
+	}))
+	defer tokenServer.Close()
+
+	userInfoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"sub": "alice"})
+	}))
+	defer userInfoServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	toa.DiscoveryDocument.UserinfoEndpoint = userInfoServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	// The recheck is due and changes the session, but doesn't renew the tokens
+	ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+		Id:             "session-id",
+		CreatedAt:      time.Now(),
+		RefreshedAt:    time.Now(),
+		IdToken:        signedToken,
+		RefreshToken:   "refresh-token",
+		IsAuthorized:   true,
+		AuthorizedAt:   time.Now().Add(-2 * time.Minute),
+		TokenExpiresIn: 3600,
+	})
+	encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Traefik calls the middleware with the path of the original request in X-Forwarded-Uri
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Uri", "/oidc/refresh")
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the session to be refreshed, but got %d: %s", rw.Code, rw.Body.String())
+	}
+	if renewals != 1 {
+		t.Fatalf("Expected the tokens to be renewed once, but got %d renewals", renewals)
+	}
+	if renewed, _ := storage.TryGetSession("session-id"); renewed == nil || renewed.AccessToken != "new-access-token" {
+		t.Fatalf("Expected the stored session to be renewed, but got %+v", renewed)
+	}
+}
+
+func TestExpiredStateIsRejected(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.StateTtl = 600
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the code not to be redeemed for an expired state")
+	}))
+	defer tokenServer.Close()
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+
+	state, _ := oidc.EncodeState(&oidc.OidcState{
+		Action:      "Login",
+		RedirectUrl: "https://example.com/",
+		IssuedAt:    time.Now().Add(-time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest("GET", "/oidc/callback?code=some-code&state="+url.QueryEscape(state), nil)
+	req.Host = "example.com"
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusInternalServerError || !strings.Contains(rw.Body.String(), "State is invalid") {
+		t.Fatalf("Expected the expired state to be rejected, but got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	// States of previous versions have no timestamp
+	legacyState := base64.RawURLEncoding.EncodeToString([]byte(`{"action":"Login","redirect_url":"https://example.com/"}`))
+	if _, _, err := toa.resolveCallbackState(httptest.NewRequest("GET", "/oidc/callback", nil), legacyState); err != nil {
+		t.Fatalf("Expected a state without a timestamp to be accepted, but got: %v", err)
+	}
+}
+
+func TestOversizedSessionIsGuarded(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fat token with many roles
+	roles := make([]string, 500)
+	for i := range roles {
+		roles[i] = fmt.Sprintf("some-application-role-%d", i)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":   "12345",
+		"roles": roles,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	tests := []struct {
+		name           string
+		overflow       session.SessionStorage
+		expectedStatus int
+	}{
+		{
+			name:           "without overflow",
+			overflow:       nil,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "with overflow",
+			overflow:       session.CreateInMemorySessionStorage(time.Hour),
+			expectedStatus: http.StatusFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toa := newServeHttpTest(t)
+			toa.SessionStorage = session.CreateSizeLimitedSessionStorage(session.CreateCookieSessionStorage(), 4096, test.overflow)
+			toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+
+			jwksServer := setupJWKS(t, toa, privateKey)
+			defer jwksServer.Close()
+
+			state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectUrl: "https://example.com/"})
+
+			req := httptest.NewRequest("GET", "/oidc/callback?code=some-code&state="+url.QueryEscape(state), nil)
+			req.Host = "example.com"
+			req.Header.Set("X-Forwarded-Proto", "https")
+			rw := httptest.NewRecorder()
+
+			toa.ServeHTTP(rw, req)
+
+			if rw.Code != test.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d: %s", test.expectedStatus, rw.Code, rw.Body.String())
+			}
+
+			sessionCookies := 0
+			for _, cookie := range rw.Result().Cookies() {
+				if strings.HasPrefix(cookie.Name, getSessionCookieName(toa.Config)) {
+					sessionCookies++
+				}
+			}
+
+			if test.overflow == nil {
+				if !strings.Contains(rw.Body.String(), "too large") {
+					t.Fatalf("Expected an error page explaining the session is too large, but got %s", rw.Body.String())
+				}
+				if sessionCookies != 0 {
+					t.Fatal("Expected no session cookie to be set")
+				}
+			} else if sessionCookies != 1 {
+				t.Fatalf("Expected a single small session cookie, but got %d", sessionCookies)
+			}
+		})
+	}
+}
+
+func TestPromptPerLoginTrigger(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.LoginUri = "/login"
+	toa.Config.AbsoluteTimeout = 3600
+	toa.Config.Prompt = &PromptConfig{
+		Login:            "select_account",
+		Reauthentication: "login",
+		Silent:           "none",
+	}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	expiredToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+	expiredToken.Header["kid"] = "test-kid"
+	signedExpiredToken, err := expiredToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createSessionCookie := func(state *session.SessionState) *http.Cookie {
+		ticket, _ := toa.SessionStorage.StoreSession(state.Id, state)
+		encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket}
+	}
+
+	tests := []struct {
+		name           string
+		target         string
+		cookie         *http.Cookie
+		expectedPrompt string
+	}{
+		{
+			name:           "fresh login",
+			target:         "/page",
+			expectedPrompt: "select_account",
+		},
+		{
+			name:   "absolute timeout exceeded",
+			target: "/page",
+			cookie: createSessionCookie(&session.SessionState{
+				Id:        "old-session",
+				CreatedAt: time.Now().Add(-2 * time.Hour),
+				IdToken:   signedExpiredToken,
+			}),
+			expectedPrompt: "login",
+		},
+		{
+			name:   "expired tokens",
+			target: "/page",
+			cookie: createSessionCookie(&session.SessionState{
+				Id:        "expired-session",
+				CreatedAt: time.Now(),
+				IdToken:   signedExpiredToken,
+			}),
+			expectedPrompt: "none",
+		},
+		{
+			name:           "prompt on the login request",
+			target:         "/login?prompt=consent",
+			expectedPrompt: "consent",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.target, nil)
+			req.Host = "example.com"
+			if test.cookie != nil {
+				req.AddCookie(test.cookie)
+			}
+			rw := httptest.NewRecorder()
+
+			toa.ServeHTTP(rw, req)
+
+			location, err := url.Parse(rw.Header().Get("Location"))
+			if rw.Code != http.StatusFound || err != nil {
+				t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Body.String())
+			}
+
+			if prompt := location.Query().Get("prompt"); prompt != test.expectedPrompt {
+				t.Fatalf("Expected prompt %q, but got %q", test.expectedPrompt, prompt)
+			}
+		})
+	}
+}
+
+func TestForceAccountSelection(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.LoginUri = "/login"
+	toa.Config.Prompt = &PromptConfig{
+		Login:                 "login",
+		ForceAccountSelection: true,
+	}
+
+	tests := []struct {
+		name           string
+		target         string
+		expectedPrompt string
+	}{
+		{name: "configured prompt", target: "/page", expectedPrompt: "login select_account"},
+		{name: "prompt on the login request", target: "/login?prompt=consent", expectedPrompt: "consent select_account"},
+		{name: "already selecting an account", target: "/login?prompt=select_account", expectedPrompt: "select_account"},
+		{name: "silent prompt", target: "/login?prompt=none", expectedPrompt: "none"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.target, nil)
+			req.Host = "example.com"
+			rw := httptest.NewRecorder()
+
+			toa.ServeHTTP(rw, req)
+
+			location, err := url.Parse(rw.Header().Get("Location"))
+			if rw.Code != http.StatusFound || err != nil {
+				t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Body.String())
+			}
+
+			if prompt := location.Query().Get("prompt"); prompt != test.expectedPrompt {
+				t.Fatalf("Expected prompt %q, but got %q", test.expectedPrompt, prompt)
+			}
+		})
+	}
+
+	toa.Config.Prompt.Login = ""
+
+	req := httptest.NewRequest("GET", "/page", nil)
+	req.Host = "example.com"
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	if prompt := location.Query().Get("prompt"); prompt != "select_account" {
+		t.Fatalf("Expected prompt select_account without a configured prompt, but got %q", prompt)
+	}
+}
+
+func TestAttachHeadersRendersListClaims(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Headers = []HeaderConfig{
+		{Name: "X-Groups", Value: "{{ .claims.groups }}"},
+		{Name: "X-Roles", Value: `{{ .claims.groups | join "|" }}`},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	claims := map[string]interface{}{
+		"groups": []interface{}{"admins", "developers", "ops"},
+	}
+
+	if err := toa.attachHeaders(req.Header, &session.SessionState{}, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := req.Header.Get("X-Groups"); groups != "admins,developers,ops" {
+		t.Errorf("Expected the groups to be comma-joined, but got %q", groups)
+	}
+	if roles := req.Header.Get("X-Roles"); roles != "admins|developers|ops" {
+		t.Errorf("Expected the groups to be joined with the given separator, but got %q", roles)
+	}
+
+	// The claims used for authorization must not be modified
+	if _, ok := claims["groups"].([]interface{}); !ok {
+		t.Error("Expected the original claims to be kept")
+	}
+}
+
+func TestAttachHeadersEmitsOneHeaderPerArrayElement(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Headers = []HeaderConfig{
+		{Name: "X-Group", MultiValueClaim: "groups"},
+		{Name: "X-Role", MultiValueClaim: "realm_access.roles"},
+		{Name: "X-Missing", MultiValueClaim: "missing"},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Group", "spoofed")
+	claims := map[string]interface{}{
+		"groups":       []interface{}{"admins", "developers", "ops"},
+		"realm_access": map[string]interface{}{"roles": []interface{}{"reader"}},
+	}
+
+	if err := toa.attachHeaders(req.Header, &session.SessionState{}, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := req.Header.Values("X-Group"); !slices.Equal(groups, []string{"admins", "developers", "ops"}) {
+		t.Errorf("Expected one header per group, but got %q", groups)
+	}
+	if roles := req.Header.Values("X-Role"); !slices.Equal(roles, []string{"reader"}) {
+		t.Errorf("Expected the nested claim to be emitted, but got %q", roles)
+	}
+	if _, ok := req.Header["X-Missing"]; ok {
+		t.Error("Expected no header for a missing claim")
+	}
+}
+
+func TestAttachHeadersForwardsTokenExpiry(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ExpiresAtHeader = "X-Auth-Expires-At"
+	toa.Config.Provider.TokenValidation = "IdToken"
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forwardedHeaders http.Header
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwardedHeaders = req.Header
+	})
+
+	serveWithSession := func(refreshedAt time.Time, tokenExpiresIn int) http.Header {
+		forwardedHeaders = nil
+
+		ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+			Id:             "session-id",
+			CreatedAt:      refreshedAt,
+			RefreshedAt:    refreshedAt,
+			IdToken:        signedIdToken,
+			IsAuthorized:   true,
+			TokenExpiresIn: tokenExpiresIn,
+		})
+		encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+		req.Header.Set("X-Auth-Expires-At", "9999999999")
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		if forwardedHeaders == nil {
+			t.Fatalf("Expected the request to be forwarded, but got %d %s", rw.Code, rw.Body.String())
+		}
+		return forwardedHeaders
+	}
+
+	refreshedAt := time.Now().Add(-time.Minute)
+
+	expected := strconv.FormatInt(refreshedAt.Add(3600*time.Second).Unix(), 10)
+	if expiresAt := serveWithSession(refreshedAt, 3600).Get("X-Auth-Expires-At"); expiresAt != expected {
+		t.Errorf("Expected the expiry %s, but got %q", expected, expiresAt)
+	}
+
+	// The expiry is unknown, when the provider didn't return one
+	if expiresAt := serveWithSession(refreshedAt, 0).Get("X-Auth-Expires-At"); expiresAt != "" {
+		t.Errorf("Expected no expiry without TokenExpiresIn, but got %q", expiresAt)
+	}
+
+	// The header is also removed when the headers are written to the response in ForwardAuthMode
+	responseHeaders := http.Header{"X-Auth-Expires-At": {"9999999999"}}
+	if err := toa.attachHeaders(responseHeaders, &session.SessionState{RefreshedAt: refreshedAt}, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt := responseHeaders.Get("X-Auth-Expires-At"); expiresAt != "" {
+		t.Errorf("Expected the header to be removed without TokenExpiresIn, but got %q", expiresAt)
+	}
+}
+
+func TestAttachRoutingHintsRendersTenantFromClaim(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.RoutingHints.Headers = []HeaderConfig{
+		{Name: "X-Tenant", Value: "{{ .org_id }}"},
+		{Name: "X-Region", Value: "{{ .region }}"},
+	}
+
+	headers := serveAuthenticatedRequest(t, toa, jwt.MapClaims{"sub": "alice", "org_id": "acme"}, map[string]string{
+		"X-Tenant": "spoofed",
+		"X-Region": "spoofed",
+	})
+
+	if tenant := headers.Get("X-Tenant"); tenant != "acme" {
+		t.Errorf("Expected the tenant of the claim, but got %q", tenant)
+	}
+
+	// A missing claim omits the header instead of routing by a spoofed or rendered placeholder value
+	if _, ok := headers["X-Region"]; ok {
+		t.Errorf("Expected no region header without the claim, but got %q", headers.Get("X-Region"))
+	}
+
+	// The header is also removed when the headers are written to the response in ForwardAuthMode
+	responseHeaders := http.Header{"X-Region": {"spoofed"}}
+	toa.attachRoutingHints(responseHeaders, map[string]interface{}{})
+	if _, ok := responseHeaders["X-Region"]; ok {
+		t.Errorf("Expected a header which isn't rendered to be removed, but got %q", responseHeaders.Get("X-Region"))
+	}
+}
+
+func TestXhrRequestReturnsUnauthorizedJson(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.XhrRequestBehavior = "Unauthorized"
+
+	tests := []struct {
+		name           string
+		header         string
+		value          string
+		expectedStatus int
+	}{
+		{name: "XMLHttpRequest", header: "X-Requested-With", value: "XMLHttpRequest", expectedStatus: http.StatusUnauthorized},
+		{name: "fetch", header: "Sec-Fetch-Mode", value: "cors", expectedStatus: http.StatusUnauthorized},
+		{name: "navigation", header: "Sec-Fetch-Mode", value: "navigate", expectedStatus: http.StatusFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/orders", nil)
+			req.Host = "example.com"
+			req.Header.Set("Accept", "text/html")
+			req.Header.Set(test.header, test.value)
+			addGarbledSessionCookies(req)
+			rw := httptest.NewRecorder()
+
+			toa.ServeHTTP(rw, req)
+
+			if rw.Code != test.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d", test.expectedStatus, rw.Code)
+			}
+
+			if test.expectedStatus != http.StatusUnauthorized {
+				return
+			}
+
+			if contentType := rw.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("Expected a JSON response, but got %s", contentType)
+			}
+			if location := rw.Header().Get("Location"); location != "" {
+				t.Errorf("Expected no redirect, but got %s", location)
+			}
+			if setCookies := rw.Header().Values("Set-Cookie"); len(setCookies) != 0 {
+				t.Errorf("Expected no cookies to be set, but got %v", setCookies)
+			}
+
+			var problem map[string]interface{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &problem); err != nil || problem["title"] != "Unauthorized" {
+				t.Errorf("Expected problem details, but got %s", rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestDefaultToHtmlOnMissingAccept(t *testing.T) {
+	tests := []struct {
+		name                string
+		behavior            string
+		defaultToHtml       bool
+		expectedStatus      int
+		expectedContentType string
+	}{
+		{name: "auto without default", behavior: "Auto", defaultToHtml: false, expectedStatus: http.StatusUnauthorized, expectedContentType: "application/problem+json"},
+		{name: "auto with default", behavior: "Auto", defaultToHtml: true, expectedStatus: http.StatusFound},
+		{name: "error page without default", behavior: "Unauthorized", defaultToHtml: false, expectedStatus: http.StatusUnauthorized, expectedContentType: "application/problem+json"},
+		{name: "error page with default", behavior: "Unauthorized", defaultToHtml: true, expectedStatus: http.StatusUnauthorized, expectedContentType: "text/html; charset=utf-8"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toa := newServeHttpTest(t)
+			toa.Config.UnauthorizedBehavior = test.behavior
+			toa.Config.DefaultToHtmlOnMissingAccept = test.defaultToHtml
+
+			req := httptest.NewRequest("GET", "/page", nil)
+			req.Host = "example.com"
+			rw := httptest.NewRecorder()
+
+			toa.ServeHTTP(rw, req)
+
+			if rw.Code != test.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d", test.expectedStatus, rw.Code)
+			}
+			if test.expectedContentType != "" && rw.Header().Get("Content-Type") != test.expectedContentType {
+				t.Fatalf("Expected content type %s, but got %s", test.expectedContentType, rw.Header().Get("Content-Type"))
+			}
+			if req.Header.Get("Accept") != "" {
+				t.Fatal("Expected the original request not to be modified")
+			}
+		})
+	}
+}
+
+func TestPostIsReplayedAfterLogin(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.PostReplay.Enabled = true
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+	toa.PendingLoginStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "12345",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc",
+			"id_token":     signedIdToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	login := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/comments?page=2", strings.NewReader("comment=Hello+%3Cworld%3E&draft=1"))
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", origin)
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if rw.Code != http.StatusFound || err != nil {
+			t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+		}
+
+		cookies := rw.Result().Cookies()
+
+		req = httptest.NewRequest("GET", "/oidc/callback?code=some-code&state="+url.QueryEscape(location.Query().Get("state")), nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		for _, cookie := range cookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		rw = httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := login("https://example.com")
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected the replay page, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	body := rw.Body.String()
+	for _, expected := range []string{
+		`action="https://example.com/comments?page=2"`,
+		`name="comment" value="Hello &lt;world&gt;"`,
+		`name="draft" value="1"`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected the replay page to contain %s, but got: %s", expected, body)
+		}
+	}
+
+	// A form posted from another site must not be submitted again
+	rw = login("https://evil.example.com")
+
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://example.com/comments?page=2" {
+		t.Fatalf("Expected a cross-origin post to be redirected, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestLogoutClearsAllPluginCookies(t *testing.T) {
+	toa := newServeHttpTest(t)
+
+	state, _ := oidc.EncodeState(&oidc.OidcState{Action: "Logout", RedirectUrl: "https://example.com/"})
+
+	req := httptest.NewRequest("GET", "/oidc/callback?state="+url.QueryEscape(state), nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Session", Value: "ticket"})
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.CodeVerifier", Value: "verifier"})
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.LoginAttempts", Value: "2"})
+	req.AddCookie(&http.Cookie{Name: "TraefikOidcAuth.Legacy", Value: "something"})
+	req.AddCookie(&http.Cookie{Name: "app", Value: "keep"})
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect after the logout, but got %d", rw.Code)
+	}
+
+	expectClearedCookies(t, rw, "TraefikOidcAuth.Session", "TraefikOidcAuth.CodeVerifier", "TraefikOidcAuth.LoginAttempts", "TraefikOidcAuth.Legacy")
+
+	for _, setCookie := range rw.Header().Values("Set-Cookie") {
+		if strings.HasPrefix(setCookie, "app=") {
+			t.Fatalf("Expected cookies of the application not to be touched, but got %s", setCookie)
+		}
+	}
+}
+
+func TestForbiddenErrorContainsHashedInstanceClaim(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.UnauthorizedBehavior = "Unauthorized"
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+	toa.Config.Authorization = &AuthorizationConfig{RequiredScopes: []string{"orders:read"}}
+	toa.Config.ErrorPages.InstanceClaim = "sub"
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "12345", "scope": "profile", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(token string) errorPages.ProblemDetails {
+		req := httptest.NewRequest("GET", "https://example.com/api/orders", nil)
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		problemDetails := errorPages.ProblemDetails{}
+		if err := json.Unmarshal(rw.Body.Bytes(), &problemDetails); err != nil {
+			t.Fatalf("Expected problem details, but got %d %s", rw.Code, rw.Body.String())
+		}
+		return problemDetails
+	}
+
+	if problemDetails := serve(signedToken); problemDetails.Instance != logging.HashSubject("12345") {
+		t.Fatalf("Expected the hashed subject as instance of the forbidden error, but got %+v", problemDetails)
+	}
+
+	if problemDetails := serve(""); problemDetails.Instance != "" {
+		t.Fatalf("Expected no instance on an unauthenticated error, but got %+v", problemDetails)
+	}
+}
+
+func TestForbiddenPageExplainsTheFailedAuthorization(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+	toa.Config.Authorization = &AuthorizationConfig{AllowedGroups: []string{"admins"}, GroupsClaim: "groups"}
+
+	filePath := filepath.Join(t.TempDir(), "forbidden.html")
+	os.WriteFile(filePath, []byte(`<p>{{ .authorizationReason }} ({{ .claimName }}: {{ .claimValue | default "hidden" }})</p>`), 0600)
+	toa.Config.ErrorPages.Unauthorized = &errorPages.ErrorPageConfig{FilePath: filePath}
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "12345", "groups": []string{"developers", "ops\n"}, "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() string {
+		req := httptest.NewRequest("GET", "https://example.com/admin", nil)
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set("Authorization", "Bearer "+signedToken)
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusForbidden {
+			t.Fatalf("Expected 403, but got %d", rw.Code)
+		}
+		return rw.Body.String()
+	}
+
+	if body := serve(); !strings.Contains(body, "not a member of any of the allowed groups admins (groups: hidden)") {
+		t.Fatalf("Expected the reason without the claim value, but got %s", body)
+	}
+
+	toa.Config.ErrorPages.ExposeClaimValues = true
+
+	if body := serve(); !strings.Contains(body, "(groups: developers, ops)") {
+		t.Fatalf("Expected the sanitized claim value, but got %s", body)
+	}
+}
+
+func TestForceHttpsRedirectUri(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ForceHttpsRedirectUri = true
+	toa.DiscoveryDocument.EndSessionEndpoint = "https://idp.example.com/logout"
+
+	req := httptest.NewRequest("GET", "/some/page", nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-Proto", "http")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	location, err := url.Parse(rw.Header().Get("Location"))
+	if rw.Code != http.StatusFound || err != nil {
+		t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	if redirectUri := location.Query().Get("redirect_uri"); redirectUri != "https://example.com/oidc/callback" {
+		t.Fatalf("Expected an https redirect_uri, but got %s", redirectUri)
+	}
+
+	rw = httptest.NewRecorder()
+	toa.handleLogout(rw, req, &session.SessionState{IdToken: "id-token"})
+
+	location, err = url.Parse(rw.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redirectUri := location.Query().Get("post_logout_redirect_uri"); redirectUri != "https://example.com/oidc/callback" {
+		t.Fatalf("Expected an https post_logout_redirect_uri, but got %s", redirectUri)
+	}
+
+	state, err := oidc.DecodeState(location.Query().Get("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.RedirectUrl != "https://example.com/" {
+		t.Fatalf("Expected an https redirect after the logout, but got %s", state.RedirectUrl)
+	}
+}
+
+func TestSignedSessionCookie(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.SessionCookie.Protection = "Sign"
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	storage.StoreSession("session-id", &session.SessionState{Id: "session-id", Subject: "alice", IsAuthorized: true})
+
+	if ticket, err := toa.unprotectSessionTicket(utils.Sign("session-id", toa.Config.Secret)); err != nil || ticket != "session-id" {
+		t.Fatalf("Expected the signed ticket to be valid, but got %s: %v", ticket, err)
+	}
+
+	// A modified session id must not be accepted
+	tampered := "other-id" + strings.TrimPrefix(utils.Sign("session-id", toa.Config.Secret), "session-id")
+
+	req := httptest.NewRequest("GET", "/some/page", nil)
+	req.Host = "example.com"
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: tampered})
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound || !strings.HasPrefix(rw.Header().Get("Location"), "https://idp.example.com/authorize?") {
+		t.Fatalf("Expected the modified cookie to be rejected, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	expectClearedCookies(t, rw, getSessionCookieName(toa.Config))
+}
+
+func TestSpoofedIdentityHeadersAreStrippedFromAnonymousRequests(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Headers = []HeaderConfig{
+		{Name: "X-Auth-Email", Value: "{{ .claims.email }}"},
+	}
+
+	bypassRule, err := rules.ParseRequestCondition("PathPrefix(`/public`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toa.BypassAuthenticationRule = bypassRule
+
+	forwarded := 0
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded++
+
+		if value := req.Header.Get("X-Auth-Email"); value != "" {
+			t.Errorf("Expected the spoofed header to be removed, but got %s", value)
+		}
+		if req.Header.Get("X-Other") != "kept" {
+			t.Error("Expected other headers to be forwarded")
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/public/page", nil)
+	req.Header.Set("X-Auth-Email", "admin@example.com")
+	req.Header.Set("X-Other", "kept")
+	toa.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = newPreflightRequest("https://app.example.com")
+	req.Header.Set("X-Auth-Email", "admin@example.com")
+	req.Header.Set("X-Other", "kept")
+	toa.ServeHTTP(httptest.NewRecorder(), req)
+
+	if forwarded != 2 {
+		t.Fatalf("Expected both anonymous requests to be forwarded, but got %d", forwarded)
+	}
+}
+
+func TestSpoofedIdentityHeadersAreStrippedFromAuthenticatedRequests(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.ExpiresAtHeader = "X-Auth-Expires-At"
+	toa.Config.RoutingHints.Headers = []HeaderConfig{{Name: "X-Tenant", Value: "{{ .org_id }}"}}
+	toa.Config.TokenExchange = &TokenExchangeConfig{Enabled: true, HeaderName: "X-Exchanged-Token"}
+
+	// None of the headers is set from this session: the token has no expires_in, there is no org_id claim
+	// and no token exchange audience
+	headers := serveAuthenticatedRequest(t, toa, jwt.MapClaims{"sub": "alice"}, map[string]string{
+		"X-Auth-Expires-At": "9999999999",
+		"X-Tenant":          "other-tenant",
+		"X-Exchanged-Token": "Bearer spoofed",
+		"X-Other":           "kept",
+	})
+
+	for _, name := range []string{"X-Auth-Expires-At", "X-Tenant", "X-Exchanged-Token"} {
+		if value := headers.Get(name); value != "" {
+			t.Errorf("Expected the spoofed header %s to be removed, but got %s", name, value)
+		}
+	}
+	if headers.Get("X-Other") != "kept" {
+		t.Error("Expected other headers to be forwarded")
+	}
+}
+
+func TestLoginRedirectStatusCode(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.LoginRedirectStatusCode = http.StatusSeeOther
+
+	req := httptest.NewRequest("POST", "/some/form", strings.NewReader("a=b"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusSeeOther || !strings.HasPrefix(rw.Header().Get("Location"), "https://idp.example.com/authorize?") {
+		t.Fatalf("Expected a 303 redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestLongRedirectUrlIsStoredOnTheServer(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.SessionStorage.MaxStateSize = 256
+	toa.RedirectUrlStorage = session.CreateInMemorySessionStorage(time.Hour)
+
+	login := func(requestUri string) *oidc.OidcState {
+		req := httptest.NewRequest("GET", requestUri, nil)
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		location, err := url.Parse(rw.Header().Get("Location"))
+		if rw.Code != http.StatusFound || err != nil {
+			t.Fatalf("Expected a redirect to the provider, but got %d %s", rw.Code, rw.Header().Get("Location"))
+		}
+
+		stateParameter := location.Query().Get("state")
+		if len(stateParameter) > toa.Config.SessionStorage.MaxStateSize {
+			t.Fatalf("Expected the state to be limited to %d bytes, but got %d", toa.Config.SessionStorage.MaxStateSize, len(stateParameter))
+		}
+
+		state, _, err := toa.resolveCallbackState(httptest.NewRequest("GET", "/oidc/callback", nil), stateParameter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	if state := login("/short?a=b"); state.RedirectKey != "" || state.RedirectUrl != "http://example.com/short?a=b" {
+		t.Fatalf("Expected a short redirect url to be kept in the state, but got %+v", state)
+	}
+
+	longUri := "/long?filter=" + strings.Repeat("x", 1000)
+	state := login(longUri)
+	if state.RedirectKey == "" || state.RedirectUrl != "http://example.com"+longUri {
+		t.Fatalf("Expected the long redirect url to be restored from the server, but got %+v", state)
+	}
+
+	// The stored redirect url can only be used once
+	encodedState, _ := oidc.EncodeState(&oidc.OidcState{Action: "Login", RedirectKey: state.RedirectKey})
+	if _, _, err := toa.resolveCallbackState(httptest.NewRequest("GET", "/oidc/callback", nil), encodedState); err == nil {
+		t.Fatal("Expected a used redirect key to be rejected")
+	}
+
+	// Urls which are too long to be stored fall back to the PostLoginRedirectUri
+	if state := login("/long?filter=" + strings.Repeat("x", maxStoredRedirectUrlLength)); state.RedirectKey != "" || state.RedirectUrl != "" {
+		t.Fatalf("Expected a too long redirect url not to be stored, but got %+v", state)
+	}
+}
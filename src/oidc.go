@@ -1,6 +1,7 @@
 package src
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,7 +21,7 @@ import (
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
-func GetOidcDiscovery(logger *logging.Logger, httpClient *http.Client, providerUrl *url.URL) (*oidc.OidcDiscovery, error) {
+func GetOidcDiscovery(ctx context.Context, logger *logging.Logger, httpClient *http.Client, providerUrl *url.URL) (*oidc.OidcDiscovery, error) {
 	wellKnownUrl := *providerUrl
 
 	wellKnownUrl.Path = path.Join(wellKnownUrl.Path, ".well-known/openid-configuration")
@@ -34,7 +36,12 @@ func GetOidcDiscovery(logger *logging.Logger, httpClient *http.Client, providerU
 	// client := &http.Client{Transport: tr}
 
 	// Make HTTP GET request to the OpenID provider's discovery endpoint
-	resp, err := httpClient.Get(wellKnownUrl.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnownUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
 		logger.Log(logging.LevelError, "http-get discovery endpoints - Err: %s", err.Error())
@@ -61,6 +68,62 @@ func GetOidcDiscovery(logger *logging.Logger, httpClient *http.Client, providerU
 	return &document, nil
 }
 
+// Rewrites the endpoints of a discovery document which has been fetched from the internal URL of the provider.
+// Endpoints used by the browser and the issuer are rewritten to the public URL, while the endpoints
+// the middleware calls itself are rewritten to the internal URL.
+func applySplitHorizonEndpoints(document *oidc.OidcDiscovery, internalUrl *url.URL, publicUrl *url.URL) {
+	internalBase := strings.TrimSuffix(internalUrl.String(), "/")
+	publicBase := strings.TrimSuffix(publicUrl.String(), "/")
+
+	toPublic := func(endpoint string) string {
+		return replaceUrlPrefix(endpoint, internalBase, publicBase)
+	}
+	toInternal := func(endpoint string) string {
+		return replaceUrlPrefix(endpoint, publicBase, internalBase)
+	}
+
+	document.Issuer = toPublic(document.Issuer)
+	document.AuthorizationEndpoint = toPublic(document.AuthorizationEndpoint)
+	document.EndSessionEndpoint = toPublic(document.EndSessionEndpoint)
+
+	document.TokenEndpoint = toInternal(document.TokenEndpoint)
+	document.JWKSURI = toInternal(document.JWKSURI)
+	document.UserinfoEndpoint = toInternal(document.UserinfoEndpoint)
+	document.IntrospectionEndpoint = toInternal(document.IntrospectionEndpoint)
+	document.PushedAuthorizationRequestEndpoint = toInternal(document.PushedAuthorizationRequestEndpoint)
+	document.RevocationEndpoint = toInternal(document.RevocationEndpoint)
+}
+
+// Replaces the endpoints of the discovery document with those configured for the provider, which take precedence.
+func applyDiscoveryOverrides(document *oidc.OidcDiscovery, provider *ProviderConfig) {
+	if provider.AuthorizationEndpoint != "" {
+		document.AuthorizationEndpoint = provider.AuthorizationEndpoint
+	}
+	if provider.TokenEndpoint != "" {
+		document.TokenEndpoint = provider.TokenEndpoint
+	}
+	if provider.JwksUri != "" {
+		document.JWKSURI = provider.JwksUri
+	}
+	if provider.EndSessionEndpoint != "" {
+		document.EndSessionEndpoint = provider.EndSessionEndpoint
+	}
+	if provider.IntrospectionEndpoint != "" {
+		document.IntrospectionEndpoint = provider.IntrospectionEndpoint
+	}
+}
+
+func replaceUrlPrefix(value string, from string, to string) string {
+	if value == from {
+		return to
+	}
+	if strings.HasPrefix(value, from+"/") {
+		return to + strings.TrimPrefix(value, from)
+	}
+
+	return value
+}
+
 func randomBytesInHex(count int) (string, error) {
 	buf := make([]byte, count)
 	_, err := io.ReadFull(rand.Reader, buf)
@@ -71,7 +134,8 @@ func randomBytesInHex(count int) (string, error) {
 	return hex.EncodeToString(buf), nil
 }
 
-func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode string) (*oidc.OidcTokenResponse, error) {
+// The codeVerifier is only passed for pending logins stored on the server. Otherwise it's read from the cookie of the verifierKey.
+func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode string, codeVerifier string, verifierKey string) (*oidc.OidcTokenResponse, error) {
 	redirectUrl := oidcAuth.GetAbsoluteCallbackURL(req).String()
 
 	urlValues := url.Values{
@@ -81,35 +145,32 @@ func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode str
 		"redirect_uri": {redirectUrl},
 	}
 
-	if oidcAuth.Config.Provider.ClientSecret != "" {
-		urlValues.Add("client_secret", oidcAuth.Config.Provider.ClientSecret)
+	for _, resource := range oidcAuth.Config.Resources {
+		urlValues.Add("resource", resource)
 	}
 
-	if oidcAuth.ClientJwtPrivateKey != nil {
-		clientAssertionToken, err := oidcAuth.getClientAssertionJwtToken()
-		if err != nil {
-			return nil, err
-		}
-
-		urlValues.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
-		urlValues.Add("client_assertion", clientAssertionToken)
+	err := oidcAuth.addClientAuthentication(urlValues)
+	if err != nil {
+		return nil, err
 	}
 
 	if oidcAuth.Config.Provider.UsePkceBool {
-		codeVerifierCookie, err := req.Cookie(getCodeVerifierCookieName(oidcAuth.Config))
-		if err != nil {
-			return nil, err
-		}
+		if codeVerifier == "" {
+			codeVerifierCookie, err := req.Cookie(getStateCodeVerifierCookieName(oidcAuth.Config, verifierKey))
+			if err != nil {
+				return nil, err
+			}
 
-		codeVerifier, err := utils.Decrypt(codeVerifierCookie.Value, oidcAuth.Config.Secret)
-		if err != nil {
-			return nil, err
+			codeVerifier, err = utils.Decrypt(codeVerifierCookie.Value, oidcAuth.Config.Secret)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		urlValues.Add("code_verifier", codeVerifier)
 	}
 
-	resp, err := oidcAuth.httpClient.PostForm(oidcAuth.DiscoveryDocument.TokenEndpoint, urlValues)
+	resp, err := oidcAuth.postForm(req.Context(), oidcAuth.DiscoveryDocument.TokenEndpoint, urlValues)
 
 	if err != nil {
 		oidcAuth.logger.Log(logging.LevelError, "exchangeAuthCode: couldn't POST to Provider: %s", err.Error())
@@ -133,10 +194,118 @@ func exchangeAuthCode(oidcAuth *TraefikOidcAuth, req *http.Request, authCode str
 	return tokenResponse, nil
 }
 
-func (toa *TraefikOidcAuth) validateTokenLocally(tokenString string) (bool, map[string]interface{}, error) {
+// Returns the audience which must be present in the token or an empty string if the audience should not be validated.
+func (toa *TraefikOidcAuth) getExpectedAudience(isBearerToken bool) string {
+	if isBearerToken && toa.Config.Provider.ResourceAudience != "" {
+		return toa.Config.Provider.ResourceAudience
+	}
+
+	if toa.Config.Provider.ValidateAudienceBool {
+		return toa.Config.Provider.ValidAudience
+	}
+
+	return ""
+}
+
+// Like http.Client.PostForm, but the request is aborted when the context is done.
+func (toa *TraefikOidcAuth) postForm(ctx context.Context, endpoint string, urlValues url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(urlValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return toa.httpClient.Do(req)
+}
+
+func (toa *TraefikOidcAuth) addClientAuthentication(urlValues url.Values) error {
+	if toa.Config.Provider.ClientSecret != "" {
+		urlValues.Add("client_secret", toa.Config.Provider.ClientSecret)
+	}
+
+	if toa.ClientJwtPrivateKey != nil {
+		clientAssertionToken, err := toa.getClientAssertionJwtToken()
+		if err != nil {
+			return err
+		}
+
+		urlValues.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		urlValues.Add("client_assertion", clientAssertionToken)
+	}
+
+	return nil
+}
+
+// Pushes the authorization parameters to the provider (RFC 9126) and returns the request_uri which must be used instead.
+// The request_uri is short-lived and only valid for a single authorization request, so it is never cached.
+func (toa *TraefikOidcAuth) pushAuthorizationRequest(ctx context.Context, authorizationParams url.Values) (*oidc.OidcPushedAuthorizationResponse, error) {
+	urlValues := url.Values{}
+	for key, values := range authorizationParams {
+		urlValues[key] = values
+	}
+
+	err := toa.addClientAuthentication(urlValues)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := toa.postForm(ctx, toa.DiscoveryDocument.PushedAuthorizationRequestEndpoint, urlValues)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "pushAuthorizationRequest: couldn't POST to Provider: %s", err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+
+		errorResponse := &oidc.OidcErrorResponse{}
+		if json.Unmarshal(body, errorResponse) == nil && errorResponse.Error != "" {
+			toa.logger.Log(logging.LevelError, "pushAuthorizationRequest: Provider rejected the request (Status: %d): %s %s", resp.StatusCode, errorResponse.Error, errorResponse.ErrorDescription)
+			return nil, fmt.Errorf("pushed authorization request failed: %s", errorResponse.Error)
+		}
+
+		toa.logger.Log(logging.LevelError, "pushAuthorizationRequest: received bad HTTP response from Provider (Status: %d): %s", resp.StatusCode, string(body))
+		return nil, errors.New("invalid status code")
+	}
+
+	parResponse := &oidc.OidcPushedAuthorizationResponse{}
+	err = json.NewDecoder(resp.Body).Decode(parResponse)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "pushAuthorizationRequest: couldn't decode OidcPushedAuthorizationResponse: %s", err.Error())
+		return nil, err
+	}
+
+	if parResponse.RequestUri == "" {
+		return nil, errors.New("pushed authorization response is missing the request_uri")
+	}
+
+	toa.logger.Log(logging.LevelDebug, "Pushed authorization request. The request_uri expires in %ds.", parResponse.ExpiresIn)
+
+	return parResponse, nil
+}
+
+func (toa *TraefikOidcAuth) validateTokenLocally(ctx context.Context, tokenString string, audience string) (bool, map[string]interface{}, error) {
 	claims := jwt.MapClaims{}
 
-	err := toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, false)
+	jwks := toa.Jwks
+	validateIssuer := toa.Config.Provider.ValidateIssuerBool
+	validIssuer := toa.Config.Provider.ValidIssuer
+
+	// Tokens of any other issuer are verified using the JWKS of the provider, which rejects them if the issuer is validated
+	if trustedIssuer := toa.getTrustedIssuer(tokenString); trustedIssuer != nil {
+		var err error
+		jwks, err = toa.getTrustedIssuerJwks(ctx, trustedIssuer)
+		if err != nil {
+			return false, nil, err
+		}
+
+		validateIssuer = true
+		validIssuer = trustedIssuer.Issuer
+	}
+
+	err := jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, false)
 	if err != nil {
 		return false, nil, err
 	}
@@ -145,24 +314,27 @@ func (toa *TraefikOidcAuth) validateTokenLocally(tokenString string) (bool, map[
 		jwt.WithExpirationRequired(),
 	}
 
-	if toa.Config.Provider.ValidateIssuerBool {
-		options = append(options, jwt.WithIssuer(toa.Config.Provider.ValidIssuer))
+	if validateIssuer {
+		options = append(options, jwt.WithIssuer(validIssuer))
 	}
-	if toa.Config.Provider.ValidateAudienceBool {
-		options = append(options, jwt.WithAudience(toa.Config.Provider.ValidAudience))
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	if len(toa.Config.Provider.AllowedSigningAlgorithms) > 0 {
+		options = append(options, jwt.WithValidMethods(toa.Config.Provider.AllowedSigningAlgorithms))
 	}
 
 	parser := jwt.NewParser(options...)
 
-	_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+	_, err = parser.ParseWithClaims(tokenString, claims, jwks.LoggingKeyfunc(toa.logger))
 
 	if err != nil {
-		err := toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, true)
+		err := jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, true)
 		if err != nil {
 			return false, nil, err
 		}
 
-		_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+		_, err = parser.ParseWithClaims(tokenString, claims, jwks.LoggingKeyfunc(toa.logger))
 
 		if err != nil {
 			if errors.Is(err, jwt.ErrTokenExpired) || err.Error() == "token has invalid claims: token is expired" {
@@ -178,7 +350,69 @@ func (toa *TraefikOidcAuth) validateTokenLocally(tokenString string) (bool, map[
 	return true, claims, nil
 }
 
-func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]interface{}, error) {
+// Returns the TrustedIssuer matching the iss claim of the token or nil if it's issued by any other issuer.
+// The claim is read without verifying the token, it's only used to select the JWKS the token is verified with.
+func (toa *TraefikOidcAuth) getTrustedIssuer(tokenString string) *TrustedIssuerConfig {
+	if len(toa.Config.Provider.TrustedIssuers) == 0 {
+		return nil
+	}
+
+	unverifiedClaims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, unverifiedClaims); err != nil {
+		return nil
+	}
+
+	issuer, _ := unverifiedClaims.GetIssuer()
+
+	// The tokens of the provider itself are always verified using its own JWKS
+	if issuer == "" || issuer == toa.Config.Provider.ValidIssuer {
+		return nil
+	}
+
+	for i := range toa.Config.Provider.TrustedIssuers {
+		if toa.Config.Provider.TrustedIssuers[i].Issuer == issuer {
+			return &toa.Config.Provider.TrustedIssuers[i]
+		}
+	}
+
+	return nil
+}
+
+// Returns the JWKS of a TrustedIssuer. It is shared with all middleware instances trusting the same issuer.
+func (toa *TraefikOidcAuth) getTrustedIssuerJwks(ctx context.Context, trustedIssuer *TrustedIssuerConfig) (*oidc.JwksHandler, error) {
+	cacheKey := "issuer " + trustedIssuer.Issuer + " " + trustedIssuer.JwksUri
+	if toa.httpClientKey != "" {
+		cacheKey += " client " + toa.httpClientKey
+	}
+
+	providerCache := oidc.GetProviderCache(cacheKey)
+
+	_, err := providerCache.EnsureDiscovery(toa.logger, func() (*oidc.OidcDiscovery, error) {
+		if trustedIssuer.JwksUri != "" {
+			return &oidc.OidcDiscovery{
+				Issuer:  trustedIssuer.Issuer,
+				JWKSURI: trustedIssuer.JwksUri,
+			}, nil
+		}
+
+		toa.logger.Log(logging.LevelInfo, "Getting OIDC discovery document of the trusted issuer %s...", trustedIssuer.Issuer)
+
+		issuerUrl, err := utils.ParseUrl(trustedIssuer.Issuer)
+		if err != nil {
+			return nil, err
+		}
+
+		return GetOidcDiscovery(ctx, toa.logger, toa.httpClient, issuerUrl)
+	})
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Error while retrieving the discovery document of the trusted issuer %s: %s", trustedIssuer.Issuer, err.Error())
+		return nil, err
+	}
+
+	return providerCache.Jwks, nil
+}
+
+func (toa *TraefikOidcAuth) introspectToken(ctx context.Context, token string, audience string) (bool, map[string]interface{}, error) {
 	data := url.Values{
 		"token": {token},
 	}
@@ -201,7 +435,8 @@ func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]inte
 	//	endpoint = toa.DiscoveryDocument.UserinfoEndpoint
 	//}
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		http.MethodPost,
 		endpoint,
 		strings.NewReader(data.Encode()),
@@ -233,14 +468,132 @@ func (toa *TraefikOidcAuth) introspectToken(token string) (bool, map[string]inte
 	// TODO: Remove
 	//toa.logAvailableClaims(introspectResponse)
 
-	if introspectResponse["active"] != nil {
-		return introspectResponse["active"].(bool), introspectResponse, nil
-	} else {
-		return false, nil, errors.New("received invalid introspection response")
+	err = toa.validateIntrospectionResponse(introspectResponse, audience)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, introspectResponse, nil
+}
+
+// Validates the response of the introspection endpoint (RFC 7662).
+// The response is used as the claim set of the token, so it must be active, not expired and issued for the expected audience.
+func (toa *TraefikOidcAuth) validateIntrospectionResponse(introspectResponse map[string]interface{}, audience string) error {
+	active, ok := introspectResponse["active"].(bool)
+	if !ok {
+		return errors.New("received invalid introspection response")
+	}
+	if !active {
+		return errors.New("token is not active")
+	}
+
+	if exp, ok := introspectResponse["exp"]; ok {
+		expiresAt, ok := exp.(float64)
+		if !ok {
+			return errors.New("introspection response contains an invalid exp claim")
+		}
+		if time.Now().Unix() >= int64(expiresAt) {
+			return errors.New("token is expired")
+		}
+	}
+
+	// The aud of the introspection response is optional (RFC 7662), so it's only validated when present.
+	// Use ValidateIntrospectionClientId to ensure responses without it belong to this client.
+	if _, ok := introspectResponse["aud"]; ok && audience != "" && !hasAudience(introspectResponse, audience) {
+		return fmt.Errorf("token audience doesn't include %s", audience)
+	}
+
+	if toa.Config.Provider.ValidateIntrospectionClientIdBool {
+		clientId, _ := introspectResponse["client_id"].(string)
+		if clientId != toa.Config.Provider.ClientId {
+			return fmt.Errorf("token has been issued to client '%s' instead of %s", clientId, toa.Config.Provider.ClientId)
+		}
+	}
+
+	return nil
+}
+
+// A token renewal which is in progress. Other requests using the same refresh token wait for it to complete.
+type tokenRenewal struct {
+	done     chan struct{}
+	response *oidc.OidcTokenResponse
+	err      error
+}
+
+// Renews the tokens, but makes sure only a single renewal per refresh token is sent to the provider at a time.
+// Concurrent callers wait for the renewal in progress and share its result. If it doesn't complete within
+// the TokenRenewalWaitTimeout, they give up and the session must be re-authenticated.
+func (toa *TraefikOidcAuth) renewTokenOnce(ctx context.Context, refreshToken string) (*oidc.OidcTokenResponse, error) {
+	toa.renewalsLock.Lock()
+
+	if toa.renewals == nil {
+		toa.renewals = make(map[string]*tokenRenewal)
+	}
+
+	if renewal, ok := toa.renewals[refreshToken]; ok {
+		toa.renewalsLock.Unlock()
+
+		toa.logger.Log(logging.LevelDebug, "Waiting for a token renewal which is already in progress...")
+
+		timeout := time.Duration(toa.Config.Provider.TokenRenewalWaitTimeout) * time.Second
+
+		select {
+		case <-renewal.done:
+			return renewal.response, renewal.err
+		case <-time.After(timeout):
+			return nil, fmt.Errorf("timed out after %s waiting for a token renewal in progress", timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	renewal := &tokenRenewal{
+		done: make(chan struct{}),
+	}
+	toa.renewals[refreshToken] = renewal
+
+	toa.renewalsLock.Unlock()
+
+	renewal.response, renewal.err = toa.renewTokenWithRetries(ctx, refreshToken)
+
+	toa.renewalsLock.Lock()
+	delete(toa.renewals, refreshToken)
+	toa.renewalsLock.Unlock()
+
+	close(renewal.done)
+
+	return renewal.response, renewal.err
+}
+
+// Returned when the provider rejects the refresh token with invalid_grant, eg. because it's expired or revoked.
+// The session can't be renewed anymore and requires a new login.
+var errRefreshTokenRejected = errors.New("the refresh token has been rejected")
+
+// Returned when the token endpoint is unreachable or fails with a server error, so the renewal may succeed later.
+var errTokenEndpointUnavailable = errors.New("the token endpoint is unavailable")
+
+// The delay before a failed token renewal is retried, multiplied by the number of the attempt.
+const tokenRenewalRetryDelay = 250 * time.Millisecond
+
+// Renews the tokens, retrying up to Provider.TokenRenewalRetries times while the token endpoint is unavailable.
+func (toa *TraefikOidcAuth) renewTokenWithRetries(ctx context.Context, refreshToken string) (*oidc.OidcTokenResponse, error) {
+	for attempt := 1; ; attempt++ {
+		tokenResponse, err := toa.renewToken(ctx, refreshToken)
+		if err == nil || !errors.Is(err, errTokenEndpointUnavailable) || attempt > toa.Config.Provider.TokenRenewalRetries {
+			return tokenResponse, err
+		}
+
+		toa.logger.Log(logging.LevelWarn, "Token renewal failed, retrying (%d of %d): %s", attempt, toa.Config.Provider.TokenRenewalRetries, err.Error())
+
+		select {
+		case <-time.After(time.Duration(attempt) * tokenRenewalRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
 
-func (toa *TraefikOidcAuth) renewToken(refreshToken string) (*oidc.OidcTokenResponse, error) {
+func (toa *TraefikOidcAuth) renewToken(ctx context.Context, refreshToken string) (*oidc.OidcTokenResponse, error) {
 	urlValues := url.Values{
 		"grant_type":    {"refresh_token"},
 		"client_id":     {toa.Config.Provider.ClientId},
@@ -248,21 +601,37 @@ func (toa *TraefikOidcAuth) renewToken(refreshToken string) (*oidc.OidcTokenResp
 		"refresh_token": {refreshToken},
 	}
 
+	for _, resource := range toa.Config.Resources {
+		urlValues.Add("resource", resource)
+	}
+
 	if toa.Config.Provider.ClientSecret != "" {
 		urlValues.Add("client_secret", toa.Config.Provider.ClientSecret)
 	}
 
-	resp, err := toa.httpClient.PostForm(toa.DiscoveryDocument.TokenEndpoint, urlValues)
+	resp, err := toa.postForm(ctx, toa.DiscoveryDocument.TokenEndpoint, urlValues)
 
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "renewToken: couldn't POST to Provider: %s", err.Error())
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", errTokenEndpointUnavailable, err.Error())
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		toa.logger.Log(logging.LevelError, "renewToken: received bad HTTP response from Provider: %s", string(body))
+
+		errorResponse := &oidc.OidcErrorResponse{}
+		if json.Unmarshal(body, errorResponse) == nil && errorResponse.Error == "invalid_grant" {
+			return nil, fmt.Errorf("%w: %s", errRefreshTokenRejected, errorResponse.ErrorDescription)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w: status code %d", errTokenEndpointUnavailable, resp.StatusCode)
+		}
+
 		return nil, errors.New("invalid status code")
 	}
 
@@ -276,6 +645,122 @@ func (toa *TraefikOidcAuth) renewToken(refreshToken string) (*oidc.OidcTokenResp
 	return tokenResponse, nil
 }
 
+// Exchanged tokens are not used anymore when they expire within this duration.
+const exchangedTokenExpiryMargin = 30 * time.Second
+
+// An access token which has been obtained by a token exchange, cached for the access token of the session.
+type exchangedToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// Returns the audience the token of the request is exchanged for, or an empty string if it isn't exchanged.
+func (toa *TraefikOidcAuth) getTokenExchangeAudience(req *http.Request) string {
+	if toa.Config.TokenExchange == nil || !toa.Config.TokenExchange.Enabled {
+		return ""
+	}
+
+	for _, route := range toa.Config.TokenExchange.Routes {
+		if route.rule != nil && route.rule.Match(toa.logger, req) {
+			return route.Audience
+		}
+	}
+
+	return toa.Config.TokenExchange.Audience
+}
+
+func exchangedTokenKey(subjectToken string, audience string) string {
+	return audience + " " + subjectToken
+}
+
+// Returns the exchanged token for the given access token of a session and audience. It is cached until shortly
+// before it expires, so renewing the session's tokens also results in a new exchange.
+func (toa *TraefikOidcAuth) getExchangedToken(ctx context.Context, subjectToken string, audience string) (string, error) {
+	now := time.Now()
+	key := exchangedTokenKey(subjectToken, audience)
+
+	toa.exchangedTokensLock.Lock()
+	if cached, ok := toa.exchangedTokens[key]; ok && now.Before(cached.expiresAt) {
+		toa.exchangedTokensLock.Unlock()
+		return cached.accessToken, nil
+	}
+	toa.exchangedTokensLock.Unlock()
+
+	tokenResponse, err := toa.exchangeToken(ctx, subjectToken, audience)
+	if err != nil {
+		return "", err
+	}
+
+	// Without an expiry, we don't know for how long the token can be reused
+	if tokenResponse.ExpiresIn > 0 {
+		toa.exchangedTokensLock.Lock()
+
+		if toa.exchangedTokens == nil {
+			toa.exchangedTokens = make(map[string]*exchangedToken)
+		}
+
+		// Remove the tokens which can't be used anymore, so the cache doesn't grow forever
+		for key, cached := range toa.exchangedTokens {
+			if !now.Before(cached.expiresAt) {
+				delete(toa.exchangedTokens, key)
+			}
+		}
+
+		toa.exchangedTokens[key] = &exchangedToken{
+			accessToken: tokenResponse.AccessToken,
+			expiresAt:   now.Add(time.Duration(tokenResponse.ExpiresIn)*time.Second - exchangedTokenExpiryMargin),
+		}
+
+		toa.exchangedTokensLock.Unlock()
+	}
+
+	return tokenResponse.AccessToken, nil
+}
+
+// Exchanges the given access token for one issued to the audience (RFC 8693).
+func (toa *TraefikOidcAuth) exchangeToken(ctx context.Context, subjectToken string, audience string) (*oidc.OidcTokenResponse, error) {
+	urlValues := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"client_id":            {toa.Config.Provider.ClientId},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:access_token"},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"audience":             {audience},
+	}
+
+	err := toa.addClientAuthentication(urlValues)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := toa.postForm(ctx, toa.DiscoveryDocument.TokenEndpoint, urlValues)
+
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "exchangeToken: couldn't POST to Provider: %s", err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		toa.logger.Log(logging.LevelError, "exchangeToken: received bad HTTP response from Provider (Status: %d): %s", resp.StatusCode, string(body))
+		return nil, errors.New("invalid status code")
+	}
+
+	tokenResponse := &oidc.OidcTokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(tokenResponse)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "exchangeToken: couldn't decode OidcTokenResponse: %s", err.Error())
+		return nil, err
+	}
+
+	if tokenResponse.AccessToken == "" {
+		return nil, errors.New("the token exchange response doesn't contain an access token")
+	}
+
+	return tokenResponse, nil
+}
+
 func (toa *TraefikOidcAuth) getClientAssertionJwtToken() (string, error) {
 	claims := jwt.MapClaims{
 		"iss": toa.Config.Provider.ClientId,
@@ -296,12 +781,12 @@ func (toa *TraefikOidcAuth) getClientAssertionJwtToken() (string, error) {
 	return clientAssertionJwt, nil
 }
 
-func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject string) (map[string]interface{}, error) {
+func (toa *TraefikOidcAuth) getUserInfo(ctx context.Context, accessToken string, idTokenSubject string) (map[string]interface{}, error) {
 	if toa.DiscoveryDocument.UserinfoEndpoint == "" {
 		return nil, errors.New("userinfo_endpoint is not set")
 	}
 
-	req, err := http.NewRequest("GET", toa.DiscoveryDocument.UserinfoEndpoint, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, toa.DiscoveryDocument.UserinfoEndpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -335,7 +820,7 @@ func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject strin
 
 		claims := jwt.MapClaims{}
 
-		err = toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, false)
+		err = toa.Jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, false)
 		if err != nil {
 			return nil, err
 		}
@@ -345,18 +830,21 @@ func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject strin
 		if toa.Config.Provider.ValidateIssuerBool {
 			options = append(options, jwt.WithIssuer(toa.Config.Provider.ValidIssuer))
 		}
+		if len(toa.Config.Provider.AllowedSigningAlgorithms) > 0 {
+			options = append(options, jwt.WithValidMethods(toa.Config.Provider.AllowedSigningAlgorithms))
+		}
 
 		parser := jwt.NewParser(options...)
 
-		_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+		_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.LoggingKeyfunc(toa.logger))
 
 		if err != nil {
-			err := toa.Jwks.EnsureLoaded(toa.logger, toa.httpClient, true)
+			err := toa.Jwks.EnsureLoaded(ctx, toa.logger, toa.httpClient, true)
 			if err != nil {
 				return nil, err
 			}
 
-			_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.Keyfunc)
+			_, err = parser.ParseWithClaims(tokenString, claims, toa.Jwks.LoggingKeyfunc(toa.logger))
 
 			if err != nil {
 				toa.logger.Log(logging.LevelError, "Failed to parse userinfo token: %v", err)
@@ -388,30 +876,98 @@ func (toa *TraefikOidcAuth) getUserInfo(accessToken string, idTokenSubject strin
 	return userInfoClaims, nil
 }
 
-// mergeClaims merges userinfo claims into token claims, preserving security-critical claims
-func mergeClaims(tokenClaims, userInfoClaims map[string]interface{}) map[string]interface{} {
+// Validates the at_hash and c_hash claims of the id token returned by the token endpoint.
+// The signature of the id token must have been verified before, otherwise the alg of its header can't be trusted.
+func validateIdTokenHashes(idToken string, accessToken string, code string) error {
+	claims := jwt.MapClaims{}
+
+	token, _, err := jwt.NewParser().ParseUnverified(idToken, claims)
+	if err != nil {
+		return err
+	}
+
+	alg := token.Method.Alg()
+
+	atHash, ok := claims["at_hash"].(string)
+	if !ok {
+		return errors.New("id token doesn't contain an at_hash claim")
+	}
+
+	err = oidc.ValidateTokenHash(alg, atHash, accessToken)
+	if err != nil {
+		return fmt.Errorf("invalid at_hash: %s", err.Error())
+	}
+
+	// c_hash is only required for the hybrid flow, but validate it whenever it is present
+	if cHash, ok := claims["c_hash"].(string); ok {
+		err = oidc.ValidateTokenHash(alg, cHash, code)
+		if err != nil {
+			return fmt.Errorf("invalid c_hash: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validateResourceAudience ensures the token claims are issued for all configured resources
+func (toa *TraefikOidcAuth) validateResourceAudience(claims map[string]interface{}) error {
+	for _, resource := range toa.Config.Resources {
+		if !hasAudience(claims, resource) {
+			return fmt.Errorf("token audience doesn't include the resource %s", resource)
+		}
+	}
+
+	return nil
+}
+
+// hasAudience checks whether the aud claim, which may be a string or an array of strings, contains the given audience
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []string:
+		return slices.Contains(aud, audience)
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Claims that should NOT be overwritten from userinfo or another token
+var protectedClaims = map[string]bool{
+	"iss": true, // issuer
+	"aud": true, // audience
+	"exp": true, // expiration time
+	"iat": true, // issued at
+	"nbf": true, // not before
+	"jti": true, // JWT ID
+	"azp": true, // authorized party
+}
+
+// mergeClaims merges userinfo claims into token claims, preserving security-critical claims.
+// When preferTokenClaims is set, claims which are already present in the token are not overwritten either.
+func mergeClaims(tokenClaims, userInfoClaims map[string]interface{}, preferTokenClaims bool) map[string]interface{} {
 	// Create a copy of the token claims to avoid modifying the original
 	mergedClaims := make(map[string]interface{})
 	for key, value := range tokenClaims {
 		mergedClaims[key] = value
 	}
 
-	// Define claims that should NOT be overwritten from userinfo
-	protectedClaims := map[string]bool{
-		"iss": true, // issuer
-		"aud": true, // audience
-		"exp": true, // expiration time
-		"iat": true, // issued at
-		"nbf": true, // not before
-		"jti": true, // JWT ID
-		"azp": true, // authorized party
-	}
-
 	// Merge userinfo claims, skipping protected claims
 	for key, value := range userInfoClaims {
-		if !protectedClaims[key] {
-			mergedClaims[key] = value
+		if protectedClaims[key] {
+			continue
+		}
+		if _, exists := tokenClaims[key]; exists && preferTokenClaims {
+			continue
 		}
+
+		mergedClaims[key] = value
 	}
 
 	return mergedClaims
@@ -1,9 +1,12 @@
 package oidc
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,12 +20,33 @@ import (
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
+const (
+	// The number of consecutive failures after which the circuit breaker opens.
+	jwksFailureThreshold = 3
+	// The cooldown after the circuit breaker opened. It doubles with every failed probe.
+	jwksInitialCooldown = 10 * time.Second
+	jwksMaxCooldown     = 5 * time.Minute
+)
+
+// The maximum number of keys a token without a kid is verified against.
+const maxKidlessKeys = 5
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
 type JwksHandler struct {
 	Url       string
 	RsaKeys   []*RsaKey
 	EcdsaKeys []*EcdsaKey
+	EdDsaKeys []*EdDsaKey
 	CacheDate time.Time
 
+	consecutiveFailures int
+	circuitOpenUntil    time.Time
+
 	Lock sync.RWMutex
 }
 
@@ -51,7 +75,12 @@ type EcdsaKey struct {
 	key *ecdsa.PublicKey
 }
 
-func (h *JwksHandler) EnsureLoaded(logger *logging.Logger, httpClient *http.Client, forceReload bool) error {
+type EdDsaKey struct {
+	kid string
+	key ed25519.PublicKey
+}
+
+func (h *JwksHandler) EnsureLoaded(ctx context.Context, logger *logging.Logger, httpClient *http.Client, forceReload bool) error {
 	h.Lock.Lock()
 	defer h.Lock.Unlock()
 
@@ -59,7 +88,7 @@ func (h *JwksHandler) EnsureLoaded(logger *logging.Logger, httpClient *http.Clie
 	maxCacheTimeout := now.Add(-6 * time.Hour)
 	minCacheTimeout := now.Add(-5 * time.Minute)
 
-	reload := h.RsaKeys == nil && h.EcdsaKeys == nil
+	reload := h.RsaKeys == nil && h.EcdsaKeys == nil && h.EdDsaKeys == nil
 
 	if h.CacheDate.Compare(maxCacheTimeout) == -1 {
 		reload = true
@@ -70,13 +99,25 @@ func (h *JwksHandler) EnsureLoaded(logger *logging.Logger, httpClient *http.Clie
 	}
 
 	if reload {
+		if now.Before(h.circuitOpenUntil) {
+			logger.Log(logging.LevelDebug, "JWKS circuit breaker is open until %s. Not reloading.", h.circuitOpenUntil.Format(time.RFC3339))
+			return errors.New("JWKS circuit breaker is open")
+		}
+
 		logger.Log(logging.LevelInfo, "Reloading JWKS...")
 
-		err := h.loadKeys(httpClient)
+		err := h.loadKeys(ctx, httpClient)
 		if err != nil {
 			logger.Log(logging.LevelError, "Error loading JWKS: %v", err)
+
+			// A request which ran out of time doesn't mean that the provider is failing
+			if ctx.Err() == nil {
+				h.recordFailure(logger, now)
+			}
 		} else {
 			logger.Log(logging.LevelInfo, "...JWKS reloaded :)")
+			h.consecutiveFailures = 0
+			h.circuitOpenUntil = time.Time{}
 		}
 
 		return err
@@ -85,8 +126,50 @@ func (h *JwksHandler) EnsureLoaded(logger *logging.Logger, httpClient *http.Clie
 	return nil
 }
 
-func (h *JwksHandler) loadKeys(httpClient *http.Client) error {
-	resp, err := httpClient.Get(h.Url)
+func (h *JwksHandler) recordFailure(logger *logging.Logger, now time.Time) {
+	h.consecutiveFailures++
+
+	if h.consecutiveFailures < jwksFailureThreshold {
+		return
+	}
+
+	// Back off exponentially for every failed probe after the breaker opened
+	cooldown := jwksInitialCooldown
+	for i := jwksFailureThreshold; i < h.consecutiveFailures && cooldown < jwksMaxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > jwksMaxCooldown {
+		cooldown = jwksMaxCooldown
+	}
+
+	h.circuitOpenUntil = now.Add(cooldown)
+
+	logger.Log(logging.LevelWarn, "Loading JWKS failed %d times in a row. Opening circuit breaker for %s.", h.consecutiveFailures, cooldown)
+}
+
+// Returns the state of the circuit breaker around fetching the JWKS. Can be one of CircuitClosed, CircuitOpen or CircuitHalfOpen.
+func (h *JwksHandler) CircuitState() string {
+	h.Lock.RLock()
+	defer h.Lock.RUnlock()
+
+	if h.consecutiveFailures < jwksFailureThreshold {
+		return CircuitClosed
+	}
+
+	if time.Now().Before(h.circuitOpenUntil) {
+		return CircuitOpen
+	}
+
+	return CircuitHalfOpen
+}
+
+func (h *JwksHandler) loadKeys(ctx context.Context, httpClient *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.Url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
 		return err
@@ -94,6 +177,10 @@ func (h *JwksHandler) loadKeys(httpClient *http.Client) error {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= 300 {
+		return errors.New("HTTP error - Status code: " + resp.Status)
+	}
+
 	loaded := JwksKeys{}
 	err = json.NewDecoder(resp.Body).Decode(&loaded)
 
@@ -101,21 +188,40 @@ func (h *JwksHandler) loadKeys(httpClient *http.Client) error {
 		return err
 	}
 
-	rsaKeys, ecdsaKeys, err := extractKeys(&loaded)
+	rsaKeys, ecdsaKeys, edDsaKeys, err := extractKeys(&loaded)
 	if err != nil {
 		return err
 	}
 
 	h.RsaKeys = rsaKeys
 	h.EcdsaKeys = ecdsaKeys
+	h.EdDsaKeys = edDsaKeys
 	h.CacheDate = time.Now()
 
 	return nil
 }
 
 func (h *JwksHandler) Keyfunc(token *jwt.Token) (any, error) {
+	return h.getKey(nil, token)
+}
+
+// Same as Keyfunc, but logs when a token without a kid has to be verified against multiple keys.
+func (h *JwksHandler) LoggingKeyfunc(logger *logging.Logger) jwt.Keyfunc {
+	return func(token *jwt.Token) (any, error) {
+		return h.getKey(logger, token)
+	}
+}
+
+func (h *JwksHandler) getKey(logger *logging.Logger, token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	// Some providers don't send a kid when they only have a single signing key
+	if kid == "" {
+		return h.getKidlessKeys(logger, token.Method.Alg())
+	}
+
 	if strings.HasPrefix(token.Method.Alg(), "RS") {
-		k, err := h.getRsaKey(token.Header["kid"].(string))
+		k, err := h.getRsaKey(kid)
 
 		if err != nil {
 			return nil, err
@@ -126,7 +232,17 @@ func (h *JwksHandler) Keyfunc(token *jwt.Token) (any, error) {
 
 	if strings.HasPrefix(token.Method.Alg(), "EC") ||
 		strings.HasPrefix(token.Method.Alg(), "ES") {
-		k, err := h.getEcdsaKey(token.Header["kid"].(string))
+		k, err := h.getEcdsaKey(kid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return k, nil
+	}
+
+	if token.Method.Alg() == "EdDSA" {
+		k, err := h.getEdDsaKey(kid)
 
 		if err != nil {
 			return nil, err
@@ -138,6 +254,42 @@ func (h *JwksHandler) Keyfunc(token *jwt.Token) (any, error) {
 	return nil, fmt.Errorf("unsupported algorithm %s", token.Method.Alg())
 }
 
+// Returns all keys for the algorithm, up to maxKidlessKeys, which are tried one after another.
+func (h *JwksHandler) getKidlessKeys(logger *logging.Logger, alg string) (jwt.VerificationKeySet, error) {
+	keySet := jwt.VerificationKeySet{}
+
+	if strings.HasPrefix(alg, "RS") {
+		for _, k := range h.RsaKeys {
+			keySet.Keys = append(keySet.Keys, k.key)
+		}
+	} else if strings.HasPrefix(alg, "EC") || strings.HasPrefix(alg, "ES") {
+		for _, k := range h.EcdsaKeys {
+			keySet.Keys = append(keySet.Keys, k.key)
+		}
+	} else if alg == "EdDSA" {
+		for _, k := range h.EdDsaKeys {
+			keySet.Keys = append(keySet.Keys, k.key)
+		}
+	} else {
+		return keySet, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+
+	if len(keySet.Keys) == 0 {
+		return keySet, errors.New("the token has no kid and there is no key for algorithm " + alg)
+	}
+
+	keyCount := len(keySet.Keys)
+	if keyCount > maxKidlessKeys {
+		keySet.Keys = keySet.Keys[:maxKidlessKeys]
+	}
+
+	if keyCount > 1 && logger != nil {
+		logger.Log(logging.LevelDebug, "The token has no kid. Trying %d of %d keys for algorithm %s.", len(keySet.Keys), keyCount, alg)
+	}
+
+	return keySet, nil
+}
+
 func (h *JwksHandler) getRsaKey(kid string) (*rsa.PublicKey, error) {
 	k := h.findRsaKey(kid)
 
@@ -157,6 +309,16 @@ func (h *JwksHandler) getEcdsaKey(kid string) (*ecdsa.PublicKey, error) {
 	return nil, errors.New("unknown kid " + kid)
 }
 
+func (h *JwksHandler) getEdDsaKey(kid string) (ed25519.PublicKey, error) {
+	k := h.findEdDsaKey(kid)
+
+	if k != nil {
+		return k.key, nil
+	}
+
+	return nil, errors.New("unknown kid " + kid)
+}
+
 func (h *JwksHandler) findRsaKey(kid string) *RsaKey {
 	for i := 0; i < len(h.RsaKeys); i++ {
 		if kid == h.RsaKeys[i].kid {
@@ -175,10 +337,20 @@ func (h *JwksHandler) findEcdsaKey(kid string) *EcdsaKey {
 
 	return nil
 }
+func (h *JwksHandler) findEdDsaKey(kid string) *EdDsaKey {
+	for i := 0; i < len(h.EdDsaKeys); i++ {
+		if kid == h.EdDsaKeys[i].kid {
+			return h.EdDsaKeys[i]
+		}
+	}
+
+	return nil
+}
 
-func extractKeys(keys *JwksKeys) ([]*RsaKey, []*EcdsaKey, error) {
+func extractKeys(keys *JwksKeys) ([]*RsaKey, []*EcdsaKey, []*EdDsaKey, error) {
 	var rsaKeys []*RsaKey
 	var ecdsaKeys []*EcdsaKey
+	var edDsaKeys []*EdDsaKey
 
 	for i := 0; i < len(keys.Keys); i++ {
 		k := keys.Keys[i]
@@ -196,15 +368,21 @@ func extractKeys(keys *JwksKeys) ([]*RsaKey, []*EcdsaKey, error) {
 				if err == nil {
 					ecdsaKeys = append(ecdsaKeys, extracted)
 				}
+			} else if k.Kty == "OKP" {
+				extracted, err := extractEdDsaKey(&k)
+
+				if err == nil {
+					edDsaKeys = append(edDsaKeys, extracted)
+				}
 			}
 		}
 	}
 
-	if len(ecdsaKeys) == 0 && len(rsaKeys) == 0 {
-		return nil, nil, errors.New("no public Keys found")
+	if len(ecdsaKeys) == 0 && len(rsaKeys) == 0 && len(edDsaKeys) == 0 {
+		return nil, nil, nil, errors.New("no public Keys found")
 	}
 
-	return rsaKeys, ecdsaKeys, nil
+	return rsaKeys, ecdsaKeys, edDsaKeys, nil
 }
 func extractRsaKey(key *JwksKey) (*RsaKey, error) {
 	decodedN, err := utils.ParseBigInt(key.N)
@@ -227,6 +405,12 @@ func extractRsaKey(key *JwksKey) (*RsaKey, error) {
 	}, nil
 }
 func extractEcdsaKey(key *JwksKey) (*EcdsaKey, error) {
+	curve := getEllipticCurve(key.Crv)
+
+	if curve == nil {
+		return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+	}
+
 	decodedX, err := utils.ParseBigInt(key.X)
 
 	if err != nil {
@@ -242,12 +426,34 @@ func extractEcdsaKey(key *JwksKey) (*EcdsaKey, error) {
 	return &EcdsaKey{
 		kid: key.Kid,
 		key: &ecdsa.PublicKey{
-			Curve: getEllipticCurve(key.Crv),
+			Curve: curve,
 			X:     decodedX,
 			Y:     decodedY},
 	}, nil
 }
 
+func extractEdDsaKey(key *JwksKey) (*EdDsaKey, error) {
+	// Only Ed25519 is supported by the jwt library
+	if key.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+	}
+
+	decodedX, err := base64.RawURLEncoding.DecodeString(key.X)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decodedX) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key size %d", len(decodedX))
+	}
+
+	return &EdDsaKey{
+		kid: key.Kid,
+		key: ed25519.PublicKey(decodedX),
+	}, nil
+}
+
 func getEllipticCurve(crv string) elliptic.Curve {
 	switch crv {
 	case "P-224":
@@ -0,0 +1,240 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestJwksCircuitBreakerOpensAfterRepeatedFailures(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	h := &JwksHandler{
+		Url: server.URL,
+	}
+
+	for i := 0; i < jwksFailureThreshold; i++ {
+		if h.CircuitState() != CircuitClosed {
+			t.Fatalf("Expected circuit breaker to be closed after %d failures", i)
+		}
+
+		if err := h.EnsureLoaded(context.Background(), logger, server.Client(), true); err == nil {
+			t.Fatal("Expected loading the JWKS to fail")
+		}
+	}
+
+	if h.CircuitState() != CircuitOpen {
+		t.Fatalf("Expected circuit breaker to be open, but it is %s", h.CircuitState())
+	}
+
+	// Further attempts should fail fast without hitting the endpoint
+	for i := 0; i < 5; i++ {
+		if err := h.EnsureLoaded(context.Background(), logger, server.Client(), true); err == nil {
+			t.Fatal("Expected loading the JWKS to fail while the circuit breaker is open")
+		}
+	}
+
+	if requestCount != jwksFailureThreshold {
+		t.Fatalf("Expected %d requests to the JWKS endpoint, but got %d", jwksFailureThreshold, requestCount)
+	}
+
+	// Simulate the cooldown has passed. The next attempt probes the endpoint again.
+	h.circuitOpenUntil = time.Now().Add(-time.Second)
+
+	if h.CircuitState() != CircuitHalfOpen {
+		t.Fatalf("Expected circuit breaker to be half-open, but it is %s", h.CircuitState())
+	}
+
+	before := time.Now()
+	h.EnsureLoaded(context.Background(), logger, server.Client(), true)
+
+	if requestCount != jwksFailureThreshold+1 {
+		t.Fatalf("Expected the endpoint to be probed again, but got %d requests", requestCount)
+	}
+
+	if h.CircuitState() != CircuitOpen {
+		t.Fatalf("Expected circuit breaker to be open again after a failed probe, but it is %s", h.CircuitState())
+	}
+
+	if h.circuitOpenUntil.Before(before.Add(2 * jwksInitialCooldown)) {
+		t.Fatalf("Expected the cooldown to be doubled after a failed probe")
+	}
+}
+
+func serveJwks(key JwksKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&JwksKeys{Keys: []JwksKey{key}})
+	}))
+}
+
+func verifyWithJwks(t *testing.T, server *httptest.Server, method jwt.SigningMethod, privateKey any) {
+	h := &JwksHandler{
+		Url: server.URL,
+	}
+
+	if err := h.EnsureLoaded(context.Background(), logging.CreateLogger(logging.LevelDebug), server.Client(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "alice"})
+	token.Header["kid"] = "test-kid"
+	signedToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(signedToken, h.Keyfunc); err != nil {
+		t.Fatalf("Expected the %s token to be valid, but got: %v", method.Alg(), err)
+	}
+
+	// A token signed by another key must be rejected
+	var otherKey any
+	switch privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		otherKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ed25519.PrivateKey:
+		_, otherKey, _ = ed25519.GenerateKey(rand.Reader)
+	}
+
+	signedToken, err = token.SignedString(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(signedToken, h.Keyfunc); err == nil {
+		t.Fatalf("Expected the %s token signed by another key to be invalid", method.Alg())
+	}
+}
+
+func TestJwksES256(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := serveJwks(JwksKey{
+		Kid: "test-kid",
+		Kty: "EC",
+		Use: "sig",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.Y.FillBytes(make([]byte, 32))),
+	})
+	defer server.Close()
+
+	verifyWithJwks(t, server, jwt.SigningMethodES256, privateKey)
+}
+
+func TestJwksEdDSA(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := serveJwks(JwksKey{
+		Kid: "test-kid",
+		Kty: "OKP",
+		Use: "sig",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(publicKey),
+	})
+	defer server.Close()
+
+	verifyWithJwks(t, server, jwt.SigningMethodEdDSA, privateKey)
+}
+
+func TestJwksRejectsUnsupportedCurves(t *testing.T) {
+	_, _, _, err := extractKeys(&JwksKeys{Keys: []JwksKey{
+		{Kid: "a", Kty: "OKP", Use: "sig", Crv: "X25519", X: base64.RawURLEncoding.EncodeToString(make([]byte, 32))},
+		{Kid: "b", Kty: "EC", Use: "sig", Crv: "P-192", X: "AQ", Y: "AQ"},
+	}})
+
+	if err == nil {
+		t.Fatal("Expected no usable keys to be found")
+	}
+}
+
+func TestJwksTokenWithoutKid(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := serveJwks(JwksKey{
+		Kid: "only-key",
+		Kty: "OKP",
+		Use: "sig",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(publicKey),
+	})
+	defer server.Close()
+
+	h := &JwksHandler{
+		Url: server.URL,
+	}
+
+	logger := logging.CreateLogger(logging.LevelDebug)
+
+	if err := h.EnsureLoaded(context.Background(), logger, server.Client(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	signedToken, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "alice"}).SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(signedToken, h.LoggingKeyfunc(logger)); err != nil {
+		t.Fatalf("Expected the token without a kid to be verified with the single key, but got: %v", err)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	signedToken, err = jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "alice"}).SignedString(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(signedToken, h.Keyfunc); err == nil {
+		t.Fatal("Expected the token without a kid signed by another key to be invalid")
+	}
+}
+
+func TestJwksTokenWithoutKidTriesLimitedKeys(t *testing.T) {
+	h := &JwksHandler{}
+	for i := 0; i < maxKidlessKeys+2; i++ {
+		publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		h.EdDsaKeys = append(h.EdDsaKeys, &EdDsaKey{key: publicKey})
+	}
+
+	keySet, err := h.getKidlessKeys(logging.CreateLogger(logging.LevelDebug), "EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keySet.Keys) != maxKidlessKeys {
+		t.Fatalf("Expected %d keys to be tried, but got %d", maxKidlessKeys, len(keySet.Keys))
+	}
+
+	if _, err := h.getKidlessKeys(nil, "RS256"); err == nil {
+		t.Fatal("Expected an error when there is no key for the algorithm")
+	}
+}
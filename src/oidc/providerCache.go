@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+const (
+	// The discovery document is reloaded after this time, like the JWKS, so changed endpoints are picked up.
+	discoveryMaxAge = 6 * time.Hour
+	// A failed reload keeps the previous document and is retried after this time.
+	discoveryRetryInterval = 5 * time.Minute
+)
+
+// ProviderCache holds the discovery document and the JWKS of a provider.
+// Traefik creates a separate middleware instance for every configured middleware, so instances
+// using the same provider share a cache to avoid fetching the same documents multiple times.
+type ProviderCache struct {
+	Jwks *JwksHandler
+
+	discovery          *OidcDiscovery
+	discoveryExpiresAt time.Time
+	lock               sync.Mutex
+}
+
+var providerCaches = make(map[string]*ProviderCache)
+var providerCachesLock sync.Mutex
+
+// Returns the cache for the given key, which should identify the provider, eg. by its URL.
+// The cache is created on first use.
+func GetProviderCache(key string) *ProviderCache {
+	providerCachesLock.Lock()
+	defer providerCachesLock.Unlock()
+
+	cache, ok := providerCaches[key]
+	if !ok {
+		cache = &ProviderCache{
+			Jwks: &JwksHandler{},
+		}
+		providerCaches[key] = cache
+	}
+
+	return cache
+}
+
+// Returns the cached discovery document or loads it using the given function, once it has expired.
+// Concurrent callers wait for a single load. A failed load is not cached, so the next call tries again.
+// If a reload fails, the expired document is used until the next retry, because the provider may only be unavailable temporarily.
+func (cache *ProviderCache) EnsureDiscovery(logger *logging.Logger, load func() (*OidcDiscovery, error)) (*OidcDiscovery, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := time.Now()
+
+	if cache.discovery != nil && now.Before(cache.discoveryExpiresAt) {
+		return cache.discovery, nil
+	}
+
+	discovery, err := load()
+	if err != nil {
+		if cache.discovery == nil {
+			return nil, err
+		}
+
+		logger.Log(logging.LevelWarn, "Failed to reload the discovery document, using the previous one: %s", err.Error())
+		cache.discoveryExpiresAt = now.Add(discoveryRetryInterval)
+
+		return cache.discovery, nil
+	}
+
+	cache.Jwks.Lock.Lock()
+	cache.Jwks.Url = discovery.JWKSURI
+	cache.Jwks.Lock.Unlock()
+
+	cache.discovery = discovery
+	cache.discoveryExpiresAt = now.Add(discoveryMaxAge)
+
+	return discovery, nil
+}
+
+// Returns whether the discovery document must be loaded by EnsureDiscovery.
+func (cache *ProviderCache) IsDiscoveryExpired() bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.discovery == nil || !time.Now().Before(cache.discoveryExpiresAt)
+}
@@ -0,0 +1,122 @@
+package oidc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestProviderCacheIsSharedByKey(t *testing.T) {
+	if GetProviderCache("https://idp-a.example.com") != GetProviderCache("https://idp-a.example.com") {
+		t.Fatal("Expected the same cache for the same key")
+	}
+	if GetProviderCache("https://idp-a.example.com") == GetProviderCache("https://idp-b.example.com") {
+		t.Fatal("Expected different caches for different keys")
+	}
+}
+
+func TestProviderCacheLoadsDiscoveryOnce(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	cache := GetProviderCache("https://idp-load-once.example.com")
+
+	var loadCount int32
+
+	load := func() (*OidcDiscovery, error) {
+		atomic.AddInt32(&loadCount, 1)
+		return &OidcDiscovery{JWKSURI: "https://idp-load-once.example.com/jwks"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := cache.EnsureDiscovery(logger, load); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loadCount != 1 {
+		t.Fatalf("Expected the discovery document to be loaded once, but it was loaded %d times", loadCount)
+	}
+	if cache.Jwks.Url != "https://idp-load-once.example.com/jwks" {
+		t.Fatalf("Expected the JWKS url to be taken from the discovery document, but got %s", cache.Jwks.Url)
+	}
+}
+
+func TestProviderCacheRetriesFailedLoads(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	cache := GetProviderCache("https://idp-retry.example.com")
+
+	_, err := cache.EnsureDiscovery(logger, func() (*OidcDiscovery, error) {
+		return nil, errors.New("provider unavailable")
+	})
+	if err == nil {
+		t.Fatal("Expected the error of the load to be returned")
+	}
+
+	discovery, err := cache.EnsureDiscovery(logger, func() (*OidcDiscovery, error) {
+		return &OidcDiscovery{Issuer: "https://idp-retry.example.com"}, nil
+	})
+	if err != nil || discovery.Issuer != "https://idp-retry.example.com" {
+		t.Fatalf("Expected the discovery document to be loaded on retry, but got %+v: %v", discovery, err)
+	}
+}
+
+func TestProviderCacheReloadsExpiredDiscovery(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	cache := GetProviderCache("https://idp-expiry.example.com")
+
+	_, err := cache.EnsureDiscovery(logger, func() (*OidcDiscovery, error) {
+		return &OidcDiscovery{TokenEndpoint: "https://idp-expiry.example.com/token"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.IsDiscoveryExpired() {
+		t.Fatal("Expected a freshly loaded discovery document not to be expired")
+	}
+
+	cache.discoveryExpiresAt = time.Now().Add(-time.Second)
+	if !cache.IsDiscoveryExpired() {
+		t.Fatal("Expected the discovery document to be expired")
+	}
+
+	discovery, err := cache.EnsureDiscovery(logger, func() (*OidcDiscovery, error) {
+		return &OidcDiscovery{TokenEndpoint: "https://idp-expiry.example.com/v2/token"}, nil
+	})
+	if err != nil || discovery.TokenEndpoint != "https://idp-expiry.example.com/v2/token" {
+		t.Fatalf("Expected the expired discovery document to be reloaded, but got %+v: %v", discovery, err)
+	}
+}
+
+func TestProviderCacheKeepsExpiredDiscoveryWhenReloadFails(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	cache := GetProviderCache("https://idp-stale.example.com")
+
+	_, err := cache.EnsureDiscovery(logger, func() (*OidcDiscovery, error) {
+		return &OidcDiscovery{Issuer: "https://idp-stale.example.com"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.discoveryExpiresAt = time.Now().Add(-time.Second)
+
+	discovery, err := cache.EnsureDiscovery(logger, func() (*OidcDiscovery, error) {
+		return nil, errors.New("provider unavailable")
+	})
+	if err != nil || discovery.Issuer != "https://idp-stale.example.com" {
+		t.Fatalf("Expected the previous discovery document to be used, but got %+v: %v", discovery, err)
+	}
+	if cache.IsDiscoveryExpired() {
+		t.Fatal("Expected the reload not to be retried before the retry interval")
+	}
+}
@@ -3,14 +3,28 @@ package oidc
 import (
 	"encoding/base64"
 	"encoding/json"
+	"time"
 )
 
 type OidcState struct {
 	Action      string `json:"action"`
 	RedirectUrl string `json:"redirect_url"`
+
+	// The key of the RedirectUrl, if it's kept on the server because the state would be too large otherwise.
+	RedirectKey string `json:"redirect_key,omitempty"`
+
+	// The key of the code verifier cookie of this login, so parallel logins in multiple tabs don't overwrite each other.
+	VerifierKey string `json:"verifier_key,omitempty"`
+
+	// The unix time the state has been encoded at.
+	IssuedAt int64 `json:"iat,omitempty"`
 }
 
 func EncodeState(state *OidcState) (string, error) {
+	if state.IssuedAt == 0 {
+		state.IssuedAt = time.Now().Unix()
+	}
+
 	stateBytes, err := json.Marshal(state)
 
 	if err != nil {
@@ -36,3 +50,8 @@ func DecodeState(base64State string) (*OidcState, error) {
 
 	return &state, nil
 }
+
+// States encoded by previous versions have no timestamp and never expire.
+func (state *OidcState) IsOlderThan(ttl time.Duration) bool {
+	return state.IssuedAt != 0 && time.Since(time.Unix(state.IssuedAt, 0)) > ttl
+}
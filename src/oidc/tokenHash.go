@@ -0,0 +1,45 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+)
+
+// Computes the at_hash or c_hash of the given value as described in https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken.
+// The hash function is chosen by the signing algorithm of the id token.
+func ComputeTokenHash(alg string, value string) (string, error) {
+	var h hash.Hash
+
+	switch alg {
+	case "RS256", "PS256", "ES256", "HS256":
+		h = sha256.New()
+	case "RS384", "PS384", "ES384", "HS384":
+		h = sha512.New384()
+	case "RS512", "PS512", "ES512", "HS512", "EdDSA":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported algorithm %s for token hash", alg)
+	}
+
+	h.Write([]byte(value))
+	sum := h.Sum(nil)
+
+	// Use the left-most half of the hash
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+func ValidateTokenHash(alg string, expectedHash string, value string) error {
+	actualHash, err := ComputeTokenHash(alg, value)
+	if err != nil {
+		return err
+	}
+
+	if actualHash != expectedHash {
+		return fmt.Errorf("hash mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package oidc
+
+import "testing"
+
+func TestComputeTokenHash(t *testing.T) {
+	// Example from https://openid.net/specs/openid-connect-core-1_0.html#code-id_tokenExample
+	hash, err := ComputeTokenHash("RS256", "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash != "77QmUPtjPfzWtF2AnpK9RQ" {
+		t.Errorf("Expected hash to be '77QmUPtjPfzWtF2AnpK9RQ', but got '%s'", hash)
+	}
+
+	if err := ValidateTokenHash("RS256", "77QmUPtjPfzWtF2AnpK9RQ", "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y"); err != nil {
+		t.Errorf("Expected hash to be valid, but got: %v", err)
+	}
+
+	if err := ValidateTokenHash("RS256", "77QmUPtjPfzWtF2AnpK9RQ", "some-other-token"); err == nil {
+		t.Error("Expected hash mismatch")
+	}
+
+	if _, err := ComputeTokenHash("none", "value"); err == nil {
+		t.Error("Expected an error for an unsupported algorithm")
+	}
+}
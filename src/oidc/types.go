@@ -21,6 +21,7 @@ type OidcDiscovery struct {
 	AuthorizationEncryptionAlgValuesSupported                 []string       `json:"authorization_encryption_alg_values_supported"`
 	AuthorizationEncryptionEncValuesSupported                 []string       `json:"authorization_encryption_enc_values_supported"`
 	AuthorizationEndpoint                                     string         `json:"authorization_endpoint"`
+	AuthorizationResponseIssParameterSupported                bool           `json:"authorization_response_iss_parameter_supported"`
 	AuthorizationSigningAlgValuesSupported                    []string       `json:"authorization_signing_alg_values_supported"`
 	BackchannelAuthenticationEndpoint                         string         `json:"backchannel_authentication_endpoint"`
 	BackchannelAuthenticationRequestSigningAlgValuesSupported []string       `json:"backchannel_authentication_request_signing_alg_values_supported"`
@@ -87,8 +88,21 @@ type OidcTokenResponse struct {
 	TokenType    string `json:"token_type"`
 	ExpiresIn    int    `json:"expires_in"`
 	RefreshToken string `json:"refresh_token"`
+
+	// Only returned by a token exchange (RFC 8693)
+	IssuedTokenType string `json:"issued_token_type"`
 }
 
 type OidcIntrospectionResponse struct {
 	Active bool `json:"active"`
 }
+
+type OidcPushedAuthorizationResponse struct {
+	RequestUri string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+type OidcErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
@@ -1,15 +1,21 @@
 package src
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/sevensolutions/traefik-oidc-auth/src/rules"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
@@ -53,7 +59,7 @@ func TestGetUserInfo_Success_JSON(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	claims, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	claims, err := toa.getUserInfo(context.Background(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err != nil {
 		t.Fatalf("Expected no error, but got: %v", err)
@@ -75,7 +81,7 @@ func TestGetUserInfo_Unauthorized(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	_, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	_, err := toa.getUserInfo(context.Background(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err == nil {
 		t.Fatal("Expected an error, but got none")
@@ -96,7 +102,7 @@ func TestGetUserInfo_SubMismatch(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	claims, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	claims, err := toa.getUserInfo(context.Background(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err != nil {
 		t.Fatalf("Expected no error, but got: %v", err)
@@ -113,7 +119,7 @@ func TestGetUserInfo_NoEndpoint(t *testing.T) {
 	toa.DiscoveryDocument.UserinfoEndpoint = ""
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	_, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	_, err := toa.getUserInfo(context.Background(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err == nil {
 		t.Fatal("Expected an error, but got none")
@@ -161,7 +167,7 @@ func TestGetUserInfo_Success_JWT(t *testing.T) {
 	toa.Config.Provider.ValidIssuer = "https://issuer.example.com"
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	claims, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	claims, err := toa.getUserInfo(context.Background(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err != nil {
 		t.Fatalf("Expected no error, but got: %v", err)
@@ -199,7 +205,7 @@ func TestMergeClaims_BasicMerging(t *testing.T) {
 		"picture":     "https://example.com/avatar.jpg",
 	}
 
-	merged := mergeClaims(tokenClaims, userInfoClaims)
+	merged := mergeClaims(tokenClaims, userInfoClaims, false)
 
 	// Protected claims should not be overwritten
 	if merged["iss"] != "https://issuer.example.com" {
@@ -254,7 +260,7 @@ func TestMergeClaims_ProtectedClaimsNotOverwritten(t *testing.T) {
 		"name": "John Doe",
 	}
 
-	merged := mergeClaims(tokenClaims, userInfoClaims)
+	merged := mergeClaims(tokenClaims, userInfoClaims, false)
 
 	// All protected claims should retain token values
 	if merged["iss"] != "https://token-issuer.example.com" {
@@ -299,7 +305,7 @@ func TestMergeClaims_EmptyUserInfo(t *testing.T) {
 
 	userInfoClaims := map[string]interface{}{}
 
-	merged := mergeClaims(tokenClaims, userInfoClaims)
+	merged := mergeClaims(tokenClaims, userInfoClaims, false)
 
 	// Original claims should be preserved
 	if merged["sub"] != "12345" {
@@ -324,7 +330,7 @@ func TestMergeClaims_EmptyTokenClaims(t *testing.T) {
 		"iss":   "should-not-be-added", // Protected claim
 	}
 
-	merged := mergeClaims(tokenClaims, userInfoClaims)
+	merged := mergeClaims(tokenClaims, userInfoClaims, false)
 
 	// Non-protected claims should be added
 	if merged["name"] != "John Doe" {
@@ -369,7 +375,7 @@ func TestMergeClaims_ComplexClaims(t *testing.T) {
 		},
 	}
 
-	merged := mergeClaims(tokenClaims, userInfoClaims)
+	merged := mergeClaims(tokenClaims, userInfoClaims, false)
 
 	// Check that complex claims are properly merged (overwritten)
 	if merged["name"] != "John Doe" {
@@ -419,13 +425,198 @@ func TestGetUserInfo_InvalidJWT(t *testing.T) {
 	defer server.Close()
 
 	idTokenClaims := jwt.MapClaims{"sub": "12345"}
-	_, err := toa.getUserInfo("some-access-token", idTokenClaims["sub"].(string))
+	_, err := toa.getUserInfo(context.Background(), "some-access-token", idTokenClaims["sub"].(string))
 
 	if err == nil {
 		t.Fatal("Expected an error, but got none")
 	}
 }
 
+func TestHasAudience(t *testing.T) {
+	if !hasAudience(map[string]interface{}{"aud": "api"}, "api") {
+		t.Error("Expected string audience to match")
+	}
+	if !hasAudience(map[string]interface{}{"aud": []interface{}{"web", "api"}}, "api") {
+		t.Error("Expected array audience to match")
+	}
+	if hasAudience(map[string]interface{}{"aud": []interface{}{"web"}}, "api") {
+		t.Error("Expected array audience without the value not to match")
+	}
+	if hasAudience(map[string]interface{}{}, "api") {
+		t.Error("Expected missing audience not to match")
+	}
+}
+
+func newPushedAuthorizationRequestTest(t *testing.T, handler http.HandlerFunc) (*TraefikOidcAuth, *httptest.Server) {
+	server := httptest.NewServer(handler)
+
+	toa := &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: &Config{
+			Provider: &ProviderConfig{
+				ClientId:     "my-client",
+				ClientSecret: "my-secret",
+			},
+		},
+		httpClient: server.Client(),
+		DiscoveryDocument: &oidc.OidcDiscovery{
+			PushedAuthorizationRequestEndpoint: server.URL,
+		},
+	}
+
+	return toa, server
+}
+
+func TestPushAuthorizationRequest_Success(t *testing.T) {
+	var receivedForm url.Values
+
+	toa, server := newPushedAuthorizationRequestTest(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		receivedForm = r.PostForm
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"request_uri":"urn:ietf:params:oauth:request_uri:abc","expires_in":60}`)
+	})
+	defer server.Close()
+
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"my-client"},
+		"state":         {"some-state"},
+	}
+
+	parResponse, err := toa.pushAuthorizationRequest(context.Background(), params)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if parResponse.RequestUri != "urn:ietf:params:oauth:request_uri:abc" {
+		t.Errorf("Expected request_uri to be returned, but got '%s'", parResponse.RequestUri)
+	}
+
+	if receivedForm.Get("state") != "some-state" || receivedForm.Get("client_secret") != "my-secret" {
+		t.Errorf("Expected the authorization parameters and client authentication to be pushed, but got %v", receivedForm)
+	}
+
+	if params.Get("client_secret") != "" {
+		t.Error("Expected the original authorization parameters not to be modified")
+	}
+}
+
+func TestPushAuthorizationRequest_Error(t *testing.T) {
+	toa, server := newPushedAuthorizationRequestTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_request","error_description":"redirect_uri is not allowed"}`)
+	})
+	defer server.Close()
+
+	_, err := toa.pushAuthorizationRequest(context.Background(), url.Values{})
+	if err == nil {
+		t.Fatal("Expected an error, but got none")
+	}
+
+	if err.Error() != "pushed authorization request failed: invalid_request" {
+		t.Errorf("Expected the provider error to be returned, but got '%s'", err.Error())
+	}
+}
+
+func TestValidateResourceAudience(t *testing.T) {
+	toa := &TraefikOidcAuth{
+		Config: &Config{
+			Resources: []string{"https://api.example.com", "https://files.example.com"},
+		},
+	}
+
+	err := toa.validateResourceAudience(map[string]interface{}{
+		"aud": []interface{}{"https://api.example.com", "https://files.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	err = toa.validateResourceAudience(map[string]interface{}{
+		"aud": "https://api.example.com",
+	})
+	if err == nil {
+		t.Fatal("Expected an error as a resource is missing in the audience")
+	}
+}
+
+func TestExchangeAuthCodeSendsResources(t *testing.T) {
+	var receivedForm url.Values
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		receivedForm = r.PostForm
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"abc","token_type":"Bearer"}`)
+	}))
+	defer server.Close()
+
+	callbackUrl, _ := url.Parse("/oidc/callback")
+
+	toa := &TraefikOidcAuth{
+		logger:      logging.CreateLogger(logging.LevelDebug),
+		httpClient:  server.Client(),
+		CallbackURL: callbackUrl,
+		Config: &Config{
+			Provider:  &ProviderConfig{ClientId: "my-client"},
+			Resources: []string{"https://api.example.com", "https://files.example.com"},
+		},
+		DiscoveryDocument: &oidc.OidcDiscovery{
+			TokenEndpoint: server.URL,
+		},
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/oidc/callback", nil)
+
+	_, err := exchangeAuthCode(toa, req, "some-code", "", "")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	resources := receivedForm["resource"]
+	if len(resources) != 2 || resources[0] != "https://api.example.com" || resources[1] != "https://files.example.com" {
+		t.Errorf("Expected both resources to be sent, but got %v", resources)
+	}
+}
+
+func TestValidateIdTokenHashes(t *testing.T) {
+	signIdToken := func(claims jwt.MapClaims) string {
+		signedToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	accessToken := "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y"
+	code := "Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk"
+
+	idToken := signIdToken(jwt.MapClaims{"sub": "12345", "at_hash": "77QmUPtjPfzWtF2AnpK9RQ", "c_hash": "LDktKdoQak3Pk0cnXxCltA"})
+	if err := validateIdTokenHashes(idToken, accessToken, code); err != nil {
+		t.Fatalf("Expected valid token hashes, but got: %v", err)
+	}
+
+	idToken = signIdToken(jwt.MapClaims{"sub": "12345", "at_hash": "AAAAAAAAAAAAAAAAAAAAAA"})
+	if err := validateIdTokenHashes(idToken, accessToken, code); err == nil {
+		t.Fatal("Expected an error for an incorrect at_hash")
+	}
+
+	idToken = signIdToken(jwt.MapClaims{"sub": "12345", "at_hash": "77QmUPtjPfzWtF2AnpK9RQ", "c_hash": "AAAAAAAAAAAAAAAAAAAAAA"})
+	if err := validateIdTokenHashes(idToken, accessToken, code); err == nil {
+		t.Fatal("Expected an error for an incorrect c_hash")
+	}
+
+	idToken = signIdToken(jwt.MapClaims{"sub": "12345"})
+	if err := validateIdTokenHashes(idToken, accessToken, code); err == nil {
+		t.Fatal("Expected an error for a missing at_hash")
+	}
+}
+
 // generateRSAKey generates an RSA private key for testing
 func generateRSAKey() (*rsa.PrivateKey, error) {
 	return rsa.GenerateKey(rand.Reader, 2048)
@@ -433,6 +624,26 @@ func generateRSAKey() (*rsa.PrivateKey, error) {
 
 // setupJWKS sets up a JWKS server for JWT verification in tests
 func setupJWKS(t *testing.T, toa *TraefikOidcAuth, privateKey *rsa.PrivateKey) *httptest.Server {
+	jwksServer := newJwksServer(privateKey)
+
+	toa.Jwks.Url = jwksServer.URL
+	return jwksServer
+}
+
+// newJwksServer serves the public key of the given private key with the key id test-kid
+func newJwksServer(privateKey *rsa.PrivateKey) *httptest.Server {
+	jwks := newJwks(privateKey)
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+
+	return jwksServer
+}
+
+// newJwks contains the public key of the given private key with the key id test-kid
+func newJwks(privateKey *rsa.PrivateKey) *oidc.JwksKeys {
 	publicKey := &privateKey.PublicKey
 	jwk := oidc.JwksKey{
 		Kid: "test-kid",
@@ -441,15 +652,650 @@ func setupJWKS(t *testing.T, toa *TraefikOidcAuth, privateKey *rsa.PrivateKey) *
 		N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
 		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
 	}
-	jwks := &oidc.JwksKeys{
+	return &oidc.JwksKeys{
 		Keys: []oidc.JwksKey{jwk},
 	}
+}
+
+func TestMergeClaimsPreferTokenClaims(t *testing.T) {
+	tokenClaims := map[string]interface{}{
+		"sub":   "12345",
+		"email": "token@example.com",
+	}
+
+	userInfoClaims := map[string]interface{}{
+		"sub":    "12345",
+		"email":  "userinfo@example.com",
+		"groups": []interface{}{"admin"},
+	}
+
+	merged := mergeClaims(tokenClaims, userInfoClaims, true)
+
+	if merged["email"] != "token@example.com" {
+		t.Errorf("Expected email from the token to take precedence, but got '%v'", merged["email"])
+	}
+
+	if groups, ok := merged["groups"].([]interface{}); !ok || len(groups) != 1 {
+		t.Errorf("Expected groups to be added from userinfo, but got '%v'", merged["groups"])
+	}
+}
+
+func TestSplitHorizonDiscovery(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var internalServer *httptest.Server
+	internalServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalUrl := internalServer.URL + "/realms/test"
 
-	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(jwks)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 internalUrl,
+			"authorization_endpoint": internalUrl + "/protocol/openid-connect/auth",
+			"end_session_endpoint":   internalUrl + "/protocol/openid-connect/logout",
+			"token_endpoint":         "https://auth.example.com/realms/test/protocol/openid-connect/token",
+			"jwks_uri":               internalUrl + "/protocol/openid-connect/certs",
+			"userinfo_endpoint":      "https://other.example.com/userinfo",
+		})
 	}))
+	defer internalServer.Close()
 
-	toa.Jwks.Url = jwksServer.URL
-	return jwksServer
+	publicUrl, _ := url.Parse("https://auth.example.com/realms/test")
+	internalUrl, _ := url.Parse(internalServer.URL + "/realms/test")
+
+	toa := &TraefikOidcAuth{
+		logger:              logging.CreateLogger(logging.LevelDebug),
+		httpClient:          http.DefaultClient,
+		ProviderURL:         publicUrl,
+		InternalProviderURL: internalUrl,
+		Config: &Config{
+			Provider: &ProviderConfig{
+				ClientId:           "my-client",
+				ValidateIssuerBool: true,
+			},
+		},
+	}
+
+	if err := toa.EnsureOidcDiscovery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	document := toa.DiscoveryDocument
+
+	if toa.Config.Provider.ValidIssuer != "https://auth.example.com/realms/test" {
+		t.Errorf("Expected the public issuer, but got %s", toa.Config.Provider.ValidIssuer)
+	}
+	if document.AuthorizationEndpoint != "https://auth.example.com/realms/test/protocol/openid-connect/auth" {
+		t.Errorf("Expected the public authorization endpoint, but got %s", document.AuthorizationEndpoint)
+	}
+	if document.EndSessionEndpoint != "https://auth.example.com/realms/test/protocol/openid-connect/logout" {
+		t.Errorf("Expected the public end session endpoint, but got %s", document.EndSessionEndpoint)
+	}
+	if document.TokenEndpoint != internalServer.URL+"/realms/test/protocol/openid-connect/token" {
+		t.Errorf("Expected the internal token endpoint, but got %s", document.TokenEndpoint)
+	}
+	if document.UserinfoEndpoint != "https://other.example.com/userinfo" {
+		t.Errorf("Expected unrelated endpoints to be kept as is, but got %s", document.UserinfoEndpoint)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	signToken := func(issuer string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": issuer,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	if ok, _, err := toa.validateTokenLocally(context.Background(), signToken("https://auth.example.com/realms/test"), ""); !ok {
+		t.Fatalf("Expected a token with the public issuer to be valid, but got: %v", err)
+	}
+	if ok, _, _ := toa.validateTokenLocally(context.Background(), signToken(internalUrl.String()), ""); ok {
+		t.Fatal("Expected a token with the internal issuer to be invalid")
+	}
+}
+
+func TestAllowedSigningAlgorithms(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: http.DefaultClient,
+		Config: &Config{
+			Provider: &ProviderConfig{
+				AllowedSigningAlgorithms: []string{"RS256"},
+			},
+		},
+		Jwks: &oidc.JwksHandler{},
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	claims := jwt.MapClaims{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-kid"
+	rs256Token, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _, err := toa.validateTokenLocally(context.Background(), rs256Token, ""); !ok {
+		t.Fatalf("Expected the RS256 token to be valid, but got: %v", err)
+	}
+
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "test-kid"
+	hs256Token, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _, _ := toa.validateTokenLocally(context.Background(), hs256Token, ""); ok {
+		t.Fatal("Expected the HS256 token to be rejected")
+	}
+
+	token = jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	noneToken, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _, _ := toa.validateTokenLocally(context.Background(), noneToken, ""); ok {
+		t.Fatal("Expected the token with alg none to be rejected")
+	}
+
+	toa.Config.Provider.AllowedSigningAlgorithms = []string{"ES256"}
+
+	if ok, _, _ := toa.validateTokenLocally(context.Background(), rs256Token, ""); ok {
+		t.Fatal("Expected the RS256 token to be rejected when only ES256 is allowed")
+	}
+}
+
+func newRenewTokenTest(t *testing.T, delay time.Duration, waitTimeout int) (*TraefikOidcAuth, *httptest.Server, *int32) {
+	var requestCount int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		time.Sleep(delay)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcTokenResponse{
+			AccessToken:  "new-access-token",
+			RefreshToken: "new-refresh-token",
+		})
+	}))
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: http.DefaultClient,
+		Config: &Config{
+			Provider: &ProviderConfig{
+				TokenRenewalWaitTimeout: waitTimeout,
+			},
+		},
+		DiscoveryDocument: &oidc.OidcDiscovery{TokenEndpoint: server.URL},
+	}
+
+	return toa, server, &requestCount
+}
+
+func TestRenewTokenOnceSharesConcurrentRenewals(t *testing.T) {
+	toa, server, requestCount := newRenewTokenTest(t, 200*time.Millisecond, 10)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tokens, err := toa.renewTokenOnce(context.Background(), "refresh-token")
+			if err == nil && tokens.RefreshToken != "new-refresh-token" {
+				err = fmt.Errorf("unexpected refresh token %s", tokens.RefreshToken)
+			}
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if *requestCount != 1 {
+		t.Fatalf("Expected a single renewal request, but got %d", *requestCount)
+	}
+
+	// Once the renewal completed, the next one hits the provider again
+	if _, err := toa.renewTokenOnce(context.Background(), "refresh-token"); err != nil || *requestCount != 2 {
+		t.Fatalf("Expected a new renewal request, but got %d: %v", *requestCount, err)
+	}
+}
+
+func TestRenewTokenOnceWaitersTimeOut(t *testing.T) {
+	toa, server, _ := newRenewTokenTest(t, 1500*time.Millisecond, 1)
+	defer server.Close()
+
+	leaderDone := make(chan error)
+	go func() {
+		_, err := toa.renewTokenOnce(context.Background(), "refresh-token")
+		leaderDone <- err
+	}()
+
+	// Make sure the first renewal is in progress
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err := toa.renewTokenOnce(context.Background(), "refresh-token")
+
+	if err == nil {
+		t.Fatal("Expected the waiting renewal to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 1400*time.Millisecond {
+		t.Fatalf("Expected the waiter to give up after the timeout, but it took %s", elapsed)
+	}
+
+	if err := <-leaderDone; err != nil {
+		t.Fatalf("Expected the slow renewal itself to complete, but got: %v", err)
+	}
+}
+
+func TestGetExchangedTokenIsCachedPerSessionToken(t *testing.T) {
+	var requestCount int32
+	var receivedForm url.Values
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&requestCount, 1)
+
+		r.ParseForm()
+		receivedForm = r.PostForm
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcTokenResponse{
+			AccessToken:     fmt.Sprintf("exchanged-%d", count),
+			TokenType:       "Bearer",
+			ExpiresIn:       300,
+			IssuedTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		})
+	}))
+	defer server.Close()
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: server.Client(),
+		Config: &Config{
+			Provider:      &ProviderConfig{ClientId: "my-client", ClientSecret: "secret"},
+			TokenExchange: &TokenExchangeConfig{Enabled: true, Audience: "orders-api"},
+		},
+		DiscoveryDocument: &oidc.OidcDiscovery{TokenEndpoint: server.URL},
+	}
+
+	token, err := toa.getExchangedToken(context.Background(), "session-token-1", "orders-api")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if token != "exchanged-1" {
+		t.Fatalf("Expected the exchanged token, but got %s", token)
+	}
+
+	if receivedForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" ||
+		receivedForm.Get("subject_token") != "session-token-1" ||
+		receivedForm.Get("subject_token_type") != "urn:ietf:params:oauth:token-type:access_token" ||
+		receivedForm.Get("audience") != "orders-api" ||
+		receivedForm.Get("client_secret") != "secret" {
+		t.Fatalf("Unexpected token exchange request: %v", receivedForm)
+	}
+
+	if token, _ := toa.getExchangedToken(context.Background(), "session-token-1", "orders-api"); token != "exchanged-1" {
+		t.Fatalf("Expected the cached token, but got %s", token)
+	}
+	if count := atomic.LoadInt32(&requestCount); count != 1 {
+		t.Fatalf("Expected a single token exchange, but got %d", count)
+	}
+
+	if token, _ := toa.getExchangedToken(context.Background(), "session-token-2", "orders-api"); token != "exchanged-2" {
+		t.Fatalf("Expected another session to get its own token, but got %s", token)
+	}
+
+	// Tokens which are about to expire are exchanged again
+	toa.exchangedTokens[exchangedTokenKey("session-token-1", "orders-api")].expiresAt = time.Now().Add(-time.Second)
+
+	if token, _ := toa.getExchangedToken(context.Background(), "session-token-1", "orders-api"); token != "exchanged-3" {
+		t.Fatalf("Expected the expired token to be exchanged again, but got %s", token)
+	}
+}
+
+func TestExchangeTokenFailsOnErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_target"}`)
+	}))
+	defer server.Close()
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: server.Client(),
+		Config: &Config{
+			Provider:      &ProviderConfig{ClientId: "my-client"},
+			TokenExchange: &TokenExchangeConfig{Enabled: true, Audience: "orders-api"},
+		},
+		DiscoveryDocument: &oidc.OidcDiscovery{TokenEndpoint: server.URL},
+	}
+
+	if _, err := toa.getExchangedToken(context.Background(), "session-token", "orders-api"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(toa.exchangedTokens) != 0 {
+		t.Fatal("Expected failures not to be cached")
+	}
+}
+
+func TestGetExchangedTokenPerRouteAudience(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcTokenResponse{
+			AccessToken: "exchanged-for-" + r.PostForm.Get("audience"),
+			TokenType:   "Bearer",
+			ExpiresIn:   300,
+		})
+	}))
+	defer server.Close()
+
+	billingRule, err := rules.ParseRequestCondition("PathPrefix(`/billing`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: server.Client(),
+		Config: &Config{
+			Provider: &ProviderConfig{ClientId: "my-client"},
+			TokenExchange: &TokenExchangeConfig{
+				Enabled:  true,
+				Audience: "orders-api",
+				Routes:   []TokenExchangeRouteConfig{{Rule: "PathPrefix(`/billing`)", Audience: "billing-api", rule: billingRule}},
+			},
+		},
+		DiscoveryDocument: &oidc.OidcDiscovery{TokenEndpoint: server.URL},
+	}
+
+	ordersAudience := toa.getTokenExchangeAudience(httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+	billingAudience := toa.getTokenExchangeAudience(httptest.NewRequest(http.MethodGet, "/billing/1", nil))
+	if ordersAudience != "orders-api" || billingAudience != "billing-api" {
+		t.Fatalf("Unexpected audiences %s and %s", ordersAudience, billingAudience)
+	}
+
+	for _, audience := range []string{ordersAudience, billingAudience, ordersAudience} {
+		token, err := toa.getExchangedToken(context.Background(), "session-token", audience)
+		if err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		if token != "exchanged-for-"+audience {
+			t.Fatalf("Expected the token of %s, but got %s", audience, token)
+		}
+	}
+
+	if len(toa.exchangedTokens) != 2 {
+		t.Fatalf("Expected a cached token per audience, but got %d", len(toa.exchangedTokens))
+	}
+}
+
+func TestTrustedIssuersUseTheirOwnJwks(t *testing.T) {
+	providerKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partnerKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	discoveredKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partnerJwksServer := newJwksServer(partnerKey)
+	defer partnerJwksServer.Close()
+
+	discoveredJwksServer := newJwksServer(discoveredKey)
+	defer discoveredJwksServer.Close()
+
+	// An issuer whose JWKS is taken from its discovery document
+	var discoveryServer *httptest.Server
+	discoveryServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcDiscovery{
+			Issuer:  discoveryServer.URL,
+			JWKSURI: discoveredJwksServer.URL,
+		})
+	}))
+	defer discoveryServer.Close()
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: http.DefaultClient,
+		Config: &Config{
+			Provider: &ProviderConfig{
+				ValidateIssuerBool: true,
+				ValidIssuer:        "https://idp.example.com",
+				TrustedIssuers: []TrustedIssuerConfig{
+					{Issuer: "https://partner.example.com", JwksUri: partnerJwksServer.URL},
+					{Issuer: discoveryServer.URL},
+				},
+			},
+		},
+		Jwks: &oidc.JwksHandler{},
+	}
+
+	providerJwksServer := setupJWKS(t, toa, providerKey)
+	defer providerJwksServer.Close()
+
+	signToken := func(issuer string, privateKey *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": issuer,
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected bool
+	}{
+		{"provider", signToken("https://idp.example.com", providerKey), true},
+		{"trusted issuer with jwks_uri", signToken("https://partner.example.com", partnerKey), true},
+		{"trusted issuer with discovery", signToken(discoveryServer.URL, discoveredKey), true},
+		{"trusted issuer signed with the key of the provider", signToken("https://partner.example.com", providerKey), false},
+		{"provider signed with the key of a trusted issuer", signToken("https://idp.example.com", partnerKey), false},
+		{"unknown issuer", signToken("https://unknown.example.com", providerKey), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, claims, err := toa.validateTokenLocally(context.Background(), test.token, "")
+
+			if ok != test.expected {
+				t.Fatalf("Expected the token to be valid: %v, but got %v: %v", test.expected, ok, err)
+			}
+			if ok && claims["sub"] != "alice" {
+				t.Fatalf("Expected the claims of the token, but got %v", claims)
+			}
+		})
+	}
+}
+
+func newIntrospectionTest(t *testing.T, response map[string]interface{}) *TraefikOidcAuth {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("token") != "opaque-token" {
+			t.Errorf("Expected the token to be introspected, but got %s", r.FormValue("token"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: &Config{
+			Provider: &ProviderConfig{
+				ClientId: "my-client",
+			},
+		},
+		httpClient: server.Client(),
+		DiscoveryDocument: &oidc.OidcDiscovery{
+			IntrospectionEndpoint: server.URL,
+		},
+	}
+}
+
+func TestIntrospectTokenAudience(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+
+	tests := []struct {
+		name  string
+		aud   interface{}
+		valid bool
+	}{
+		{name: "string audience", aud: "my-client", valid: true},
+		{name: "array audience", aud: []string{"account", "my-client"}, valid: true},
+		{name: "other string audience", aud: "account", valid: false},
+		{name: "other array audience", aud: []string{"account", "api"}, valid: false},
+		{name: "missing audience", aud: nil, valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := map[string]interface{}{
+				"active": true,
+				"exp":    exp,
+				"sub":    "alice",
+			}
+			if test.aud != nil {
+				response["aud"] = test.aud
+			}
+			toa := newIntrospectionTest(t, response)
+
+			ok, claims, err := toa.introspectToken(context.Background(), "opaque-token", "my-client")
+
+			if !test.valid {
+				if err == nil || ok {
+					t.Fatal("Expected the token to be rejected because of the audience")
+				}
+				return
+			}
+
+			if err != nil || !ok {
+				t.Fatalf("Expected the token to be valid, but got: %v", err)
+			}
+			if claims["sub"] != "alice" {
+				t.Errorf("Expected the response to be used as claims, but got %v", claims)
+			}
+		})
+	}
+}
+
+func TestIntrospectTokenRejectsInvalidResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response map[string]interface{}
+	}{
+		{name: "inactive", response: map[string]interface{}{"active": false}},
+		{name: "missing active", response: map[string]interface{}{"sub": "alice"}},
+		{name: "invalid active", response: map[string]interface{}{"active": "true"}},
+		{name: "expired", response: map[string]interface{}{"active": true, "exp": float64(time.Now().Add(-time.Minute).Unix())}},
+		{name: "other client", response: map[string]interface{}{"active": true, "client_id": "other-client"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toa := newIntrospectionTest(t, test.response)
+			toa.Config.Provider.ValidateIntrospectionClientIdBool = true
+
+			ok, _, err := toa.introspectToken(context.Background(), "opaque-token", "")
+			if err == nil || ok {
+				t.Fatal("Expected the introspection response to be rejected")
+			}
+		})
+	}
+}
+
+func TestDiscoveryOverrides(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		providerUrl := server.URL + "/realms/test"
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 providerUrl,
+			"authorization_endpoint": providerUrl + "/protocol/openid-connect/auth",
+			"token_endpoint":         providerUrl + "/protocol/openid-connect/token",
+			"jwks_uri":               providerUrl + "/protocol/openid-connect/certs",
+		})
+	}))
+	defer server.Close()
+
+	providerUrl, _ := url.Parse(server.URL + "/realms/test")
+
+	toa := &TraefikOidcAuth{
+		logger:      logging.CreateLogger(logging.LevelDebug),
+		httpClient:  http.DefaultClient,
+		ProviderURL: providerUrl,
+		Config: &Config{
+			Provider: &ProviderConfig{
+				ClientId:      "my-client",
+				TokenEndpoint: "https://proxy.example.com/token",
+				JwksUri:       "https://proxy.example.com/certs",
+			},
+		},
+	}
+
+	if err := toa.EnsureOidcDiscovery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	document := toa.DiscoveryDocument
+
+	if document.TokenEndpoint != "https://proxy.example.com/token" {
+		t.Errorf("Expected the overridden token endpoint, but got %s", document.TokenEndpoint)
+	}
+	if document.JWKSURI != "https://proxy.example.com/certs" {
+		t.Errorf("Expected the overridden JWKS uri, but got %s", document.JWKSURI)
+	}
+	if document.AuthorizationEndpoint != providerUrl.String()+"/protocol/openid-connect/auth" {
+		t.Errorf("Expected the discovered authorization endpoint to be kept, but got %s", document.AuthorizationEndpoint)
+	}
 }
@@ -0,0 +1,56 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/errorPages"
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Holds the context of the incoming request, which is restored before the request is forwarded.
+type upstreamContextKey struct{}
+
+// Limits the time for authenticating the request to the RequestTimeout.
+// The returned request must only be used until it is forwarded, see withoutRequestTimeout.
+func (toa *TraefikOidcAuth) withRequestTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	upstreamCtx := req.Context()
+
+	ctx, cancel := context.WithTimeout(upstreamCtx, time.Duration(toa.Config.RequestTimeout)*time.Second)
+	ctx = context.WithValue(ctx, upstreamContextKey{}, upstreamCtx)
+
+	return req.WithContext(ctx), cancel
+}
+
+// Removes the RequestTimeout from the request, so it doesn't limit the upstream service.
+func withoutRequestTimeout(req *http.Request) *http.Request {
+	upstreamCtx, ok := req.Context().Value(upstreamContextKey{}).(context.Context)
+	if !ok {
+		return req
+	}
+
+	return req.WithContext(upstreamCtx)
+}
+
+// Writes a 503 error page and returns true, if the RequestTimeout has elapsed.
+// The errors returned in this case are caused by the timeout and must not be treated like a rejected token.
+func (toa *TraefikOidcAuth) writeErrorIfTimedOut(rw http.ResponseWriter, req *http.Request) bool {
+	if toa.Config.RequestTimeout <= 0 || !errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+		return false
+	}
+
+	toa.logger.Log(logging.LevelError, "Authenticating the request exceeded the RequestTimeout of %ds", toa.Config.RequestTimeout)
+
+	data := toa.newPageData()
+
+	data["statusType"] = "https://tools.ietf.org/html/rfc9110#section-15.6.4"
+	data["statusCode"] = http.StatusServiceUnavailable
+	data["statusName"] = "Service Unavailable"
+	data["description"] = "The authentication could not be completed in time.\nPlease try again later."
+
+	toa.writeError(&errorPages.ErrorPageConfig{}, rw, req, data)
+
+	return true
+}
@@ -0,0 +1,80 @@
+package src
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newRequestTimeoutTest(t *testing.T, delay time.Duration) *TraefikOidcAuth {
+	introspectionServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body allows the server to notice when the client gives up
+		r.ParseForm()
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"active": true,
+			"sub":    "alice",
+		})
+	}))
+	t.Cleanup(introspectionServer.Close)
+
+	toa := newServeHttpTest(t)
+	toa.Config.RequestTimeout = 1
+	toa.Config.Provider.TokenValidation = "Introspection"
+	toa.Config.Provider.ValidateAudienceBool = false
+	toa.Config.AuthorizationHeader = &AuthorizationHeaderConfig{Name: "Authorization"}
+	toa.httpClient = introspectionServer.Client()
+	toa.DiscoveryDocument.IntrospectionEndpoint = introspectionServer.URL
+
+	return toa
+}
+
+func TestRequestTimeoutFailsFastOnSlowProvider(t *testing.T) {
+	toa := newRequestTimeoutTest(t, 10*time.Second)
+
+	req := httptest.NewRequest("GET", "/some/page", nil)
+	req.Header.Set("Authorization", "Bearer opaque-token")
+	rw := httptest.NewRecorder()
+
+	start := time.Now()
+	toa.ServeHTTP(rw, req)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the request to fail after the RequestTimeout, but it took %s", elapsed)
+	}
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, but got %d", rw.Code)
+	}
+}
+
+func TestRequestTimeoutDoesNotLimitUpstream(t *testing.T) {
+	toa := newRequestTimeoutTest(t, 0)
+
+	forwarded := false
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = true
+
+		if _, ok := req.Context().Deadline(); ok {
+			t.Error("Expected the RequestTimeout not to be passed upstream")
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/some/page", nil)
+	req.Header.Set("Authorization", "Bearer opaque-token")
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if !forwarded {
+		t.Fatalf("Expected the request to be forwarded, but got %d", rw.Code)
+	}
+}
@@ -1,18 +1,54 @@
 package src
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"math"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
 	"github.com/sevensolutions/traefik-oidc-auth/src/session"
 	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
+// Returned when a session cookie is present but cannot be read, decrypted or decoded.
+var errCorruptSession = errors.New("the session is corrupt")
+
+// Returned when the session exceeded its lifetime, so the user needs to log in again.
+var errSessionExpired = errors.New("the session is expired")
+
+// Returned when the session is used by another client than the one it has been bound to at login.
+var errSessionBindingMismatch = errors.New("the session is bound to another client")
+
+// Returns why a login is needed, based on the reason the session has been rejected.
+func getLoginTrigger(err error) string {
+	if errors.Is(err, errSessionExpired) {
+		return loginTriggerReauthentication
+	}
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return loginTriggerSilent
+	}
+
+	return loginTriggerLogin
+}
+
+// Returns whether the session has been rejected by the SessionStorage, because it exceeds the MaxSize.
+func isSessionTooLargeError(err error) bool {
+	return errors.Is(err, session.ErrSessionTooLarge)
+}
+
+// Returns whether the session or token has been rejected, because it is expired.
+func isExpiredError(err error) bool {
+	return errors.Is(err, errSessionExpired) || errors.Is(err, jwt.ErrTokenExpired)
+}
+
 func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.SessionState, bool, map[string]interface{}, error) {
 	// Use AuthorizationHeader, if present
 	if toa.Config.AuthorizationHeader != nil && toa.Config.AuthorizationHeader.Name != "" {
@@ -23,19 +59,19 @@ func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.Se
 				authHeader = strings.TrimPrefix(authHeader, "Bearer ")
 			}
 
-			toa.logger.Log(logging.LevelDebug, "Custom AuthorizationHeader is present on the request and will be used.")
+			toa.logger.LogSampled("authorization-header", logging.LevelDebug, "Custom AuthorizationHeader is present on the request and will be used.")
 
 			session := &session.SessionState{
 				Id:          "AuthorizationHeader",
 				AccessToken: authHeader,
 			}
 
-			ok, claims, err := toa.validateToken(session)
+			ok, claims, err := toa.validateToken(req.Context(), session)
 
 			if ok {
 				return session, false, claims, err
 			} else {
-				return nil, false, nil, fmt.Errorf("failed to validate token from AuthorizationHeader: %s", err.Error())
+				return nil, false, nil, fmt.Errorf("failed to validate token from AuthorizationHeader: %w", err)
 			}
 		}
 	}
@@ -45,37 +81,44 @@ func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.Se
 		authCookie, err := req.Cookie(toa.Config.AuthorizationCookie.Name)
 
 		if authCookie != nil && err == nil && authCookie.Value != "" {
-			toa.logger.Log(logging.LevelDebug, "Custom AuthorizationCookie is present on the request and will be used.")
+			toa.logger.LogSampled("authorization-cookie", logging.LevelDebug, "Custom AuthorizationCookie is present on the request and will be used.")
 
 			session := &session.SessionState{
 				Id:          "AuthorizationCookie",
 				AccessToken: authCookie.Value,
 			}
 
-			ok, claims, err := toa.validateToken(session)
+			ok, claims, err := toa.validateToken(req.Context(), session)
 
 			if ok {
 				return session, false, claims, err
 			} else {
-				return nil, false, nil, fmt.Errorf("failed to validate token from AuthorizationCookie: %s", err.Error())
+				return nil, false, nil, fmt.Errorf("failed to validate token from AuthorizationCookie: %w", err)
 			}
 		}
 	}
 
-	// Use SessionCookie, if present
-	sessionTicket, err := readChunkedCookie(req, getSessionCookieName(toa.Config))
+	// Use SessionHeader or SessionCookie, if present
+	sessionTicket, err := toa.readSessionTicket(req)
 
 	if err != nil {
-		return nil, false, nil, fmt.Errorf("unable to read session cookie: %s", strings.TrimLeft(err.Error(), "http: "))
+		if errors.Is(err, http.ErrNoCookie) {
+			return nil, false, nil, fmt.Errorf("no session cookie is present")
+		}
+
+		return nil, false, nil, fmt.Errorf("%w: unable to read session cookie: %s", errCorruptSession, strings.TrimLeft(err.Error(), "http: "))
 	}
 	if sessionTicket == "" {
 		return nil, false, nil, fmt.Errorf("no session cookie is present")
 	}
 
-	session, claims, updatedSession, err := validateSessionTicket(toa, sessionTicket)
+	session, claims, updatedSession, err := validateSessionTicket(req.Context(), toa, sessionTicket, toa.getClientFingerprint(req))
 
 	if err != nil {
-		return nil, false, claims, fmt.Errorf("failed to validate session ticket: %s", err.Error())
+		return nil, false, claims, fmt.Errorf("failed to validate session ticket: %w", err)
+	}
+	if session == nil {
+		return nil, false, nil, nil
 	}
 
 	if toa.logger.MinLevel == logging.LevelDebug {
@@ -84,30 +127,80 @@ func (toa *TraefikOidcAuth) getSessionForRequest(req *http.Request) (*session.Se
 			tokenExpiresText = fmt.Sprintf("The IDP token expires in %ds.", int(math.Round(time.Until(session.RefreshedAt.Add(time.Duration(session.TokenExpiresIn)*time.Second)).Seconds())))
 		}
 
-		toa.logger.Log(logging.LevelDebug, "A session is present for the request. %s", tokenExpiresText)
+		toa.logger.LogSampled("session-present", logging.LevelDebug, "A session is present for the request. %s", tokenExpiresText)
 	}
 
 	return session, updatedSession != nil, claims, nil
 }
 
-func validateSessionTicket(toa *TraefikOidcAuth, encryptedTicket string) (*session.SessionState, map[string]interface{}, *session.SessionState, error) {
-	plainSessionTicket, err := utils.Decrypt(encryptedTicket, toa.Config.Secret)
+func (toa *TraefikOidcAuth) readSessionTicket(req *http.Request) (string, error) {
+	if toa.Config.SessionHeader != nil && toa.Config.SessionHeader.Name != "" {
+		sessionTicket := req.Header.Get(toa.Config.SessionHeader.Name)
+
+		if sessionTicket != "" {
+			toa.logger.LogSampled("session-header", logging.LevelDebug, "SessionHeader is present on the request and will be used.")
+			return decodeCookieValue(toa.Config, sessionTicket)
+		}
+	}
+
+	return readChunkedCookie(toa.Config, req, getSessionCookieName(toa.Config))
+}
+
+func (toa *TraefikOidcAuth) isSignedSessionTicket() bool {
+	return toa.Config.SessionCookie != nil && toa.Config.SessionCookie.Protection == "Sign"
+}
+
+// Encrypts or signs the session ticket, depending on the SessionCookie.Protection.
+func (toa *TraefikOidcAuth) protectSessionTicket(sessionTicket string) (string, error) {
+	if toa.isSignedSessionTicket() {
+		return utils.Sign(sessionTicket, toa.Config.Secret), nil
+	}
+
+	return utils.EncryptWithAlgorithm(sessionTicket, toa.Config.Secret, toa.Config.CookieEncryptionAlgorithm)
+}
+
+// Decrypts the session ticket or verifies its signature, depending on the SessionCookie.Protection.
+func (toa *TraefikOidcAuth) unprotectSessionTicket(protectedTicket string) (string, error) {
+	if toa.isSignedSessionTicket() {
+		return utils.VerifySignature(protectedTicket, toa.Config.Secret)
+	}
+
+	return utils.Decrypt(protectedTicket, toa.Config.Secret)
+}
+
+func validateSessionTicket(ctx context.Context, toa *TraefikOidcAuth, protectedTicket string, clientFingerprint string) (*session.SessionState, map[string]interface{}, *session.SessionState, error) {
+	plainSessionTicket, err := toa.unprotectSessionTicket(protectedTicket)
 	if err != nil {
-		toa.logger.Log(logging.LevelError, "Failed to decrypt session ticket: %v", err.Error())
-		return nil, nil, nil, err
+		toa.logger.Log(logging.LevelError, "Failed to decrypt or verify session ticket: %v", err.Error())
+		return nil, nil, nil, fmt.Errorf("%w: %s", errCorruptSession, err.Error())
 	}
 
 	session, err := toa.SessionStorage.TryGetSession(plainSessionTicket)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Reading session failed: %v", err.Error())
-		return nil, nil, nil, err
+		return nil, nil, nil, fmt.Errorf("%w: %s", errCorruptSession, err.Error())
 	}
 	if session == nil {
 		toa.logger.Log(logging.LevelDebug, "No session found")
 		return nil, nil, nil, nil
 	}
 
-	success, claims, err := toa.validateToken(session)
+	if checkSessionExceededAbsoluteTimeout(toa, session) {
+		return nil, nil, nil, fmt.Errorf("%w: exceeded the absolute timeout of %ds", errSessionExpired, toa.Config.AbsoluteTimeout)
+	}
+
+	// A stolen session must neither be used nor renewed
+	if session.Fingerprint != clientFingerprint {
+		toa.logger.Log(logging.LevelWarn, "The session is used by another client than the one it is bound to. Invalidating it.")
+
+		if err := toa.SessionStorage.DeleteSession(plainSessionTicket); err != nil {
+			toa.logger.Log(logging.LevelWarn, "Failed to delete the session: %s", err.Error())
+		}
+
+		return nil, nil, nil, errSessionBindingMismatch
+	}
+
+	success, claims, err := toa.validateToken(ctx, session)
 
 	// Check if the session or IDP token expires soon
 	idpTokenExpiresSoon := false
@@ -117,54 +210,138 @@ func validateSessionTicket(toa *TraefikOidcAuth, encryptedTicket string) (*sessi
 
 	if !success || err != nil || idpTokenExpiresSoon {
 		if session.RefreshToken != "" {
-			toa.logger.Log(logging.LevelInfo, "Trying to renew tokens...")
+			claims, err := toa.renewSession(ctx, session)
+			if errors.Is(err, errRefreshTokenRejected) {
+				toa.logger.Log(logging.LevelInfo, "The refresh token has been rejected. Invalidating the session: %s", err.Error())
 
-			newTokens, err := toa.renewToken(session.RefreshToken)
+				if err := toa.SessionStorage.DeleteSession(plainSessionTicket); err != nil {
+					toa.logger.Log(logging.LevelWarn, "Failed to delete the session: %s", err.Error())
+				}
 
+				return nil, nil, nil, fmt.Errorf("%w: %s", errSessionExpired, err.Error())
+			}
 			if err != nil {
 				return nil, nil, nil, err
 			}
 
-			session.AccessToken = newTokens.AccessToken
+			return session, claims, session, nil
+		} else {
+			toa.missingRefreshTokenLogged.Do(func() {
+				toa.logger.Log(logging.LevelInfo, "The session has no RefreshToken, eg. because the offline_access scope is missing. Sessions can't be renewed and require a new login when the tokens expire.")
+			})
 
-			if newTokens.RefreshToken != "" {
-				session.RefreshToken = newTokens.RefreshToken
-			} else {
-				toa.logger.Log(logging.LevelDebug, "The auth provider didn't return a new RefreshToken. Still keeping the old one.")
+			// Without a refresh token, the tokens are used until they actually expire
+			if success && err == nil {
+				return session, claims, nil, nil
 			}
 
-			// We had some problems with some providers which didn't return a new IdToken when renewing the tokens.
-			// Thats why i'am logging this case specifically here.
-			if newTokens.IdToken != "" {
-				session.IdToken = newTokens.IdToken
-			} else {
-				if toa.Config.Provider.TokenValidation == "IdToken" {
-					toa.logger.Log(logging.LevelWarn, "The auth provider didn't return a new IdToken. Still keeping the old one.")
-				} else {
-					toa.logger.Log(logging.LevelDebug, "The auth provider didn't return a new IdToken. Still keeping the old one.")
-				}
-			}
+			return nil, nil, nil, err
+		}
+	}
 
-			success, claims, err = toa.validateToken(session)
+	return session, claims, nil, nil
+}
 
-			if !success || err != nil {
-				toa.logger.Log(logging.LevelError, "Failed to validate renewed session: %v", err)
-				return nil, nil, session, err
-			}
+// A session without an AuthorizedAt has no decision yet, because the check failed on login.
+func (toa *TraefikOidcAuth) isAuthorizationRecheckDue(session *session.SessionState) bool {
+	if session.AuthorizedAt.IsZero() {
+		return true
+	}
+	if toa.Config.Authorization.RecheckInterval < 1 {
+		return false
+	}
 
-			// Update expirations
-			session.RefreshedAt = time.Now()
-			session.TokenExpiresIn = newTokens.ExpiresIn
+	return time.Since(session.AuthorizedAt) >= time.Duration(toa.Config.Authorization.RecheckInterval)*time.Second
+}
+
+// Returns current claims for an authorization recheck. The claims of the tokens are those of the last renewal,
+// so the session is renewed unless that has just happened or the claims come from the userinfo.
+// If the renewal fails, the recheck uses the claims of the current tokens.
+func (toa *TraefikOidcAuth) refreshClaimsForRecheck(ctx context.Context, session *session.SessionState, claims map[string]interface{}, renewed bool) (map[string]interface{}, bool) {
+	if renewed || session.RefreshToken == "" || toa.Config.Provider.UseClaimsFromUserInfoBool {
+		return claims, renewed
+	}
 
-			toa.logger.Log(logging.LevelInfo, "Successfully renewed session")
+	renewedClaims, err := toa.renewSession(ctx, session)
+	if err != nil {
+		toa.logger.Log(logging.LevelWarn, "Failed to renew the session for the authorization recheck: %s", err.Error())
+		return claims, false
+	}
+
+	return renewedClaims, true
+}
 
-			return session, claims, session, err
+// Renews the tokens of the session using its refresh token and validates them.
+// Concurrent renewals of the same refresh token are joined.
+func (toa *TraefikOidcAuth) renewSession(ctx context.Context, session *session.SessionState) (map[string]interface{}, error) {
+	toa.logger.Log(logging.LevelInfo, "Trying to renew tokens...")
+
+	newTokens, err := toa.renewTokenOnce(ctx, session.RefreshToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	session.AccessToken = newTokens.AccessToken
+
+	if newTokens.RefreshToken != "" {
+		session.RefreshToken = newTokens.RefreshToken
+	} else {
+		toa.logger.Log(logging.LevelDebug, "The auth provider didn't return a new RefreshToken. Still keeping the old one.")
+	}
+
+	// We had some problems with some providers which didn't return a new IdToken when renewing the tokens.
+	// Thats why i'am logging this case specifically here.
+	if newTokens.IdToken != "" {
+		session.IdToken = newTokens.IdToken
+	} else {
+		if toa.Config.Provider.TokenValidation == "IdToken" {
+			toa.logger.Log(logging.LevelWarn, "The auth provider didn't return a new IdToken. Still keeping the old one.")
 		} else {
-			return nil, nil, nil, err
+			toa.logger.Log(logging.LevelDebug, "The auth provider didn't return a new IdToken. Still keeping the old one.")
 		}
 	}
 
-	return session, claims, nil, nil
+	success, claims, err := toa.validateToken(ctx, session)
+
+	if !success || err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to validate renewed session: %v", err)
+		if err == nil {
+			err = errors.New("the renewed tokens are invalid")
+		}
+		return nil, err
+	}
+
+	// Update expirations
+	session.RefreshedAt = time.Now()
+	session.TokenExpiresIn = newTokens.ExpiresIn
+
+	toa.logger.Log(logging.LevelInfo, "Successfully renewed session")
+
+	return claims, nil
+}
+
+// Identifies the client by a hash of its IP address and/or user agent, depending on the configured session bindings.
+// Returns an empty string when the session is not bound.
+func (toa *TraefikOidcAuth) getClientFingerprint(req *http.Request) string {
+	if !toa.Config.BindSessionToIp && !toa.Config.BindSessionToUserAgent {
+		return ""
+	}
+
+	hash := sha256.New()
+
+	if toa.Config.BindSessionToIp {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		hash.Write([]byte("ip:" + ip + "\n"))
+	}
+	if toa.Config.BindSessionToUserAgent {
+		hash.Write([]byte("user-agent:" + req.UserAgent() + "\n"))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
 }
 
 func checkIdpTokenExpiresSoon(toa *TraefikOidcAuth, session *session.SessionState) bool {
@@ -182,12 +359,33 @@ func checkIdpTokenExpiresSoon(toa *TraefikOidcAuth, session *session.SessionStat
 	return false
 }
 
-func (toa *TraefikOidcAuth) validateToken(session *session.SessionState) (bool, map[string]interface{}, error) {
+func checkSessionExceededAbsoluteTimeout(toa *TraefikOidcAuth, session *session.SessionState) bool {
+	if toa.Config.AbsoluteTimeout <= 0 {
+		return false
+	}
+
+	// Sessions created before the creation time was tracked have no CreatedAt and are treated as expired.
+	if session.CreatedAt.IsZero() {
+		toa.logger.Log(logging.LevelDebug, "The session has no creation time. Requiring re-authentication.")
+		return true
+	}
+
+	if time.Since(session.CreatedAt) > time.Duration(toa.Config.AbsoluteTimeout)*time.Second {
+		toa.logger.Log(logging.LevelDebug, "The session exceeded the absolute timeout of %ds. Requiring re-authentication.", toa.Config.AbsoluteTimeout)
+		return true
+	}
+
+	return false
+}
+
+func (toa *TraefikOidcAuth) validateToken(ctx context.Context, session *session.SessionState) (bool, map[string]interface{}, error) {
 	var token string
 
+	isBearerToken := session.Id == "AuthorizationHeader" || session.Id == "AuthorizationCookie"
+
 	// Little bit hacky. In case the request contains a custom AuthorizationHeader or Cookie, only AccessToken is used.
 	// See getSessionForRequest-function.
-	if session.Id == "AuthorizationHeader" || session.Id == "AuthorizationCookie" {
+	if isBearerToken {
 		token = session.AccessToken
 	} else {
 		switch toa.Config.Provider.TokenValidation {
@@ -201,61 +399,116 @@ func (toa *TraefikOidcAuth) validateToken(session *session.SessionState) (bool,
 	}
 
 	if toa.Config.Provider.TokenValidation == "Introspection" {
-		return toa.introspectToken(token)
+		ok, claims, err := toa.introspectToken(ctx, token, toa.getExpectedAudience(isBearerToken))
+		if !ok {
+			return ok, claims, err
+		}
+
+		return ok, toa.applyClaimSources(claims, session.IdToken, session.AccessToken), nil
 	}
 
-	ok, claims, err := toa.validateTokenLocally(token)
+	ok, claims, err := toa.validateTokenLocally(ctx, token, toa.getExpectedAudience(isBearerToken))
 
 	if !ok {
 		return ok, claims, err
 	}
 
+	claims = toa.applyClaimSources(claims, session.IdToken, session.AccessToken)
+
 	if toa.Config.Provider.UseClaimsFromUserInfoBool {
 		subClaim, ok := claims["sub"].(string)
 		if !ok {
 			return false, nil, fmt.Errorf("failed to fetch UserInfo: 'sub' claim is not a string or missing")
 		}
 
-		userInfoClaims, err := toa.getUserInfo(session.AccessToken, subClaim)
+		userInfoClaims, err := toa.getUserInfo(ctx, session.AccessToken, subClaim)
 		if err != nil {
 			return false, nil, fmt.Errorf("failed to fetch UserInfo: %s", err.Error())
 		}
 
-		claims = mergeClaims(claims, userInfoClaims)
+		claims = mergeClaims(claims, userInfoClaims, toa.Config.Provider.PreferTokenClaimsBool)
 	}
 
 	return ok, claims, err
 }
 
-func (toa *TraefikOidcAuth) storeSessionAndAttachCookie(session *session.SessionState, rw http.ResponseWriter) {
+// Stores the session and attaches the session cookie.
+// When an error is returned, an error response has already been written.
+func (toa *TraefikOidcAuth) storeSessionAndAttachCookie(session *session.SessionState, rw http.ResponseWriter, req *http.Request) error {
 	sessionTicket, err := toa.SessionStorage.StoreSession(session.Id, session)
+	if isSessionTooLargeError(err) {
+		toa.logger.Log(logging.LevelWarn, "Failed to store session: %s", err.Error())
+		toa.writeSessionTooLargeError(rw, req)
+		return err
+	}
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Failed to store session: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	toa.logger.Log(logging.LevelDebug, "Session stored. Id %s", session.Id)
 
-	encryptedSessionTicket, err := utils.Encrypt(sessionTicket, toa.Config.Secret)
+	if toa.Config.SessionCookie.Secure && strings.HasPrefix(utils.GetFullHost(req), "http://") {
+		// The browser won't send the cookie back, so the user would end up in a login loop
+		toa.logger.LogSampled("secure-cookie-over-http", logging.LevelWarn, "The session cookie is Secure, but the request has been made over http. The browser will not send the cookie back. Check the X-Forwarded-Proto header or set SessionCookie.Secure to false.")
+	}
+
+	protectedSessionTicket, err := toa.protectSessionTicket(sessionTicket)
 	if err != nil {
 		toa.logger.Log(logging.LevelError, "Failed to encrypt session ticket: %s", err.Error())
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	setChunkedCookies(toa.Config, rw, getSessionCookieName(toa.Config), encryptedSessionTicket)
+	err = setChunkedCookies(toa.logger, toa.Config, rw, req, getSessionCookieName(toa.Config), protectedSessionTicket)
+	if err != nil {
+		toa.logger.Log(logging.LevelError, "Failed to attach session cookie: %s", err.Error())
+		toa.writeSessionTooLargeError(rw, req)
+		return err
+	}
+
+	return nil
 }
 
-func createSessionCookie(config *Config) *http.Cookie {
-	return &http.Cookie{
+func (toa *TraefikOidcAuth) getSessionSubject(claims map[string]interface{}) string {
+	if toa.Config.SubjectClaim == "" {
+		return ""
+	}
+
+	subject, ok := claims[toa.Config.SubjectClaim].(string)
+	if !ok {
+		toa.logger.Log(logging.LevelWarn, "The subject claim '%s' is not a string or missing.", toa.Config.SubjectClaim)
+		return ""
+	}
+
+	return subject
+}
+
+func createSessionCookie(logger *logging.Logger, config *Config, req *http.Request) *http.Cookie {
+	cookie := &http.Cookie{
 		Name:     getSessionCookieName(config),
 		Value:    "",
-		Secure:   config.SessionCookie.Secure,
+		Secure:   isSecureCookieRequest(config, req),
 		HttpOnly: config.SessionCookie.HttpOnly,
 		Path:     config.SessionCookie.Path,
 		Domain:   config.SessionCookie.Domain,
-		SameSite: parseCookieSameSite(config.SessionCookie.SameSite),
+		SameSite: parseCookieSameSite(logger, config.SessionCookie.SameSite, req),
 		MaxAge:   config.SessionCookie.MaxAge,
 	}
+
+	// Embedded cookies are only accepted by browsers when they're Secure and get partitioned by the embedding site
+	if isAutoCookieSameSite(config.SessionCookie.SameSite) && cookie.SameSite == http.SameSiteNoneMode {
+		cookie.Secure = true
+		cookie.Partitioned = true
+	}
+
+	if config.SessionCookie.DowngradeSameSiteNoneOnHttp && cookie.SameSite == http.SameSiteNoneMode && !isHttpsRequest(config, req) {
+		logger.LogSampled("same-site-none-downgrade", logging.LevelWarn, "The request has been made over http, so the cookies are set with SameSite Lax instead of None and without Secure. This is meant for local development only!")
+		cookie.SameSite = http.SameSiteLaxMode
+		cookie.Secure = false
+		cookie.Partitioned = false
+	}
+
+	return cookie
 }
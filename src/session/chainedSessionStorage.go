@@ -0,0 +1,172 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNoSessionStorageAvailable = errors.New("no session storage is available")
+
+var ErrTooManyQueuedDeletions = errors.New("too many deletions are queued for a session storage which is down")
+
+// The number of deletions which are queued for a storage while it's down. Further deletions fail.
+const maxQueuedDeletions = 10000
+
+// ChainedSessionStorage wraps an ordered list of storages, eg. a shared storage with a fallback to the memory
+// or the cookie. Sessions are written to the first storage which is available and read from each in order,
+// until one of them knows the session.
+// A storage which fails to store or delete a session is considered down and skipped for the retryInterval.
+// Deletions are queued while a storage is down and applied before it's used again, so a logout or a revocation
+// isn't undone when the storage comes back.
+type ChainedSessionStorage struct {
+	lock            sync.Mutex
+	storages        []SessionStorage
+	downUntil       []time.Time
+	queuedDeletions [][]func(inner SessionStorage) error
+	retryInterval   time.Duration
+}
+
+func CreateChainedSessionStorage(retryInterval time.Duration, storages ...SessionStorage) *ChainedSessionStorage {
+	return &ChainedSessionStorage{
+		storages:        storages,
+		downUntil:       make([]time.Time, len(storages)),
+		queuedDeletions: make([][]func(inner SessionStorage) error, len(storages)),
+		retryInterval:   retryInterval,
+	}
+}
+
+func (storage *ChainedSessionStorage) StoreSession(sessionId string, state *SessionState) (string, error) {
+	lastErr := ErrNoSessionStorageAvailable
+
+	for i, inner := range storage.storages {
+		if !storage.isAvailable(i) {
+			continue
+		}
+
+		sessionTicket, err := inner.StoreSession(sessionId, state)
+		if err == nil {
+			return sessionTicket, nil
+		}
+
+		storage.markDown(i)
+		lastErr = err
+	}
+
+	return "", lastErr
+}
+
+// Errors of single storages are skipped, as the ticket may have been issued by another one.
+// They are only returned, if no storage knows the session.
+func (storage *ChainedSessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	var lastErr error
+
+	for i, inner := range storage.storages {
+		if !storage.isAvailable(i) {
+			continue
+		}
+
+		state, err := inner.TryGetSession(sessionTicket)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if state != nil {
+			return state, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (storage *ChainedSessionStorage) DeleteSession(sessionTicket string) error {
+	return storage.deleteFromAll(func(inner SessionStorage) error {
+		return inner.DeleteSession(sessionTicket)
+	})
+}
+
+func (storage *ChainedSessionStorage) DeleteBySubject(subject string) error {
+	return storage.deleteFromAll(func(inner SessionStorage) error {
+		return inner.DeleteBySubject(subject)
+	})
+}
+
+// The limit is applied to each storage separately.
+func (storage *ChainedSessionStorage) LimitSessionsPerSubject(subject string, maxSessions int) error {
+	return storage.deleteFromAll(func(inner SessionStorage) error {
+		return inner.LimitSessionsPerSubject(subject, maxSessions)
+	})
+}
+
+// Runs the deletion on all storages, as the session may be known by any of them. For storages which are down,
+// it's queued until they are available again.
+// An error is returned, if the deletion can't be queued or if it hasn't succeeded on any storage yet.
+func (storage *ChainedSessionStorage) deleteFromAll(deletion func(inner SessionStorage) error) error {
+	lastErr := ErrNoSessionStorageAvailable
+	succeeded := false
+
+	for i, inner := range storage.storages {
+		if storage.isAvailable(i) {
+			err := deletion(inner)
+			if err == nil {
+				succeeded = true
+				continue
+			}
+
+			storage.markDown(i)
+			lastErr = err
+		}
+
+		if !storage.queueDeletion(i, deletion) {
+			return ErrTooManyQueuedDeletions
+		}
+	}
+
+	if succeeded {
+		return nil
+	}
+
+	return lastErr
+}
+
+func (storage *ChainedSessionStorage) queueDeletion(index int, deletion func(inner SessionStorage) error) bool {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if len(storage.queuedDeletions[index]) >= maxQueuedDeletions {
+		return false
+	}
+
+	storage.queuedDeletions[index] = append(storage.queuedDeletions[index], deletion)
+
+	return true
+}
+
+// A storage which comes back applies the queued deletions first, so it never returns a session which has been
+// deleted while it was down. If one of them fails, it's considered down again.
+func (storage *ChainedSessionStorage) isAvailable(index int) bool {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if time.Now().Before(storage.downUntil[index]) {
+		return false
+	}
+
+	for len(storage.queuedDeletions[index]) > 0 {
+		if err := storage.queuedDeletions[index][0](storage.storages[index]); err != nil {
+			storage.downUntil[index] = time.Now().Add(storage.retryInterval)
+			return false
+		}
+
+		storage.queuedDeletions[index] = storage.queuedDeletions[index][1:]
+	}
+
+	return true
+}
+
+func (storage *ChainedSessionStorage) markDown(index int) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	storage.downUntil[index] = time.Now().Add(storage.retryInterval)
+}
@@ -0,0 +1,169 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errStorageDown = errors.New("storage is down")
+
+// A storage which fails while down is set, like a shared storage which is unreachable.
+type failingSessionStorage struct {
+	*InMemorySessionStorage
+	down  bool
+	calls int
+}
+
+func (storage *failingSessionStorage) StoreSession(sessionId string, state *SessionState) (string, error) {
+	storage.calls++
+	if storage.down {
+		return "", errStorageDown
+	}
+
+	return storage.InMemorySessionStorage.StoreSession(sessionId, state)
+}
+
+func (storage *failingSessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	storage.calls++
+	if storage.down {
+		return nil, errStorageDown
+	}
+
+	return storage.InMemorySessionStorage.TryGetSession(sessionTicket)
+}
+
+func (storage *failingSessionStorage) DeleteSession(sessionTicket string) error {
+	storage.calls++
+	if storage.down {
+		return errStorageDown
+	}
+
+	return storage.InMemorySessionStorage.DeleteSession(sessionTicket)
+}
+
+func TestChainedSessionStorageFallsBack(t *testing.T) {
+	primary := &failingSessionStorage{InMemorySessionStorage: CreateInMemorySessionStorage(time.Hour), down: true}
+	fallback := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateChainedSessionStorage(time.Hour, primary, fallback)
+
+	ticket, err := storage.StoreSession("abc", &SessionState{Id: "abc", Subject: "alice"})
+	if err != nil {
+		t.Fatalf("Expected the session to be stored in the fallback, but got %v", err)
+	}
+
+	restored, err := storage.TryGetSession(ticket)
+	if err != nil || restored == nil || restored.Subject != "alice" {
+		t.Fatalf("Expected the fallback to serve the session, but got %+v: %v", restored, err)
+	}
+
+	// The primary is skipped while it's down
+	if primary.calls != 1 {
+		t.Fatalf("Expected the primary to be called once, but got %d calls", primary.calls)
+	}
+
+	if err := storage.DeleteSession(ticket); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := fallback.TryGetSession(ticket); restored != nil {
+		t.Fatal("Expected the session to be deleted from the fallback")
+	}
+}
+
+func TestChainedSessionStorageRetriesThePrimary(t *testing.T) {
+	primary := &failingSessionStorage{InMemorySessionStorage: CreateInMemorySessionStorage(time.Hour), down: true}
+	fallback := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateChainedSessionStorage(time.Hour, primary, fallback)
+
+	fallbackTicket, _ := storage.StoreSession("old", &SessionState{Id: "old"})
+
+	// The retry interval has passed and the primary is back
+	storage.downUntil[0] = time.Now().Add(-time.Second)
+	primary.down = false
+
+	if _, err := storage.StoreSession("new", &SessionState{Id: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := primary.InMemorySessionStorage.TryGetSession("new"); restored == nil {
+		t.Fatal("Expected new sessions to be stored in the primary again")
+	}
+
+	// Sessions written during the outage are still found
+	if restored, err := storage.TryGetSession(fallbackTicket); err != nil || restored == nil {
+		t.Fatalf("Expected the session of the fallback to be restored, but got %+v: %v", restored, err)
+	}
+}
+
+func TestChainedSessionStorageQueuesDeletionsWhileDown(t *testing.T) {
+	primary := &failingSessionStorage{InMemorySessionStorage: CreateInMemorySessionStorage(time.Hour)}
+	fallback := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateChainedSessionStorage(time.Hour, primary, fallback)
+
+	storage.StoreSession("logout", &SessionState{Id: "logout", Subject: "alice"})
+	storage.StoreSession("revoked", &SessionState{Id: "revoked", Subject: "bob"})
+	storage.StoreSession("kept", &SessionState{Id: "kept", Subject: "carol"})
+
+	// The primary goes down and the deletions fail or skip it
+	primary.down = true
+	if err := storage.DeleteSession("logout"); err != nil {
+		t.Fatalf("Expected the deletion to succeed on the fallback, but got %v", err)
+	}
+	storage.DeleteBySubject("bob")
+
+	// The primary comes back with the sessions it had before the outage
+	storage.downUntil[0] = time.Now().Add(-time.Second)
+	primary.down = false
+
+	for _, sessionId := range []string{"logout", "revoked"} {
+		if restored, err := storage.TryGetSession(sessionId); err != nil || restored != nil {
+			t.Fatalf("Expected the session %s to stay deleted, but got %+v: %v", sessionId, restored, err)
+		}
+		if restored, _ := primary.InMemorySessionStorage.TryGetSession(sessionId); restored != nil {
+			t.Fatalf("Expected the queued deletion of %s to be applied to the primary", sessionId)
+		}
+	}
+	if restored, _ := storage.TryGetSession("kept"); restored == nil {
+		t.Fatal("Expected the other sessions to be kept")
+	}
+}
+
+func TestChainedSessionStorageFailsWithoutAvailableStorage(t *testing.T) {
+	primary := &failingSessionStorage{InMemorySessionStorage: CreateInMemorySessionStorage(time.Hour), down: true}
+	storage := CreateChainedSessionStorage(time.Hour, primary)
+
+	if _, err := storage.StoreSession("abc", &SessionState{Id: "abc"}); !errors.Is(err, errStorageDown) {
+		t.Fatalf("Expected the error of the storage, but got %v", err)
+	}
+	if _, err := storage.StoreSession("abc", &SessionState{Id: "abc"}); !errors.Is(err, ErrNoSessionStorageAvailable) {
+		t.Fatalf("Expected ErrNoSessionStorageAvailable, but got %v", err)
+	}
+}
+
+func TestChainedSessionStorageMigratesCookieSessions(t *testing.T) {
+	memoryStorage := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateChainedSessionStorage(0, memoryStorage, CreateLegacyCookieSessionStorage())
+
+	legacyTicket, _ := CreateCookieSessionStorage().StoreSession("abc", &SessionState{Id: "abc", Subject: "alice"})
+
+	restored, err := storage.TryGetSession(legacyTicket)
+	if err != nil || restored == nil || restored.Subject != "alice" {
+		t.Fatalf("Expected the legacy cookie session to be read, but got %+v: %v", restored, err)
+	}
+
+	// The next write moves it to the memory
+	ticket, err := storage.StoreSession(restored.Id, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket == legacyTicket || ticket != "abc" {
+		t.Fatalf("Expected an opaque ticket, but got %s", ticket)
+	}
+	if stored, _ := memoryStorage.TryGetSession(ticket); stored == nil || stored.Subject != "alice" {
+		t.Fatal("Expected the session to be stored in the memory")
+	}
+
+	// Unknown opaque tickets are no error of the legacy storage
+	if restored, err := storage.TryGetSession("unknown"); restored != nil || err != nil {
+		t.Fatalf("Expected an unknown ticket not to be found, but got %+v: %v", restored, err)
+	}
+}
@@ -1,6 +1,9 @@
 package session
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+)
 
 type CookieSessionStorage struct {
 }
@@ -26,3 +29,36 @@ func (storage *CookieSessionStorage) TryGetSession(sessionTicket string) (*Sessi
 
 	return state, nil
 }
+
+// The session is stored in the cookie itself, so it's gone once the cookie is replaced or cleared.
+func (storage *CookieSessionStorage) DeleteSession(sessionTicket string) error {
+	return nil
+}
+
+// The session is stored in the cookie itself, so there is nothing we could delete on the server.
+func (storage *CookieSessionStorage) DeleteBySubject(subject string) error {
+	return nil
+}
+
+// The sessions aren't known on the server, so they can't be limited.
+func (storage *CookieSessionStorage) LimitSessionsPerSubject(subject string, maxSessions int) error {
+	return nil
+}
+
+// Reads the sessions which have been stored in the cookie, while migrating to another storage.
+// Tickets of the other storage are not an error, but simply not known to this one.
+type LegacyCookieSessionStorage struct {
+	CookieSessionStorage
+}
+
+func CreateLegacyCookieSessionStorage() *LegacyCookieSessionStorage {
+	return &LegacyCookieSessionStorage{}
+}
+
+func (storage *LegacyCookieSessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	if !strings.HasPrefix(sessionTicket, "{") {
+		return nil, nil
+	}
+
+	return storage.CookieSessionStorage.TryGetSession(sessionTicket)
+}
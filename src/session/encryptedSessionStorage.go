@@ -0,0 +1,91 @@
+package session
+
+import (
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// EncryptedSessionStorage encrypts the tokens of a session before they are passed to the inner storage
+// and decrypts them on read. This protects the tokens at rest, independent of the cookie encryption.
+type EncryptedSessionStorage struct {
+	inner  SessionStorage
+	secret string
+}
+
+func CreateEncryptedSessionStorage(inner SessionStorage, secret string) *EncryptedSessionStorage {
+	return &EncryptedSessionStorage{
+		inner:  inner,
+		secret: secret,
+	}
+}
+
+func (storage *EncryptedSessionStorage) StoreSession(sessionId string, state *SessionState) (string, error) {
+	// Don't modify the state of the caller
+	encryptedState := *state
+
+	var err error
+
+	encryptedState.AccessToken, err = storage.encrypt(state.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	encryptedState.IdToken, err = storage.encrypt(state.IdToken)
+	if err != nil {
+		return "", err
+	}
+	encryptedState.RefreshToken, err = storage.encrypt(state.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	return storage.inner.StoreSession(sessionId, &encryptedState)
+}
+
+func (storage *EncryptedSessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	state, err := storage.inner.TryGetSession(sessionTicket)
+	if err != nil || state == nil {
+		return state, err
+	}
+
+	state.AccessToken, err = storage.decrypt(state.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	state.IdToken, err = storage.decrypt(state.IdToken)
+	if err != nil {
+		return nil, err
+	}
+	state.RefreshToken, err = storage.decrypt(state.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (storage *EncryptedSessionStorage) DeleteSession(sessionTicket string) error {
+	return storage.inner.DeleteSession(sessionTicket)
+}
+
+func (storage *EncryptedSessionStorage) DeleteBySubject(subject string) error {
+	return storage.inner.DeleteBySubject(subject)
+}
+
+func (storage *EncryptedSessionStorage) LimitSessionsPerSubject(subject string, maxSessions int) error {
+	return storage.inner.LimitSessionsPerSubject(subject, maxSessions)
+}
+
+func (storage *EncryptedSessionStorage) encrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	return utils.Encrypt(value, storage.secret)
+}
+
+func (storage *EncryptedSessionStorage) decrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	return utils.Decrypt(value, storage.secret)
+}
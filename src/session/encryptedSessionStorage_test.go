@@ -0,0 +1,65 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+func TestEncryptedSessionStorage(t *testing.T) {
+	inner := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateEncryptedSessionStorage(inner, testSecret)
+
+	state := &SessionState{
+		Id:           "session-id",
+		AccessToken:  "plain-access-token",
+		IdToken:      "plain-id-token",
+		RefreshToken: "plain-refresh-token",
+	}
+
+	ticket, err := storage.StoreSession(state.Id, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.AccessToken != "plain-access-token" {
+		t.Fatal("Expected the state of the caller not to be modified")
+	}
+
+	stored := inner.sessions[state.Id].state
+	for _, value := range []string{stored.AccessToken, stored.IdToken, stored.RefreshToken} {
+		if value == "" || strings.Contains(value, "plain") {
+			t.Fatalf("Expected the stored token to be encrypted, but got %s", value)
+		}
+	}
+
+	restored, err := storage.TryGetSession(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.AccessToken != "plain-access-token" || restored.IdToken != "plain-id-token" || restored.RefreshToken != "plain-refresh-token" {
+		t.Fatalf("Expected the tokens to be decrypted, but got %+v", restored)
+	}
+}
+
+func TestEncryptedSessionStorageKeepsEmptyTokens(t *testing.T) {
+	inner := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateEncryptedSessionStorage(inner, testSecret)
+
+	ticket, err := storage.StoreSession("session-id", &SessionState{Id: "session-id", AccessToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inner.sessions["session-id"].state.RefreshToken != "" {
+		t.Fatal("Expected an empty refresh token to stay empty")
+	}
+
+	restored, err := storage.TryGetSession(ticket)
+	if err != nil || restored.RefreshToken != "" || restored.AccessToken != "token" {
+		t.Fatalf("Unexpected session %+v: %v", restored, err)
+	}
+}
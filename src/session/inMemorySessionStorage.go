@@ -0,0 +1,363 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
+)
+
+// Pending logins which are not completed within this time are discarded, unless LimitPendingLogins sets another one.
+const defaultPendingLoginMaxAge = 10 * time.Minute
+
+// Every unauthenticated request may start a login, so the number of pending logins is limited.
+// When the limit is reached, the oldest pending login is discarded.
+const defaultMaxPendingLogins = 10000
+
+// Expired entries are removed on write, but not more often than this.
+const inMemoryCleanupInterval = time.Minute
+
+// InMemorySessionStorage keeps the sessions in the memory of the Traefik instance.
+// The session ticket is only the session id, so the session cookie stays small.
+// Sessions are lost when Traefik restarts, unless they are persisted using Save and Load, and are not shared between multiple instances.
+type InMemorySessionStorage struct {
+	lock          sync.Mutex
+	sessions      map[string]*inMemorySession
+	pendingLogins map[string]*PendingLogin
+	maxAge        time.Duration
+	lastCleanup   time.Time
+
+	pendingLoginMaxAge time.Duration
+	maxPendingLogins   int
+
+	// Counts the writes and deletions of sessions, so a persisted storage is only saved when it has changed.
+	changes uint64
+
+	// Signals deletions of sessions, so a persisted storage can save them right away.
+	deletions chan struct{}
+}
+
+type inMemorySession struct {
+	state    SessionState
+	storedAt time.Time
+}
+
+// Sessions which haven't been written for maxAge are discarded.
+func CreateInMemorySessionStorage(maxAge time.Duration) *InMemorySessionStorage {
+	return &InMemorySessionStorage{
+		sessions:      make(map[string]*inMemorySession),
+		pendingLogins: make(map[string]*PendingLogin),
+		maxAge:        maxAge,
+		lastCleanup:   time.Now(),
+
+		pendingLoginMaxAge: defaultPendingLoginMaxAge,
+		maxPendingLogins:   defaultMaxPendingLogins,
+
+		deletions: make(chan struct{}, 1),
+	}
+}
+
+// Pending logins are discarded after maxAge. At most maxPendingLogins are kept, discarding the oldest ones.
+func (storage *InMemorySessionStorage) LimitPendingLogins(maxPendingLogins int, maxAge time.Duration) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	storage.maxPendingLogins = maxPendingLogins
+	storage.pendingLoginMaxAge = maxAge
+}
+
+func (storage *InMemorySessionStorage) StoreSession(sessionId string, state *SessionState) (string, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	storage.cleanup()
+
+	storage.sessions[sessionId] = &inMemorySession{
+		state:    *state,
+		storedAt: time.Now(),
+	}
+	storage.changes++
+
+	return sessionId, nil
+}
+
+func (storage *InMemorySessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	entry, ok := storage.sessions[sessionTicket]
+	if !ok {
+		return nil, nil
+	}
+
+	if time.Since(entry.storedAt) > storage.maxAge {
+		delete(storage.sessions, sessionTicket)
+		return nil, nil
+	}
+
+	// Return a copy, so the caller can't modify the stored session
+	state := entry.state
+	return &state, nil
+}
+
+func (storage *InMemorySessionStorage) DeleteSession(sessionTicket string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if _, ok := storage.sessions[sessionTicket]; ok {
+		delete(storage.sessions, sessionTicket)
+		storage.notifyDeletion()
+	}
+	storage.changes++
+
+	return nil
+}
+
+func (storage *InMemorySessionStorage) DeleteBySubject(subject string) error {
+	if subject == "" {
+		return nil
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for sessionId, entry := range storage.sessions {
+		if entry.state.Subject == subject {
+			delete(storage.sessions, sessionId)
+			storage.changes++
+			storage.notifyDeletion()
+		}
+	}
+
+	return nil
+}
+
+func (storage *InMemorySessionStorage) LimitSessionsPerSubject(subject string, maxSessions int) error {
+	if subject == "" || maxSessions < 1 {
+		return nil
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	sessionIds := make([]string, 0)
+	for sessionId, entry := range storage.sessions {
+		if entry.state.Subject == subject {
+			sessionIds = append(sessionIds, sessionId)
+		}
+	}
+
+	if len(sessionIds) <= maxSessions {
+		return nil
+	}
+
+	// Oldest first. Renewals don't change the creation time, so a session which is in use is still evicted when it's the oldest.
+	sort.Slice(sessionIds, func(i, j int) bool {
+		return storage.sessions[sessionIds[i]].createdAt().Before(storage.sessions[sessionIds[j]].createdAt())
+	})
+
+	for _, sessionId := range sessionIds[:len(sessionIds)-maxSessions] {
+		delete(storage.sessions, sessionId)
+	}
+	storage.changes++
+	storage.notifyDeletion()
+
+	return nil
+}
+
+// Returns the number of writes and deletions of sessions so far.
+func (storage *InMemorySessionStorage) ChangeCount() uint64 {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	return storage.changes
+}
+
+// Receives a value after sessions have been deleted, eg. by a logout. Multiple deletions may be signaled only once.
+func (storage *InMemorySessionStorage) Deletions() <-chan struct{} {
+	return storage.deletions
+}
+
+// Doesn't block, because a pending signal already covers this deletion.
+func (storage *InMemorySessionStorage) notifyDeletion() {
+	select {
+	case storage.deletions <- struct{}{}:
+	default:
+	}
+}
+
+// The serialized form of a session, because the fields of inMemorySession are not exported.
+type persistedSession struct {
+	State    SessionState `json:"state"`
+	StoredAt time.Time    `json:"stored_at"`
+}
+
+// Save writes all sessions, encrypted with the secret, to the file.
+// The file is replaced atomically, so a concurrent Load never reads a partially written file.
+func (storage *InMemorySessionStorage) Save(filePath string, secret string) error {
+	storage.lock.Lock()
+
+	sessions := make(map[string]persistedSession, len(storage.sessions))
+	for sessionId, entry := range storage.sessions {
+		sessions[sessionId] = persistedSession{
+			State:    entry.state,
+			StoredAt: entry.storedAt,
+		}
+	}
+
+	storage.lock.Unlock()
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := utils.Encrypt(string(data), secret)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.WriteString(encrypted)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), filePath)
+}
+
+// Load reads the sessions written by Save and adds them to the storage. Expired sessions are skipped.
+// A missing file is not an error, because there is nothing to restore on the first start.
+func (storage *InMemorySessionStorage) Load(filePath string, secret string) error {
+	encrypted, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := utils.Decrypt(string(encrypted), secret)
+	if err != nil {
+		return err
+	}
+
+	var sessions map[string]persistedSession
+	err = json.Unmarshal([]byte(data), &sessions)
+	if err != nil {
+		return err
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	for sessionId, entry := range sessions {
+		if time.Since(entry.StoredAt) > storage.maxAge {
+			continue
+		}
+
+		storage.sessions[sessionId] = &inMemorySession{
+			state:    entry.State,
+			storedAt: entry.StoredAt,
+		}
+	}
+
+	return nil
+}
+
+func (entry *inMemorySession) createdAt() time.Time {
+	if entry.state.CreatedAt.IsZero() {
+		return entry.storedAt
+	}
+
+	return entry.state.CreatedAt
+}
+
+func (storage *InMemorySessionStorage) StorePendingLogin(state string, login *PendingLogin) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	storage.cleanup()
+
+	pendingLogin := *login
+	if pendingLogin.CreatedAt.IsZero() {
+		pendingLogin.CreatedAt = time.Now()
+	}
+
+	if _, exists := storage.pendingLogins[state]; !exists {
+		for len(storage.pendingLogins) >= storage.maxPendingLogins {
+			storage.discardOldestPendingLogin()
+		}
+	}
+
+	storage.pendingLogins[state] = &pendingLogin
+
+	return nil
+}
+
+// The lock must be held by the caller.
+func (storage *InMemorySessionStorage) discardOldestPendingLogin() {
+	oldestState := ""
+	var oldestCreatedAt time.Time
+
+	for state, login := range storage.pendingLogins {
+		if oldestState == "" || login.CreatedAt.Before(oldestCreatedAt) {
+			oldestState = state
+			oldestCreatedAt = login.CreatedAt
+		}
+	}
+
+	delete(storage.pendingLogins, oldestState)
+}
+
+func (storage *InMemorySessionStorage) TakePendingLogin(state string) (*PendingLogin, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	login, ok := storage.pendingLogins[state]
+	if !ok {
+		return nil, nil
+	}
+
+	delete(storage.pendingLogins, state)
+
+	if time.Since(login.CreatedAt) > storage.pendingLoginMaxAge {
+		return nil, nil
+	}
+
+	return login, nil
+}
+
+// Removes expired sessions and pending logins. The lock must be held by the caller.
+func (storage *InMemorySessionStorage) cleanup() {
+	if time.Since(storage.lastCleanup) < inMemoryCleanupInterval {
+		return
+	}
+
+	storage.lastCleanup = time.Now()
+
+	for sessionId, entry := range storage.sessions {
+		if time.Since(entry.storedAt) > storage.maxAge {
+			delete(storage.sessions, sessionId)
+		}
+	}
+
+	for state, login := range storage.pendingLogins {
+		if time.Since(login.CreatedAt) > storage.pendingLoginMaxAge {
+			delete(storage.pendingLogins, state)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInMemorySessionStorage(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	state := &SessionState{Id: "session-id", Subject: "alice", AccessToken: "token"}
+
+	ticket, err := storage.StoreSession(state.Id, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket != "session-id" {
+		t.Fatalf("Expected the ticket to be the session id, but got %s", ticket)
+	}
+
+	restored, err := storage.TryGetSession(ticket)
+	if err != nil || restored == nil || restored.AccessToken != "token" {
+		t.Fatalf("Expected the session to be restored, but got %+v: %v", restored, err)
+	}
+
+	restored.AccessToken = "modified"
+	if restored, _ := storage.TryGetSession(ticket); restored.AccessToken != "token" {
+		t.Fatal("Expected the stored session not to be modified by the caller")
+	}
+
+	if restored, err := storage.TryGetSession("unknown"); restored != nil || err != nil {
+		t.Fatalf("Expected no session for an unknown ticket, but got %+v: %v", restored, err)
+	}
+}
+
+func TestInMemorySessionStorageDeleteSession(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	storage.StoreSession("session-1", &SessionState{Id: "session-1"})
+	storage.StoreSession("session-2", &SessionState{Id: "session-2"})
+
+	if err := storage.DeleteSession("session-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored, _ := storage.TryGetSession("session-1"); restored != nil {
+		t.Error("Expected the session to be deleted")
+	}
+	if restored, _ := storage.TryGetSession("session-2"); restored == nil {
+		t.Error("Expected the other session to be kept")
+	}
+}
+
+func TestInMemorySessionStorageLimitSessionsPerSubject(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	const maxSessions = 3
+	start := time.Now()
+
+	for i := 0; i <= maxSessions; i++ {
+		sessionId := fmt.Sprintf("session-%d", i)
+		storage.StoreSession(sessionId, &SessionState{Id: sessionId, Subject: "alice", CreatedAt: start.Add(time.Duration(i) * time.Minute)})
+	}
+	storage.StoreSession("other", &SessionState{Id: "other", Subject: "bob", CreatedAt: start.Add(-time.Hour)})
+
+	if err := storage.LimitSessionsPerSubject("alice", maxSessions); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored, _ := storage.TryGetSession("session-0"); restored != nil {
+		t.Error("Expected the oldest session to be removed")
+	}
+	for i := 1; i <= maxSessions; i++ {
+		if restored, _ := storage.TryGetSession(fmt.Sprintf("session-%d", i)); restored == nil {
+			t.Errorf("Expected session-%d to be kept", i)
+		}
+	}
+	if restored, _ := storage.TryGetSession("other"); restored == nil {
+		t.Error("Expected the session of another subject to be kept")
+	}
+}
+
+func TestInMemorySessionStorageDeleteBySubject(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	storage.StoreSession("session-1", &SessionState{Id: "session-1", Subject: "alice"})
+	storage.StoreSession("session-2", &SessionState{Id: "session-2", Subject: "alice"})
+	storage.StoreSession("session-3", &SessionState{Id: "session-3", Subject: "bob"})
+
+	if err := storage.DeleteBySubject("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ticket := range []string{"session-1", "session-2"} {
+		if restored, _ := storage.TryGetSession(ticket); restored != nil {
+			t.Errorf("Expected session %s to be deleted", ticket)
+		}
+	}
+	if restored, _ := storage.TryGetSession("session-3"); restored == nil {
+		t.Error("Expected the session of another subject to be kept")
+	}
+}
+
+func TestInMemorySessionStorageExpiresSessions(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	storage.StoreSession("session-id", &SessionState{Id: "session-id"})
+	storage.sessions["session-id"].storedAt = time.Now().Add(-2 * time.Hour)
+
+	if restored, _ := storage.TryGetSession("session-id"); restored != nil {
+		t.Fatal("Expected an expired session not to be returned")
+	}
+}
+
+func TestInMemorySessionStoragePendingLogins(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	storage.StorePendingLogin("state-a", &PendingLogin{RedirectUrl: "https://example.com/a", CodeVerifier: "verifier-a"})
+	storage.StorePendingLogin("state-b", &PendingLogin{RedirectUrl: "https://example.com/b", CodeVerifier: "verifier-b"})
+
+	login, err := storage.TakePendingLogin("state-a")
+	if err != nil || login == nil || login.CodeVerifier != "verifier-a" || login.RedirectUrl != "https://example.com/a" {
+		t.Fatalf("Expected pending login a, but got %+v: %v", login, err)
+	}
+
+	if login, _ := storage.TakePendingLogin("state-a"); login != nil {
+		t.Fatal("Expected a pending login to be taken only once")
+	}
+
+	storage.pendingLogins["state-b"].CreatedAt = time.Now().Add(-time.Hour)
+
+	if login, _ := storage.TakePendingLogin("state-b"); login != nil {
+		t.Fatal("Expected an expired pending login not to be returned")
+	}
+}
+
+func TestInMemorySessionStorageLimitsPendingLogins(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+	storage.LimitPendingLogins(2, time.Minute)
+
+	storage.StorePendingLogin("state-a", &PendingLogin{CreatedAt: time.Now().Add(-3 * time.Second)})
+	storage.StorePendingLogin("state-b", &PendingLogin{CreatedAt: time.Now().Add(-2 * time.Second)})
+	storage.StorePendingLogin("state-c", &PendingLogin{})
+
+	if len(storage.pendingLogins) != 2 {
+		t.Fatalf("Expected at most 2 pending logins, but got %d", len(storage.pendingLogins))
+	}
+	if login, _ := storage.TakePendingLogin("state-a"); login != nil {
+		t.Fatal("Expected the oldest pending login to be discarded")
+	}
+	if login, _ := storage.TakePendingLogin("state-c"); login == nil {
+		t.Fatal("Expected the newest pending login to be kept")
+	}
+
+	storage.pendingLogins["state-b"].CreatedAt = time.Now().Add(-2 * time.Minute)
+	if login, _ := storage.TakePendingLogin("state-b"); login != nil {
+		t.Fatal("Expected a pending login older than the max age not to be returned")
+	}
+}
+
+func TestInMemorySessionStorageSaveLoad(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	filePath := filepath.Join(t.TempDir(), "sessions")
+
+	storage := CreateInMemorySessionStorage(time.Hour)
+	storage.StoreSession("session-1", &SessionState{Id: "session-1", Subject: "alice", AccessToken: "token-1"})
+	storage.StoreSession("session-2", &SessionState{Id: "session-2", Subject: "bob", RefreshToken: "refresh-2"})
+
+	if err := storage.Save(filePath, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "token-1") {
+		t.Error("Expected the persisted sessions to be encrypted")
+	}
+
+	restored := CreateInMemorySessionStorage(time.Hour)
+	if err := restored.Load(filePath, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, _ := restored.TryGetSession("session-1"); state == nil || state.Subject != "alice" || state.AccessToken != "token-1" {
+		t.Errorf("Expected session-1 to be restored, but got %+v", state)
+	}
+	if state, _ := restored.TryGetSession("session-2"); state == nil || state.Subject != "bob" || state.RefreshToken != "refresh-2" {
+		t.Errorf("Expected session-2 to be restored, but got %+v", state)
+	}
+
+	if err := CreateInMemorySessionStorage(time.Hour).Load(filePath, "AnotherSecretWith32CharactersXYZ"); err == nil {
+		t.Error("Expected the sessions not to be readable with another secret")
+	}
+}
+
+func TestInMemorySessionStorageLoadMissingFile(t *testing.T) {
+	storage := CreateInMemorySessionStorage(time.Hour)
+
+	if err := storage.Load(filepath.Join(t.TempDir(), "missing"), "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"); err != nil {
+		t.Fatalf("Expected a missing file to be ignored, but got: %v", err)
+	}
+}
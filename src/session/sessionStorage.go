@@ -9,16 +9,49 @@ import (
 type SessionStorage interface {
 	StoreSession(sessionId string, state *SessionState) (string, error)
 	TryGetSession(sessionTicket string) (*SessionState, error)
+	DeleteSession(sessionTicket string) error
+	DeleteBySubject(subject string) error
+	// Deletes the oldest sessions of the subject, so at most maxSessions remain.
+	LimitSessionsPerSubject(subject string, maxSessions int) error
+}
+
+// Implemented by storages which keep their data on the server.
+// Holds the state of logins which have been started but not completed yet, keyed by the state parameter.
+type PendingLoginStorage interface {
+	StorePendingLogin(state string, login *PendingLogin) error
+	// Returns and removes the pending login, so it can only be used once. Returns nil if it doesn't exist.
+	TakePendingLogin(state string) (*PendingLogin, error)
+}
+
+type PendingLogin struct {
+	RedirectUrl  string    `json:"redirect_url"`
+	CodeVerifier string    `json:"code_verifier"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// A form submission which started the login and is submitted again after it
+	Replay *ReplayRequest `json:"replay,omitempty"`
+}
+
+// An url-encoded form body which has been posted to the Url.
+type ReplayRequest struct {
+	Url  string `json:"url"`
+	Body string `json:"body"`
 }
 
 type SessionState struct {
 	Id             string    `json:"id"`
+	Subject        string    `json:"subject"`
 	RefreshedAt    time.Time `json:"created_at"`
+	CreatedAt      time.Time `json:"session_created_at"`
 	AccessToken    string    `json:"access_token"`
 	IdToken        string    `json:"id_token"`
 	RefreshToken   string    `json:"refresh_token"`
 	IsAuthorized   bool      `json:"is_authorized"`
+	AuthorizedAt   time.Time `json:"authorized_at"`
 	TokenExpiresIn int       `json:"token_expires_in"`
+
+	// A hash of the client properties the session is bound to, recorded at login.
+	Fingerprint string `json:"fingerprint,omitempty"`
 }
 
 func GenerateSessionId() string {
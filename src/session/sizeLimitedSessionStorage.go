@@ -0,0 +1,109 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Marks session tickets which have been issued by the overflow storage.
+const overflowTicketPrefix = "overflow:"
+
+var ErrSessionTooLarge = errors.New("the session is too large")
+
+// SizeLimitedSessionStorage rejects sessions whose serialized ticket exceeds maxSize bytes.
+// If an overflow storage is given, those sessions are stored there instead, eg. to keep
+// sessions with huge tokens on the server while all others stay in the cookie.
+type SizeLimitedSessionStorage struct {
+	inner    SessionStorage
+	overflow SessionStorage
+	maxSize  int
+}
+
+// The overflow storage is optional and may be nil.
+func CreateSizeLimitedSessionStorage(inner SessionStorage, maxSize int, overflow SessionStorage) *SizeLimitedSessionStorage {
+	return &SizeLimitedSessionStorage{
+		inner:    inner,
+		overflow: overflow,
+		maxSize:  maxSize,
+	}
+}
+
+func (storage *SizeLimitedSessionStorage) StoreSession(sessionId string, state *SessionState) (string, error) {
+	sessionTicket, err := storage.inner.StoreSession(sessionId, state)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sessionTicket) <= storage.maxSize {
+		if storage.overflow != nil {
+			// The session may have been too large before, eg. prior to a token renewal
+			if err := storage.overflow.DeleteSession(sessionId); err != nil {
+				return "", err
+			}
+		}
+
+		return sessionTicket, nil
+	}
+
+	if storage.overflow == nil {
+		return "", fmt.Errorf("%w: %d bytes exceed the maximum of %d bytes", ErrSessionTooLarge, len(sessionTicket), storage.maxSize)
+	}
+
+	// The inner storage might keep something on its own as well
+	if err := storage.inner.DeleteSession(sessionTicket); err != nil {
+		return "", err
+	}
+
+	overflowTicket, err := storage.overflow.StoreSession(sessionId, state)
+	if err != nil {
+		return "", err
+	}
+
+	return overflowTicketPrefix + overflowTicket, nil
+}
+
+func (storage *SizeLimitedSessionStorage) TryGetSession(sessionTicket string) (*SessionState, error) {
+	if overflowTicket, ok := storage.getOverflowTicket(sessionTicket); ok {
+		return storage.overflow.TryGetSession(overflowTicket)
+	}
+
+	return storage.inner.TryGetSession(sessionTicket)
+}
+
+func (storage *SizeLimitedSessionStorage) DeleteSession(sessionTicket string) error {
+	if overflowTicket, ok := storage.getOverflowTicket(sessionTicket); ok {
+		return storage.overflow.DeleteSession(overflowTicket)
+	}
+
+	return storage.inner.DeleteSession(sessionTicket)
+}
+
+func (storage *SizeLimitedSessionStorage) DeleteBySubject(subject string) error {
+	if storage.overflow != nil {
+		if err := storage.overflow.DeleteBySubject(subject); err != nil {
+			return err
+		}
+	}
+
+	return storage.inner.DeleteBySubject(subject)
+}
+
+// The limit is applied to the inner and the overflow storage separately.
+func (storage *SizeLimitedSessionStorage) LimitSessionsPerSubject(subject string, maxSessions int) error {
+	if storage.overflow != nil {
+		if err := storage.overflow.LimitSessionsPerSubject(subject, maxSessions); err != nil {
+			return err
+		}
+	}
+
+	return storage.inner.LimitSessionsPerSubject(subject, maxSessions)
+}
+
+func (storage *SizeLimitedSessionStorage) getOverflowTicket(sessionTicket string) (string, bool) {
+	if storage.overflow == nil || !strings.HasPrefix(sessionTicket, overflowTicketPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(sessionTicket, overflowTicketPrefix), true
+}
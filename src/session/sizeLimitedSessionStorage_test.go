@@ -0,0 +1,59 @@
+package session
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizeLimitedSessionStorageRejectsLargeSessions(t *testing.T) {
+	storage := CreateSizeLimitedSessionStorage(CreateCookieSessionStorage(), 512, nil)
+
+	if _, err := storage.StoreSession("small", &SessionState{Id: "small", AccessToken: "token"}); err != nil {
+		t.Fatalf("Expected a small session to be stored, but got %v", err)
+	}
+
+	_, err := storage.StoreSession("large", &SessionState{Id: "large", AccessToken: strings.Repeat("x", 1024)})
+	if !errors.Is(err, ErrSessionTooLarge) {
+		t.Fatalf("Expected ErrSessionTooLarge, but got %v", err)
+	}
+}
+
+func TestSizeLimitedSessionStorageOverflows(t *testing.T) {
+	overflow := CreateInMemorySessionStorage(time.Hour)
+	storage := CreateSizeLimitedSessionStorage(CreateCookieSessionStorage(), 512, overflow)
+
+	smallTicket, err := storage.StoreSession("small", &SessionState{Id: "small", AccessToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(smallTicket, overflowTicketPrefix) {
+		t.Fatal("Expected a small session to stay in the inner storage")
+	}
+
+	largeState := &SessionState{Id: "large", Subject: "alice", AccessToken: strings.Repeat("x", 1024)}
+
+	largeTicket, err := storage.StoreSession("large", largeState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if largeTicket != overflowTicketPrefix+"large" {
+		t.Fatalf("Expected the large session to be stored in the overflow storage, but got ticket %s", largeTicket)
+	}
+
+	for _, ticket := range []string{smallTicket, largeTicket} {
+		if restored, err := storage.TryGetSession(ticket); err != nil || restored == nil {
+			t.Fatalf("Expected the session to be restored, but got %+v: %v", restored, err)
+		}
+	}
+
+	// Once the session fits again, it is moved back to the inner storage
+	largeState.AccessToken = "token"
+	if ticket, _ := storage.StoreSession("large", largeState); strings.HasPrefix(ticket, overflowTicketPrefix) {
+		t.Fatal("Expected the session to be moved back to the inner storage")
+	}
+	if restored, _ := overflow.TryGetSession("large"); restored != nil {
+		t.Fatal("Expected the session to be removed from the overflow storage")
+	}
+}
@@ -0,0 +1,78 @@
+package src
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+// Traefik creates a new middleware instance on every configuration reload.
+// Instances using the same persistence file share their storage, so a reload doesn't lose the sessions
+// and only one instance writes the file.
+var (
+	persistentSessionStorages     = make(map[string]*session.InMemorySessionStorage)
+	persistentSessionStoragesLock sync.Mutex
+)
+
+// Returns the storage persisted to the file, restoring its sessions on the first call.
+func getPersistentSessionStorage(logger *logging.Logger, filePath string, secret string, maxAge time.Duration, interval time.Duration) *session.InMemorySessionStorage {
+	persistentSessionStoragesLock.Lock()
+	defer persistentSessionStoragesLock.Unlock()
+
+	if storage, ok := persistentSessionStorages[filePath]; ok {
+		return storage
+	}
+
+	storage := session.CreateInMemorySessionStorage(maxAge)
+
+	// A file which can't be restored, eg. because the secret has changed, only means that the users need to log in again
+	err := storage.Load(filePath, secret)
+	if err != nil {
+		logger.Log(logging.LevelWarn, "Failed to restore the sessions from %s: %s", filePath, err.Error())
+	} else {
+		logger.Log(logging.LevelInfo, "Restored the sessions from %s", filePath)
+	}
+
+	persistentSessionStorages[filePath] = storage
+
+	// Plugins don't get notified when Traefik stops, and Traefik's interpreter doesn't offer the syscall package
+	// to catch SIGTERM. So the sessions are saved periodically instead, whenever they have changed.
+	// Deletions are saved right away, so a revoked session doesn't come back after a restart.
+	go persistSessionsPeriodically(logger, storage, filePath, secret, interval, storage.ChangeCount())
+
+	return storage
+}
+
+// The restored sessions, reflected by savedChanges, don't need to be saved again.
+func persistSessionsPeriodically(logger *logging.Logger, storage *session.InMemorySessionStorage, filePath string, secret string, interval time.Duration, savedChanges uint64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-storage.Deletions():
+		}
+
+		savedChanges = persistSessionsIfChanged(logger, storage, filePath, secret, savedChanges)
+	}
+}
+
+// Saves the sessions, if they have changed since savedChanges, and returns the change count which has been saved.
+func persistSessionsIfChanged(logger *logging.Logger, storage *session.InMemorySessionStorage, filePath string, secret string, savedChanges uint64) uint64 {
+	changes := storage.ChangeCount()
+	if changes == savedChanges {
+		return savedChanges
+	}
+
+	if err := storage.Save(filePath, secret); err != nil {
+		logger.Log(logging.LevelError, "Failed to persist the sessions to %s: %s", filePath, err.Error())
+		return savedChanges
+	}
+
+	logger.Log(logging.LevelDebug, "Persisted the sessions to %s", filePath)
+
+	return changes
+}
@@ -0,0 +1,87 @@
+package src
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+)
+
+func TestSessionsArePersistedWhenChanged(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	filePath := filepath.Join(t.TempDir(), "sessions")
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	savedChanges := storage.ChangeCount()
+
+	// Nothing has changed yet, so the file isn't written
+	savedChanges = persistSessionsIfChanged(logger, storage, filePath, secret, savedChanges)
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatal("Expected no file without changes")
+	}
+
+	storage.StoreSession("session-1", &session.SessionState{Id: "session-1", Subject: "alice"})
+	savedChanges = persistSessionsIfChanged(logger, storage, filePath, secret, savedChanges)
+
+	restored := session.CreateInMemorySessionStorage(time.Hour)
+	if err := restored.Load(filePath, secret); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := restored.TryGetSession("session-1"); state == nil || state.Subject != "alice" {
+		t.Fatalf("Expected the changed sessions to be persisted, but got %+v", state)
+	}
+
+	// A logout is persisted as well
+	storage.DeleteSession("session-1")
+	persistSessionsIfChanged(logger, storage, filePath, secret, savedChanges)
+
+	restored = session.CreateInMemorySessionStorage(time.Hour)
+	if err := restored.Load(filePath, secret); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := restored.TryGetSession("session-1"); state != nil {
+		t.Fatal("Expected the deleted session not to be persisted")
+	}
+}
+
+func TestDeletedSessionsArePersistedImmediately(t *testing.T) {
+	logger := logging.CreateLogger(logging.LevelDebug)
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+	filePath := filepath.Join(t.TempDir(), "sessions")
+
+	// The interval is too long to save the deletions during the test
+	storage := getPersistentSessionStorage(logger, filePath, secret, time.Hour, time.Hour)
+
+	storage.StoreSession("session-1", &session.SessionState{Id: "session-1", Subject: "alice"})
+	storage.StoreSession("session-2", &session.SessionState{Id: "session-2", Subject: "bob"})
+	if err := storage.Save(filePath, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.DeleteSession("session-1")
+	storage.DeleteBySubject("bob")
+
+	// Simulates a restart by restoring the file into a new storage
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		restored := session.CreateInMemorySessionStorage(time.Hour)
+		if err := restored.Load(filePath, secret); err != nil {
+			t.Fatal(err)
+		}
+
+		first, _ := restored.TryGetSession("session-1")
+		second, _ := restored.TryGetSession("session-2")
+		if first == nil && second == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the deleted sessions to be gone after a restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
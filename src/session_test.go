@@ -1,11 +1,19 @@
 package src
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+	"github.com/sevensolutions/traefik-oidc-auth/src/oidc"
 	"github.com/sevensolutions/traefik-oidc-auth/src/session"
+	"github.com/sevensolutions/traefik-oidc-auth/src/utils"
 )
 
 func TestSessionIdpTokenExpiration(t *testing.T) {
@@ -49,3 +57,637 @@ func TestSessionIdpTokenExpiration(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSessionAbsoluteTimeout(t *testing.T) {
+	toa := &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: &Config{},
+	}
+
+	now := time.Now()
+
+	if checkSessionExceededAbsoluteTimeout(toa, &session.SessionState{CreatedAt: now.Add(-24 * time.Hour)}) {
+		t.Fatal("Expected the absolute timeout to be disabled by default")
+	}
+
+	toa.Config.AbsoluteTimeout = 8 * 60 * 60
+
+	if checkSessionExceededAbsoluteTimeout(toa, &session.SessionState{CreatedAt: now.Add(-7 * time.Hour), RefreshedAt: now}) {
+		t.Fatal("Expected the session to be valid within the absolute timeout")
+	}
+	if !checkSessionExceededAbsoluteTimeout(toa, &session.SessionState{CreatedAt: now.Add(-9 * time.Hour), RefreshedAt: now}) {
+		t.Fatal("Expected the session to be expired even though it was refreshed recently")
+	}
+	if !checkSessionExceededAbsoluteTimeout(toa, &session.SessionState{RefreshedAt: now}) {
+		t.Fatal("Expected a session without a creation time to be expired")
+	}
+}
+
+func TestCookieSessionStoragePreservesCreatedAt(t *testing.T) {
+	storage := session.CreateCookieSessionStorage()
+
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	ticket, err := storage.StoreSession("id", &session.SessionState{Id: "id", CreatedAt: createdAt, RefreshedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := storage.TryGetSession(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !state.CreatedAt.Equal(createdAt) {
+		t.Fatalf("Expected CreatedAt %v, but got %v", createdAt, state.CreatedAt)
+	}
+}
+
+func TestValidateBearerTokenResourceAudience(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: http.DefaultClient,
+		Config: &Config{
+			Provider: &ProviderConfig{
+				TokenValidation:      "IdToken",
+				ValidateAudienceBool: true,
+				ValidAudience:        "web-client",
+				ResourceAudience:     "https://api.example.com",
+			},
+		},
+		Jwks: &oidc.JwksHandler{},
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	signToken := func(audience interface{}) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub": "12345",
+			"aud": audience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	ok, _, err := toa.validateToken(context.Background(), &session.SessionState{
+		Id:          "AuthorizationHeader",
+		AccessToken: signToken([]string{"other", "https://api.example.com"}),
+	})
+	if !ok || err != nil {
+		t.Fatalf("Expected bearer token with the resource audience to be valid, but got: %v", err)
+	}
+
+	ok, _, _ = toa.validateToken(context.Background(), &session.SessionState{
+		Id:          "AuthorizationHeader",
+		AccessToken: signToken("web-client"),
+	})
+	if ok {
+		t.Fatal("Expected bearer token with the web client audience to be rejected")
+	}
+}
+
+func TestGetSessionSubject(t *testing.T) {
+	toa := &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: &Config{
+			SubjectClaim: "sub",
+		},
+	}
+
+	claims := map[string]interface{}{
+		"sub":   "12345",
+		"email": "john.doe@example.com",
+	}
+
+	if subject := toa.getSessionSubject(claims); subject != "12345" {
+		t.Fatalf("Expected subject to be '12345', but got '%s'", subject)
+	}
+
+	toa.Config.SubjectClaim = "email"
+
+	if subject := toa.getSessionSubject(claims); subject != "john.doe@example.com" {
+		t.Fatalf("Expected subject to be 'john.doe@example.com', but got '%s'", subject)
+	}
+
+	toa.Config.SubjectClaim = "oid"
+
+	if subject := toa.getSessionSubject(claims); subject != "" {
+		t.Fatalf("Expected subject to be empty, but got '%s'", subject)
+	}
+}
+
+func TestReadSessionTicketFromHeader(t *testing.T) {
+	toa := &TraefikOidcAuth{
+		logger: logging.CreateLogger(logging.LevelDebug),
+		Config: &Config{
+			CookieNamePrefix: "TraefikOidcAuth",
+			SessionHeader: &SessionHeaderConfig{
+				Name: "X-Session-Ticket",
+			},
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	req.AddCookie(&http.Cookie{
+		Name:  "TraefikOidcAuth.Session",
+		Value: "from-cookie",
+	})
+
+	sessionTicket, err := toa.readSessionTicket(req)
+	if err != nil || sessionTicket != "from-cookie" {
+		t.Fatalf("Expected the session cookie to be used when the header is missing, but got '%s' (%v)", sessionTicket, err)
+	}
+
+	req.Header.Set("X-Session-Ticket", "from-header")
+
+	sessionTicket, err = toa.readSessionTicket(req)
+	if err != nil || sessionTicket != "from-header" {
+		t.Fatalf("Expected the session header to be used, but got '%s' (%v)", sessionTicket, err)
+	}
+}
+
+func TestExpiredSessionWithRefreshTokenStaysAuthenticated(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signToken := func(expiresAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub": "alice",
+			"exp": expiresAt.Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	refreshSucceeds := true
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !refreshSucceeds || r.FormValue("refresh_token") != "valid-refresh-token" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(oidc.OidcTokenResponse{
+			AccessToken: "new-access-token",
+			IdToken:     signToken(time.Now().Add(time.Hour)),
+			ExpiresIn:   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: http.DefaultClient,
+		Config: &Config{
+			Secret: "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ",
+			Provider: &ProviderConfig{
+				TokenValidation:       "IdToken",
+				TokenRenewalThreshold: 0.75,
+			},
+		},
+		SessionStorage:    session.CreateCookieSessionStorage(),
+		DiscoveryDocument: &oidc.OidcDiscovery{TokenEndpoint: tokenServer.URL},
+		Jwks:              &oidc.JwksHandler{},
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	createTicket := func() string {
+		ticket, _ := toa.SessionStorage.StoreSession("session-id", &session.SessionState{
+			Id:             "session-id",
+			CreatedAt:      time.Now().Add(-2 * time.Hour),
+			RefreshedAt:    time.Now().Add(-2 * time.Hour),
+			IdToken:        signToken(time.Now().Add(-time.Minute)),
+			RefreshToken:   "valid-refresh-token",
+			IsAuthorized:   true,
+			TokenExpiresIn: 3600,
+		})
+		encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encryptedTicket
+	}
+
+	sessionState, claims, updatedSession, err := validateSessionTicket(context.Background(), toa, createTicket(), "")
+	if err != nil {
+		t.Fatalf("Expected the expired session to be renewed, but got: %v", err)
+	}
+	if sessionState == nil || updatedSession == nil || claims["sub"] != "alice" || sessionState.AccessToken != "new-access-token" {
+		t.Fatalf("Expected a renewed session, but got %+v", sessionState)
+	}
+	if sessionState.RefreshToken != "valid-refresh-token" {
+		t.Error("Expected the refresh token to be kept")
+	}
+
+	refreshSucceeds = false
+
+	sessionState, _, _, err = validateSessionTicket(context.Background(), toa, createTicket(), "")
+	if err == nil || sessionState != nil {
+		t.Fatal("Expected the session to be rejected when the renewal fails")
+	}
+}
+
+func TestSessionWithoutRefreshTokenRequiresLoginOnExpiry(t *testing.T) {
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signToken := func(expiresAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"sub": "alice",
+			"exp": expiresAt.Unix(),
+		})
+		token.Header["kid"] = "test-kid"
+		signedToken, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedToken
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no renewal without a refresh token")
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer tokenServer.Close()
+
+	toa := &TraefikOidcAuth{
+		logger:     logging.CreateLogger(logging.LevelDebug),
+		httpClient: http.DefaultClient,
+		Config: &Config{
+			Secret: "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ",
+			Provider: &ProviderConfig{
+				TokenValidation:       "IdToken",
+				TokenRenewalThreshold: 0.5,
+			},
+		},
+		SessionStorage:    session.CreateCookieSessionStorage(),
+		DiscoveryDocument: &oidc.OidcDiscovery{TokenEndpoint: tokenServer.URL},
+		Jwks:              &oidc.JwksHandler{},
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	createTicket := func(idToken string) string {
+		ticket, _ := toa.SessionStorage.StoreSession("session-id", &session.SessionState{
+			Id:             "session-id",
+			CreatedAt:      time.Now().Add(-45 * time.Minute),
+			RefreshedAt:    time.Now().Add(-45 * time.Minute),
+			IdToken:        idToken,
+			IsAuthorized:   true,
+			TokenExpiresIn: 3600,
+		})
+		encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encryptedTicket
+	}
+
+	// Past the renewal threshold, but not yet expired
+	sessionState, claims, updatedSession, err := validateSessionTicket(context.Background(), toa, createTicket(signToken(time.Now().Add(15*time.Minute))), "")
+	if err != nil || sessionState == nil || claims["sub"] != "alice" {
+		t.Fatalf("Expected the session to be used until it expires, but got %+v (%v)", sessionState, err)
+	}
+	if updatedSession != nil {
+		t.Error("Expected the session not to be updated")
+	}
+
+	sessionState, _, _, err = validateSessionTicket(context.Background(), toa, createTicket(signToken(time.Now().Add(-time.Minute))), "")
+	if sessionState != nil {
+		t.Fatal("Expected the expired session to require a new login")
+	}
+	if !isExpiredError(err) {
+		t.Errorf("Expected an expired error, but got: %v", err)
+	}
+}
+
+func TestSessionBoundToIpIsInvalidatedOnChange(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.BindSessionToIp = true
+	toa.Config.Provider.TokenValidation = "IdToken"
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginReq := httptest.NewRequest("GET", "/", nil)
+	loginReq.RemoteAddr = "198.51.100.7:51234"
+
+	ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+		Id:           "session-id",
+		CreatedAt:    time.Now(),
+		RefreshedAt:  time.Now(),
+		IdToken:      signedIdToken,
+		IsAuthorized: true,
+		Fingerprint:  toa.getClientFingerprint(loginReq),
+	})
+	encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.RemoteAddr = remoteAddr
+		req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	// Another port of the same client is fine
+	if rw := serve("198.51.100.7:60000"); rw.Code != http.StatusOK {
+		t.Fatalf("Expected the session to be valid from the same IP, but got %d", rw.Code)
+	}
+
+	if rw := serve("203.0.113.9:51234"); rw.Code != http.StatusFound {
+		t.Fatalf("Expected a new login from another IP, but got %d", rw.Code)
+	}
+
+	if stored, _ := storage.TryGetSession("session-id"); stored != nil {
+		t.Fatal("Expected the session to be invalidated")
+	}
+	if rw := serve("198.51.100.7:60000"); rw.Code != http.StatusFound {
+		t.Fatalf("Expected the invalidated session not to be usable anymore, but got %d", rw.Code)
+	}
+}
+
+func TestAuthorizationRecheckUsesCurrentUserInfo(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.TokenValidation = "IdToken"
+	toa.Config.Provider.UseClaimsFromUserInfoBool = true
+	toa.Config.Authorization.AllowedGroups = []string{"admins"}
+	toa.Config.Authorization.GroupsClaim = "groups"
+	toa.Config.Authorization.RecheckInterval = 60
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	groups := []string{"admins"}
+	userInfoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"sub": "alice", "groups": groups})
+	}))
+	defer userInfoServer.Close()
+	toa.DiscoveryDocument.UserinfoEndpoint = userInfoServer.URL
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+		Id:           "session-id",
+		CreatedAt:    time.Now(),
+		RefreshedAt:  time.Now(),
+		IdToken:      signedIdToken,
+		IsAuthorized: true,
+		AuthorizedAt: time.Now(),
+	})
+	encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	expireAuthorization := func() {
+		stored, _ := storage.TryGetSession("session-id")
+		stored.AuthorizedAt = time.Now().Add(-2 * time.Minute)
+		storage.StoreSession("session-id", stored)
+	}
+
+	// The user has been removed from the group, but the decision of the login is kept until the recheck
+	groups = []string{"developers"}
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("Expected the session to be authorized before the recheck, but got %d", code)
+	}
+
+	expireAuthorization()
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("Expected the recheck to deny the session, but got %d", code)
+	}
+	if stored, _ := storage.TryGetSession("session-id"); stored.IsAuthorized {
+		t.Fatal("Expected the denial to be stored")
+	}
+
+	// The user has been added again
+	groups = []string{"admins"}
+	expireAuthorization()
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("Expected the recheck to authorize the session again, but got %d", code)
+	}
+}
+
+func TestAuthorizationRecheckKeepsTheDecisionWhenTheWebhookFails(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.TokenValidation = "IdToken"
+	toa.Config.Authorization.RecheckInterval = 60
+	toa.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	// The webhook is unreachable
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"allow": false})
+	}))
+	webhookUrl := webhookServer.URL
+	webhookServer.Close()
+	toa.Config.Authorization.Webhook = &AuthorizationWebhookConfig{Url: webhookUrl, Timeout: 5}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	idToken.Header["kid"] = "test-kid"
+	signedIdToken, err := idToken.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedAt := time.Now().Add(-2 * time.Minute)
+	ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+		Id:           "session-id",
+		CreatedAt:    time.Now(),
+		RefreshedAt:  time.Now(),
+		IdToken:      signedIdToken,
+		IsAuthorized: true,
+		AuthorizedAt: authorizedAt,
+	})
+	encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+		rw := httptest.NewRecorder()
+
+		toa.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("Expected the previous decision to be kept, but got %d", code)
+	}
+	if stored, _ := storage.TryGetSession("session-id"); !stored.IsAuthorized || !stored.AuthorizedAt.Equal(authorizedAt) {
+		t.Fatalf("Expected the failed recheck not to be stored, but got %+v", stored)
+	}
+
+	// The webhook is reachable again, so the recheck is repeated
+	webhookServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"allow": false})
+	}))
+	defer webhookServer.Close()
+	toa.Config.Authorization.Webhook.Url = webhookServer.URL
+
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("Expected the repeated recheck to deny the session, but got %d", code)
+	}
+	if stored, _ := storage.TryGetSession("session-id"); stored.IsAuthorized {
+		t.Fatal("Expected the denial to be stored")
+	}
+}
+
+func TestRejectedRefreshTokenRestartsLogin(t *testing.T) {
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.TokenValidation = "IdToken"
+
+	storage := session.CreateInMemorySessionStorage(time.Hour)
+	toa.SessionStorage = storage
+
+	privateKey, err := generateRSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()})
+	token.Header["kid"] = "test-kid"
+	expiredIdToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider is unavailable first, which is retried, and then rejects the expired refresh token
+	requestCount := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(oidc.OidcErrorResponse{Error: "invalid_grant", ErrorDescription: "Token is not active"})
+	}))
+	defer tokenServer.Close()
+
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL
+	jwksServer := setupJWKS(t, toa, privateKey)
+	defer jwksServer.Close()
+
+	ticket, _ := storage.StoreSession("session-id", &session.SessionState{
+		Id:             "session-id",
+		CreatedAt:      time.Now().Add(-2 * time.Hour),
+		RefreshedAt:    time.Now().Add(-2 * time.Hour),
+		IdToken:        expiredIdToken,
+		RefreshToken:   "expired-refresh-token",
+		IsAuthorized:   true,
+		TokenExpiresIn: 3600,
+	})
+	encryptedTicket, err := utils.Encrypt(ticket, toa.Config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/protected", nil)
+	req.AddCookie(&http.Cookie{Name: getSessionCookieName(toa.Config), Value: encryptedTicket})
+	rw := httptest.NewRecorder()
+
+	toa.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusFound || !strings.HasPrefix(rw.Header().Get("Location"), "https://idp.example.com/authorize") {
+		t.Fatalf("Expected a redirect to a new login, but got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+	if requestCount != 2 {
+		t.Errorf("Expected the unavailable provider to be retried once, but got %d requests", requestCount)
+	}
+	if restored, _ := storage.TryGetSession(ticket); restored != nil {
+		t.Error("Expected the session to be deleted")
+	}
+	expectClearedCookies(t, rw, getSessionCookieName(toa.Config))
+}
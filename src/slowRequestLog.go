@@ -0,0 +1,38 @@
+package src
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+// Logs a warning for requests to the provider which take longer than the threshold, so a slow provider
+// can be told apart from a slow upstream.
+type slowRequestLoggingTransport struct {
+	inner     http.RoundTripper
+	logger    *logging.Logger
+	threshold time.Duration
+}
+
+func newSlowRequestLoggingTransport(inner http.RoundTripper, logger *logging.Logger, threshold time.Duration) *slowRequestLoggingTransport {
+	return &slowRequestLoggingTransport{
+		inner:     inner,
+		logger:    logger,
+		threshold: threshold,
+	}
+}
+
+func (transport *slowRequestLoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+
+	resp, err := transport.inner.RoundTrip(req)
+
+	if duration := time.Since(startedAt); duration > transport.threshold {
+		// The query is left out, as it may contain tokens
+		endpoint := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+		transport.logger.Log(logging.LevelWarn, "Slow request to the provider: %s %s took %dms.", req.Method, endpoint, duration.Milliseconds())
+	}
+
+	return resp, err
+}
@@ -0,0 +1,53 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sevensolutions/traefik-oidc-auth/src/logging"
+)
+
+func TestSlowRequestsToTheProviderAreLogged(t *testing.T) {
+	var output bytes.Buffer
+	logger := logging.CreateLogger(logging.LevelWarn)
+	logger.SetOutput(&output)
+
+	toa := newServeHttpTest(t)
+	toa.Config.Provider.SlowRequestThreshold = 20
+	httpClient, err := createHttpClient(logger, toa.Config, newProviderHosts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	toa.httpClient = httpClient
+
+	delay := 50 * time.Millisecond
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "new-access-token"})
+	}))
+	defer tokenServer.Close()
+	toa.DiscoveryDocument.TokenEndpoint = tokenServer.URL + "/token"
+
+	if _, err := toa.renewToken(context.Background(), "refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "[WARN] [traefik-oidc-auth] Slow request to the provider: POST "+tokenServer.URL+"/token took ") {
+		t.Fatalf("Expected a warning about the slow request, but got %q", output.String())
+	}
+
+	output.Reset()
+	delay = 0
+
+	if _, err := toa.renewToken(context.Background(), "refresh-token"); err != nil {
+		t.Fatal(err)
+	}
+	if output.Len() != 0 {
+		t.Fatalf("Expected fast requests not to be logged, but got %q", output.String())
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Idle buckets are removed on access, but not more often than this.
+const rateLimiterCleanupInterval = time.Minute
+
+// RateLimiter implements a token bucket per key. Every bucket holds up to burst tokens
+// and is refilled with rate tokens per second. A request consumes one token.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	lock        sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+
+	// Allows tests to control the time
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func CreateRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:        rate,
+		burst:       burst,
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// Consumes a token of the given key and returns whether the request is allowed.
+func (limiter *RateLimiter) Allow(key string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.now()
+
+	limiter.cleanup(now)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens:    float64(limiter.burst),
+			updatedAt: now,
+		}
+		limiter.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(float64(limiter.burst), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limiter.rate)
+		bucket.updatedAt = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// Returns the number of seconds after which a rejected request gets a new token.
+func (limiter *RateLimiter) RetryAfter() int {
+	return int(math.Ceil(1 / limiter.rate))
+}
+
+// Removes the buckets which have been refilled completely, because they behave like new ones.
+// The lock must be held by the caller.
+func (limiter *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(limiter.lastCleanup) < rateLimiterCleanupInterval {
+		return
+	}
+
+	limiter.lastCleanup = now
+
+	refillDuration := time.Duration(float64(limiter.burst) / limiter.rate * float64(time.Second))
+
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.updatedAt) > refillDuration {
+			delete(limiter.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	limiter := CreateRateLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+
+	if !limiter.Allow("alice") || !limiter.Allow("alice") {
+		t.Fatal("Expected the burst to be allowed")
+	}
+	if limiter.Allow("alice") {
+		t.Fatal("Expected the request exceeding the burst to be rejected")
+	}
+	if !limiter.Allow("bob") {
+		t.Fatal("Expected another key to have its own budget")
+	}
+
+	now = now.Add(time.Second)
+
+	if !limiter.Allow("alice") {
+		t.Fatal("Expected the bucket to be refilled after a second")
+	}
+	if limiter.Allow("alice") {
+		t.Fatal("Expected only one token to be refilled")
+	}
+}
+
+func TestRateLimiterRemovesIdleBuckets(t *testing.T) {
+	now := time.Now()
+
+	limiter := CreateRateLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("alice")
+
+	now = now.Add(2 * rateLimiterCleanupInterval)
+	limiter.Allow("bob")
+
+	if _, ok := limiter.buckets["alice"]; ok {
+		t.Fatal("Expected the idle bucket to be removed")
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	if retryAfter := CreateRateLimiter(0.1, 1).RetryAfter(); retryAfter != 10 {
+		t.Fatalf("Expected 10 seconds, but got %d", retryAfter)
+	}
+	if retryAfter := CreateRateLimiter(5, 1).RetryAfter(); retryAfter != 1 {
+		t.Fatalf("Expected 1 second, but got %d", retryAfter)
+	}
+}
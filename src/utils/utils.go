@@ -3,7 +3,9 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -16,6 +18,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type AcceptType struct {
@@ -156,33 +159,63 @@ func ParseInt(s string) (int, error) {
 	return int(v.Int64()), nil
 }
 
-func Encrypt(plaintext string, secret string) (string, error) {
-	aesCipher, err := aes.NewCipher([]byte(secret))
-	if err != nil {
-		return "", err
+const EncryptionAlgorithmAesGcm = "AES-256-GCM"
+
+// The version byte prefixed to the ciphertext, identifying the algorithm it was encrypted with.
+// Ciphertexts without a prefix were written by older versions and use AES-GCM.
+// Only algorithms of the standard library can be added, because Traefik's interpreter can't load
+// packages using assembly or unsafe, like golang.org/x/crypto.
+var encryptionVersions = map[string]byte{
+	EncryptionAlgorithmAesGcm: 1,
+}
+
+func IsValidEncryptionAlgorithm(algorithm string) bool {
+	_, ok := encryptionVersions[algorithm]
+	return ok
+}
+
+func createAead(algorithm string, secret string) (cipher.AEAD, error) {
+	switch algorithm {
+	case EncryptionAlgorithmAesGcm:
+		aesCipher, err := aes.NewCipher([]byte(secret))
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(aesCipher)
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", algorithm)
 	}
+}
+
+// Encrypts the plaintext using AES-GCM.
+func Encrypt(plaintext string, secret string) (string, error) {
+	return EncryptWithAlgorithm(plaintext, secret, EncryptionAlgorithmAesGcm)
+}
 
-	gcm, err := cipher.NewGCM(aesCipher)
+func EncryptWithAlgorithm(plaintext string, secret string, algorithm string) (string, error) {
+	aead, err := createAead(algorithm, secret)
 	if err != nil {
 		return "", err
 	}
 
-	// We need a 12-byte nonce for GCM (modifiable if you use cipher.NewGCMWithNonceSize())
 	// A nonce should always be randomly generated for every encryption.
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := make([]byte, aead.NonceSize())
 	_, err = rand.Read(nonce)
 	if err != nil {
 		return "", err
 	}
 
-	// ciphertext here is actually nonce+ciphertext
-	// So that when we decrypt, just knowing the nonce size
-	// is enough to separate it from the ciphertext.
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	// ciphertext here is actually version+nonce+ciphertext
+	// So that when we decrypt, the version selects the algorithm
+	// and knowing its nonce size is enough to separate it from the ciphertext.
+	ciphertext := append([]byte{encryptionVersions[algorithm]}, nonce...)
+	ciphertext = aead.Seal(ciphertext, nonce, []byte(plaintext), nil)
 
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
+// Decrypts a ciphertext of any supported algorithm, selected by its version byte.
 func Decrypt(ciphertext string, secret string) (string, error) {
 	if ciphertext == "" {
 		return "", errors.New("ciphertext must not be an empty string")
@@ -193,24 +226,36 @@ func Decrypt(ciphertext string, secret string) (string, error) {
 		return "", err
 	}
 
-	ciphertext = string(cipherbytes)
-
-	aesCipher, err := aes.NewCipher([]byte(secret))
-	if err != nil {
-		return "", err
+	// The first byte of a legacy ciphertext is random and may look like a version,
+	// so we fall back to the legacy format when it can't be opened.
+	for algorithm, version := range encryptionVersions {
+		if len(cipherbytes) > 0 && cipherbytes[0] == version {
+			plaintext, err := open(algorithm, secret, cipherbytes[1:])
+			if err == nil {
+				return plaintext, nil
+			}
+		}
 	}
 
-	gcm, err := cipher.NewGCM(aesCipher)
+	return open(EncryptionAlgorithmAesGcm, secret, cipherbytes)
+}
+
+func open(algorithm string, secret string, cipherbytes []byte) (string, error) {
+	aead, err := createAead(algorithm, secret)
 	if err != nil {
 		return "", err
 	}
 
 	// Since we know the ciphertext is actually nonce+ciphertext
 	// And len(nonce) == NonceSize(). We can separate the two.
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	nonceSize := aead.NonceSize()
+	if len(cipherbytes) < nonceSize {
+		return "", errors.New("ciphertext is too short")
+	}
+
+	nonce, cipherbytes := cipherbytes[:nonceSize], cipherbytes[nonceSize:]
 
-	plaintext, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
+	plaintext, err := aead.Open(nil, nonce, cipherbytes, nil)
 	if err != nil {
 		return "", err
 	}
@@ -218,6 +263,34 @@ func Decrypt(ciphertext string, secret string) (string, error) {
 	return string(plaintext), nil
 }
 
+// Appends an HMAC-SHA256 signature to the value. The value itself stays readable.
+func Sign(value string, secret string) string {
+	return value + "." + computeSignature(value, secret)
+}
+
+// Returns the value without the signature, if the signature is valid.
+func VerifySignature(signedValue string, secret string) (string, error) {
+	separator := strings.LastIndex(signedValue, ".")
+	if separator < 0 {
+		return "", errors.New("the value is not signed")
+	}
+
+	value, signature := signedValue[:separator], signedValue[separator+1:]
+
+	if !hmac.Equal([]byte(signature), []byte(computeSignature(value, secret))) {
+		return "", errors.New("the signature is invalid")
+	}
+
+	return value, nil
+}
+
+func computeSignature(value string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func ChunkString(input string, chunkSize int) []string {
 	var chunks []string
 
@@ -311,8 +384,8 @@ func ParseAcceptHeader(raw string) []AcceptType {
 		acceptTypes = append(acceptTypes, acceptType)
 	}
 
-	// Sort by weight in descending order
-	sort.Slice(acceptTypes, func(i, j int) bool {
+	// Sort by weight in descending order, keeping the original order for equal weights
+	sort.SliceStable(acceptTypes, func(i, j int) bool {
 		return acceptTypes[i].Weight > acceptTypes[j].Weight
 	})
 
@@ -330,3 +403,229 @@ func IsHtmlRequest(req *http.Request) bool {
 	// Assume HTML request have text/html or application/xhtml+xml with the highest weight
 	return acceptTypes[0].Type == "text/html" || acceptTypes[0].Type == "application/xhtml+xml"
 }
+
+// Returns whether the request has been sent in the background by JavaScript, using XMLHttpRequest or a cross-origin fetch.
+// Browsers only send Sec-Fetch-Mode: cors for fetch and XMLHttpRequest, never for navigations.
+func IsXhrRequest(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("X-Requested-With"), "XMLHttpRequest") ||
+		strings.EqualFold(req.Header.Get("Sec-Fetch-Mode"), "cors")
+}
+
+// Returns the offered type which is accepted with the highest weight by the request, or an empty string if none of them is acceptable.
+// Wildcards like */* or text/* in the Accept header are supported. With the same weight, an exact type is preferred
+// over a subtype wildcard like text/*, which is preferred over */*. When multiple offered types match the same media
+// range, the one listed first in offered wins.
+func NegotiateContentType(req *http.Request, offered []string) string {
+	acceptTypes := ParseAcceptHeader(req.Header.Get("Accept"))
+
+	sort.SliceStable(acceptTypes, func(i, j int) bool {
+		if acceptTypes[i].Weight != acceptTypes[j].Weight {
+			return acceptTypes[i].Weight > acceptTypes[j].Weight
+		}
+		return getMediaRangeSpecificity(acceptTypes[i].Type) > getMediaRangeSpecificity(acceptTypes[j].Type)
+	})
+
+	for _, acceptType := range acceptTypes {
+		if acceptType.Weight <= 0 {
+			continue
+		}
+
+		for _, offeredType := range offered {
+			if matchMediaRange(acceptType.Type, offeredType) {
+				return offeredType
+			}
+		}
+	}
+
+	return ""
+}
+
+// Returns 2 for an exact type, 1 for a subtype wildcard like text/* and 0 for */*.
+func getMediaRangeSpecificity(mediaRange string) int {
+	if mediaRange == "*/*" {
+		return 0
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		return 1
+	}
+	return 2
+}
+
+func matchMediaRange(mediaRange string, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+
+	if prefix, isWildcard := strings.CutSuffix(mediaRange, "/*"); isWildcard {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+
+	return false
+}
+
+// Returns the functions which are available in all templates, eg. for headers or error pages.
+func TemplateFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"split":  templateSplit,
+		"join":   templateJoin,
+		"lower":  templateLower,
+		"upper":  templateUpper,
+		"prefix": templatePrefix,
+
+		"default":    templateDefault,
+		"formatTime": templateFormatTime,
+	}
+}
+
+// The separator used when a list is printed directly, eg. {{ .claims.groups }}.
+// Use the join function for any other separator.
+const TemplateListSeparator = ","
+
+// A list which is printed as a separated string instead of Go's default format [a b c].
+// It can still be used with range, index, len and all of the template functions.
+type TemplateList []interface{}
+
+func (list TemplateList) String() string {
+	return strings.Join(toStringSlice(list), TemplateListSeparator)
+}
+
+// Returns a copy of the claims, where all lists are replaced by a TemplateList, so they can be printed directly in a template.
+func PrepareTemplateClaims(claims map[string]interface{}) map[string]interface{} {
+	if claims == nil {
+		return nil
+	}
+
+	return prepareTemplateValue(claims).(map[string]interface{})
+}
+
+func prepareTemplateValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(val))
+		for key, v := range val {
+			result[key] = prepareTemplateValue(v)
+		}
+		return result
+	case []interface{}:
+		result := make(TemplateList, len(val))
+		for i, v := range val {
+			result[i] = prepareTemplateValue(v)
+		}
+		return result
+	case []string:
+		result := make(TemplateList, len(val))
+		for i, v := range val {
+			result[i] = v
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// Converts a template value to a list of strings. Strings are returned as a single element list.
+func toStringSlice(value interface{}) []string {
+	switch val := value.(type) {
+	case nil:
+		return []string{}
+	case []string:
+		return val
+	case TemplateList:
+		return toStringSlice([]interface{}(val))
+	case []interface{}:
+		result := make([]string, len(val))
+		for i, v := range val {
+			result[i] = fmt.Sprintf("%v", v)
+		}
+		return result
+	default:
+		return []string{fmt.Sprintf("%v", val)}
+	}
+}
+
+func templateSplit(separator string, value interface{}) TemplateList {
+	if value == nil {
+		return TemplateList{}
+	}
+	return prepareTemplateValue(strings.Split(fmt.Sprintf("%v", value), separator)).(TemplateList)
+}
+
+func templateJoin(separator string, value interface{}) string {
+	return strings.Join(toStringSlice(value), separator)
+}
+
+func templateLower(value interface{}) interface{} {
+	return mapStrings(value, strings.ToLower)
+}
+
+func templateUpper(value interface{}) interface{} {
+	return mapStrings(value, strings.ToUpper)
+}
+
+func templatePrefix(prefix string, value interface{}) interface{} {
+	return mapStrings(value, func(s string) string {
+		return prefix + s
+	})
+}
+
+// Returns the default value if the value is missing or empty, eg. {{ .claims.name | default "Anonymous" }}.
+func templateDefault(defaultValue interface{}, value interface{}) interface{} {
+	switch val := value.(type) {
+	case nil:
+		return defaultValue
+	case string:
+		if val == "" {
+			return defaultValue
+		}
+	case []string, []interface{}, TemplateList:
+		if len(toStringSlice(val)) == 0 {
+			return defaultValue
+		}
+	}
+
+	return value
+}
+
+// Formats a time.Time, a unix timestamp like the exp claim or an RFC 3339 string using the Go layout, in UTC.
+// Values which can't be interpreted as a time are returned unchanged.
+func templateFormatTime(layout string, value interface{}) interface{} {
+	var t time.Time
+
+	switch val := value.(type) {
+	case time.Time:
+		t = val
+	case float64:
+		t = time.Unix(int64(val), 0)
+	case int:
+		t = time.Unix(int64(val), 0)
+	case int64:
+		t = time.Unix(val, 0)
+	case string:
+		parsed, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return value
+		}
+		t = parsed
+	default:
+		return value
+	}
+
+	return t.UTC().Format(layout)
+}
+
+// Applies fn to a single string or to every element of a list
+func mapStrings(value interface{}, fn func(string) string) interface{} {
+	switch value.(type) {
+	case nil:
+		return ""
+	case []string, []interface{}, TemplateList:
+		values := toStringSlice(value)
+		result := make(TemplateList, len(values))
+		for i, v := range values {
+			result[i] = fn(v)
+		}
+		return result
+	default:
+		return fn(fmt.Sprintf("%v", value))
+	}
+}
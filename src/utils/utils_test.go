@@ -1,8 +1,14 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"net/http"
 	"testing"
+	"text/template"
 )
 
 func TestChunkString(t *testing.T) {
@@ -44,6 +50,72 @@ func TestEncryptDecryptRoundtrip(t *testing.T) {
 	}
 }
 
+func TestEncryptDecryptRoundtripWithVersion(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+	encrypted, err := EncryptWithAlgorithm("hello", secret, EncryptionAlgorithmAesGcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cipherbytes, _ := base64.StdEncoding.DecodeString(encrypted); cipherbytes[0] != encryptionVersions[EncryptionAlgorithmAesGcm] {
+		t.Fatalf("Expected the ciphertext to be prefixed with the version, but got %d", cipherbytes[0])
+	}
+
+	decrypted, err := Decrypt(encrypted, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted != "hello" {
+		t.Fatalf("Expected hello, but got %s", decrypted)
+	}
+
+	if _, err := EncryptWithAlgorithm("hello", secret, "ChaCha20-Poly1305"); err == nil {
+		t.Fatal("Expected an unsupported algorithm to be rejected")
+	}
+}
+
+func TestDecryptLegacyCiphertext(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+	// Ciphertexts of older versions have no version prefix
+	aesCipher, _ := aes.NewCipher([]byte(secret))
+	gcm, _ := cipher.NewGCM(aesCipher)
+
+	for i := 0; i < 20; i++ {
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		// Also cover nonces which start with a version byte
+		nonce[0] = byte(i % 3)
+
+		legacy := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("hello"), nil))
+
+		decrypted, err := Decrypt(legacy, secret)
+		if err != nil || decrypted != "hello" {
+			t.Fatalf("Expected the legacy ciphertext to be readable, but got %q and %v", decrypted, err)
+		}
+	}
+}
+
+func TestSignVerifyRoundtrip(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+	signed := Sign("session-id", secret)
+
+	value, err := VerifySignature(signed, secret)
+	if err != nil || value != "session-id" {
+		t.Fatalf("Expected the signature to be valid, but got %s: %v", value, err)
+	}
+
+	// Changing the value or the signature must be detected
+	for _, modified := range []string{"other-id" + signed[len("session-id"):], signed[:len(signed)-1] + "x", "session-id", Sign("session-id", "another secret")} {
+		if _, err := VerifySignature(modified, secret); err == nil {
+			t.Errorf("Expected the modified value %s to be rejected", modified)
+		}
+	}
+}
+
 func TestDecryptEmptyString(t *testing.T) {
 	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
 
@@ -55,6 +127,17 @@ func TestDecryptEmptyString(t *testing.T) {
 	}
 }
 
+func TestDecryptShortCiphertext(t *testing.T) {
+	secret := "MLFs4TT99kOOq8h3UAVRtYoCTDYXiRcZ"
+
+	// Shorter than the nonce, with and without a version prefix
+	for _, ciphertext := range []string{"AAAA", "AQ==", base64.StdEncoding.EncodeToString(make([]byte, 12))} {
+		if _, err := Decrypt(ciphertext, secret); err == nil {
+			t.Errorf("Expected the short ciphertext %s to be rejected", ciphertext)
+		}
+	}
+}
+
 func TestValidateRedirectUri(t *testing.T) {
 	validUris := []string{
 		"/",
@@ -242,3 +325,108 @@ func TestIsHtmlRequest(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIsXhrRequest(t *testing.T) {
+	headers := []struct {
+		name     string
+		value    string
+		expected bool
+	}{
+		{"X-Requested-With", "XMLHttpRequest", true},
+		{"X-Requested-With", "xmlhttprequest", true},
+		{"Sec-Fetch-Mode", "cors", true},
+		{"Sec-Fetch-Mode", "navigate", false},
+		{"Sec-Fetch-Mode", "no-cors", false},
+		{"", "", false},
+	}
+
+	for _, header := range headers {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if header.name != "" {
+			req.Header.Set(header.name, header.value)
+		}
+
+		if IsXhrRequest(req) != header.expected {
+			t.Errorf("Expected IsXhrRequest to be %v for %s: %s", header.expected, header.name, header.value)
+		}
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offered := []string{"application/json", "text/html", "text/plain"}
+
+	expectNegotiatedContentType(t, "application/json;q=0.9, text/html;q=0.8", offered, "application/json")
+	expectNegotiatedContentType(t, "application/json;q=0.8, text/html;q=0.9", offered, "text/html")
+	expectNegotiatedContentType(t, "text/plain, text/html;q=0.5", offered, "text/plain")
+	expectNegotiatedContentType(t, "text/*", offered, "text/html")
+	expectNegotiatedContentType(t, "*/*", offered, "application/json")
+	expectNegotiatedContentType(t, "*/*, text/*, text/plain", offered, "text/plain")
+	expectNegotiatedContentType(t, "*/*, text/*", offered, "text/html")
+	expectNegotiatedContentType(t, "*/*;q=0.9, application/*;q=0.5, text/plain;q=0.9", offered, "text/plain")
+	expectNegotiatedContentType(t, "image/png", offered, "")
+	expectNegotiatedContentType(t, "text/html;q=0", offered, "")
+	expectNegotiatedContentType(t, "", offered, "")
+}
+
+func expectNegotiatedContentType(t *testing.T, accept string, offered []string, expected string) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", accept)
+
+	if actual := NegotiateContentType(req, offered); actual != expected {
+		t.Errorf("Expected Accept header \"%s\" to negotiate \"%s\", but got \"%s\"", accept, expected, actual)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	claims := map[string]interface{}{
+		"email": "John.Doe@Example.com",
+		"scope": "openid profile email",
+		"roles": []interface{}{"admin", "user"},
+	}
+
+	expectRenderedTemplate(t, "{{ .email | lower }}", claims, "john.doe@example.com")
+	expectRenderedTemplate(t, "{{ .email | upper }}", claims, "JOHN.DOE@EXAMPLE.COM")
+	expectRenderedTemplate(t, `{{ .scope | split " " | join "," }}`, claims, "openid,profile,email")
+	expectRenderedTemplate(t, `{{ .roles | join "," }}`, claims, "admin,user")
+	expectRenderedTemplate(t, `{{ .roles | prefix "role:" | join "," }}`, claims, "role:admin,role:user")
+	expectRenderedTemplate(t, `{{ .email | prefix "mailto:" }}`, claims, "mailto:John.Doe@Example.com")
+	expectRenderedTemplate(t, `{{ .missing | join "," }}`, claims, "")
+	expectRenderedTemplate(t, `{{ .missing | default "none" }}`, claims, "none")
+	expectRenderedTemplate(t, `{{ .email | default "none" }}`, claims, "John.Doe@Example.com")
+	expectRenderedTemplate(t, `{{ .exp | formatTime "2006-01-02 15:04" }}`, map[string]interface{}{"exp": float64(1767225600)}, "2026-01-01 00:00")
+}
+
+func TestPrepareTemplateClaims(t *testing.T) {
+	claims := PrepareTemplateClaims(map[string]interface{}{
+		"scope":  "openid profile",
+		"groups": []interface{}{"admins", "developers"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"offline_access", "uma_authorization"},
+		},
+	})
+
+	expectRenderedTemplate(t, "{{ .groups }}", claims, "admins,developers")
+	expectRenderedTemplate(t, "{{ .realm_access.roles }}", claims, "offline_access,uma_authorization")
+	expectRenderedTemplate(t, `{{ .groups | join ";" }}`, claims, "admins;developers")
+	expectRenderedTemplate(t, "{{ .groups | upper }}", claims, "ADMINS,DEVELOPERS")
+	expectRenderedTemplate(t, `{{ .scope | split " " }}`, claims, "openid,profile")
+	expectRenderedTemplate(t, "{{ range .groups }}[{{ . }}]{{ end }}", claims, "[admins][developers]")
+	expectRenderedTemplate(t, "{{ index .groups 1 }} {{ len .groups }}", claims, "developers 2")
+}
+
+func expectRenderedTemplate(t *testing.T, text string, data map[string]interface{}, expected string) {
+	tpl, err := template.New("").Funcs(TemplateFuncs()).Parse(text)
+	if err != nil {
+		t.Fatalf("Failed to parse template %s: %v", text, err)
+	}
+
+	var rendered bytes.Buffer
+	err = tpl.Execute(&rendered, data)
+	if err != nil {
+		t.Fatalf("Failed to execute template %s: %v", text, err)
+	}
+
+	if rendered.String() != expected {
+		t.Errorf("Expected template %s to render \"%s\", but got \"%s\"", text, expected, rendered.String())
+	}
+}